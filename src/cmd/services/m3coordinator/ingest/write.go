@@ -50,6 +50,18 @@ type DownsampleAndWriteIter interface {
 	Error() error
 }
 
+// DownsampleMappingRulesIter is a DownsampleAndWriteIter whose datapoints can
+// each be downsampled with their own mapping rules, e.g. depending on where
+// they were ingested from.
+type DownsampleMappingRulesIter interface {
+	DownsampleAndWriteIter
+
+	// CurrentDownsampleMappingRules returns the mapping rules that the current
+	// datapoints are downsampled with in place of those of the write options,
+	// or false if they're downsampled with those of the write options.
+	CurrentDownsampleMappingRules() ([]downsample.AutoMappingRule, bool)
+}
+
 // DownsamplerAndWriter is the interface for the downsamplerAndWriter which
 // writes metrics to the downsampler as well as to storage in unaggregated form.
 type DownsamplerAndWriter interface {
@@ -62,6 +74,8 @@ type DownsamplerAndWriter interface {
 		overrides WriteOptions,
 	) error
 
+	// WriteBatch writes the datapoints of the iterator, downsampling them with
+	// their own mapping rules if it's a DownsampleMappingRulesIter.
 	WriteBatch(
 		ctx context.Context,
 		iter DownsampleAndWriteIter,
@@ -344,6 +358,11 @@ func (d *downsamplerAndWriter) WriteBatch(
 				})
 			}
 		}
+		// The iterator stops at the first invalid entry unless it skips them, in
+		// which case the batch fails even though the entries before it are written.
+		if err := iter.Error(); err != nil {
+			addError(err)
+		}
 	}
 
 	// Iter does not need to be synchronized because even though we use it to spawn
@@ -378,6 +397,7 @@ func (d *downsamplerAndWriter) writeAggregatedBatch(
 
 	defer appender.Finalize()
 
+	rulesIter, hasRules := iter.(DownsampleMappingRulesIter)
 	for iter.Next() {
 		appender.Reset()
 		tags, datapoints, _, _ := iter.Current()
@@ -394,6 +414,16 @@ func (d *downsamplerAndWriter) writeAggregatedBatch(
 				},
 			}
 		}
+		if hasRules {
+			if mappingRules, ok := rulesIter.CurrentDownsampleMappingRules(); ok {
+				opts = downsample.SampleAppenderOptions{
+					Override: true,
+					OverrideRules: downsample.SamplesAppenderOverrideRules{
+						MappingRules: mappingRules,
+					},
+				}
+			}
+		}
 
 		samplesAppender, err := appender.SamplesAppender(opts)
 		if err != nil {
@@ -22,6 +22,7 @@ package ingest
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -125,6 +126,7 @@ var (
 type testIter struct {
 	idx     int
 	entries []testIterEntry
+	err     error
 }
 
 type testIterEntry struct {
@@ -160,7 +162,7 @@ func (i *testIter) Reset() error {
 }
 
 func (i *testIter) Error() error {
-	return nil
+	return i.err
 }
 
 func TestDownsampleAndWrite(t *testing.T) {
@@ -387,6 +389,30 @@ func TestDownsampleAndWriteBatchNoDownsampler(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestDownsampleAndWriteBatchIterError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl,
+		testDownsamplerAndWriterOptions{})
+	downAndWrite.downsampler = nil
+
+	for _, entry := range testEntries {
+		for _, dp := range entry.datapoints {
+			session.EXPECT().WriteTagged(
+				gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), dp.Value, gomock.Any(), entry.annotation,
+			)
+		}
+	}
+
+	iterErr := errors.New("invalid entry")
+	iter := newTestIter(testEntries)
+	iter.err = iterErr
+	err := downAndWrite.WriteBatch(context.Background(), iter, WriteOptions{})
+	require.Error(t, err)
+	require.Equal(t, []error{iterErr}, err.Errors())
+}
+
 func TestDownsampleAndWriteBatchOverrideDownsampleRules(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -444,6 +470,77 @@ func TestDownsampleAndWriteBatchOverrideDownsampleRules(t *testing.T) {
 	require.NoError(t, err)
 }
 
+type testMappingRulesIter struct {
+	*testIter
+	rules [][]downsample.AutoMappingRule
+}
+
+func (i *testMappingRulesIter) CurrentDownsampleMappingRules() ([]downsample.AutoMappingRule, bool) {
+	rules := i.rules[i.idx]
+	return rules, rules != nil
+}
+
+func TestDownsampleAndWriteBatchIterMappingRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl,
+		testDownsamplerAndWriterOptions{})
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+		iterMappingRules    = []downsample.AutoMappingRule{
+			{
+				Aggregations: []aggregation.Type{aggregation.Max},
+				Policies: policy.StoragePolicies{
+					policy.MustParseStoragePolicy("1m:40d"),
+				},
+			},
+		}
+	)
+
+	// The first entry is downsampled with the mapping rules of the iterator and
+	// the second one with the default mapping rules.
+	gomock.InOrder(
+		mockMetricsAppender.
+			EXPECT().
+			SamplesAppender(downsample.SampleAppenderOptions{
+				Override: true,
+				OverrideRules: downsample.SamplesAppenderOverrideRules{
+					MappingRules: iterMappingRules,
+				},
+			}).
+			Return(mockSamplesAppender, nil),
+		mockMetricsAppender.
+			EXPECT().
+			SamplesAppender(zeroDownsamplerAppenderOpts).
+			Return(mockSamplesAppender, nil),
+	)
+	for _, entry := range testEntries {
+		for _, tag := range entry.tags.Tags {
+			mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
+		}
+		for _, dp := range entry.datapoints {
+			mockSamplesAppender.EXPECT().AppendGaugeTimedSample(dp.Timestamp, dp.Value)
+			session.EXPECT().WriteTagged(
+				gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), dp.Value, gomock.Any(), entry.annotation,
+			)
+		}
+	}
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	mockMetricsAppender.EXPECT().Reset().Times(2)
+	mockMetricsAppender.EXPECT().Finalize()
+
+	iter := &testMappingRulesIter{
+		testIter: newTestIter(testEntries),
+		rules:    [][]downsample.AutoMappingRule{iterMappingRules, nil},
+	}
+	err := downAndWrite.WriteBatch(context.Background(), iter, WriteOptions{})
+	require.NoError(t, err)
+}
+
 func TestDownsampleAndWriteBatchOverrideStoragePolicies(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -63,6 +63,10 @@ func (c Configuration) NewServer(
 type handlerConfiguration struct {
 	// ProtobufDecoderPool configs the protobuf decoder pool.
 	ProtobufDecoderPool pool.ObjectPoolConfiguration `yaml:"protobufDecoderPool"`
+
+	// NewSeriesLimit limits the rate at which the metrics of new series are
+	// admitted, if set.
+	NewSeriesLimit *NewSeriesLimitConfiguration `yaml:"newSeriesLimit"`
 }
 
 func (c handlerConfiguration) newHandler(
@@ -78,6 +82,7 @@ func (c handlerConfiguration) newHandler(
 			}),
 		),
 		ProtobufDecoderPoolOptions: c.ProtobufDecoderPool.NewObjectPoolOptions(iOpts),
+		NewSeriesLimiter:           c.newSeriesLimiter(iOpts),
 	})
 	return consumer.NewMessageHandler(p, cOpts), nil
 }
@@ -91,5 +96,13 @@ func (c handlerConfiguration) NewOptions(
 		WriteFn:                    writeFn,
 		InstrumentOptions:          iOpts,
 		ProtobufDecoderPoolOptions: c.ProtobufDecoderPool.NewObjectPoolOptions(iOpts),
+		NewSeriesLimiter:           c.newSeriesLimiter(iOpts),
+	}
+}
+
+func (c handlerConfiguration) newSeriesLimiter(iOpts instrument.Options) *NewSeriesLimiter {
+	if c.NewSeriesLimit == nil {
+		return nil
 	}
+	return c.NewSeriesLimit.NewLimiter(iOpts)
 }
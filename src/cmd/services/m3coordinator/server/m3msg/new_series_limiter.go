@@ -0,0 +1,215 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package m3msg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/aggregator/rate"
+	"github.com/m3db/m3/src/x/clock"
+	"github.com/m3db/m3/src/x/instrument"
+
+	"github.com/cespare/xxhash"
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultNewSeriesLimitWarmup         = 10 * time.Minute
+	defaultNewSeriesLimitKnownSeriesTTL = time.Hour
+	defaultNewSeriesLimitMaxKnownSeries = 1 << 20
+
+	// The known series are sharded by their hash so that concurrent messages
+	// rarely contend for the same lock.
+	newSeriesLimiterNumShards = 64
+)
+
+// NewSeriesLimitConfiguration configures the limit on the rate at which the
+// metrics of new series are admitted.
+type NewSeriesLimitConfiguration struct {
+	// PerSecond is the maximum number of new series admitted per second.
+	PerSecond int64 `yaml:"perSecond" validate:"min=1"`
+
+	// Warmup is how long after startup the metrics of all series are admitted,
+	// since every series is new to the server until it has received a metric
+	// for it. Defaults to 10 minutes.
+	Warmup *time.Duration `yaml:"warmup"`
+
+	// KnownSeriesTTL is how long a series is known for after its last metric,
+	// at least this long and at most twice as long. Defaults to 1 hour.
+	KnownSeriesTTL *time.Duration `yaml:"knownSeriesTTL"`
+
+	// MaxKnownSeries is the maximum number of series that are known since the
+	// last rotation of the known series, which is then rotated early, so at
+	// most twice as many series are known in total. Defaults to 1048576.
+	MaxKnownSeries *int `yaml:"maxKnownSeries" validate:"omitempty,min=1"`
+
+	// Retry is whether the metrics of new series over the limit are retried
+	// rather than rejected.
+	Retry bool `yaml:"retry"`
+}
+
+// NewLimiter returns a new series limiter for the configuration.
+func (c NewSeriesLimitConfiguration) NewLimiter(iOpts instrument.Options) *NewSeriesLimiter {
+	var (
+		warmup         = defaultNewSeriesLimitWarmup
+		knownSeriesTTL = defaultNewSeriesLimitKnownSeriesTTL
+		maxKnownSeries = defaultNewSeriesLimitMaxKnownSeries
+		rejectType     = OnNonRetriableError
+	)
+	if c.Warmup != nil {
+		warmup = *c.Warmup
+	}
+	if c.KnownSeriesTTL != nil {
+		knownSeriesTTL = *c.KnownSeriesTTL
+	}
+	if c.MaxKnownSeries != nil {
+		maxKnownSeries = *c.MaxKnownSeries
+	}
+	if c.Retry {
+		rejectType = OnRetriableError
+	}
+	return newNewSeriesLimiter(c.PerSecond, warmup, knownSeriesTTL, newSeriesLimiterNumShards,
+		maxKnownSeries, rejectType, time.Now, iOpts.MetricsScope().SubScope("new-series-limiter"))
+}
+
+type newSeriesLimiterMetrics struct {
+	admitted       tally.Counter
+	admittedWarmup tally.Counter
+	limited        tally.Counter
+	earlyRotations tally.Counter
+}
+
+func newNewSeriesLimiterMetrics(scope tally.Scope) newSeriesLimiterMetrics {
+	return newSeriesLimiterMetrics{
+		admitted:       scope.Counter("admitted"),
+		admittedWarmup: scope.Counter("admitted-warmup"),
+		limited:        scope.Counter("limited"),
+		earlyRotations: scope.Counter("early-rotations"),
+	}
+}
+
+// NewSeriesLimiter limits the rate at which the metrics of series that the
+// server hasn't received a metric for recently are admitted, to protect the
+// index from a flood of new series. The metrics of known series are always
+// admitted. Series are identified by the hash of their ID, so a new series
+// that collides with a known one is admitted.
+type NewSeriesLimiter struct {
+	rateLimiter         *rate.Limiter
+	nowFn               clock.NowFn
+	warmupEnd           time.Time
+	knownSeriesTTL      time.Duration
+	maxShardKnownSeries int
+	rejectType          CallbackType
+	metrics             newSeriesLimiterMetrics
+	shards              []newSeriesLimiterShard
+}
+
+// newSeriesLimiterShard holds the known series whose hash maps to the shard.
+type newSeriesLimiterShard struct {
+	sync.Mutex
+
+	// The series that were known before the last rotation are retained until
+	// the next one and become known again if they receive a metric meanwhile.
+	known     map[uint64]struct{}
+	prevKnown map[uint64]struct{}
+	rotatedAt time.Time
+}
+
+func (s *newSeriesLimiterShard) rotate(now time.Time) {
+	s.known, s.prevKnown = s.prevKnown, s.known
+	for hash := range s.known {
+		delete(s.known, hash)
+	}
+	s.rotatedAt = now
+}
+
+func newNewSeriesLimiter(
+	perSecond int64,
+	warmup time.Duration,
+	knownSeriesTTL time.Duration,
+	numShards int,
+	maxKnownSeries int,
+	rejectType CallbackType,
+	nowFn clock.NowFn,
+	scope tally.Scope,
+) *NewSeriesLimiter {
+	maxShardKnownSeries := maxKnownSeries / numShards
+	if maxShardKnownSeries < 1 {
+		maxShardKnownSeries = 1
+	}
+	now := nowFn()
+	shards := make([]newSeriesLimiterShard, numShards)
+	for i := range shards {
+		shards[i] = newSeriesLimiterShard{
+			known:     make(map[uint64]struct{}),
+			prevKnown: make(map[uint64]struct{}),
+			rotatedAt: now,
+		}
+	}
+	return &NewSeriesLimiter{
+		rateLimiter:         rate.NewLimiter(perSecond, nowFn),
+		nowFn:               nowFn,
+		warmupEnd:           now.Add(warmup),
+		knownSeriesTTL:      knownSeriesTTL,
+		maxShardKnownSeries: maxShardKnownSeries,
+		rejectType:          rejectType,
+		metrics:             newNewSeriesLimiterMetrics(scope),
+		shards:              shards,
+	}
+}
+
+// admit returns whether the metric of the series with the given ID is admitted.
+func (l *NewSeriesLimiter) admit(id []byte) bool {
+	var (
+		hash  = xxhash.Sum64(id)
+		now   = l.nowFn()
+		shard = &l.shards[hash%uint64(len(l.shards))]
+	)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if now.Sub(shard.rotatedAt) >= l.knownSeriesTTL {
+		shard.rotate(now)
+	}
+
+	if _, ok := shard.known[hash]; ok {
+		return true
+	}
+	if _, ok := shard.prevKnown[hash]; !ok {
+		if now.Before(l.warmupEnd) {
+			l.metrics.admittedWarmup.Inc(1)
+		} else if l.rateLimiter.IsAllowed(1) {
+			l.metrics.admitted.Inc(1)
+		} else {
+			l.metrics.limited.Inc(1)
+			return false
+		}
+	}
+
+	if len(shard.known) >= l.maxShardKnownSeries {
+		// Rotate early rather than let the known series grow unbounded.
+		shard.rotate(now)
+		l.metrics.earlyRotations.Inc(1)
+	}
+	shard.known[hash] = struct{}{}
+	return true
+}
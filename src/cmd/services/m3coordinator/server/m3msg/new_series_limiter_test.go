@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package m3msg
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestNewSeriesLimiterWarmup(t *testing.T) {
+	var (
+		scope = tally.NewTestScope("", nil)
+		now   = time.Unix(1000, 0)
+		nowFn = func() time.Time { return now }
+		l     = newNewSeriesLimiter(1, time.Minute, time.Hour, newSeriesLimiterNumShards,
+			defaultNewSeriesLimitMaxKnownSeries, OnNonRetriableError, nowFn, scope)
+	)
+
+	// Every new series is admitted during the warmup.
+	require.True(t, l.admit([]byte("a")))
+	require.True(t, l.admit([]byte("b")))
+
+	now = now.Add(time.Minute)
+	require.True(t, l.admit([]byte("c")))
+	require.False(t, l.admit([]byte("d")))
+	require.True(t, l.admit([]byte("a")))
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(2), counters["admitted-warmup+"].Value())
+	require.Equal(t, int64(1), counters["admitted+"].Value())
+	require.Equal(t, int64(1), counters["limited+"].Value())
+}
+
+func TestNewSeriesLimiterKnownSeriesTTL(t *testing.T) {
+	var (
+		now   = time.Unix(1000, 0)
+		nowFn = func() time.Time { return now }
+		l     = newNewSeriesLimiter(1, 0, time.Hour, newSeriesLimiterNumShards,
+			defaultNewSeriesLimitMaxKnownSeries, OnNonRetriableError, nowFn, tally.NoopScope)
+	)
+	require.True(t, l.admit([]byte("a")))
+	require.False(t, l.admit([]byte("b")))
+	now = now.Add(time.Second)
+	require.True(t, l.admit([]byte("b")))
+
+	// Series that receive a metric within the TTL remain known.
+	now = now.Add(time.Hour)
+	require.True(t, l.admit([]byte("a")))
+	now = now.Add(time.Hour)
+	require.True(t, l.admit([]byte("a")))
+
+	// Whereas the others are forgotten after twice the TTL at most and are new
+	// again, so they're subject to the rate limit.
+	require.True(t, l.admit([]byte("c")))
+	require.False(t, l.admit([]byte("b")))
+}
+
+func TestNewSeriesLimiterMaxKnownSeries(t *testing.T) {
+	var (
+		scope = tally.NewTestScope("", nil)
+		now   = time.Unix(1000, 0)
+		nowFn = func() time.Time { return now }
+		l     = newNewSeriesLimiter(1, time.Minute, time.Hour, 1, 2, OnNonRetriableError,
+			nowFn, scope)
+	)
+	// The known series are rotated early once 2 of them are known since the last
+	// rotation, so the first 2 are forgotten by the second early rotation.
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		require.True(t, l.admit([]byte(id)))
+	}
+
+	now = now.Add(time.Minute)
+	require.True(t, l.admit([]byte("c")))
+	require.True(t, l.admit([]byte("d")))
+	require.True(t, l.admit([]byte("a")))
+	require.False(t, l.admit([]byte("b")))
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["admitted+"].Value())
+	require.Equal(t, int64(1), counters["limited+"].Value())
+	require.Equal(t, int64(3), counters["early-rotations+"].Value())
+}
+
+func TestNewSeriesLimiterShards(t *testing.T) {
+	var (
+		scope = tally.NewTestScope("", nil)
+		l     = newNewSeriesLimiter(1, time.Hour, time.Hour, newSeriesLimiterNumShards,
+			newSeriesLimiterNumShards*2, OnNonRetriableError, time.Now, scope)
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				require.True(t, l.admit([]byte(fmt.Sprintf("series-%d", j))))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every shard holds at most twice its share of the known series.
+	for i := range l.shards {
+		require.True(t, len(l.shards[i].known) <= 2)
+		require.True(t, len(l.shards[i].prevKnown) <= 2)
+	}
+}
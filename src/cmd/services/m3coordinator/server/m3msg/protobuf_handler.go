@@ -22,10 +22,15 @@ package m3msg
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/m3db/m3/src/dbnode/namespace"
 	"github.com/m3db/m3/src/metrics/encoding/protobuf"
 	"github.com/m3db/m3/src/msg/consumer"
+	"github.com/m3db/m3/src/x/ident"
 	"github.com/m3db/m3/src/x/instrument"
 	"github.com/m3db/m3/src/x/pool"
 
@@ -38,13 +43,34 @@ type Options struct {
 	InstrumentOptions          instrument.Options
 	WriteFn                    WriteFn
 	ProtobufDecoderPoolOptions pool.ObjectPoolOptions
+	// PreProcessFn is invoked with each decoded metric before it is written,
+	// every metric is written if nil.
+	PreProcessFn PreProcessFn
+	// NewSeriesLimiter limits the rate at which the metrics of new series are
+	// admitted after being pre-processed, metrics are not limited if nil.
+	NewSeriesLimiter *NewSeriesLimiter
+	// ProtoWriteFn writes the metrics that carry a marshalled proto message
+	// instead of WriteFn, such metrics are dropped if nil.
+	ProtoWriteFn ProtoWriteFn
+	// SchemaRegistry resolves the schema deploy ID of the metrics that carry a
+	// proto message against the schemas of SchemaNamespace, the latest schema is
+	// used for messages without a schema deploy ID.
+	SchemaRegistry  namespace.SchemaRegistry
+	SchemaNamespace ident.ID
 }
 
+var errNoSchemaRegistry = errors.New("proto messages require a schema registry and a proto write function")
+
 type handlerMetrics struct {
 	messageReadError             tally.Counter
 	metricAccepted               tally.Counter
 	droppedMetricDecodeError     tally.Counter
 	droppedMetricDecodeMalformed tally.Counter
+	droppedMetricSkipped         tally.Counter
+	droppedMetricRejected        tally.Counter
+	droppedMetricLimited         tally.Counter
+	droppedMetricUnknownSchema   tally.Counter
+	processingLag                tally.Histogram
 }
 
 func newHandlerMetrics(scope tally.Scope) handlerMetrics {
@@ -58,28 +84,56 @@ func newHandlerMetrics(scope tally.Scope) handlerMetrics {
 		droppedMetricDecodeMalformed: messageScope.Tagged(map[string]string{
 			"reason": "decode-malformed",
 		}).Counter("dropped"),
+		droppedMetricSkipped: messageScope.Tagged(map[string]string{
+			"reason": "pre-process-skipped",
+		}).Counter("dropped"),
+		droppedMetricRejected: messageScope.Tagged(map[string]string{
+			"reason": "pre-process-rejected",
+		}).Counter("dropped"),
+		droppedMetricLimited: messageScope.Tagged(map[string]string{
+			"reason": "new-series-limited",
+		}).Counter("dropped"),
+		droppedMetricUnknownSchema: messageScope.Tagged(map[string]string{
+			"reason": "unknown-schema",
+		}).Counter("dropped"),
+		// The lag between the time a metric was encoded by its producer and the
+		// time it is processed, from 1ms to roughly 2 hours.
+		processingLag: messageScope.Histogram("processing-lag",
+			tally.MustMakeExponentialDurationBuckets(time.Millisecond, 2, 24)),
 	}
 }
 
 type pbHandler struct {
-	ctx     context.Context
-	writeFn WriteFn
-	pool    protobuf.AggregatedDecoderPool
-	wg      *sync.WaitGroup
-	logger  *zap.Logger
-	m       handlerMetrics
+	ctx              context.Context
+	writeFn          WriteFn
+	protoWriteFn     ProtoWriteFn
+	schemaRegistry   namespace.SchemaRegistry
+	schemaNamespace  ident.ID
+	preProcessFn     PreProcessFn
+	newSeriesLimiter *NewSeriesLimiter
+	pool             protobuf.AggregatedDecoderPool
+	wg               *sync.WaitGroup
+	logger           *zap.Logger
+	m                handlerMetrics
+	nowFn            func() time.Time
 }
 
 func newProtobufProcessor(opts Options) consumer.MessageProcessor {
 	p := protobuf.NewAggregatedDecoderPool(opts.ProtobufDecoderPoolOptions)
 	p.Init()
 	return &pbHandler{
-		ctx:     context.Background(),
-		writeFn: opts.WriteFn,
-		pool:    p,
-		wg:      &sync.WaitGroup{},
-		logger:  opts.InstrumentOptions.Logger(),
-		m:       newHandlerMetrics(opts.InstrumentOptions.MetricsScope()),
+		ctx:              context.Background(),
+		writeFn:          opts.WriteFn,
+		protoWriteFn:     opts.ProtoWriteFn,
+		schemaRegistry:   opts.SchemaRegistry,
+		schemaNamespace:  opts.SchemaNamespace,
+		preProcessFn:     opts.PreProcessFn,
+		newSeriesLimiter: opts.NewSeriesLimiter,
+		pool:             p,
+		wg:               &sync.WaitGroup{},
+		logger:           opts.InstrumentOptions.Logger(),
+		m:                newHandlerMetrics(opts.InstrumentOptions.MetricsScope()),
+		nowFn:            time.Now,
 	}
 }
 
@@ -96,13 +150,77 @@ func (h *pbHandler) Process(msg consumer.Message) {
 		h.m.droppedMetricDecodeMalformed.Inc(1)
 		return
 	}
-	h.m.metricAccepted.Inc(1)
 
 	h.wg.Add(1)
 	r := NewProtobufCallback(msg, dec, h.wg)
+	var schema namespace.SchemaDescr
+	if len(dec.Annotation()) > 0 {
+		if schema, err = h.resolveSchema(dec.SchemaDeployID()); err != nil {
+			h.logger.Error("could not resolve schema of proto message",
+				zap.String("schemaDeployID", dec.SchemaDeployID()), zap.Error(err))
+			h.m.droppedMetricUnknownSchema.Inc(1)
+			r.Callback(OnNonRetriableError)
+			return
+		}
+	}
+	if h.preProcessFn != nil {
+		switch h.preProcessFn(dec.ID(), dec.TimeNanos(), dec.EncodeNanos(), dec.Value(), sp) {
+		case SkipMessage:
+			h.m.droppedMetricSkipped.Inc(1)
+			r.Callback(OnSuccess)
+			return
+		case RejectMessage:
+			h.m.droppedMetricRejected.Inc(1)
+			r.Callback(OnNonRetriableError)
+			return
+		}
+	}
+	if h.newSeriesLimiter != nil && !h.newSeriesLimiter.admit(dec.ID()) {
+		h.m.droppedMetricLimited.Inc(1)
+		r.Callback(h.newSeriesLimiter.rejectType)
+		return
+	}
+	h.m.metricAccepted.Inc(1)
+	if encodeNanos := dec.EncodeNanos(); encodeNanos > 0 {
+		lag := h.nowFn().Sub(time.Unix(0, encodeNanos))
+		if lag < 0 {
+			// The clocks of the producer and consumer can be skewed.
+			lag = 0
+		}
+		h.m.processingLag.RecordDuration(lag)
+	}
+	if schema != nil {
+		h.protoWriteFn(h.ctx, dec.ID(), dec.TimeNanos(), dec.EncodeNanos(), dec.Annotation(), schema, sp, r)
+		return
+	}
 	h.writeFn(h.ctx, dec.ID(), dec.TimeNanos(), dec.EncodeNanos(), dec.Value(), sp, r)
 }
 
+// resolveSchema returns the schema of the proto namespace that has the deploy ID,
+// or its latest schema if the deploy ID is empty.
+func (h *pbHandler) resolveSchema(deployID string) (namespace.SchemaDescr, error) {
+	if h.schemaRegistry == nil || h.protoWriteFn == nil {
+		return nil, errNoSchemaRegistry
+	}
+	var (
+		schema namespace.SchemaDescr
+		err    error
+	)
+	if deployID == "" {
+		schema, err = h.schemaRegistry.GetLatestSchema(h.schemaNamespace)
+	} else {
+		schema, err = h.schemaRegistry.GetSchema(h.schemaNamespace, deployID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		// The registry returns no schema if proto is not enabled.
+		return nil, fmt.Errorf("namespace %s has no proto schema", h.schemaNamespace)
+	}
+	return schema, nil
+}
+
 func (h *pbHandler) Close() { h.wg.Wait() }
 
 type protobufCallback struct {
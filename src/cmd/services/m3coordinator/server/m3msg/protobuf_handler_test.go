@@ -26,18 +26,24 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/testdata/prototest"
 	"github.com/m3db/m3/src/metrics/encoding/protobuf"
+	"github.com/m3db/m3/src/metrics/generated/proto/metricpb"
 	"github.com/m3db/m3/src/metrics/metric"
 	"github.com/m3db/m3/src/metrics/metric/aggregated"
 	"github.com/m3db/m3/src/metrics/policy"
 	"github.com/m3db/m3/src/msg/consumer"
 	"github.com/m3db/m3/src/msg/generated/proto/msgpb"
 	"github.com/m3db/m3/src/msg/protocol/proto"
+	"github.com/m3db/m3/src/x/ident"
 	"github.com/m3db/m3/src/x/instrument"
 	"github.com/m3db/m3/src/x/server"
 
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 var (
@@ -127,6 +133,255 @@ func TestM3msgServerWithProtobufHandler(t *testing.T) {
 	require.Equal(t, m2.StoragePolicy, payload.sp)
 }
 
+func TestM3msgServerWithProtobufHandlerPreProcessFn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	w := &mockWriter{m: make(map[string]payload)}
+	scope := tally.NewTestScope("", nil)
+	hOpts := Options{
+		WriteFn:           w.write,
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		PreProcessFn: func(
+			id []byte,
+			metricNanos, encodeNanos int64,
+			value float64,
+			sp policy.StoragePolicy,
+		) PreProcessResult {
+			switch string(id) {
+			case "skip":
+				return SkipMessage
+			case "reject":
+				return RejectMessage
+			}
+			return ProcessMessage
+		},
+	}
+	opts := consumer.NewOptions().
+		SetAckBufferSize(1).
+		SetConnectionWriteBufferSize(1)
+
+	s := server.NewServer(
+		"a",
+		consumer.NewMessageHandler(newProtobufProcessor(hOpts), opts),
+		server.NewOptions(),
+	)
+	s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	dec := proto.NewDecoder(conn, opts.DecoderOptions())
+
+	// Skipped and rejected messages are acked without being written.
+	for i, id := range []string{"skip", "reject", testID} {
+		encoder := protobuf.NewAggregatedEncoder(nil)
+		require.NoError(t, encoder.Encode(aggregated.MetricWithStoragePolicy{
+			Metric: aggregated.Metric{
+				ID:        []byte(id),
+				TimeNanos: 1000,
+				Value:     1,
+				Type:      metric.GaugeType,
+			},
+			StoragePolicy: validStoragePolicy,
+		}, int64(2000+i)))
+		enc := proto.NewEncoder(opts.EncoderOptions())
+		require.NoError(t, enc.Encode(&msgpb.Message{
+			Value: encoder.Buffer().Bytes(),
+		}))
+		_, err = conn.Write(enc.Bytes())
+		require.NoError(t, err)
+
+		var a msgpb.Ack
+		require.NoError(t, dec.Decode(&a))
+	}
+	require.Equal(t, 1, w.ingested())
+	_, ok := w.m[key(testID, 2002)]
+	require.True(t, ok)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["metric.accepted+"].Value())
+	require.Equal(t, int64(1), counters["metric.dropped+reason=pre-process-skipped"].Value())
+	require.Equal(t, int64(1), counters["metric.dropped+reason=pre-process-rejected"].Value())
+}
+
+func TestProtobufHandlerProcessingLag(t *testing.T) {
+	w := &mockWriter{m: make(map[string]payload)}
+	scope := tally.NewTestScope("", nil)
+	h := newProtobufProcessor(Options{
+		WriteFn:           w.write,
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+	})
+	encodeTime := time.Unix(0, 2000)
+	h.(*pbHandler).nowFn = func() time.Time {
+		return encodeTime.Add(3 * time.Millisecond)
+	}
+
+	encoder := protobuf.NewAggregatedEncoder(nil)
+	require.NoError(t, encoder.Encode(aggregated.MetricWithStoragePolicy{
+		Metric: aggregated.Metric{
+			ID:        []byte(testID),
+			TimeNanos: 1000,
+			Value:     1,
+			Type:      metric.GaugeType,
+		},
+		StoragePolicy: validStoragePolicy,
+	}, encodeTime.UnixNano()))
+	msg := &testMessage{bytes: encoder.Buffer().Bytes()}
+	h.Process(msg)
+	h.Close()
+	require.True(t, msg.acked)
+
+	histograms := scope.Snapshot().Histograms()
+	lag, ok := histograms["metric.processing-lag+"]
+	require.True(t, ok)
+	require.Equal(t, int64(1), lag.Durations()[4*time.Millisecond])
+}
+
+func TestProtobufHandlerNewSeriesLimiter(t *testing.T) {
+	var (
+		w            = &mockWriter{m: make(map[string]payload)}
+		scope        = tally.NewTestScope("", nil)
+		handlerScope = tally.NewTestScope("", nil)
+		now          = time.Unix(1000, 0)
+		nowFn        = func() time.Time { return now }
+	)
+	h := newProtobufProcessor(Options{
+		WriteFn:           w.write,
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(handlerScope),
+		NewSeriesLimiter: newNewSeriesLimiter(1, 0, time.Hour, newSeriesLimiterNumShards,
+			defaultNewSeriesLimitMaxKnownSeries, OnRetriableError,
+			nowFn, scope),
+	})
+
+	process := func(id string, encodeNanos int64) *testMessage {
+		encoder := protobuf.NewAggregatedEncoder(nil)
+		require.NoError(t, encoder.Encode(aggregated.MetricWithStoragePolicy{
+			Metric: aggregated.Metric{
+				ID:        []byte(id),
+				TimeNanos: 1000,
+				Value:     1,
+				Type:      metric.GaugeType,
+			},
+			StoragePolicy: validStoragePolicy,
+		}, encodeNanos))
+		msg := &testMessage{bytes: encoder.Buffer().Bytes()}
+		h.Process(msg)
+		return msg
+	}
+
+	// Only one new series is admitted per second, the metrics of the other new
+	// series are retried (not acked) whereas those of known series are written.
+	require.True(t, process("a", 1).acked)
+	require.False(t, process("b", 2).acked)
+	require.True(t, process("a", 3).acked)
+
+	now = now.Add(time.Second)
+	require.True(t, process("b", 4).acked)
+	h.Close()
+
+	require.Equal(t, 3, w.ingested())
+	for _, k := range []string{key("a", 1), key("a", 3), key("b", 4)} {
+		_, ok := w.m[k]
+		require.True(t, ok, k)
+	}
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(2), counters["admitted+"].Value())
+	require.Equal(t, int64(1), counters["limited+"].Value())
+
+	counters = handlerScope.Snapshot().Counters()
+	require.Equal(t, int64(3), counters["metric.accepted+"].Value())
+	require.Equal(t, int64(1), counters["metric.dropped+reason=new-series-limited"].Value())
+}
+
+func TestProtobufHandlerProtoMessages(t *testing.T) {
+	var (
+		nsID     = ident.StringID("proto-ns")
+		registry = namespace.NewSchemaRegistry(true, nil)
+		scope    = tally.NewTestScope("", nil)
+		w        = &mockWriter{m: make(map[string]payload)}
+		written  = make(map[string]string)
+	)
+	require.NoError(t, registry.SetSchemaHistory(nsID, prototest.NewEvolvedSchemaHistory()))
+
+	protoWrite := func(
+		ctx context.Context,
+		id []byte,
+		metricNanos, encodeNanos int64,
+		annotation []byte,
+		schema namespace.SchemaDescr,
+		sp policy.StoragePolicy,
+		callback Callbackable,
+	) {
+		require.Equal(t, "annotation", string(annotation))
+		written[string(id)] = schema.DeployId()
+		callback.Callback(OnSuccess)
+	}
+	newHandler := func(registry namespace.SchemaRegistry) consumer.MessageProcessor {
+		return newProtobufProcessor(Options{
+			WriteFn:           w.write,
+			ProtoWriteFn:      protoWrite,
+			SchemaRegistry:    registry,
+			SchemaNamespace:   nsID,
+			InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		})
+	}
+	process := func(h consumer.MessageProcessor, id string, annotation string, deployID string) *testMessage {
+		pb := metricpb.AggregatedMetric{
+			Annotation:     []byte(annotation),
+			SchemaDeployId: deployID,
+		}
+		require.NoError(t, aggregated.MetricWithStoragePolicy{
+			Metric: aggregated.Metric{
+				ID:        []byte(id),
+				TimeNanos: 1000,
+				Type:      metric.GaugeType,
+			},
+			StoragePolicy: validStoragePolicy,
+		}.ToProto(&pb.Metric))
+		b, err := pb.Marshal()
+		require.NoError(t, err)
+		msg := &testMessage{bytes: b}
+		h.Process(msg)
+		return msg
+	}
+
+	// The deploy IDs of the messages are resolved against the schema registry,
+	// messages without one are decoded with the latest schema.
+	h := newHandler(registry)
+	require.True(t, process(h, "first", "annotation", prototest.EvolvedSchemaFirstDeployID).acked)
+	require.True(t, process(h, "second", "annotation", prototest.EvolvedSchemaSecondDeployID).acked)
+	require.True(t, process(h, "latest", "annotation", "").acked)
+	require.True(t, process(h, "unknown", "annotation", "unknown-deploy-id").acked)
+	require.True(t, process(h, "float", "", "").acked)
+	h.Close()
+
+	// Messages can't be decoded without a schema registry.
+	h = newHandler(nil)
+	require.True(t, process(h, "no-registry", "annotation", "").acked)
+	h.Close()
+
+	require.Equal(t, map[string]string{
+		"first":  prototest.EvolvedSchemaFirstDeployID,
+		"second": prototest.EvolvedSchemaSecondDeployID,
+		"latest": prototest.EvolvedSchemaSecondDeployID,
+	}, written)
+	require.Equal(t, 1, w.ingested())
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(4), counters["metric.accepted+"].Value())
+	require.Equal(t, int64(2), counters["metric.dropped+reason=unknown-schema"].Value())
+}
+
+type testMessage struct {
+	bytes []byte
+	acked bool
+}
+
+func (m *testMessage) Bytes() []byte { return m.bytes }
+
+func (m *testMessage) Ack() { m.acked = true }
+
 type mockWriter struct {
 	sync.Mutex
 
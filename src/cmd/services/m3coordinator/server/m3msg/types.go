@@ -23,6 +23,7 @@ package m3msg
 import (
 	"context"
 
+	"github.com/m3db/m3/src/dbnode/namespace"
 	"github.com/m3db/m3/src/metrics/policy"
 )
 
@@ -36,6 +37,18 @@ type WriteFn func(
 	callback Callbackable,
 )
 
+// ProtoWriteFn is the function that writes a metric that carries a marshalled
+// proto message, along with the schema that the message was marshalled with.
+type ProtoWriteFn func(
+	ctx context.Context,
+	id []byte,
+	metricNanos, encodeNanos int64,
+	annotation []byte,
+	schema namespace.SchemaDescr,
+	sp policy.StoragePolicy,
+	callback Callbackable,
+)
+
 // CallbackType defines the type for the callback.
 type CallbackType int
 
@@ -53,3 +66,25 @@ const (
 type Callbackable interface {
 	Callback(t CallbackType)
 }
+
+// PreProcessResult is the decision of a PreProcessFn about a message.
+type PreProcessResult int
+
+// Supported PreProcessResults.
+const (
+	// ProcessMessage will write the metric of the message as usual.
+	ProcessMessage PreProcessResult = iota
+	// SkipMessage will ack the message without writing its metric.
+	SkipMessage
+	// RejectMessage will drop the message as a non retriable error.
+	RejectMessage
+)
+
+// PreProcessFn inspects the metric decoded from a message before it is written,
+// which allows filtering or sampling metrics without a separate component.
+type PreProcessFn func(
+	id []byte,
+	metricNanos, encodeNanos int64,
+	value float64,
+	sp policy.StoragePolicy,
+) PreProcessResult
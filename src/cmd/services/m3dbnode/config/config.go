@@ -385,6 +385,10 @@ type ProtoConfiguration struct {
 	// Enabled specifies whether proto is enabled.
 	Enabled        bool                            `yaml:"enabled"`
 	SchemaRegistry map[string]NamespaceProtoSchema `yaml:"schema_registry"`
+
+	// LogMarshalFallbacks specifies whether the fields of the schemas that are
+	// marshalled rather than custom encoded are logged, and why.
+	LogMarshalFallbacks bool `yaml:"logMarshalFallbacks"`
 }
 
 // NamespaceProtoSchema is the namespace protobuf schema.
@@ -30,6 +30,7 @@ import (
 	ingestm3msg "github.com/m3db/m3/src/cmd/services/m3coordinator/ingest/m3msg"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/server/m3msg"
 	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/metrics/policy"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
 	"github.com/m3db/m3/src/query/graphite/graphite"
 	"github.com/m3db/m3/src/query/models"
@@ -124,6 +125,9 @@ type Configuration struct {
 	// Carbon is the carbon configuration.
 	Carbon *CarbonConfiguration `yaml:"carbon"`
 
+	// Influx is the InfluxDB API configuration.
+	Influx InfluxConfiguration `yaml:"influx"`
+
 	// Limits specifies limits on per-query resource usage.
 	Limits LimitsConfiguration `yaml:"limits"`
 
@@ -292,6 +296,144 @@ type CarbonConfiguration struct {
 	Ingester *CarbonIngesterConfiguration `yaml:"ingester"`
 }
 
+// InfluxConfiguration is the configuration for the InfluxDB API endpoints.
+type InfluxConfiguration struct {
+	// Write is the configuration for the InfluxDB write endpoint.
+	Write InfluxWriteConfiguration `yaml:"write"`
+}
+
+// InfluxWriteConfiguration is the configuration for the InfluxDB write endpoint.
+type InfluxWriteConfiguration struct {
+	// PartialWrites when enabled ingests the valid points of a batch and skips
+	// the invalid ones, reporting how many were dropped in the response, rather
+	// than failing the whole batch.
+	PartialWrites bool `yaml:"partialWrites"`
+
+	// EmptyMeasurementName is the measurement used for points with an empty
+	// measurement, if not set such points are rejected as invalid.
+	EmptyMeasurementName string `yaml:"emptyMeasurementName"`
+
+	// ExemplarTags are the tags that are stored as exemplar labels in the
+	// annotation of the datapoints of a point (encoded as Prometheus labels)
+	// rather than as labels of its series, e.g. trace IDs that would otherwise
+	// create a new series for every point.
+	ExemplarTags []string `yaml:"exemplarTags"`
+
+	// PreserveOriginalNames when enabled stores the original measurement,
+	// field key and tag keys of each point, prior to being rewritten into
+	// valid Prometheus names, in the annotation of its datapoints (encoded as
+	// Prometheus labels along with any exemplar labels) so that the points
+	// can be re-exported in the Influx format without loss.
+	PreserveOriginalNames bool `yaml:"preserveOriginalNames"`
+
+	// MaxFutureSkew is how far past the current time the timestamps of points
+	// may be, points with timestamps beyond it are rejected as invalid. Zero
+	// means no limit.
+	MaxFutureSkew time.Duration `yaml:"maxFutureSkew"`
+
+	// MaxPastAge is how far before the current time the timestamps of points
+	// may be, typically the retention of the namespaces written to, points
+	// with older timestamps are rejected as invalid. Zero means no limit.
+	MaxPastAge time.Duration `yaml:"maxPastAge"`
+
+	// PathRouting when set additionally serves writes at the write URL followed
+	// by path segments (e.g. /write/{org}/{bucket}) from which routing
+	// information is extracted, for gateways that route by path rather than by
+	// query parameters or headers.
+	PathRouting *InfluxWritePathRoutingConfiguration `yaml:"pathRouting"`
+
+	// MeasurementDownsampling maps measurements to the aggregations and
+	// storage policies that the datapoints of their points are downsampled
+	// with in place of the downsampling rules, routing them into dedicated
+	// rollup pipelines. Writes that aren't downsampled, e.g. those routed to a
+	// namespace by path, are unaffected.
+	MeasurementDownsampling map[string]InfluxMeasurementDownsamplingConfiguration `yaml:"measurementDownsampling"`
+}
+
+// InfluxMeasurementDownsamplingConfiguration is the configuration for the
+// downsampling of the datapoints of an InfluxDB measurement.
+type InfluxMeasurementDownsamplingConfiguration struct {
+	// Aggregations are the aggregations applied to the datapoints, the default
+	// aggregations are applied if not set.
+	Aggregations []aggregation.Type `yaml:"aggregations"`
+
+	// Policies are the storage policies of the aggregated namespaces that the
+	// aggregated datapoints are written to.
+	Policies []policy.StoragePolicy `yaml:"policies"`
+}
+
+// Validate validates that the datapoints are written to at least one
+// aggregated namespace.
+func (c InfluxMeasurementDownsamplingConfiguration) Validate() error {
+	if len(c.Policies) == 0 {
+		return errors.New("influx measurement downsampling requires policies")
+	}
+	return nil
+}
+
+// MappingRule returns the mapping rule that the datapoints are downsampled with.
+func (c InfluxMeasurementDownsamplingConfiguration) MappingRule() downsample.AutoMappingRule {
+	return downsample.AutoMappingRule{
+		Aggregations: c.Aggregations,
+		Policies:     c.Policies,
+	}
+}
+
+// InfluxWritePathRoutingConfiguration is the configuration for extracting
+// routing information from the path segments of InfluxDB writes.
+type InfluxWritePathRoutingConfiguration struct {
+	// Segments are the names of the path segments that follow the write URL,
+	// e.g. [org, bucket] for writes to /api/v1/influxdb/write/{org}/{bucket}.
+	Segments []string `yaml:"segments" validate:"nonzero"`
+
+	// TagSegments are the segments whose values are added as a tag, named
+	// after the segment, to every series of a write.
+	TagSegments []string `yaml:"tagSegments"`
+
+	// NamespaceSegment is the segment whose value selects the aggregated
+	// namespace that a write goes to, by looking it up in Namespaces. Writes
+	// with values that are not in Namespaces are rejected.
+	NamespaceSegment string `yaml:"namespaceSegment"`
+
+	// Namespaces maps the values of the namespace segment to the storage
+	// policy of the aggregated namespace that is written to.
+	Namespaces map[string]policy.StoragePolicy `yaml:"namespaces"`
+}
+
+// Validate validates that the tag and namespace segments are amongst the
+// path segments.
+func (c InfluxWritePathRoutingConfiguration) Validate() error {
+	if len(c.Segments) == 0 {
+		return errors.New("influx write path routing requires segments")
+	}
+	segments := make(map[string]struct{}, len(c.Segments))
+	for _, segment := range c.Segments {
+		if segment == "" {
+			return errors.New("influx write path segments must be non-empty")
+		}
+		if _, ok := segments[segment]; ok {
+			return fmt.Errorf("duplicate influx write path segment: %s", segment)
+		}
+		segments[segment] = struct{}{}
+	}
+	for _, segment := range c.TagSegments {
+		if _, ok := segments[segment]; !ok {
+			return fmt.Errorf("influx write tag segment is not a path segment: %s", segment)
+		}
+	}
+	if c.NamespaceSegment == "" {
+		return nil
+	}
+	if _, ok := segments[c.NamespaceSegment]; !ok {
+		return fmt.Errorf("influx write namespace segment is not a path segment: %s",
+			c.NamespaceSegment)
+	}
+	if len(c.Namespaces) == 0 {
+		return errors.New("influx write namespace segment requires namespaces")
+	}
+	return nil
+}
+
 // CarbonIngesterConfiguration is the configuration struct for carbon ingestion.
 type CarbonIngesterConfiguration struct {
 	// Deprecated: simply use the logger debug level, this has been deprecated
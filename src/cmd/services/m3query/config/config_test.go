@@ -268,3 +268,28 @@ func TestKeepNaNsDefault(t *testing.T) {
 	r = ResultOptions{}
 	assert.Equal(t, false, r.KeepNans)
 }
+
+func TestInfluxWritePathRoutingConfig(t *testing.T) {
+	var cfg InfluxWritePathRoutingConfiguration
+	config := `
+segments: [org, bucket]
+tagSegments: [org]
+namespaceSegment: bucket
+namespaces:
+  metrics-1m: 1m:40d
+`
+	require.NoError(t, yaml.Unmarshal([]byte(config), &cfg))
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, "1m:40d", cfg.Namespaces["metrics-1m"].String())
+
+	invalid := []InfluxWritePathRoutingConfiguration{
+		{},
+		{Segments: []string{"org", "org"}},
+		{Segments: []string{"org"}, TagSegments: []string{"bucket"}},
+		{Segments: []string{"org"}, NamespaceSegment: "bucket"},
+		{Segments: []string{"bucket"}, NamespaceSegment: "bucket"},
+	}
+	for _, cfg := range invalid {
+		assert.Error(t, cfg.Validate(), "config: %+v", cfg)
+	}
+}
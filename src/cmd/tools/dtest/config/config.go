@@ -48,14 +48,52 @@ type Configuration struct {
 
 // DTestConfig is a collection of DTest configs
 type DTestConfig struct {
-	DebugPort               int                 `yaml:"debugPort" validate:"nonzero"`
-	BootstrapTimeout        time.Duration       `yaml:"bootstrapTimeout" validate:"nonzero"`
-	BootstrapReportInterval time.Duration       `yaml:"bootstrapReportInterval" validate:"nonzero"`
-	NodePort                int                 `yaml:"nodePort" validate:"nonzero"`
-	ServiceID               string              `yaml:"serviceID" validate:"nonzero"`
-	DataDir                 string              `yaml:"dataDir" validate:"nonzero"` // path relative to m3em agent working directory
-	Seeds                   []SeedConfig        `yaml:"seeds"`
-	Instances               []PlacementInstance `yaml:"instances" validate:"min=1"`
+	DebugPort               int                  `yaml:"debugPort" validate:"nonzero"`
+	BootstrapTimeout        time.Duration        `yaml:"bootstrapTimeout" validate:"nonzero"`
+	BootstrapReportInterval time.Duration        `yaml:"bootstrapReportInterval" validate:"nonzero"`
+	NodePort                int                  `yaml:"nodePort" validate:"nonzero"`
+	ServiceID               string               `yaml:"serviceID" validate:"nonzero"`
+	DataDir                 string               `yaml:"dataDir" validate:"nonzero"` // path relative to m3em agent working directory
+	Seeds                   []SeedConfig         `yaml:"seeds"`
+	SeedConcurrency         int                  `yaml:"seedConcurrency"` // defaults to the m3em cluster node concurrency
+	Instances               []PlacementInstance  `yaml:"instances" validate:"min=1"`
+	NetworkFaults           *NetworkFaultsConfig `yaml:"networkFaults"`
+}
+
+// NetworkFaultsConfig configures the injection of network faults on the hosts of the
+// instances. Faults are injected with tc/netem, which is run over ssh since the m3em
+// agents can only run the process under test.
+type NetworkFaultsConfig struct {
+	Interface string       `yaml:"interface" validate:"nonzero"` // network interface of the hosts to inject faults on
+	SSHUser   string       `yaml:"sshUser"`                      // defaults to the current user
+	SSHArgs   []string     `yaml:"sshArgs"`                      // e.g. identity file or port
+	Sudo      bool         `yaml:"sudo"`                         // run tc with sudo
+	Fault     NetworkFault `yaml:"fault"`                        // fault injected by dtests that degrade the network
+}
+
+// NetworkFault describes degraded network conditions, which are applied to the
+// packets sent by a host.
+type NetworkFault struct {
+	Latency    time.Duration `yaml:"latency"`
+	Jitter     time.Duration `yaml:"jitter"`
+	PacketLoss float64       `yaml:"packetLoss"` // percentage of packets that are dropped
+}
+
+// Validate validates the network fault.
+func (f NetworkFault) Validate() error {
+	if f.Latency < 0 || f.Jitter < 0 {
+		return fmt.Errorf("network fault latency and jitter must not be negative")
+	}
+	if f.Jitter > 0 && f.Latency == 0 {
+		return fmt.Errorf("network fault jitter requires latency")
+	}
+	if f.PacketLoss < 0 || f.PacketLoss > 100 {
+		return fmt.Errorf("network fault packet loss must be a percentage, got %v", f.PacketLoss)
+	}
+	if f.Latency == 0 && f.PacketLoss == 0 {
+		return fmt.Errorf("network fault must add latency or packet loss")
+	}
+	return nil
 }
 
 // SeedConfig is a collection of Seed Data configurations
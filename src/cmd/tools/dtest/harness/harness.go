@@ -33,6 +33,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	clusterclient "github.com/m3db/m3/src/cluster/client"
 	etcdclient "github.com/m3db/m3/src/cluster/client/etcd"
 	"github.com/m3db/m3/src/cluster/placement"
 	"github.com/m3db/m3/src/cluster/services"
@@ -63,8 +64,9 @@ import (
 )
 
 const (
-	buildFilename  = "m3dbnode"
-	configFilename = "m3dbnode.yaml"
+	buildFilename      = "m3dbnode"
+	configFilename     = "m3dbnode.yaml"
+	defaultNamespaceID = "metrics"
 )
 
 type closeFn func() error
@@ -88,6 +90,8 @@ type DTestHarness struct {
 	nodeOpts         node.Options
 	clusterOpts      cluster.Options
 	nodes            []m3emnode.Node
+	faultedHosts     map[string]node.ServiceNode
+	kvClient         clusterclient.Client
 }
 
 // New constructs a new DTestHarness
@@ -132,6 +136,7 @@ func New(cliOpts *config.Args, rawLogger *zap.Logger) *DTestHarness {
 	if err != nil {
 		logger.Fatalf("unable to create kv client: %v", err)
 	}
+	dt.kvClient = kvClient
 
 	// set the namespace in kv
 	kvStore, err := kvClient.KV()
@@ -282,8 +287,24 @@ func (dt *DTestHarness) BootstrapTimeout() time.Duration {
 	return dt.Configuration().DTest.BootstrapTimeout
 }
 
-// Seed seeds the cluster nodes within the placement with data
+// Seed seeds the cluster nodes within the placement with data, seeding up to the
+// configured seed concurrency number of nodes in parallel.
 func (dt *DTestHarness) Seed(nodes []node.ServiceNode) error {
+	concurrency := dt.conf.DTest.SeedConcurrency
+	if concurrency <= 0 {
+		concurrency = dt.ClusterOptions().NodeConcurrency()
+	}
+	return dt.SeedWithConcurrency(nodes, concurrency)
+}
+
+// SeedWithConcurrency seeds the cluster nodes within the placement with data, seeding
+// up to concurrency number of nodes in parallel. Errors encountered while seeding any
+// of the nodes are aggregated and returned.
+func (dt *DTestHarness) SeedWithConcurrency(nodes []node.ServiceNode, concurrency int) error {
+	if concurrency <= 0 {
+		return fmt.Errorf("seed concurrency must be positive, got: %d", concurrency)
+	}
+
 	c := dt.Cluster()
 	if c.Status() == cluster.ClusterStatusUninitialized {
 		return fmt.Errorf("cluster must be Setup() prior to seeding it with data")
@@ -296,7 +317,7 @@ func (dt *DTestHarness) Seed(nodes []node.ServiceNode) error {
 	}
 
 	for _, conf := range seedConfigs {
-		if err := dt.seedWithConfig(nodes, conf); err != nil {
+		if err := dt.seedWithConfig(nodes, conf, concurrency); err != nil {
 			return err
 		}
 	}
@@ -304,6 +325,50 @@ func (dt *DTestHarness) Seed(nodes []node.ServiceNode) error {
 	return nil
 }
 
+// ResetNode stops the provided node (if it's running) and re-initializes it, removing
+// all of the contents of its remote working directory (including the data directory)
+// in the process. The shards of the node are marked as initializing in the placement
+// so that the node bootstraps them from its peers rather than from its (now empty)
+// filesystem. The node is left in the Setup state, i.e. it needs to be started again
+// by the caller.
+func (dt *DTestHarness) ResetNode(n node.ServiceNode) error {
+	if n.Status() == node.StatusRunning {
+		if err := n.Stop(); err != nil {
+			return fmt.Errorf("unable to stop node: %v", err)
+		}
+	}
+
+	co := dt.ClusterOptions()
+	if err := n.Setup(co.ServiceBuild(), co.ServiceConfig(), co.SessionToken(), co.SessionOverride()); err != nil {
+		return fmt.Errorf("unable to re-initialize node: %v", err)
+	}
+
+	if err := dt.markInstanceShardsInitializing(n.ID()); err != nil {
+		return fmt.Errorf("unable to mark shards of node as initializing: %v", err)
+	}
+
+	return nil
+}
+
+func (dt *DTestHarness) markInstanceShardsInitializing(id string) error {
+	p, err := dt.placementService.Placement()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve placement: %v", err)
+	}
+
+	p = p.Clone()
+	inst, ok := p.Instance(id)
+	if !ok {
+		return fmt.Errorf("instance %s is not in the placement", id)
+	}
+	for _, s := range inst.Shards().All() {
+		s.SetState(shard.Initializing)
+	}
+
+	_, err = dt.placementService.CheckAndSet(p, p.Version())
+	return err
+}
+
 func delayedNowFn(delay time.Duration) xclock.NowFn {
 	if delay == 0 {
 		return time.Now
@@ -314,7 +379,11 @@ func delayedNowFn(delay time.Duration) xclock.NowFn {
 	}
 }
 
-func (dt *DTestHarness) seedWithConfig(nodes []node.ServiceNode, seedConf config.SeedConfig) error {
+func (dt *DTestHarness) seedWithConfig(
+	nodes []node.ServiceNode,
+	seedConf config.SeedConfig,
+	concurrency int,
+) error {
 	dt.logger.Info("seeding data with configuration", zap.Any("config", seedConf))
 
 	seedDir := path.Join(dt.harnessDir, "seed", seedConf.Namespace)
@@ -352,7 +421,6 @@ func (dt *DTestHarness) seedWithConfig(nodes []node.ServiceNode, seedConf config
 		dataDir      = dt.conf.DTest.DataDir
 		co           = dt.ClusterOptions()
 		placement    = dt.Cluster().Placement()
-		concurrency  = co.NodeConcurrency()
 		timeout      = co.NodeOperationTimeout()
 		transferFunc = func(n node.ServiceNode) error {
 			for _, file := range localFiles {
@@ -367,7 +435,7 @@ func (dt *DTestHarness) seedWithConfig(nodes []node.ServiceNode, seedConf config
 		}
 	)
 
-	dt.logger.Info("transferring data to nodes")
+	dt.logger.Info("transferring data to nodes", zap.Int("concurrency", concurrency))
 	transferDataExecutor := node.NewConcurrentExecutor(nodes, concurrency, timeout, transferFunc)
 	if err := transferDataExecutor.Run(); err != nil {
 		return fmt.Errorf("unable to transfer generated data, err: %v", err)
@@ -426,6 +494,41 @@ func (dt *DTestHarness) WaitUntilAllShardsAvailable() error {
 	return nil
 }
 
+// ScaleOut starts the provided spare nodes and adds them to the cluster placement in
+// numSteps batches of roughly equal size. After each batch it waits until all the
+// shards in the placement are marked available before adding the next one, so the
+// cluster rebalances once per batch.
+func (dt *DTestHarness) ScaleOut(spares []node.ServiceNode, numSteps int) error {
+	if numSteps < 1 || numSteps > len(spares) {
+		return fmt.Errorf(
+			"unable to add %d nodes in %d steps", len(spares), numSteps)
+	}
+
+	testCluster := dt.Cluster()
+	for step := 0; step < numSteps; step++ {
+		var (
+			start = step * len(spares) / numSteps
+			end   = (step + 1) * len(spares) / numSteps
+			batch = spares[start:end]
+		)
+		dt.logger.Info("adding nodes to the cluster",
+			zap.Int("step", step+1), zap.Int("numSteps", numSteps), zap.Int("numNodes", len(batch)))
+		for _, n := range batch {
+			if err := n.Start(); err != nil {
+				return fmt.Errorf("unable to start node %s: %v", n.ID(), err)
+			}
+			if err := testCluster.AddSpecifiedNode(n); err != nil {
+				return fmt.Errorf("unable to add node %s: %v", n.ID(), err)
+			}
+		}
+
+		if err := dt.WaitUntilAllShardsAvailable(); err != nil {
+			return fmt.Errorf("step %d of %d: %v", step+1, numSteps, err)
+		}
+	}
+	return nil
+}
+
 // AllShardsAvailable returns if the placement service has all shards marked available
 func (dt *DTestHarness) AllShardsAvailable() bool {
 	p, err := dt.placementService.Placement()
@@ -448,6 +551,36 @@ func (dt *DTestHarness) AllShardsAvailable() bool {
 	return true
 }
 
+// AssertPlacementSatisfiesRF returns an error if any shard in the current placement has
+// fewer than replication factor number of replicas that are either available or initializing.
+func (dt *DTestHarness) AssertPlacementSatisfiesRF() error {
+	p, err := dt.placementService.Placement()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve placement: %v", err)
+	}
+
+	numReplicas := make(map[uint32]int, p.NumShards())
+	for _, inst := range p.Instances() {
+		for _, s := range inst.Shards().All() {
+			if state := s.State(); state == shard.Available || state == shard.Initializing {
+				numReplicas[s.ID()]++
+			}
+		}
+	}
+
+	var (
+		rf       = p.ReplicaFactor()
+		multiErr xerrors.MultiError
+	)
+	for _, shardID := range p.Shards() {
+		if n := numReplicas[shardID]; n < rf {
+			multiErr = multiErr.Add(fmt.Errorf(
+				"shard %d has %d available/initializing replicas, expected at least %d", shardID, n, rf))
+		}
+	}
+	return multiErr.FinalError()
+}
+
 // AnyInstanceShardHasState returns a flag if the placement service has any instance
 // with the specified shard state
 func (dt *DTestHarness) AnyInstanceShardHasState(id string, state shard.State) bool {
@@ -550,7 +683,7 @@ func newConfig(logger *zap.Logger, filename string) build.ServiceConfiguration {
 
 func defaultNamespaceProtoValue() (proto.Message, error) {
 	md, err := namespace.NewMetadata(
-		ident.StringID("metrics"),
+		ident.StringID(defaultNamespaceID),
 		namespace.NewOptions().
 			SetBootstrapEnabled(true).
 			SetCleanupEnabled(true).
@@ -0,0 +1,178 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package harness
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/tools/dtest/config"
+	"github.com/m3db/m3/src/m3em/node"
+
+	"go.uber.org/zap"
+)
+
+// InjectNetworkFault degrades the network of the hosts of the provided nodes by applying
+// the fault to all the packets they send, including those sent to the other nodes. Any
+// fault previously injected on the same hosts is replaced. Faults remain in place until
+// they're cleared with ClearNetworkFaults, or until the harness is closed at the latest.
+func (dt *DTestHarness) InjectNetworkFault(nodes []node.ServiceNode, fault config.NetworkFault) error {
+	if dt.conf.DTest.NetworkFaults == nil {
+		return fmt.Errorf("network faults are not configured")
+	}
+	if err := fault.Validate(); err != nil {
+		return err
+	}
+
+	dt.Lock()
+	if dt.faultedHosts == nil {
+		dt.faultedHosts = make(map[string]node.ServiceNode)
+		// Restore normal networking on teardown, regardless of how the dtest ends.
+		dt.addCloser(dt.clearAllNetworkFaults)
+	}
+	dt.Unlock()
+
+	args := append([]string{"qdisc", "replace"}, dt.netemDeviceArgs()...)
+	args = append(args, netemArgs(fault)...)
+	return dt.runOnHosts(nodes, func(n node.ServiceNode) error {
+		if err := dt.runTC(n.Hostname(), args...); err != nil {
+			return err
+		}
+
+		dt.Lock()
+		dt.faultedHosts[n.Hostname()] = n
+		dt.Unlock()
+		dt.logger.Info("injected network fault",
+			zap.String("host", n.Hostname()), zap.Any("fault", fault))
+		return nil
+	})
+}
+
+// ClearNetworkFaults restores normal networking on the hosts of the provided nodes.
+func (dt *DTestHarness) ClearNetworkFaults(nodes []node.ServiceNode) error {
+	if dt.conf.DTest.NetworkFaults == nil {
+		return fmt.Errorf("network faults are not configured")
+	}
+
+	args := append([]string{"qdisc", "del"}, dt.netemDeviceArgs()...)
+	return dt.runOnHosts(nodes, func(n node.ServiceNode) error {
+		dt.Lock()
+		_, faulted := dt.faultedHosts[n.Hostname()]
+		dt.Unlock()
+		if !faulted {
+			return nil
+		}
+
+		if err := dt.runTC(n.Hostname(), args...); err != nil {
+			return err
+		}
+
+		dt.Lock()
+		delete(dt.faultedHosts, n.Hostname())
+		dt.Unlock()
+		dt.logger.Info("cleared network fault", zap.String("host", n.Hostname()))
+		return nil
+	})
+}
+
+func (dt *DTestHarness) clearAllNetworkFaults() error {
+	dt.Lock()
+	nodes := make([]node.ServiceNode, 0, len(dt.faultedHosts))
+	for _, n := range dt.faultedHosts {
+		nodes = append(nodes, n)
+	}
+	dt.Unlock()
+
+	if len(nodes) == 0 {
+		return nil
+	}
+	return dt.ClearNetworkFaults(nodes)
+}
+
+// runOnHosts runs fn for one node of each distinct host amongst the provided nodes.
+func (dt *DTestHarness) runOnHosts(nodes []node.ServiceNode, fn node.ServiceNodeFn) error {
+	var (
+		hosts       = make(map[string]struct{}, len(nodes))
+		uniqueNodes = make([]node.ServiceNode, 0, len(nodes))
+	)
+	for _, n := range nodes {
+		if _, ok := hosts[n.Hostname()]; ok {
+			continue
+		}
+		hosts[n.Hostname()] = struct{}{}
+		uniqueNodes = append(uniqueNodes, n)
+	}
+
+	var (
+		co       = dt.ClusterOptions()
+		executor = node.NewConcurrentExecutor(uniqueNodes, co.NodeConcurrency(), co.NodeOperationTimeout(), fn)
+	)
+	return executor.Run()
+}
+
+func (dt *DTestHarness) netemDeviceArgs() []string {
+	return []string{"dev", dt.conf.DTest.NetworkFaults.Interface, "root"}
+}
+
+// runTC runs tc with the provided arguments on the host over ssh.
+func (dt *DTestHarness) runTC(host string, args ...string) error {
+	conf := dt.conf.DTest.NetworkFaults
+	target := host
+	if conf.SSHUser != "" {
+		target = conf.SSHUser + "@" + host
+	}
+
+	sshArgs := append(append([]string(nil), conf.SSHArgs...), target)
+	if conf.Sudo {
+		sshArgs = append(sshArgs, "sudo")
+	}
+	sshArgs = append(sshArgs, "tc")
+	sshArgs = append(sshArgs, args...)
+
+	output, err := exec.Command("ssh", sshArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to run tc %s on host %s: %v, output: %s",
+			strings.Join(args, " "), host, err, output)
+	}
+	return nil
+}
+
+// netemArgs returns the tc arguments of the netem qdisc that applies the fault.
+func netemArgs(fault config.NetworkFault) []string {
+	args := []string{"netem"}
+	if fault.Latency > 0 {
+		args = append(args, "delay", netemDuration(fault.Latency))
+		if fault.Jitter > 0 {
+			args = append(args, netemDuration(fault.Jitter))
+		}
+	}
+	if fault.PacketLoss > 0 {
+		args = append(args, "loss", strconv.FormatFloat(fault.PacketLoss, 'f', -1, 64)+"%")
+	}
+	return args
+}
+
+func netemDuration(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Microsecond), 10) + "us"
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package harness
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cluster/placement"
+	"github.com/m3db/m3/src/cluster/services"
+	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3/src/dbnode/generated/thrift/rpc"
+	"github.com/m3db/m3/src/dbnode/sharding"
+	"github.com/m3db/m3/src/dbnode/topology"
+	m3emnode "github.com/m3db/m3/src/dbnode/x/m3em/node"
+	"github.com/m3db/m3/src/m3em/node"
+	xerrors "github.com/m3db/m3/src/x/errors"
+	"github.com/m3db/m3/src/x/ident"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	backgroundWriterIDPrefix = "dtest.background-writer."
+	// maxMissingWritesReported bounds the number of missing writes included in the
+	// error returned by Verify.
+	maxMissingWritesReported = 10
+)
+
+// BackgroundWriter continuously writes datapoints to a fixed set of series in the
+// cluster, for example while a dtest changes the topology of the cluster, and keeps
+// track of the writes that were acknowledged so that it can later verify that none
+// of them were lost.
+type BackgroundWriter struct {
+	sync.Mutex
+
+	session          client.Session
+	placementService placement.Service
+	ns               ident.ID
+	ids              []ident.ID
+	interval         time.Duration
+	logger           *zap.Logger
+
+	acked     map[string]map[time.Time]float64
+	numAcked  int
+	numFailed int
+
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+// StartBackgroundWriter starts writing a datapoint to each of numSeries series of the
+// dtest namespace every interval, until the returned writer is stopped. Writes use the
+// default write consistency level so they may fail while the topology is changing, in
+// which case they're not verified.
+func (dt *DTestHarness) StartBackgroundWriter(numSeries int, interval time.Duration) (*BackgroundWriter, error) {
+	if numSeries <= 0 {
+		return nil, fmt.Errorf("number of series must be positive, got: %d", numSeries)
+	}
+	if interval < time.Millisecond {
+		// Datapoints are written at millisecond resolution, one per interval.
+		return nil, fmt.Errorf("write interval must be at least 1ms, got: %v", interval)
+	}
+
+	session, err := dt.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]ident.ID, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		ids = append(ids, ident.StringID(fmt.Sprintf("%s%d", backgroundWriterIDPrefix, i)))
+	}
+
+	w := &BackgroundWriter{
+		session:          session,
+		placementService: dt.placementService,
+		ns:               ident.StringID(defaultNamespaceID),
+		ids:              ids,
+		interval:         interval,
+		logger:           dt.logger,
+		acked:            make(map[string]map[time.Time]float64, numSeries),
+		closeCh:          make(chan struct{}),
+		doneCh:           make(chan struct{}),
+	}
+	go w.writeLoop()
+
+	dt.addCloser(func() error {
+		w.Stop()
+		return session.Close()
+	})
+	return w, nil
+}
+
+// newSession returns a new session with the cluster that reads from all the replicas
+// of each shard.
+func (dt *DTestHarness) newSession() (client.Session, error) {
+	topoOpts := topology.NewDynamicOptions().
+		SetConfigServiceClient(dt.kvClient).
+		SetServiceID(dt.serviceID()).
+		SetQueryOptions(services.NewQueryOptions().SetIncludeUnhealthy(true)).
+		SetInstrumentOptions(dt.iopts)
+	opts := client.NewOptions().
+		SetTopologyInitializer(topology.NewDynamicInitializer(topoOpts)).
+		SetReadConsistencyLevel(topology.ReadConsistencyLevelAll).
+		SetInstrumentOptions(dt.iopts)
+
+	c, err := client.NewClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %v", err)
+	}
+	session, err := c.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create session: %v", err)
+	}
+	return session, nil
+}
+
+func (w *BackgroundWriter) writeLoop() {
+	defer close(w.doneCh)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var value float64
+	for {
+		select {
+		case <-w.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		value++
+		t := time.Now().Truncate(time.Millisecond)
+		for _, id := range w.ids {
+			err := w.session.Write(w.ns, id, t, value, xtime.Millisecond, nil)
+
+			w.Lock()
+			if err != nil {
+				w.numFailed++
+			} else {
+				series, ok := w.acked[id.String()]
+				if !ok {
+					series = make(map[time.Time]float64)
+					w.acked[id.String()] = series
+				}
+				series[t] = value
+				w.numAcked++
+			}
+			w.Unlock()
+
+			if err != nil {
+				w.logger.Debug("background write failed",
+					zap.Stringer("id", id), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Stop stops the writer and waits until any in-flight writes have completed. It's safe
+// to call Stop more than once.
+func (w *BackgroundWriter) Stop() {
+	w.Lock()
+	select {
+	case <-w.closeCh:
+	default:
+		close(w.closeCh)
+	}
+	w.Unlock()
+	<-w.doneCh
+}
+
+// NumWrites returns the number of writes that were acknowledged and that failed.
+func (w *BackgroundWriter) NumWrites() (acked int, failed int) {
+	w.Lock()
+	defer w.Unlock()
+	return w.numAcked, w.numFailed
+}
+
+// Verify stops the writer and reads back all of the series it wrote to, returning an
+// error if any of the writes that were acknowledged is missing or has a different value.
+func (w *BackgroundWriter) Verify() error {
+	w.Stop()
+	return w.verify(w.ids, w.fetchFromSession)
+}
+
+// VerifyNode stops the writer and reads back the series it wrote to that belong to the
+// shards of the provided node from that node alone, returning an error if any of the
+// writes that were acknowledged is missing from it or has a different value. Unlike
+// Verify this detects writes that are only present on the other replicas of the series,
+// for example after the node lost its data and had to bootstrap it from its peers.
+func (w *BackgroundWriter) VerifyNode(n node.ServiceNode) error {
+	w.Stop()
+
+	mn, ok := n.(m3emnode.Node)
+	if !ok {
+		return fmt.Errorf("unable to cast: %v to m3dbnode", n.String())
+	}
+
+	p, err := w.placementService.Placement()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve placement: %v", err)
+	}
+	inst, ok := p.Instance(n.ID())
+	if !ok {
+		return fmt.Errorf("node %s is not in the placement", n.ID())
+	}
+
+	var (
+		hashFn = sharding.DefaultHashFn(p.NumShards())
+		ids    []ident.ID
+	)
+	for _, id := range w.ids {
+		if inst.Shards().Contains(hashFn(id)) {
+			ids = append(ids, id)
+		}
+	}
+
+	return w.verify(ids, func(id ident.ID, start, end time.Time) (map[time.Time]float64, error) {
+		result, err := mn.Fetch(&rpc.FetchRequest{
+			RangeStart:     xtime.ToNormalizedTime(start, time.Millisecond),
+			RangeEnd:       xtime.ToNormalizedTime(end, time.Millisecond),
+			NameSpace:      w.ns.String(),
+			ID:             id.String(),
+			RangeType:      rpc.TimeType_UNIX_MILLISECONDS,
+			ResultTimeType: rpc.TimeType_UNIX_MILLISECONDS,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch series %s from node %s: %v", id.String(), n.ID(), err)
+		}
+
+		actual := make(map[time.Time]float64, len(result.Datapoints))
+		for _, dp := range result.Datapoints {
+			actual[xtime.FromNormalizedTime(dp.Timestamp, time.Millisecond)] = dp.Value
+		}
+		return actual, nil
+	})
+}
+
+// fetchSeriesFn returns the values of the datapoints of a series within [start, end),
+// keyed by their timestamp.
+type fetchSeriesFn func(id ident.ID, start, end time.Time) (map[time.Time]float64, error)
+
+func (w *BackgroundWriter) fetchFromSession(id ident.ID, start, end time.Time) (map[time.Time]float64, error) {
+	iter, err := w.session.Fetch(w.ns, id, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch series %s: %v", id.String(), err)
+	}
+	defer iter.Close()
+
+	actual := make(map[time.Time]float64)
+	for iter.Next() {
+		dp, _, _ := iter.Current()
+		actual[dp.Timestamp] = dp.Value
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read series %s: %v", id.String(), err)
+	}
+	return actual, nil
+}
+
+func (w *BackgroundWriter) verify(ids []ident.ID, fetchFn fetchSeriesFn) error {
+	var (
+		multiErr    xerrors.MultiError
+		numMissing  int
+		numVerified int
+	)
+	for _, id := range ids {
+		expected := w.acked[id.String()]
+		if len(expected) == 0 {
+			continue
+		}
+
+		var start, end time.Time
+		for t := range expected {
+			if start.IsZero() || t.Before(start) {
+				start = t
+			}
+			if t.After(end) {
+				end = t
+			}
+		}
+
+		actual, err := fetchFn(id, start, end.Add(time.Millisecond))
+		if err != nil {
+			return err
+		}
+
+		for t, value := range expected {
+			numVerified++
+			if actualValue, ok := actual[t]; ok && actualValue == value {
+				continue
+			}
+			numMissing++
+			if numMissing <= maxMissingWritesReported {
+				multiErr = multiErr.Add(fmt.Errorf(
+					"series %s is missing acknowledged write of %v at %v", id.String(), value, t))
+			}
+		}
+	}
+
+	if numMissing > 0 {
+		return fmt.Errorf("%d of %d acknowledged writes are missing: %v",
+			numMissing, numVerified, multiErr.FinalError())
+	}
+	return nil
+}
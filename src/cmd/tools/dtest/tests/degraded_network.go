@@ -0,0 +1,115 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dtests
+
+import (
+	"github.com/m3db/m3/src/cmd/tools/dtest/harness"
+
+	"github.com/spf13/cobra"
+)
+
+var degradedNetworkTestCmd = &cobra.Command{
+	Use:   "degraded_network",
+	Short: "Run a dtest where a node is re-bootstrapped from its peers while the network between the nodes is degraded",
+	Long: `
+	Perform the following operations on the provided set of nodes:
+	(1) Create a new cluster placement using all the provided nodes.
+	(2) Seed the nodes used in (1), with initial data on their respective file-systems.
+	(3) Start the nodes from (1), and wait until they are bootstrapped.
+	(4) Start writing to a set of series in the background.
+	(5) Inject the network fault of the dtest configuration (latency and/or packet loss) on all the nodes.
+	(6) Stop any one node from the cluster, clear its data directory, and mark its shards as initializing.
+	(7) Restart the node from (6), and wait until it is bootstrapped from its peers.
+	(8) Wait until all the shards in the placement are marked as available.
+	(9) Restore normal networking on all the nodes.
+	(10) Stop the background writes, and verify all the acknowledged writes can be read back from every node.
+
+	Requires the networkFaults section of the dtest configuration.
+`,
+	Example: `./dtest degraded_network --m3db-build path/to/m3dbnode --m3db-config path/to/m3dbnode.yaml --dtest-config path/to/dtest.yaml`,
+	Run:     degradedNetworkDTest,
+}
+
+func degradedNetworkDTest(cmd *cobra.Command, args []string) {
+	if err := globalArgs.Validate(); err != nil {
+		printUsage(cmd)
+		return
+	}
+
+	rawLogger := newLogger(cmd)
+	defer rawLogger.Sync()
+	logger := rawLogger.Sugar()
+
+	dt := harness.New(globalArgs, rawLogger)
+	defer dt.Close()
+
+	faultsConf := dt.Configuration().DTest.NetworkFaults
+	panicIf(faultsConf == nil, "network faults are not configured")
+
+	nodes := dt.Nodes()
+	numNodes := len(nodes)
+	testCluster := dt.Cluster()
+
+	logger.Infof("setting up cluster")
+	setupNodes, err := testCluster.Setup(numNodes)
+	panicIfErr(err, "unable to setup cluster")
+	logger.Infof("setup cluster with %d nodes", numNodes)
+
+	logger.Infof("seeding nodes with initial data")
+	panicIfErr(dt.Seed(setupNodes), "unable to seed nodes")
+	logger.Infof("seeded nodes")
+
+	logger.Infof("starting cluster")
+	panicIfErr(testCluster.Start(), "unable to start nodes")
+	logger.Infof("started cluster with %d nodes", numNodes)
+
+	logger.Infof("waiting until all instances are bootstrapped")
+	panicIfErr(dt.WaitUntilAllBootstrapped(setupNodes), "unable to bootstrap all nodes")
+	logger.Infof("all nodes bootstrapped successfully!")
+
+	logger.Infof("starting background writes")
+	writer, err := dt.StartBackgroundWriter(backgroundWriterNumSeries, backgroundWriterInterval)
+	panicIfErr(err, "unable to start background writes")
+	logger.Infof("started background writes to %d series", backgroundWriterNumSeries)
+
+	// degrade the network between all of the nodes, the harness restores it on
+	// teardown if the test fails before it's restored below
+	logger.Infof("injecting network fault: %+v", faultsConf.Fault)
+	panicIfErr(dt.InjectNetworkFault(setupNodes, faultsConf.Fault), "unable to inject network fault")
+	logger.Infof("injected network fault")
+
+	// stop the first node from the cluster and wipe its data directory
+	resetNodeFromPeers(dt, logger, setupNodes[0])
+
+	logger.Infof("restoring network")
+	panicIfErr(dt.ClearNetworkFaults(setupNodes), "unable to restore network")
+	logger.Infof("restored network")
+
+	writer.Stop()
+	acked, failed := writer.NumWrites()
+	logger.Infof("stopped background writes, %d acknowledged, %d failed", acked, failed)
+
+	for _, n := range setupNodes {
+		logger.Infof("verifying acknowledged writes on node: %v", n.String())
+		panicIfErr(writer.VerifyNode(n), "acknowledged writes lost")
+	}
+	logger.Infof("all %d acknowledged writes verified on all nodes!", acked)
+}
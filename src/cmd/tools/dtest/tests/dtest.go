@@ -60,6 +60,10 @@ func init() {
 		addUpNodeRemoveTestCmd,
 		replaceUpNodeRemoveTestCmd,
 		replaceUpNodeRemoveUnseededTestCmd,
+		resetNodeDataTestCmd,
+		degradedNetworkTestCmd,
+		writesDuringNodeRemovalTestCmd,
+		scaleOutTestCmd,
 	)
 
 	globalArgs.RegisterFlags(DTestCmd)
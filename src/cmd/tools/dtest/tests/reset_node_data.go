@@ -0,0 +1,128 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dtests
+
+import (
+	"time"
+
+	"github.com/m3db/m3/src/cmd/tools/dtest/harness"
+	"github.com/m3db/m3/src/m3em/node"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// resetNodeDataWritesDuration is how long data is written to the cluster for before
+// the node is reset.
+const resetNodeDataWritesDuration = 10 * backgroundWriterInterval
+
+var resetNodeDataTestCmd = &cobra.Command{
+	Use:   "reset_node_data",
+	Short: "Run a dtest where a node has its data directory wiped, and is re-bootstrapped from its peers",
+	Long: `
+	Perform the following operations on the provided set of nodes:
+	(1) Create a new cluster placement using all the provided nodes.
+	(2) Seed the nodes used in (1), with initial data on their respective file-systems.
+	(3) Start the nodes from (1), and wait until they are bootstrapped.
+	(4) Write to a set of series for a while, and stop writing to them.
+	(5) Stop any one node from the cluster, clear its data directory, and mark its shards as initializing.
+	(6) Restart the node from (5), and wait until it is bootstrapped from its peers.
+	(7) Wait until all the shards in the placement are marked as available.
+	(8) Verify all the acknowledged writes from (4) can be read back from the node from (5).
+`,
+	Example: `./dtest reset_node_data --m3db-build path/to/m3dbnode --m3db-config path/to/m3dbnode.yaml --dtest-config path/to/dtest.yaml`,
+	Run:     resetNodeDataDTest,
+}
+
+func resetNodeDataDTest(cmd *cobra.Command, args []string) {
+	if err := globalArgs.Validate(); err != nil {
+		printUsage(cmd)
+		return
+	}
+
+	rawLogger := newLogger(cmd)
+	defer rawLogger.Sync()
+	logger := rawLogger.Sugar()
+
+	dt := harness.New(globalArgs, rawLogger)
+	defer dt.Close()
+
+	nodes := dt.Nodes()
+	numNodes := len(nodes)
+	testCluster := dt.Cluster()
+
+	logger.Infof("setting up cluster")
+	setupNodes, err := testCluster.Setup(numNodes)
+	panicIfErr(err, "unable to setup cluster")
+	logger.Infof("setup cluster with %d nodes", numNodes)
+
+	logger.Infof("seeding nodes with initial data")
+	panicIfErr(dt.Seed(setupNodes), "unable to seed nodes")
+	logger.Infof("seeded nodes")
+
+	logger.Infof("starting cluster")
+	panicIfErr(testCluster.Start(), "unable to start nodes")
+	logger.Infof("started cluster with %d nodes", numNodes)
+
+	logger.Infof("waiting until all instances are bootstrapped")
+	panicIfErr(dt.WaitUntilAllBootstrapped(setupNodes), "unable to bootstrap all nodes")
+	logger.Infof("all nodes bootstrapped successfully!")
+
+	panicIfErr(dt.AssertPlacementSatisfiesRF(), "placement does not satisfy replication factor")
+
+	logger.Infof("writing to %d series for %v", backgroundWriterNumSeries, resetNodeDataWritesDuration)
+	writer, err := dt.StartBackgroundWriter(backgroundWriterNumSeries, backgroundWriterInterval)
+	panicIfErr(err, "unable to start background writes")
+	time.Sleep(resetNodeDataWritesDuration)
+	writer.Stop()
+	acked, failed := writer.NumWrites()
+	logger.Infof("stopped writes, %d acknowledged, %d failed", acked, failed)
+
+	// stop the first node from the cluster and wipe its data directory
+	resetNode := setupNodes[0]
+	resetNodeFromPeers(dt, logger, resetNode)
+
+	logger.Infof("verifying acknowledged writes on node: %v", resetNode.String())
+	panicIfErr(writer.VerifyNode(resetNode), "acknowledged writes lost by reset node")
+	logger.Infof("all acknowledged writes verified on node!")
+}
+
+// resetNodeFromPeers resets the provided node, restarts it and waits until it has
+// bootstrapped its data from its peers and all the shards are available again.
+func resetNodeFromPeers(dt *harness.DTestHarness, logger *zap.SugaredLogger, resetNode node.ServiceNode) {
+	logger.Infof("resetting node: %v", resetNode.String())
+	panicIfErr(dt.ResetNode(resetNode), "unable to reset node")
+	logger.Infof("reset node: %s", resetNode.ID())
+
+	logger.Infof("restarting node: %v", resetNode.String())
+	panicIfErr(resetNode.Start(), "unable to start node")
+
+	logger.Infof("waiting until node is bootstrapped from its peers")
+	panicIfErr(dt.WaitUntilAllBootstrapped([]node.ServiceNode{resetNode}), "unable to bootstrap node")
+	logger.Infof("node bootstrapped successfully!")
+
+	// wait until all shards are marked available again
+	logger.Infof("waiting till all shards are available")
+	panicIfErr(dt.WaitUntilAllShardsAvailable(), "all shards not available")
+	logger.Infof("all shards available!")
+
+	panicIfErr(dt.AssertPlacementSatisfiesRF(), "placement does not satisfy replication factor")
+}
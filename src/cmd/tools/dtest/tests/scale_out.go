@@ -0,0 +1,113 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dtests
+
+import (
+	"github.com/m3db/m3/src/cmd/tools/dtest/harness"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	scaleOutTestCmd = &cobra.Command{
+		Use:   "scale_out",
+		Short: "Run a dtest where the capacity of the cluster is doubled from N to 2N nodes, and verify no acknowledged writes are lost.",
+		Long: `
+	Perform the following operations on the provided set of nodes:
+	(1) Create a new cluster placement using half of the provided nodes.
+	(2) Seed the nodes used in (1), with initial data on their respective file-systems.
+	(3) Start the nodes from (1), and wait until they are bootstrapped.
+	(4) Start writing to a set of series in the background.
+	(5) Start the unused nodes, and add them to the cluster placement in --scale-steps batches,
+	    waiting until all the shards in the placement are marked as available after each batch.
+	(6) Verify every shard in the placement has replication factor available replicas.
+	(7) Stop the background writes, and verify all the acknowledged writes can be read back.
+`,
+		Example: `./dtest scale_out --scale-steps 2 --m3db-build path/to/m3dbnode --m3db-config path/to/m3dbnode.yaml --dtest-config path/to/dtest.yaml`,
+		Run:     scaleOutDTest,
+	}
+
+	scaleOutNumSteps int
+)
+
+func init() {
+	scaleOutTestCmd.Flags().IntVar(&scaleOutNumSteps, "scale-steps", 1,
+		"Number of placement changes to add the new nodes in")
+}
+
+func scaleOutDTest(cmd *cobra.Command, args []string) {
+	if err := globalArgs.Validate(); err != nil {
+		printUsage(cmd)
+		return
+	}
+
+	rawLogger := newLogger(cmd)
+	defer rawLogger.Sync()
+	logger := rawLogger.Sugar()
+
+	dt := harness.New(globalArgs, rawLogger)
+	defer dt.Close()
+
+	nodes := dt.Nodes()
+	numNodes := len(nodes) / 2 // leaving the other half as spares
+	panicIf(numNodes < 1, "at least 2 nodes are required")
+	testCluster := dt.Cluster()
+
+	logger.Infof("setting up cluster")
+	setupNodes, err := testCluster.Setup(numNodes)
+	panicIfErr(err, "unable to setup cluster")
+	logger.Infof("setup cluster with %d nodes", numNodes)
+
+	logger.Infof("seeding nodes with initial data")
+	panicIfErr(dt.Seed(setupNodes), "unable to seed nodes")
+	logger.Infof("seeded nodes")
+
+	logger.Infof("starting cluster")
+	panicIfErr(testCluster.Start(), "unable to start nodes")
+	logger.Infof("started cluster with %d nodes", numNodes)
+
+	logger.Infof("waiting until all instances are bootstrapped")
+	panicIfErr(dt.WaitUntilAllBootstrapped(setupNodes), "unable to bootstrap all nodes")
+	logger.Infof("all nodes bootstrapped successfully!")
+
+	logger.Infof("starting background writes")
+	writer, err := dt.StartBackgroundWriter(backgroundWriterNumSeries, backgroundWriterInterval)
+	panicIfErr(err, "unable to start background writes")
+	logger.Infof("started background writes to %d series", backgroundWriterNumSeries)
+
+	// add as many nodes as are already in the placement
+	spares := testCluster.SpareNodes()
+	panicIf(len(spares) < numNodes, "not enough spares to double the cluster")
+	spares = spares[:numNodes]
+	logger.Infof("adding %d nodes in %d steps", len(spares), scaleOutNumSteps)
+	panicIfErr(dt.ScaleOut(spares, scaleOutNumSteps), "unable to scale out cluster")
+	logger.Infof("cluster scaled out to %d nodes, all shards available!", len(testCluster.ActiveNodes()))
+
+	panicIfErr(dt.AssertPlacementSatisfiesRF(), "placement does not satisfy replication factor")
+
+	writer.Stop()
+	acked, failed := writer.NumWrites()
+	logger.Infof("stopped background writes, %d acknowledged, %d failed", acked, failed)
+
+	logger.Infof("verifying acknowledged writes")
+	panicIfErr(writer.Verify(), "acknowledged writes lost")
+	logger.Infof("all %d acknowledged writes verified!", acked)
+}
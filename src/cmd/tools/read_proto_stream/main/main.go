@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/tools"
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/dbnode/encoding/proto"
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/ts"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/pborman/getopt"
+	"go.uber.org/zap"
+)
+
+type datapoint struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Unit      string          `json:"unit"`
+	Message   json.RawMessage `json:"message,omitempty"`
+	// Messages is set instead of Message for streams of message batches.
+	Messages []json.RawMessage `json:"messages,omitempty"`
+}
+
+func main() {
+	var (
+		optStreamFile  = getopt.StringLong("stream-file", 'f', "", "Encoded proto stream file [e.g. /tmp/segment.bin]")
+		optSchemaFile  = getopt.StringLong("schema-file", 's', "", "Proto schema file [e.g. /tmp/schema.proto]")
+		optMessageName = getopt.StringLong("message-name", 'm', "", "Proto message name [e.g. mypackage.MyMessage]")
+	)
+	getopt.Parse()
+
+	rawLogger, err := zap.NewDevelopment()
+	if err != nil {
+		log.Fatalf("unable to create logger: %+v", err)
+	}
+	log := rawLogger.Sugar()
+
+	if *optStreamFile == "" || *optSchemaFile == "" || *optMessageName == "" {
+		getopt.Usage()
+		os.Exit(1)
+	}
+
+	schema, err := proto.ParseProtoSchema(*optSchemaFile, *optMessageName)
+	if err != nil {
+		log.Fatalf("unable to parse schema: %v", err)
+	}
+
+	stream, err := ioutil.ReadFile(*optStreamFile)
+	if err != nil {
+		log.Fatalf("unable to read stream file: %v", err)
+	}
+
+	bytesPool := tools.NewCheckedBytesPool()
+	bytesPool.Init()
+
+	var (
+		opts = proto.NewOptions().SetEncodingOptions(encoding.NewOptions().SetBytesPool(bytesPool))
+		// Write to stdout so the output can be redirected separately from the logs.
+		encoder = json.NewEncoder(os.Stdout)
+	)
+
+	header, err := proto.ReadStreamHeader(bytes.NewReader(stream), opts)
+	if err != nil {
+		log.Fatalf("unable to read stream header: %v", err)
+	}
+	if err := encoder.Encode(map[string]proto.StreamHeader{"header": header}); err != nil {
+		log.Fatalf("unable to write stream header: %v", err)
+	}
+
+	var (
+		iter       = proto.NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), opts)
+		message    = dynamic.NewMessage(schema)
+		batch      []ts.Annotation
+		numDecoded int
+	)
+	messageJSON := func(annotation []byte) json.RawMessage {
+		if err := message.Unmarshal(annotation); err != nil {
+			log.Fatalf("unable to unmarshal message of datapoint %d: %v", numDecoded, err)
+		}
+		messageJSON, err := message.MarshalJSON()
+		if err != nil {
+			log.Fatalf("unable to marshal message of datapoint %d to JSON: %v", numDecoded, err)
+		}
+		return messageJSON
+	}
+	defer iter.Close()
+	for iter.Next() {
+		dp, unit, annotation := iter.Current()
+		result := datapoint{
+			Timestamp: dp.Timestamp,
+			Unit:      unit.String(),
+		}
+		if header.MessageBatches {
+			batch, err = proto.SplitMessageBatch(batch[:0], annotation)
+			if err != nil {
+				log.Fatalf("unable to split messages of datapoint %d: %v", numDecoded, err)
+			}
+			for _, m := range batch {
+				result.Messages = append(result.Messages, messageJSON(m))
+			}
+		} else {
+			result.Message = messageJSON(annotation)
+		}
+		if err := encoder.Encode(result); err != nil {
+			log.Fatalf("unable to write datapoint %d: %v", numDecoded, err)
+		}
+		numDecoded++
+	}
+	if err := iter.Err(); err != nil {
+		// The datapoints that precede the error (e.g. in a truncated stream) have
+		// already been written out.
+		log.Fatalf("unable to decode stream after %d datapoints: %v", numDecoded, err)
+	}
+}
@@ -404,8 +404,9 @@ func (o *options) SetEncodingM3TSZ() Options {
 
 func (o *options) SetEncodingProto(encodingOpts encoding.Options) Options {
 	opts := *o
+	protoOpts := proto.NewOptions().SetEncodingOptions(encodingOpts)
 	opts.readerIteratorAllocate = func(r io.Reader, descr namespace.SchemaDescr) encoding.ReaderIterator {
-		return proto.NewIterator(r, descr, encodingOpts)
+		return proto.NewIterator(r, descr, protoOpts)
 	}
 	opts.isProtoEnabled = true
 	return &opts
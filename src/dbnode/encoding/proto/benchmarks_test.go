@@ -22,15 +22,18 @@ package proto
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/jhump/protoreflect/desc/builder"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/m3db/m3/src/dbnode/encoding"
 	"github.com/m3db/m3/src/dbnode/namespace"
 	"github.com/m3db/m3/src/dbnode/ts"
 	"github.com/m3db/m3/src/dbnode/x/xio"
 	"github.com/m3db/m3/src/x/context"
+	"github.com/m3db/m3/src/x/pool"
 	xtime "github.com/m3db/m3/src/x/time"
 )
 
@@ -47,7 +50,7 @@ func benchmarkEncoder(b *testing.B, nonCustomFieldsEnabled bool) {
 	var (
 		_, messagesBytes = testMessages(100, nonCustomFieldsEnabled)
 		start            = time.Now()
-		encoder          = NewEncoder(start, encoding.NewOptions())
+		encoder          = NewEncoder(start, NewOptions())
 	)
 	encoder.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
 
@@ -61,6 +64,55 @@ func benchmarkEncoder(b *testing.B, nonCustomFieldsEnabled bool) {
 	}
 }
 
+// BenchmarkEncoderConcurrentBytesPool measures the throughput of many goroutines that each
+// encode their own series, with and without sharing a bytes pool for the stream buffers.
+func BenchmarkEncoderConcurrentBytesPool(b *testing.B) {
+	bytesPool := pool.NewCheckedBytesPool([]pool.Bucket{
+		{Capacity: 64, Count: 4096},
+		{Capacity: 256, Count: 4096},
+		{Capacity: 1024, Count: 4096},
+		{Capacity: 4096, Count: 4096},
+	}, nil, func(s []pool.Bucket) pool.BytesPool {
+		return pool.NewBytesPool(s, nil)
+	})
+	bytesPool.Init()
+
+	b.Run("shared bytes pool", func(b *testing.B) {
+		benchmarkEncoderConcurrent(b, NewOptions().SetEncodingOptions(encoding.NewOptions().SetBytesPool(bytesPool)))
+	})
+	b.Run("no bytes pool", func(b *testing.B) {
+		benchmarkEncoderConcurrent(b, NewOptions())
+	})
+}
+
+func benchmarkEncoderConcurrent(b *testing.B, opts Options) {
+	var (
+		_, messagesBytes = testMessages(10, true)
+		schema           = namespace.GetTestSchemaDescr(testVLSchema)
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			start   = time.Now()
+			encoder = NewEncoder(start, opts)
+		)
+		// Each iteration encodes a short series and releases its buffers, like an encoder
+		// that is reused for a new block, so that buffers are acquired at a high rate.
+		for pb.Next() {
+			encoder.Reset(start, 0, schema)
+			for _, protoBytes := range messagesBytes {
+				start = start.Add(time.Second)
+				if err := encoder.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, protoBytes); err != nil {
+					panic(err)
+				}
+			}
+			segment := encoder.Discard()
+			segment.Finalize()
+		}
+	})
+}
+
 func BenchmarkIterator(b *testing.B) {
 	b.Run("with non custom encoded fields enabled", func(b *testing.B) {
 		benchmarkIterator(b, true)
@@ -77,8 +129,8 @@ func benchmarkIterator(b *testing.B, nonCustomFieldsEnabled bool) {
 	var (
 		_, messagesBytes = testMessages(100, nonCustomFieldsEnabled)
 		start            = time.Now()
-		encodingOpts     = encoding.NewOptions()
-		encoder          = NewEncoder(start, encodingOpts)
+		opts             = NewOptions()
+		encoder          = NewEncoder(start, opts)
 		schema           = namespace.GetTestSchemaDescr(testVLSchema)
 	)
 	encoder.SetSchema(schema)
@@ -97,7 +149,7 @@ func benchmarkIterator(b *testing.B, nonCustomFieldsEnabled bool) {
 	segment, err := stream.Segment()
 	handleErr(err)
 
-	iterator := NewIterator(stream, schema, encodingOpts)
+	iterator := NewIterator(stream, schema, opts)
 	reader := xio.NewSegmentReader(segment)
 	for i := 0; i < b.N; i++ {
 		reader.Reset(segment)
@@ -109,6 +161,123 @@ func benchmarkIterator(b *testing.B, nonCustomFieldsEnabled bool) {
 	}
 }
 
+// BenchmarkEncoderWorkloads measures encoding the messages of each of the benchmark workloads.
+func BenchmarkEncoderWorkloads(b *testing.B) {
+	for _, workload := range benchmarkWorkloads {
+		workload := workload
+		b.Run(workload.name, func(b *testing.B) {
+			var (
+				messagesBytes = workload.messagesBytes(100)
+				start         = time.Now()
+				encoder       = NewEncoder(start, NewOptions())
+				schema        = namespace.GetTestSchemaDescr(testVLSchema)
+			)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoder.Reset(start, 0, schema)
+				for j, protoBytes := range messagesBytes {
+					dp := ts.Datapoint{Timestamp: start.Add(time.Duration(j) * time.Second)}
+					if err := encoder.Encode(dp, xtime.Second, protoBytes); err != nil {
+						panic(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkIteratorWorkloads measures decoding the streams of each of the benchmark workloads,
+// both reconstructing every message in full and extracting the value of a single field.
+func BenchmarkIteratorWorkloads(b *testing.B) {
+	for _, workload := range benchmarkWorkloads {
+		workload := workload
+		b.Run(workload.name+"/full message", func(b *testing.B) {
+			benchmarkIteratorWorkload(b, workload, func(iter encoding.Iterator) {
+				if _, _, _, err := iter.(*iterator).CachedMessage(); err != nil {
+					panic(err)
+				}
+			})
+		})
+		b.Run(workload.name+"/single field", func(b *testing.B) {
+			fieldNum := testVLSchema.FindFieldByName(workload.fieldName).GetNumber()
+			benchmarkIteratorWorkload(b, workload, func(iter encoding.Iterator) {
+				_, _, annotation := iter.Current()
+				err := forEachMarshalledField(annotation, func(num int32, field []byte) {
+					if num == fieldNum {
+						benchmarkFieldSink = field
+					}
+				})
+				handleErr(err)
+			})
+		})
+	}
+}
+
+func benchmarkIteratorWorkload(
+	b *testing.B,
+	workload benchmarkWorkload,
+	readCurrent func(iter encoding.Iterator),
+) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	var (
+		messagesBytes = workload.messagesBytes(100)
+		start         = time.Now()
+		opts          = NewOptions()
+		encoder       = NewEncoder(start, opts)
+		schema        = namespace.GetTestSchemaDescr(testVLSchema)
+	)
+	encoder.SetSchema(schema)
+	for _, protoBytes := range messagesBytes {
+		start = start.Add(time.Second)
+		if err := encoder.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, protoBytes); err != nil {
+			panic(err)
+		}
+	}
+
+	stream, ok := encoder.Stream(ctx)
+	if !ok {
+		panic("encoder had no stream")
+	}
+	segment, err := stream.Segment()
+	handleErr(err)
+
+	iter := NewIterator(stream, schema, opts)
+	reader := xio.NewSegmentReader(segment)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(segment)
+		iter.Reset(reader, schema)
+		for iter.Next() {
+			readCurrent(iter)
+		}
+		handleErr(iter.Err())
+	}
+}
+
+func BenchmarkEncodeCustomSchemaTypes(b *testing.B) {
+	// A wide schema with high field numbers but sparse custom encoded fields.
+	schemaBuilder := builder.NewMessage("WideMessage")
+	for i := 1; i <= 200; i++ {
+		schemaBuilder.AddField(builder.NewField(fmt.Sprintf("field%d", i),
+			builder.FieldTypeInt64()).SetNumber(int32(i * 25)))
+	}
+	schema, err := schemaBuilder.Build()
+	handleErr(err)
+
+	encoder := NewEncoder(time.Now(), NewOptions())
+	encoder.SetSchema(namespace.GetTestSchemaDescr(schema))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encoder.stream.Reset(nil)
+		encoder.encodeCustomSchemaTypes()
+	}
+}
+
 func testMessages(numMessages int, includeAttributes bool) ([]*dynamic.Message, [][]byte) {
 	var (
 		messages      = make([]*dynamic.Message, 0, numMessages)
@@ -136,6 +305,85 @@ func testMessages(numMessages int, includeAttributes bool) ([]*dynamic.Message,
 	return messages, messagesBytes
 }
 
+// benchmarkFieldSink prevents the compiler from optimizing away the extraction of fields.
+var benchmarkFieldSink []byte
+
+// benchmarkWorkload generates messages that resemble a kind of series, for benchmarking both
+// the encoder and the iterator on the same data.
+type benchmarkWorkload struct {
+	name string
+	// fieldName is the field whose value is extracted when benchmarking single field reads.
+	fieldName  string
+	newMessage func(m *dynamic.Message, i int, rng *rand.Rand)
+}
+
+var benchmarkWorkloads = []benchmarkWorkload{
+	{
+		// A monotonically increasing int field with unchanging other fields.
+		name:      "counters",
+		fieldName: "epoch",
+		newMessage: func(m *dynamic.Message, i int, rng *rand.Rand) {
+			m.SetFieldByName("latitude", float64(1))
+			m.SetFieldByName("epoch", int64(i*10+rng.Intn(10)))
+		},
+	},
+	{
+		// Float fields that wander around a value.
+		name:      "gauges",
+		fieldName: "latitude",
+		newMessage: func(m *dynamic.Message, i int, rng *rand.Rand) {
+			m.SetFieldByName("latitude", 37.7+rng.Float64()/100)
+			m.SetFieldByName("longitude", -122.4+rng.Float64()/100)
+		},
+	},
+	{
+		// Long bytes values from a small set of values and a map field.
+		name:      "bytes heavy",
+		fieldName: "deliveryID",
+		newMessage: func(m *dynamic.Message, i int, rng *rand.Rand) {
+			id := rng.Intn(8)
+			m.SetFieldByName("deliveryID", []byte(fmt.Sprintf("some-really-really-really-really-long-id-%d", id)))
+			m.SetFieldByName("attributes", map[string]string{
+				"region":  fmt.Sprintf("region-%d", id%2),
+				"service": fmt.Sprintf("service-%d", id),
+			})
+		},
+	},
+	{
+		// Every field changing, though not necessarily with every message.
+		name:      "mixed",
+		fieldName: "latitude",
+		newMessage: func(m *dynamic.Message, i int, rng *rand.Rand) {
+			m.SetFieldByName("latitude", 37.7+rng.Float64()/100)
+			m.SetFieldByName("longitude", -122.4+rng.Float64()/100)
+			m.SetFieldByName("epoch", int64(i))
+			m.SetFieldByName("deliveryID", []byte(fmt.Sprintf("some-really-really-really-really-long-id-%d", rng.Intn(32))))
+			if i%4 == 0 {
+				m.SetFieldByName("attributes", map[string]string{
+					"key": fmt.Sprintf("val_%d", rng.Intn(4)),
+				})
+			}
+		},
+	},
+}
+
+// messagesBytes returns numMessages marshalled messages of the workload, the same ones on every
+// call.
+func (w benchmarkWorkload) messagesBytes(numMessages int) [][]byte {
+	var (
+		rng           = rand.New(rand.NewSource(0))
+		messagesBytes = make([][]byte, 0, numMessages)
+	)
+	for i := 0; i < numMessages; i++ {
+		m := dynamic.NewMessage(testVLSchema)
+		w.newMessage(m, i, rng)
+		bytes, err := m.Marshal()
+		handleErr(err)
+		messagesBytes = append(messagesBytes, bytes)
+	}
+	return messagesBytes
+}
+
 func handleErr(e error) {
 	if e != nil {
 		panic(e)
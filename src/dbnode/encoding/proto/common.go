@@ -21,11 +21,15 @@
 package proto
 
 import (
+	"fmt"
+	"math"
 	"reflect"
 	"sort"
 
+	"github.com/m3db/m3/src/dbnode/encoding"
 	"github.com/m3db/m3/src/dbnode/encoding/m3tsz"
 
+	"github.com/cespare/xxhash"
 	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
 )
@@ -33,6 +37,11 @@ import (
 // Schema represents a schema for a protobuf message.
 type Schema *desc.MessageDescriptor
 
+// bytesHash is the hash function used to compare bytes values against the values in the
+// dictionaries of the encoder. Equal hashes are always confirmed by comparing the bytes so
+// it's a variable that tests can override to force hash collisions.
+var bytesHash = xxhash.Sum64
+
 const (
 	// ~1GiB is an intentionally large number to avoid users ever running into any
 	// limitations, but we want some theoretical maximum so that in the case of data / memory
@@ -43,6 +52,11 @@ const (
 	// maxCustomFieldNum is included for the same rationale as maxMarshalledProtoMessageSize.
 	maxCustomFieldNum = 10000
 
+	// maxInternedBytesValues is the maximum number of values of a bytes field that can be
+	// interned, interning is intended for fields with a handful of distinct values and the
+	// interned values are searched linearly.
+	maxInternedBytesValues = 256
+
 	protoFieldTypeNotFound dpb.FieldDescriptorProto_Type = -1
 )
 
@@ -71,6 +85,31 @@ const (
 	numCustomTypes = 9
 )
 
+func (t customFieldType) String() string {
+	switch t {
+	case notCustomEncodedField:
+		return "none"
+	case signedInt64Field:
+		return "int64"
+	case signedInt32Field:
+		return "int32"
+	case unsignedInt64Field:
+		return "uint64"
+	case unsignedInt32Field:
+		return "uint32"
+	case float64Field:
+		return "float64"
+	case float32Field:
+		return "float32"
+	case bytesField:
+		return "bytes"
+	case boolField:
+		return "bool"
+	default:
+		return fmt.Sprintf("unknown(%d)", int8(t))
+	}
+}
+
 // -1 because iota's are zero-indexed so the highest value will be the number of
 // custom types - 1.
 var numBitsToEncodeCustomType = numBitsRequiredForNumUpToN(numCustomTypes - 1)
@@ -97,6 +136,12 @@ const (
 	opCodeInterpretSubsequentBitsAsLRUIndex          = 0
 	opCodeInterpretSubsequentBitsAsBytesLengthVarInt = 1
 
+	opCodeBytesNotInStaticDict                     = 0
+	opCodeInterpretSubsequentBitsAsStaticDictIndex = 1
+
+	opCodeBytesNotInterned                       = 0
+	opCodeInterpretSubsequentBitsAsInternedIndex = 1
+
 	opCodeNoFieldsSetToDefaultProtoMarshal = 0
 	opCodeFieldsSetToDefaultProtoMarshal   = 1
 
@@ -108,8 +153,174 @@ const (
 
 	opCodeBoolTrue  = 1
 	opCodeBoolFalse = 0
+
+	opCodeEndOfStream    = 0
+	opCodeBytesDictReset = 1
+
+	opCodeIntChangesPerField = 0
+	opCodeIntChangesBitset   = 1
+
+	opCodeIntDelta        = 0
+	opCodeIntDeltaOfDelta = 1
+
+	opCodeNoProtoPortion  = 0
+	opCodeHasProtoPortion = 1
+
+	opCodeFloatXOR            = 0
+	opCodeIntValuedFloatDelta = 1
+
+	opCodeBytesNotPrefixDelta = 0
+	opCodeBytesPrefixDelta    = 1
+)
+
+// streamFeatures is a bitset of optional features that are enabled for a given stream. It's
+// encoded into the stream header for versions of the encoding scheme that support it.
+type streamFeatures uint64
+
+const (
+	// streamFeatureEndOfStreamMarker indicates that the stream is terminated with an
+	// explicit end-of-stream marker such that truncated streams can be detected.
+	streamFeatureEndOfStreamMarker streamFeatures = 1 << iota
+	// streamFeatureMapFieldDiffs indicates that changes to map fields are encoded as
+	// diffs of the map entries rather than the entire map.
+	streamFeatureMapFieldDiffs
+	// streamFeatureFullNonCustomFields indicates that the non custom encoded fields of every
+	// message are marshalled in full instead of only the fields that changed since the
+	// previous message.
+	streamFeatureFullNonCustomFields
+	// streamFeatureStaticBytesDict indicates that bytes values that are not in the LRU
+	// dictionary may be encoded as an index into a static dictionary shared by many
+	// streams, the hash of which follows the stream features in the header.
+	streamFeatureStaticBytesDict
+	// streamFeatureOneofFields indicates that the members of oneof fields are never custom
+	// encoded and that a member which is set implicitly clears the other members of its
+	// oneof, so they're not included in the fields that were set to their default value.
+	streamFeatureOneofFields
+	// streamFeatureInternedBytes indicates that the first few distinct values of each bytes
+	// field are interned and that interned values that are not in the LRU dictionary may be
+	// encoded as an index into the interned values, the maximum number of which follows the
+	// stream features in the header.
+	streamFeatureInternedBytes
+	// streamFeatureBytesDictResets indicates that the stream may contain markers at which the
+	// LRU dictionaries and interned values of all the bytes fields are reset.
+	streamFeatureBytesDictResets
+	// streamFeatureIntChangesBitset indicates that for schemas with enough custom encoded int
+	// fields, each write begins with a control bit that indicates whether the int fields
+	// that changed are encoded as a single bitset rather than one bit per field.
+	streamFeatureIntChangesBitset
+	// streamFeatureIntDeltaOfDelta indicates that some custom encoded int fields may be encoded
+	// as the delta of the delta between consecutive values, the custom types of each schema
+	// are then followed by a bit for each custom encoded int field that indicates whether it is.
+	streamFeatureIntDeltaOfDelta
+	// streamFeatureSchemaHash indicates that the stream header ends with a hash of the schema
+	// the stream was encoded with so that iterators can verify that they use the same schema.
+	streamFeatureSchemaHash
+	// streamFeaturePrimedBytesDicts indicates that the LRU dictionaries of some bytes fields
+	// are primed with values that are not part of the stream before the first write, the
+	// stream header then ends with the hash of the primed values.
+	streamFeaturePrimedBytesDicts
+	// streamFeatureOmitEmptyProtoPortion indicates that each schema is followed by a bit
+	// that indicates whether the writes with that schema have a Protobuf marshalled portion,
+	// which is omitted entirely (including its control bit) if the schema has no fields
+	// that aren't custom encoded.
+	streamFeatureOmitEmptyProtoPortion
+	// streamFeatureValueRangesTrailer indicates that the end-of-stream marker is followed by
+	// a trailer that contains the minimum and maximum value of each custom encoded numeric
+	// field, see ReadValueRanges.
+	streamFeatureValueRangesTrailer
+	// streamFeatureLimitedCustomFields indicates that every schema is followed by the numbers
+	// of the fields that could have been custom encoded but that the encoder marshals as
+	// Protobuf instead because it limits the number of custom encoded fields.
+	streamFeatureLimitedCustomFields
+	// streamFeatureCustomFieldOrder indicates that every schema is followed by the numbers of
+	// the custom encoded fields whose values are written first in every write, in that order,
+	// before the values of the rest of the custom encoded fields in field number order.
+	streamFeatureCustomFieldOrder
+	// streamFeatureIntValuedFloats indicates that the change of a custom encoded float field
+	// from an integer value may be encoded as the delta between integers, see
+	// encodeIntValuedFloatValue.
+	streamFeatureIntValuedFloats
+	// streamFeatureStreamMetadata indicates that the stream header ends with an opaque blob
+	// of metadata that is preceded by its length, see StreamMetadata.
+	streamFeatureStreamMetadata
+	// streamFeatureFloatBaselines indicates that the stream header contains a hash of the
+	// baselines that the first value of some custom encoded float fields is XOR'd with, see
+	// FloatBaselines.
+	streamFeatureFloatBaselines
+	// streamFeatureBytesPrefixDelta indicates that a new value of a custom encoded bytes field
+	// may be encoded as the difference with its previous value, see encodeBytesPrefixDelta.
+	streamFeatureBytesPrefixDelta
+	// streamFeatureMessageBatches indicates that the timestamp of every write is followed by
+	// the number of messages that share it, see Encoder.EncodeMulti.
+	streamFeatureMessageBatches
+
+	supportedStreamFeatures = streamFeatureEndOfStreamMarker |
+		streamFeatureMapFieldDiffs |
+		streamFeatureFullNonCustomFields |
+		streamFeatureStaticBytesDict |
+		streamFeatureOneofFields |
+		streamFeatureInternedBytes |
+		streamFeatureBytesDictResets |
+		streamFeatureIntChangesBitset |
+		streamFeatureIntDeltaOfDelta |
+		streamFeatureSchemaHash |
+		streamFeaturePrimedBytesDicts |
+		streamFeatureOmitEmptyProtoPortion |
+		streamFeatureValueRangesTrailer |
+		streamFeatureLimitedCustomFields |
+		streamFeatureCustomFieldOrder |
+		streamFeatureIntValuedFloats |
+		streamFeatureStreamMetadata |
+		streamFeatureFloatBaselines |
+		streamFeatureBytesPrefixDelta |
+		streamFeatureMessageBatches
 )
 
+// minCustomIntFieldsForChangesBitset is the minimum number of custom encoded int fields for
+// which encoding the int fields that changed as a bitset can be more compact than one bit per
+// field, since the varint that precedes the bitset takes up at least a byte.
+const minCustomIntFieldsForChangesBitset = 9
+
+// canEncodeIntChangesBitset returns whether the int fields that changed may be encoded as a
+// bitset for the next write, which requires enough custom encoded int fields and that the
+// first value of each of them has already been encoded (the first value has no change bit).
+func canEncodeIntChangesBitset(customFields []customFieldState) bool {
+	numIntFields := 0
+	for _, customField := range customFields {
+		if !isCustomIntEncodedField(customField.fieldType) {
+			continue
+		}
+		if !customField.intEncAndIter.hasEncodedFirst {
+			return false
+		}
+		numIntFields++
+	}
+
+	return numIntFields >= minCustomIntFieldsForChangesBitset
+}
+
+func (f streamFeatures) has(feature streamFeatures) bool {
+	return f&feature != 0
+}
+
+// writeEndOfStreamMarker writes the end-of-stream marker which reuses the (otherwise impossible)
+// per-write control bit combination that indicates that the stream contains at least one more
+// write, but that neither the time unit nor the schema have changed.
+func writeEndOfStreamMarker(stream encoding.OStream) {
+	stream.WriteBit(opCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange)
+	stream.WriteBit(opCodeTimeUnitChangeAndOrSchemaChange)
+	stream.WriteBit(opCodeTimeUnitUnchanged)
+	stream.WriteBit(opCodeSchemaUnchanged)
+}
+
+// writeBytesDictResetMarker writes the bytes dictionaries reset marker which is the end-of-stream
+// marker followed by an additional control bit. The end-of-stream marker is always followed by
+// padding zero bits (or the end of the stream) so the two can't be mistaken for each other.
+func writeBytesDictResetMarker(stream encoding.OStream) {
+	writeEndOfStreamMarker(stream)
+	stream.WriteBit(opCodeBytesDictReset)
+}
+
 var (
 	typeOfBytes = reflect.TypeOf(([]byte)(nil))
 
@@ -157,6 +368,12 @@ type customFieldState struct {
 	// the floats and ints.
 	bytesFieldDict         []encoderBytesFieldDictState
 	iteratorBytesFieldDict [][]byte
+	// Number of entries that have been evicted from bytesFieldDict.
+	bytesFieldDictEvictions int
+	// The interned values of the field in the order they were first encountered, unlike
+	// the dictionary they're never evicted.
+	internedBytes         []encoderBytesFieldDictState
+	iteratorInternedBytes [][]byte
 	// Float state. Works as both an encoder and iterator (I.E the encoder calls
 	// the encode methods and the iterator calls the read methods).
 	floatEncAndIter m3tsz.FloatEncoderAndIterator
@@ -166,6 +383,10 @@ type customFieldState struct {
 	fieldNum       int
 	protoFieldType dpb.FieldDescriptorProto_Type
 	fieldType      customFieldType
+
+	// The index of the range of the values of the field in the value ranges of the
+	// encoder, only used by the encoder if it writes a value ranges trailer.
+	valueRangeIdx int
 }
 
 type encoderBytesFieldDictState struct {
@@ -177,6 +398,16 @@ type encoderBytesFieldDictState struct {
 	hash     uint64
 	startPos uint32
 	length   uint32
+	// In dry-run mode the stream is not retained so a copy of the bytes is
+	// kept for comparison instead.
+	dryRunBytes []byte
+	// Values that were encoded as an index into the static dictionary, or that
+	// the dictionary was primed with, are not in the stream so they're compared
+	// against the dictionary or primed value instead.
+	staticBytes []byte
+	// Values that were encoded as the difference with the previous value are not
+	// in the stream in full so a copy of the bytes is kept for comparison instead.
+	deltaBytes []byte
 }
 
 func newCustomFieldState(
@@ -196,13 +427,20 @@ func newCustomFieldState(
 
 // TODO(rartoul): Improve this function to be less naive and actually explore nested messages
 // for fields that we can use our custom compression on: https://github.com/m3db/m3/issues/1471
+//
+// customAndNonCustomFields returns the state of the custom encoded fields and the non custom
+// fields of the schema, both sorted by field number. Their order determines the layout of the
+// schema and of every write in the stream, so it must only depend on the numbers and types of
+// the fields and not on the order in which the descriptor returns them (which isn't guaranteed
+// to be their declaration order) such that the same schema always yields identical streams.
 func customAndNonCustomFields(
 	customFields []customFieldState,
 	nonCustomFields []marshalledField,
 	schema *desc.MessageDescriptor,
+	oneofFields bool,
 ) ([]customFieldState, []marshalledField) {
 	fields := schema.GetFields()
-	numCustomFields := numCustomFields(schema)
+	numCustomFields := numCustomFields(schema, oneofFields)
 	numNonCustomFields := len(fields) - numCustomFields
 
 	if cap(customFields) >= numCustomFields {
@@ -235,8 +473,9 @@ func customAndNonCustomFields(
 		if fieldNum < prevFieldNum {
 			isSorted = false
 		}
+		prevFieldNum = fieldNum
 
-		customFieldType, ok := isCustomField(fieldType, field.IsRepeated())
+		customFieldType, ok := isCustomSchemaField(field, oneofFields)
 		if !ok {
 			nonCustomFields = append(nonCustomFields, marshalledField{fieldNum: fieldNum})
 			continue
@@ -258,6 +497,96 @@ func customAndNonCustomFields(
 	return customFields, nonCustomFields
 }
 
+// customFieldOrder returns the indexes of the custom fields in the order that their values
+// are written in, which is the order of fieldNums followed by the rest of the custom fields
+// in field number order. It returns an empty slice if they're written in field number order.
+func customFieldOrder(
+	order []int,
+	customFields []customFieldState,
+	fieldNums []int32,
+) ([]int, error) {
+	order = order[:0]
+	if len(fieldNums) == 0 {
+		return order, nil
+	}
+
+	for _, fieldNum := range fieldNums {
+		idx := -1
+		for i, customField := range customFields {
+			if customField.fieldNum == int(fieldNum) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("field number %d is not a custom encoded field", fieldNum)
+		}
+		for _, prevIdx := range order {
+			if prevIdx == idx {
+				return nil, fmt.Errorf("duplicate field number %d", fieldNum)
+			}
+		}
+		order = append(order, idx)
+	}
+
+	for i := range customFields {
+		isOrdered := false
+		for _, idx := range order[:len(fieldNums)] {
+			if idx == i {
+				isOrdered = true
+				break
+			}
+		}
+		if !isOrdered {
+			order = append(order, i)
+		}
+	}
+	return order, nil
+}
+
+// customFieldIdx returns the index of the custom field whose value is written at position
+// pos given the order returned by customFieldOrder.
+func customFieldIdx(order []int, pos int) int {
+	if len(order) == 0 {
+		return pos
+	}
+	return order[pos]
+}
+
+// maxExactIntValuedFloat is the largest magnitude up to which every integer can be represented
+// exactly as a float64, so the delta between two such integers also fits in an int64.
+const maxExactIntValuedFloat = 1 << 53
+
+// isIntValuedFloat returns whether the float is an integer that can be represented exactly,
+// in which case its change to another such float may be encoded as the delta between them.
+func isIntValuedFloat(v float64) bool {
+	return v == math.Trunc(v) && math.Abs(v) <= maxExactIntValuedFloat
+}
+
+// minBytesPrefixDeltaCommonLen is the minimum number of bytes that a new value of a bytes
+// field must have in common with its previous value, as a prefix and suffix, for encoding it
+// as the difference to be more compact than encoding it in full, since the lengths of the
+// prefix and suffix take up at least a byte each.
+const minBytesPrefixDeltaCommonLen = 3
+
+// commonPrefixAndSuffixLen returns the lengths of the longest common prefix of a and b and
+// of their longest common suffix that doesn't overlap with the prefix in either of them.
+func commonPrefixAndSuffixLen(a, b []byte) (int, int) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	prefixLen := 0
+	for prefixLen < n && a[prefixLen] == b[prefixLen] {
+		prefixLen++
+	}
+	suffixLen := 0
+	for suffixLen < n-prefixLen && a[len(a)-1-suffixLen] == b[len(b)-1-suffixLen] {
+		suffixLen++
+	}
+	return prefixLen, suffixLen
+}
+
 func isCustomFloatEncodedField(t customFieldType) bool {
 	return t == float64Field || t == float32Field
 }
@@ -273,14 +602,14 @@ func isUnsignedInt(t customFieldType) bool {
 	return t == unsignedInt64Field || t == unsignedInt32Field
 }
 
-func numCustomFields(schema *desc.MessageDescriptor) int {
+func numCustomFields(schema *desc.MessageDescriptor, oneofFields bool) int {
 	var (
 		fields          = schema.GetFields()
 		numCustomFields = 0
 	)
 
 	for _, field := range fields {
-		if _, ok := isCustomField(field.GetType(), field.IsRepeated()); ok {
+		if _, ok := isCustomSchemaField(field, oneofFields); ok {
 			numCustomFields++
 		}
 	}
@@ -288,6 +617,17 @@ func numCustomFields(schema *desc.MessageDescriptor) int {
 	return numCustomFields
 }
 
+// isCustomSchemaField returns the custom type of the field if it's custom encoded. The
+// members of oneofs are left as non custom fields if oneofFields is set so that the
+// active member of a oneof is always explicitly encoded, even if its value is the
+// default value of the field.
+func isCustomSchemaField(field *desc.FieldDescriptor, oneofFields bool) (customFieldType, bool) {
+	if oneofFields && field.GetOneOf() != nil {
+		return -1, false
+	}
+	return isCustomField(field.GetType(), field.IsRepeated())
+}
+
 func isCustomField(fieldType dpb.FieldDescriptorProto_Type, isRepeated bool) (customFieldType, bool) {
 	if isRepeated {
 		return -1, false
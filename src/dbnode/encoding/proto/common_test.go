@@ -90,3 +90,59 @@ func TestNumBitsRequiredForNumUpToN(t *testing.T) {
 		require.Equal(t, tc.expectedOutput, output, "failed for input %d", tc.input)
 	}
 }
+
+func TestNumBitsToEncodeCustomType(t *testing.T) {
+	// The exported constant is part of the wire format so it must be kept in sync
+	// with the number of custom types.
+	require.Equal(t, numBitsToEncodeCustomType, NumBitsToEncodeCustomType)
+}
+
+func TestWireFormatOpCodes(t *testing.T) {
+	// The exported op codes are the stable definition of the wire format so their values
+	// must never change.
+	testCases := []struct {
+		name     string
+		opCode   int
+		expected int
+	}{
+		{"OpCodeMoreData", OpCodeMoreData, 1},
+		{"OpCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange", OpCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange, 0},
+		{"OpCodeTimeUnitChangeAndOrSchemaChange", OpCodeTimeUnitChangeAndOrSchemaChange, 1},
+		{"OpCodeNoMoreData", OpCodeNoMoreData, 0},
+		{"OpCodeTimeUnitChange", OpCodeTimeUnitChange, 1},
+		{"OpCodeTimeUnitUnchanged", OpCodeTimeUnitUnchanged, 0},
+		{"OpCodeSchemaChange", OpCodeSchemaChange, 1},
+		{"OpCodeSchemaUnchanged", OpCodeSchemaUnchanged, 0},
+		{"OpCodeChange", OpCodeChange, 1},
+		{"OpCodeNoChange", OpCodeNoChange, 0},
+		{"OpCodeInterpretSubsequentBitsAsLRUIndex", OpCodeInterpretSubsequentBitsAsLRUIndex, 0},
+		{"OpCodeInterpretSubsequentBitsAsBytesLengthVarInt", OpCodeInterpretSubsequentBitsAsBytesLengthVarInt, 1},
+		{"OpCodeInterpretSubsequentBitsAsStaticDictIndex", OpCodeInterpretSubsequentBitsAsStaticDictIndex, 1},
+		{"OpCodeBytesNotInStaticDict", OpCodeBytesNotInStaticDict, 0},
+		{"OpCodeInterpretSubsequentBitsAsInternedIndex", OpCodeInterpretSubsequentBitsAsInternedIndex, 1},
+		{"OpCodeBytesNotInterned", OpCodeBytesNotInterned, 0},
+		{"OpCodeFieldsSetToDefaultProtoMarshal", OpCodeFieldsSetToDefaultProtoMarshal, 1},
+		{"OpCodeNoFieldsSetToDefaultProtoMarshal", OpCodeNoFieldsSetToDefaultProtoMarshal, 0},
+		{"OpCodeIntDeltaNegative", OpCodeIntDeltaNegative, 1},
+		{"OpCodeIntDeltaPositive", OpCodeIntDeltaPositive, 0},
+		{"OpCodeBitsetValueIsSet", OpCodeBitsetValueIsSet, 1},
+		{"OpCodeBitsetValueIsNotSet", OpCodeBitsetValueIsNotSet, 0},
+		{"OpCodeBoolTrue", OpCodeBoolTrue, 1},
+		{"OpCodeBoolFalse", OpCodeBoolFalse, 0},
+		{"OpCodeBytesDictReset", OpCodeBytesDictReset, 1},
+		{"OpCodeEndOfStream", OpCodeEndOfStream, 0},
+		{"OpCodeIntChangesBitset", OpCodeIntChangesBitset, 1},
+		{"OpCodeIntChangesPerField", OpCodeIntChangesPerField, 0},
+		{"OpCodeIntDeltaOfDelta", OpCodeIntDeltaOfDelta, 1},
+		{"OpCodeIntDelta", OpCodeIntDelta, 0},
+		{"OpCodeHasProtoPortion", OpCodeHasProtoPortion, 1},
+		{"OpCodeNoProtoPortion", OpCodeNoProtoPortion, 0},
+		{"OpCodeIntValuedFloatDelta", OpCodeIntValuedFloatDelta, 1},
+		{"OpCodeFloatXOR", OpCodeFloatXOR, 0},
+		{"OpCodeBytesPrefixDelta", OpCodeBytesPrefixDelta, 1},
+		{"OpCodeBytesNotPrefixDelta", OpCodeBytesNotPrefixDelta, 0},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, tc.opCode, tc.name)
+	}
+}
@@ -34,10 +34,12 @@ type customFieldMarshaller interface {
 	encInt32(tag int32, x int32)
 	encSInt32(tag int32, x int32)
 	encSFixedInt32(tax int32, x int32)
+	encFixedUInt32(tag int32, x uint32)
 	encUInt32(tag int32, x uint32)
 	encInt64(tag int32, x int64)
 	encSInt64(tag int32, x int64)
 	encSFixedInt64(tax int32, x int64)
+	encFixedUInt64(tag int32, x uint64)
 	encUInt64(tag int32, x uint64)
 	encBool(tag int32, x bool)
 	encBytes(tag int32, x []byte)
@@ -103,6 +105,11 @@ func (m *customMarshaller) encSFixedInt32(tag int32, x int32) {
 	m.buf.encodeFixed32(uint32(x))
 }
 
+func (m *customMarshaller) encFixedUInt32(tag int32, x uint32) {
+	m.buf.encodeTagAndWireType(tag, proto.WireFixed32)
+	m.buf.encodeFixed32(x)
+}
+
 func (m *customMarshaller) encUInt32(tag int32, x uint32) {
 	m.encUInt64(tag, uint64(x))
 }
@@ -120,6 +127,11 @@ func (m *customMarshaller) encSFixedInt64(tag int32, x int64) {
 	m.buf.encodeFixed64(uint64(x))
 }
 
+func (m *customMarshaller) encFixedUInt64(tag int32, x uint64) {
+	m.buf.encodeTagAndWireType(tag, proto.WireFixed64)
+	m.buf.encodeFixed64(x)
+}
+
 func (m *customMarshaller) encUInt64(tag int32, x uint64) {
 	if x == 0 {
 		// Default values are not included in the stream.
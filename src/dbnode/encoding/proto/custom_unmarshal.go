@@ -23,6 +23,7 @@ package proto
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"sort"
 
@@ -32,10 +33,8 @@ import (
 )
 
 var (
-	// Groups in the Protobuf wire format are deprecated, so simplify the code significantly by
-	// not supporting them.
-	errGroupsAreNotSupported = errors.New("use of groups in proto wire format is not supported")
-	zeroValue                unmarshalValue
+	errUnexpectedEndGroup = errors.New("unexpected end group in proto wire format")
+	zeroValue             unmarshalValue
 )
 
 type customFieldUnmarshaller interface {
@@ -43,10 +42,22 @@ type customFieldUnmarshaller interface {
 	sortedNonCustomFieldValues() sortedMarshalledFields
 	numNonCustomValues() int
 	resetAndUnmarshal(schema *desc.MessageDescriptor, buf []byte) error
+	// setNonCustomFieldNums sets the sorted numbers of the fields that are unmarshalled as
+	// non custom fields regardless of the schema.
+	setNonCustomFieldNums(fieldNums []int32)
 }
 
 type customUnmarshallerOptions struct {
 	skipUnknownFields bool
+	// Unmarshal the fields that aren't in the schema as non custom fields instead of
+	// skipping over them, takes precedence over skipUnknownFields.
+	keepUnknownFields bool
+	// Skip over the values of custom fields that can't be interpreted according to
+	// the schema so that they're treated as default values instead of returning an
+	// error.
+	skipInvalidCustomFields bool
+	// Treat the members of oneofs as non custom fields (see streamFeatureOneofFields).
+	oneofFields bool
 }
 
 type customUnmarshaller struct {
@@ -56,6 +67,8 @@ type customUnmarshaller struct {
 
 	nonCustomValues sortedMarshalledFields
 	numNonCustom    int
+	// Fields that are non custom fields regardless of the schema.
+	nonCustomFieldNums []int32
 
 	opts customUnmarshallerOptions
 }
@@ -94,7 +107,7 @@ func (u *customUnmarshaller) unmarshal() error {
 		}
 
 		fd := u.schema.FindFieldByNumber(fieldNum)
-		if fd == nil {
+		if fd == nil && !u.opts.keepUnknownFields {
 			if !u.opts.skipUnknownFields {
 				return fmt.Errorf("encountered unknown field with field number: %d", fieldNum)
 			}
@@ -105,16 +118,19 @@ func (u *customUnmarshaller) unmarshal() error {
 			continue
 		}
 
-		if !u.isCustomField(fd) {
+		if fd == nil || !u.isCustomField(fd) {
 			_, err = u.skip(wireType)
 			if err != nil {
 				return err
 			}
 
 			var (
-				startIdx   = tagAndWireTypeStartOffset
-				endIdx     = u.decodeBuf.index
-				marshalled = u.decodeBuf.buf[startIdx:endIdx]
+				startIdx = tagAndWireTypeStartOffset
+				endIdx   = u.decodeBuf.index
+				// Cap the slice so that appending to it below (for repeated fields whose
+				// entries are interleaved with other fields) copies rather than overwriting
+				// the subsequent bytes in the buffer which other fields may reference.
+				marshalled = u.decodeBuf.buf[startIdx:endIdx:endIdx]
 			)
 			// A marshalled Protobuf message consists of a stream of <fieldNumber, wireType, value>
 			// tuples, all of which are optional, with no additional header or footer information.
@@ -122,7 +138,10 @@ func (u *customUnmarshaller) unmarshal() error {
 			// marshalled message and as a result we can build up the []marshalledField one field at
 			// a time.
 			updatedExisting := false
-			if fd.IsRepeated() {
+			// Fields that are non custom fields regardless of the schema were repeated in the
+			// schema the message was marshalled with, and it's unknown whether fields that aren't
+			// in the schema are repeated.
+			if fd == nil || fd.IsRepeated() || u.isNonCustomFieldNum(fieldNum) {
 				// If the fd is a repeated type and not using `packed` encoding then their could be multiple
 				// entries in the stream with the same field number so their marshalled bytes needs to be all
 				// concatenated together.
@@ -149,11 +168,12 @@ func (u *customUnmarshaller) unmarshal() error {
 				})
 			}
 
-			if areNonCustomValuesSorted && len(u.nonCustomValues) > 1 {
+			if !updatedExisting && areNonCustomValuesSorted && len(u.nonCustomValues) > 1 {
 				// Check if the slice is sorted as it's built to avoid resorting
-				// unnecessarily at the end.
-				lastFieldNum := u.nonCustomValues[len(u.nonCustomValues)-1].fieldNum
-				if fieldNum < lastFieldNum {
+				// unnecessarily at the end. The value for this field was just appended
+				// so compare it against the one before it.
+				prevFieldNum := u.nonCustomValues[len(u.nonCustomValues)-2].fieldNum
+				if fieldNum < prevFieldNum {
 					areNonCustomValuesSorted = false
 				}
 			}
@@ -162,12 +182,21 @@ func (u *customUnmarshaller) unmarshal() error {
 			continue
 		}
 
+		valueStartOffset := u.decodeBuf.index
 		value, err := u.unmarshalCustomField(fd, wireType)
 		if err != nil {
-			return err
+			if !u.opts.skipInvalidCustomFields {
+				return err
+			}
+			if skipErr := u.skipInvalidCustomField(fieldNum, wireType, valueStartOffset); skipErr != nil {
+				// The value can't be skipped over either so the rest of the message
+				// can't be read.
+				return err
+			}
+			continue
 		}
 
-		if areCustomValuesSorted && len(u.customValues) > 1 {
+		if areCustomValuesSorted && len(u.customValues) > 0 {
 			// Check if the slice is sorted as it's built to avoid resorting
 			// unnecessarily at the end.
 			lastFieldNum := u.customValues[len(u.customValues)-1].fieldNumber
@@ -192,6 +221,28 @@ func (u *customUnmarshaller) unmarshal() error {
 	return nil
 }
 
+// skipInvalidCustomField skips over the value of a custom field (starting at offset)
+// that could not be unmarshalled and discards any earlier values for the same field
+// so that the field is interpreted as its default value.
+func (u *customUnmarshaller) skipInvalidCustomField(fieldNum int32, wireType int8, offset int) error {
+	u.decodeBuf.index = offset
+	if _, err := u.skip(wireType); err != nil {
+		return err
+	}
+	if u.decodeBuf.index > len(u.decodeBuf.buf) {
+		return io.ErrUnexpectedEOF
+	}
+
+	values := u.customValues[:0]
+	for _, v := range u.customValues {
+		if v.fieldNumber != fieldNum {
+			values = append(values, v)
+		}
+	}
+	u.customValues = values
+	return nil
+}
+
 // isCustomField checks whether the encoder would have custom encoded this field or left
 // it up to the `jhump/dynamic` package to handle the encoding. This is important because
 // it allows us to use the efficient unmarshal path only for fields that the encoder can
@@ -207,7 +258,16 @@ func (u *customUnmarshaller) isCustomField(fd *desc.FieldDescriptor) bool {
 		return false
 	}
 
-	return true
+	if u.opts.oneofFields && fd.GetOneOf() != nil {
+		return false
+	}
+
+	return !u.isNonCustomFieldNum(fd.GetNumber())
+}
+
+func (u *customUnmarshaller) isNonCustomFieldNum(fieldNum int32) bool {
+	// Binary search since there may be hundreds of them for very wide schemas.
+	return isSortedFieldNum(u.nonCustomFieldNums, fieldNum)
 }
 
 // skip will skip over the next value in the encoded stream (given that the tag and
@@ -251,16 +311,48 @@ func (u *customUnmarshaller) skip(wireType int8) (int, error) {
 		return bytesSkipped, nil
 
 	case proto.WireStartGroup:
-		return 0, errGroupsAreNotSupported
+		// Groups in the Protobuf wire format are deprecated, but the fields of type group of
+		// schemas that still use them are never custom encoded so they only need skipping.
+		offsetBeforeSkipGroup := u.decodeBuf.index
+		if err := u.skipGroup(); err != nil {
+			return 0, err
+		}
+		return u.decodeBuf.index - offsetBeforeSkipGroup, nil
 
 	case proto.WireEndGroup:
-		return 0, errGroupsAreNotSupported
+		return 0, errUnexpectedEndGroup
 
 	default:
 		return 0, proto.ErrInternalBadWireType
 	}
 }
 
+// skipGroup skips over the fields of a group, including any nested groups, up to and including
+// the end group tag that terminates it.
+func (u *customUnmarshaller) skipGroup() error {
+	for depth := 1; depth > 0; {
+		_, wireType, err := u.decodeBuf.decodeTagAndWireType()
+		if err != nil {
+			return err
+		}
+
+		switch wireType {
+		case proto.WireStartGroup:
+			depth++
+		case proto.WireEndGroup:
+			depth--
+		default:
+			if _, err := u.skip(wireType); err != nil {
+				return err
+			}
+			if u.decodeBuf.index > len(u.decodeBuf.buf) {
+				return io.ErrUnexpectedEOF
+			}
+		}
+	}
+	return nil
+}
+
 func (u *customUnmarshaller) unmarshalCustomField(fd *desc.FieldDescriptor, wireType int8) (unmarshalValue, error) {
 	switch wireType {
 	case proto.WireFixed32:
@@ -308,7 +400,10 @@ func (u *customUnmarshaller) unmarshalCustomField(fd *desc.FieldDescriptor, wire
 		return val, nil
 
 	case proto.WireStartGroup:
-		return zeroValue, errGroupsAreNotSupported
+		// This should never happen since fields of type group are never custom encoded.
+		return zeroValue, fmt.Errorf(
+			"tried to unmarshal field with wire type: start group and proto field type: %s",
+			fd.GetType().String())
 
 	default:
 		return zeroValue, proto.ErrInternalBadWireType
@@ -377,6 +472,10 @@ func unmarshalSimpleField(fd *desc.FieldDescriptor, v uint64) (unmarshalValue, e
 	}
 }
 
+func (u *customUnmarshaller) setNonCustomFieldNums(fieldNums []int32) {
+	u.nonCustomFieldNums = fieldNums
+}
+
 func (u *customUnmarshaller) resetAndUnmarshal(schema *desc.MessageDescriptor, buf []byte) error {
 	u.schema = schema
 	u.numNonCustom = 0
@@ -436,3 +535,58 @@ func (v *unmarshalValue) asFloat64() float64 {
 func (v *unmarshalValue) asBytes() []byte {
 	return v.bytes
 }
+
+// appendMarshalledFieldNums appends the numbers of the fields of the marshalled message to
+// dst, in the order they appear in.
+func appendMarshalledFieldNums(dst []int32, marshalled []byte) ([]int32, error) {
+	err := forEachMarshalledField(marshalled, func(fieldNum int32, _ []byte) {
+		dst = append(dst, fieldNum)
+	})
+	return dst, err
+}
+
+// appendMarshalledFieldsExcept appends the fields of the marshalled message to dst except for
+// those whose numbers are in the sorted excluded field numbers.
+func appendMarshalledFieldsExcept(dst, marshalled []byte, excluded []int32) ([]byte, error) {
+	err := forEachMarshalledField(marshalled, func(fieldNum int32, field []byte) {
+		if !isSortedFieldNum(excluded, fieldNum) {
+			dst = append(dst, field...)
+		}
+	})
+	return dst, err
+}
+
+// forEachMarshalledField calls fn with the number and the marshalled bytes (including the tag)
+// of every field of the marshalled message, in the order they appear in.
+func forEachMarshalledField(marshalled []byte, fn func(fieldNum int32, field []byte)) error {
+	// Only the skipping logic of the unmarshaller is used.
+	u := customUnmarshaller{decodeBuf: newCodedBuffer(marshalled)}
+	for !u.decodeBuf.eof() {
+		start := u.decodeBuf.index
+		fieldNum, wireType, err := u.decodeBuf.decodeTagAndWireType()
+		if err != nil {
+			return err
+		}
+		if _, err := u.skip(wireType); err != nil {
+			return err
+		}
+		if u.decodeBuf.index > len(marshalled) {
+			return io.ErrUnexpectedEOF
+		}
+		fn(fieldNum, marshalled[start:u.decodeBuf.index])
+	}
+	return nil
+}
+
+func sortAndDedupeFieldNums(fieldNums []int32) []int32 {
+	sort.Slice(fieldNums, func(i, j int) bool {
+		return fieldNums[i] < fieldNums[j]
+	})
+	deduped := fieldNums[:0]
+	for i, fieldNum := range fieldNums {
+		if i == 0 || fieldNum != fieldNums[i-1] {
+			deduped = append(deduped, fieldNum)
+		}
+	}
+	return deduped
+}
@@ -26,6 +26,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jhump/protoreflect/desc/builder"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/stretchr/testify/require"
 )
@@ -166,6 +167,96 @@ func TestCustomFieldUnmarshaller(t *testing.T) {
 	}
 }
 
+func TestCustomFieldUnmarshallerSortsOutOfOrderNonCustomFields(t *testing.T) {
+	schema, err := builder.NewMessage("OutOfOrder").
+		AddField(builder.NewField("a", builder.FieldTypeInt64()).SetRepeated().SetNumber(1)).
+		AddField(builder.NewField("b", builder.FieldTypeString()).SetRepeated().SetNumber(2)).
+		AddField(builder.NewField("c", builder.FieldTypeInt64()).SetRepeated().SetNumber(3)).
+		Build()
+	require.NoError(t, err)
+
+	// Fields in the order 2, 3, 1, 2 (the last one being a repeated entry for an
+	// existing field).
+	marshalled := []byte{
+		2<<3 | 2, 1, 'x',
+		3 << 3, 1,
+		1 << 3, 1,
+		2<<3 | 2, 1, 'y',
+	}
+	unmarshaller := newCustomFieldUnmarshaller(customUnmarshallerOptions{})
+	require.NoError(t, unmarshaller.resetAndUnmarshal(schema, marshalled))
+
+	values := unmarshaller.sortedNonCustomFieldValues()
+	require.Equal(t, sortedMarshalledFields{
+		{fieldNum: 1, marshalled: []byte{1 << 3, 1}},
+		{fieldNum: 2, marshalled: []byte{2<<3 | 2, 1, 'x', 2<<3 | 2, 1, 'y'}},
+		{fieldNum: 3, marshalled: []byte{3 << 3, 1}},
+	}, values)
+}
+
+func TestCustomFieldUnmarshallerSortsOutOfOrderCustomFields(t *testing.T) {
+	schema, err := builder.NewMessage("OutOfOrder").
+		AddField(builder.NewField("a", builder.FieldTypeInt64()).SetNumber(1)).
+		AddField(builder.NewField("b", builder.FieldTypeInt64()).SetNumber(2)).
+		AddField(builder.NewField("c", builder.FieldTypeInt64()).SetNumber(3)).
+		Build()
+	require.NoError(t, err)
+
+	// Fields in the order 2, 1, 3 so that only the first two are out of order.
+	marshalled := []byte{
+		2 << 3, 20,
+		1 << 3, 10,
+		3 << 3, 30,
+	}
+	unmarshaller := newCustomFieldUnmarshaller(customUnmarshallerOptions{})
+	require.NoError(t, unmarshaller.resetAndUnmarshal(schema, marshalled))
+
+	var fieldNums []int32
+	for _, value := range unmarshaller.sortedCustomFieldValues() {
+		fieldNums = append(fieldNums, value.fieldNumber)
+	}
+	require.Equal(t, []int32{1, 2, 3}, fieldNums)
+}
+
+func TestCustomFieldUnmarshallerSkipsGroups(t *testing.T) {
+	group := builder.NewMessage("Group").
+		AddField(builder.NewField("g", builder.FieldTypeInt32()).SetNumber(5))
+	file, err := builder.NewFile("groups.proto").
+		SetProto3(false).
+		AddMessage(builder.NewMessage("Groups").
+			AddField(builder.NewField("a", builder.FieldTypeInt64()).SetNumber(1)).
+			AddField(builder.NewGroupField(group).SetNumber(2))).
+		Build()
+	require.NoError(t, err)
+	schema := file.FindMessage("Groups")
+
+	group2 := []byte{
+		2<<3 | 3,
+		5 << 3, 9,
+		// A nested group with a field of every other wire type.
+		6<<3 | 3,
+		7 << 3, 1,
+		8<<3 | 1, 0, 0, 0, 0, 0, 0, 0, 0,
+		9<<3 | 2, 1, 'x',
+		10<<3 | 5, 0, 0, 0, 0,
+		6<<3 | 4,
+		2<<3 | 4,
+	}
+	marshalled := append([]byte{1 << 3, 7}, group2...)
+	unmarshaller := newCustomFieldUnmarshaller(customUnmarshallerOptions{})
+	require.NoError(t, unmarshaller.resetAndUnmarshal(schema, marshalled))
+	require.Equal(t, sortedCustomFieldValues{{fieldNumber: 1, v: 7}}, unmarshaller.sortedCustomFieldValues())
+	require.Equal(t, sortedMarshalledFields{{fieldNum: 2, marshalled: group2}},
+		unmarshaller.sortedNonCustomFieldValues())
+
+	// The group is terminated by the end of the message.
+	err = unmarshaller.resetAndUnmarshal(schema, group2[:len(group2)-1])
+	require.Error(t, err)
+	// An end group tag without a group.
+	err = unmarshaller.resetAndUnmarshal(schema, []byte{1 << 3, 7, 2<<3 | 4})
+	require.Equal(t, errUnexpectedEndGroup, err)
+}
+
 func assertAttributesEqualMarshalledBytes(
 	t *testing.T,
 	actualMarshalled []byte,
@@ -24,11 +24,17 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/m3db/m3/src/dbnode/encoding"
 	"github.com/m3db/m3/src/dbnode/encoding/m3tsz"
 	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/tracepoint"
 	"github.com/m3db/m3/src/dbnode/ts"
 	"github.com/m3db/m3/src/dbnode/x/xio"
 	"github.com/m3db/m3/src/x/checked"
@@ -36,15 +42,43 @@ import (
 	"github.com/m3db/m3/src/x/instrument"
 	xtime "github.com/m3db/m3/src/x/time"
 
-	"github.com/cespare/xxhash"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	opentracing "github.com/opentracing/opentracing-go"
+	opentracingext "github.com/opentracing/opentracing-go/ext"
+	opentracinglog "github.com/opentracing/opentracing-go/log"
 )
 
 // Make sure encoder implements encoding.Encoder.
 var _ encoding.Encoder = &Encoder{}
 
+// Make sure encoder implements io.WriterTo.
+var _ io.WriterTo = &Encoder{}
+
 const (
-	currentEncodingSchemeVersion = 1
+	// baseEncodingSchemeVersion is the original version of the encoding scheme. Streams that
+	// don't make use of any optional features are still encoded with it so that they remain
+	// readable by older iterators.
+	baseEncodingSchemeVersion = 1
+	// streamFeaturesEncodingSchemeVersion adds a varint bitset of optional stream features to
+	// the stream header.
+	streamFeaturesEncodingSchemeVersion = 2
+
+	// compactHeaderEncodingSchemeVersion is used for streams whose initial schema has no
+	// custom encoded fields. The stream header omits the dictionary compression LRU cache
+	// size (which is deferred until a schema with custom encoded fields is encountered, if
+	// ever) and the custom types of the initial schema are omitted entirely.
+	compactHeaderEncodingSchemeVersion = 3
+
+	currentEncodingSchemeVersion = streamFeaturesEncodingSchemeVersion
+	// latestEncodingSchemeVersion is the most recent version of the encoding scheme that
+	// streams may be encoded with.
+	latestEncodingSchemeVersion = compactHeaderEncodingSchemeVersion
+
+	// dryRunCompactThreshold is the size the stream of a dry-run encoder can grow
+	// to before the bytes that have already been accounted for are dropped.
+	dryRunCompactThreshold = 4096
 )
 
 var (
@@ -53,32 +87,120 @@ var (
 	errEncoderMessageHasUnknownFields = fmt.Errorf("%s message has unknown fields", encErrPrefix)
 	errEncoderClosed                  = fmt.Errorf("%s encoder is closed", encErrPrefix)
 	errNoEncodedDatapoints            = fmt.Errorf("%s encoder has no encoded datapoints", encErrPrefix)
+	errEncoderDryRunAfterEncode       = fmt.Errorf("%s cannot change dry-run mode after encoding datapoints", encErrPrefix)
+	errEncoderLRUSizeAfterEncode      = fmt.Errorf("%s cannot change byte field dictionary LRU size after encoding datapoints", encErrPrefix)
+	errEncoderInvalidLRUSize          = fmt.Errorf("%s byte field dictionary LRU size must be positive", encErrPrefix)
+	errEncoderNotSharingStream        = fmt.Errorf("%s encoder does not write into a shared stream", encErrPrefix)
+	errEncoderSectionClosed           = fmt.Errorf("%s section of the shared stream is closed", encErrPrefix)
+	errEncoderDryRunSharedStream      = fmt.Errorf("%s dry-run mode is not supported with a shared stream", encErrPrefix)
+	errEncoderEmptyAnnotation         = fmt.Errorf("%s annotation is empty", encErrPrefix)
+	errEncoderBytesDictResetsDisabled = fmt.Errorf("%s bytes dictionary resets are not enabled", encErrPrefix)
+	errEncoderPrimeAfterEncode        = fmt.Errorf("%s cannot prime bytes dictionaries after encoding datapoints", encErrPrefix)
+	errEncoderAppendDryRun            = fmt.Errorf("%s cannot append the datapoints of a dry-run encoder", encErrPrefix)
+	errEncoderAppendOutOfOrder        = fmt.Errorf("%s appended datapoints must not precede the last encoded datapoint", encErrPrefix)
+	errEncoderUnknownSchemeVersion    = fmt.Errorf(
+		"%s target encoding scheme version must be between %d and %d",
+		encErrPrefix, baseEncodingSchemeVersion, latestEncodingSchemeVersion)
+	errEncoderMessageTooLarge = fmt.Errorf(
+		"%s message is larger than the maximum size of %d bytes", encErrPrefix, maxMarshalledProtoMessageSize)
+	errEncoderDeltaMapFieldDiffs = fmt.Errorf(
+		"%s cannot encode deltas when map field diffs are enabled", encErrPrefix)
+	errEncoderLastEncodedMessageNotRetained = fmt.Errorf(
+		"%s last encoded message is not retained", encErrPrefix)
+	errEncoderMessageBatchesDisabled = fmt.Errorf(
+		"%s message batches are not enabled", encErrPrefix)
+	errEncoderEmptyMessageBatch = fmt.Errorf(
+		"%s message batch is empty", encErrPrefix)
 )
 
 // Encoder compresses arbitrary ProtoBuf streams given a schema.
 type Encoder struct {
-	opts encoding.Options
+	opts Options
 
 	stream     encoding.OStream
 	schemaDesc namespace.SchemaDescr
 	schema     *desc.MessageDescriptor
 
-	numEncoded      int
-	lastEncodedDP   ts.Datapoint
-	customFields    []customFieldState
-	nonCustomFields []marshalledField
+	numEncoded    int
+	lastEncodedDP ts.Datapoint
+	// Only retained if the RetainLastEncodedMessage of the options is set.
+	lastEncodedBytes []byte
+	customFields     []customFieldState
+	nonCustomFields  []marshalledField
+	// The sorted numbers of the fields of the schema that could be custom encoded but are
+	// not because of the MaxCustomFields or the CustomFieldsAllowlist.
+	limitedCustomFieldNums []int32
+	// The numbers of the custom encoded fields from the CustomFieldOrder whose values
+	// are written first and the indexes of the custom fields in the order that their values
+	// are written in, empty if they're written in field number order.
+	customFieldOrderNums []int32
+	customFieldOrder     []int
 
 	// Fields that are reused between function calls to
 	// avoid allocations.
-	varIntBuf              [8]byte
+	varIntBuf              [binary.MaxVarintLen64]byte
 	fieldsChangedToDefault []int32
+	changedIntFields       []int32
+	customFieldValues      []customFieldValue
 	marshalBuf             []byte
 
 	unmarshaller customFieldUnmarshaller
+	mapFieldDiff mapFieldDiff
+
+	streamFeatures streamFeatures
+	// Whether the int fields that changed are encoded as a bitset for the current write.
+	intChangesBitset bool
+	// Whether the marshalled fields of the current write only changed if they're amongst
+	// the sorted deltaFieldNums (see EncodeDelta and EncodeWithChangeHints).
+	encodingDelta  bool
+	deltaFieldNums []int32
+	deltaBuf       []byte
+	// The messages of the current write, which only contains the message passed to
+	// Encode unless it's a batch passed to EncodeMulti.
+	messages [][]byte
+	// Whether the stream began with a compact header and, if so, whether the
+	// dictionary compression LRU cache size has been encoded since.
+	compactHeader     bool
+	hasEncodedLRUSize bool
 
 	hasEncodedSchema bool
 	closed           bool
 
+	dryRun             bool
+	dryRunCompactBytes int
+
+	// Overrides the ByteFieldDictionaryLRUSize of the options if non-zero.
+	byteFieldDictLRUSize int
+	// Built from the StaticBytesDictionary of the options, nil if not set.
+	staticBytesDict *staticBytesDict
+	floatBaselines  floatBaselines
+	// The values the bytes dictionaries are primed with, see PrimeBytesDict.
+	primedBytesDicts primedBytesDicts
+
+	// Whether the stream ends with a value ranges trailer (see ValueRangesTrailer)
+	// and the ranges of the values of the custom encoded numeric fields of the stream.
+	valueRangesTrailer bool
+	valueRanges        []ValueRange
+
+	// Whether the stream was provided by the caller (see NewEncoderWithStream),
+	// in which case the encoder only writes the section of it that begins at
+	// sectionStart.
+	sharedStream  bool
+	sectionStart  int
+	sectionClosed bool
+
+	// Held while the stream is written to by Encode and ResetBytesDictionaries so that
+	// Snapshot can copy it from another goroutine.
+	snapshotLock sync.Mutex
+
+	// The Tracer of the options, nil if tracing is disabled. encodeSpan is the
+	// span of the in-progress call to Encode that the spans of its phases are children of.
+	tracer     opentracing.Tracer
+	encodeSpan opentracing.Span
+
+	// Non-nil if the LogMarshalFallbacks of the options is set.
+	marshalFallbacksLogLimiter *marshalFallbacksLogLimiter
+
 	stats            encoderStats
 	timestampEncoder m3tsz.TimestampEncoder
 }
@@ -87,6 +209,46 @@ type Encoder struct {
 type EncoderStats struct {
 	UncompressedBytes int
 	CompressedBytes   int
+	// BytesFieldDictionaryEvictions contains the number of LRU evictions that have
+	// occurred in the dictionary of each bytes field (keyed by field number) since
+	// the encoder was last reset. A high eviction rate indicates that the configured
+	// ByteFieldDictionaryLRUSize is too small for the cardinality of the field.
+	BytesFieldDictionaryEvictions map[int]int
+}
+
+// CustomFieldInfo describes a field of the schema that the encoder compresses with
+// one of its custom encodings rather than marshalling it as protobuf.
+type CustomFieldInfo struct {
+	FieldNum int
+	// ProtoType is the type of the field in the schema.
+	ProtoType dpb.FieldDescriptorProto_Type
+	// CustomType is the name of the custom encoding that is used for the field, one
+	// of: int64, int32, uint64, uint32, float64, float32, bytes or bool.
+	CustomType string
+}
+
+// EncodedBlock is the encoded stream of an encoder together with its metadata, as of
+// the same point in time, see Finalize.
+type EncodedBlock struct {
+	// Segment is a copy of the encoded stream that is owned by the caller, it's empty if
+	// no datapoints have been encoded or if the encoder is in dry-run mode.
+	Segment ts.Segment
+	// NumEncoded is the number of encoded datapoints.
+	NumEncoded int
+	// LastEncoded is the last encoded datapoint, zero if none have been encoded.
+	LastEncoded ts.Datapoint
+	// NumBits is the number of bits that the encoded datapoints occupy in the stream,
+	// excluding the padding of the final byte and the end-of-stream marker, if any.
+	NumBits int
+	// Stats are the statistics about the compression of the stream.
+	Stats EncoderStats
+}
+
+// customFieldValue is the value of a custom encoded field in the marshalled message that is
+// being encoded, isSet is false if the field is not set in the message.
+type customFieldValue struct {
+	value unmarshalValue
+	isSet bool
 }
 
 type encoderStats struct {
@@ -98,15 +260,50 @@ func (s *encoderStats) IncUncompressedBytes(x int) {
 }
 
 // NewEncoder creates a new protobuf encoder.
-func NewEncoder(start time.Time, opts encoding.Options) *Encoder {
-	initAllocIfEmpty := opts.EncoderPool() == nil
-	stream := encoding.NewOStream(nil, initAllocIfEmpty, opts.BytesPool())
+func NewEncoder(start time.Time, opts Options) *Encoder {
+	initAllocIfEmpty := opts.EncodingOptions().EncoderPool() == nil
+	stream := encoding.NewOStream(nil, initAllocIfEmpty, opts.EncodingOptions().BytesPool())
+	return newEncoder(start, stream, opts)
+}
+
+// NewEncoderWithStream creates a new protobuf encoder that writes into the
+// provided stream rather than into a stream of its own, so that several series
+// can be encoded into sections of one larger stream. The section of the encoder
+// begins at the end of the stream, padded to the next byte, and is delimited
+// again every time the encoder is reset. Once all of its datapoints have been
+// encoded the section must be closed with CloseSection, which returns the byte
+// range that it occupies within the stream.
+//
+// The caller retains ownership of the stream, closing the encoder does not
+// release it.
+func NewEncoderWithStream(
+	start time.Time,
+	stream encoding.OStream,
+	opts Options,
+) *Encoder {
+	enc := newEncoder(start, stream, opts)
+	enc.sharedStream = true
+	enc.startSection()
+	return enc
+}
+
+func newEncoder(start time.Time, stream encoding.OStream, opts Options) *Encoder {
+	var marshalFallbacksLogLimiter *marshalFallbacksLogLimiter
+	if opts.LogMarshalFallbacks() {
+		marshalFallbacksLogLimiter = defaultMarshalFallbacksLogLimiter
+	}
 	return &Encoder{
 		opts:   opts,
 		stream: stream,
 		timestampEncoder: m3tsz.NewTimestampEncoder(
-			start, opts.DefaultTimeUnit(), opts),
-		varIntBuf: [8]byte{},
+			start, opts.EncodingOptions().DefaultTimeUnit(), opts.EncodingOptions()),
+		varIntBuf:       [binary.MaxVarintLen64]byte{},
+		staticBytesDict: newStaticBytesDict(opts.StaticBytesDictionary(), true),
+		floatBaselines:  newFloatBaselines(opts.FloatBaselines()),
+		tracer:          opts.Tracer(),
+
+		valueRangesTrailer:         opts.ValueRangesTrailer(),
+		marshalFallbacksLogLimiter: marshalFallbacksLogLimiter,
 	}
 }
 
@@ -116,6 +313,41 @@ func NewEncoder(start time.Time, opts encoding.Options) *Encoder {
 // return 0 on subsequent iteration. In addition, the provided annotation is expected to
 // be a marshalled protobuf message that matches the configured schema.
 func (enc *Encoder) Encode(dp ts.Datapoint, timeUnit xtime.Unit, protoBytes ts.Annotation) error {
+	enc.messages = append(enc.messages[:0], protoBytes)
+	err := enc.encode(dp, timeUnit, enc.messages)
+	enc.messages[0] = nil
+	return err
+}
+
+// EncodeMulti encodes several protobuf messages that share the same timestamp, such as a
+// batch of events that occurred at the same instant, as a single write. The timestamp is
+// followed by the number of messages and each message is encoded against the state left by
+// the one before it, as if it had been passed to Encode, so consecutive messages compress as
+// well as consecutive writes. Iterators return the batch as a single datapoint whose
+// annotation contains all of its messages in order, see SplitMessageBatch. Batches require
+// the MessageBatches option, in which case Encode writes batches of a single message. All of
+// the messages are validated before any of them are encoded so that an invalid message does
+// not leave a partially encoded batch in the stream.
+func (enc *Encoder) EncodeMulti(dp ts.Datapoint, timeUnit xtime.Unit, protoBytes []ts.Annotation) error {
+	if !enc.opts.MessageBatches() {
+		return errEncoderMessageBatchesDisabled
+	}
+	if len(protoBytes) == 0 {
+		return errEncoderEmptyMessageBatch
+	}
+
+	enc.messages = enc.messages[:0]
+	for _, message := range protoBytes {
+		enc.messages = append(enc.messages, message)
+	}
+	err := enc.encode(dp, timeUnit, enc.messages)
+	for i := range enc.messages {
+		enc.messages[i] = nil
+	}
+	return err
+}
+
+func (enc *Encoder) encode(dp ts.Datapoint, timeUnit xtime.Unit, messages [][]byte) error {
 	if unusableErr := enc.isUsable(); unusableErr != nil {
 		return unusableErr
 	}
@@ -124,24 +356,59 @@ func (enc *Encoder) Encode(dp ts.Datapoint, timeUnit xtime.Unit, protoBytes ts.A
 		// It is a programmatic error that schema is not set at all prior to encoding, panic to fix it asap.
 		return instrument.InvariantErrorf(errEncoderSchemaIsRequired.Error())
 	}
+	if enc.sectionClosed {
+		return errEncoderSectionClosed
+	}
+	messagesSize := 0
+	for _, protoBytes := range messages {
+		if len(protoBytes) == 0 && enc.opts.RejectEmptyAnnotations() {
+			return errEncoderEmptyAnnotation
+		}
+		if len(protoBytes) > maxMarshalledProtoMessageSize {
+			// The marshalled portions of the message that are length prefixed in the stream are
+			// no larger than the message itself, iterators reject any that exceed the maximum.
+			return errEncoderMessageTooLarge
+		}
+		messagesSize += len(protoBytes)
+	}
+
+	if enc.numEncoded == 0 {
+		if err := enc.validateTargetSchemeVersion(); err != nil {
+			return err
+		}
+	}
 
 	// Proto encoder value is meaningless, but make sure its always zero just to be safe so that
 	// it doesn't cause LastEncoded() to produce invalid results.
 	dp.Value = float64(0)
 
-	if enc.unmarshaller == nil {
-		// Lazy init.
-		enc.unmarshaller = newCustomFieldUnmarshaller(customUnmarshallerOptions{})
+	if enc.tracer != nil {
+		enc.encodeSpan = enc.tracer.StartSpan(tracepoint.ProtoEncoderEncode)
+		defer enc.finishEncodeSpan()
 	}
-	// resetAndUnmarshal before any data is written so that the marshalled message can be validated
+
+	enc.lazyInitUnmarshaller()
+	// resetAndUnmarshal before any data is written so that the marshalled messages can be validated
 	// upfront, otherwise errors could be encountered mid-write leaving the stream in a corrupted state.
-	if err := enc.unmarshaller.resetAndUnmarshal(enc.schema, protoBytes); err != nil {
-		return fmt.Errorf(
-			"%s error unmarshalling message: %v", encErrPrefix, err)
+	for i, protoBytes := range messages {
+		if err := enc.unmarshalAndValidate(protoBytes); err != nil {
+			if len(messages) > 1 {
+				return fmt.Errorf("error in message %d of batch: %v", i, err)
+			}
+			return err
+		}
 	}
+	if enc.encodeSpan != nil {
+		enc.encodeSpan.SetTag("messageSize", messagesSize)
+		enc.encodeSpan.SetTag("numCustomFields", len(enc.customFields))
+	}
+
+	enc.snapshotLock.Lock()
+	defer enc.snapshotLock.Unlock()
 
 	if enc.numEncoded == 0 {
 		enc.encodeStreamHeader()
+		enc.primeBytesDicts()
 	}
 
 	var (
@@ -161,17 +428,334 @@ func (enc *Encoder) Encode(dp ts.Datapoint, timeUnit xtime.Unit, protoBytes ts.A
 			"%s error encoding timestamp: %v", encErrPrefix, err)
 	}
 
-	if err := enc.encodeProto(protoBytes); err != nil {
-		return fmt.Errorf(
-			"%s error encoding proto portion of message: %v", encErrPrefix, err)
+	if enc.streamFeatures.has(streamFeatureMessageBatches) {
+		enc.encodeVarInt(uint64(len(messages)))
+	}
+	for i, protoBytes := range messages {
+		if len(messages) > 1 {
+			// The unmarshaller holds the last message of the batch after validating them.
+			if err := enc.unmarshaller.resetAndUnmarshal(enc.schema, protoBytes); err != nil {
+				return fmt.Errorf(
+					"%s error unmarshalling message %d of batch: %v", encErrPrefix, i, err)
+			}
+		}
+		if err := enc.encodeProto(protoBytes); err != nil {
+			return fmt.Errorf(
+				"%s error encoding proto portion of message: %v", encErrPrefix, err)
+		}
 	}
 
 	enc.numEncoded++
 	enc.lastEncodedDP = dp
-	enc.stats.IncUncompressedBytes(len(protoBytes))
+	if enc.opts.RetainLastEncodedMessage() {
+		enc.lastEncodedBytes = append(enc.lastEncodedBytes[:0], messages[len(messages)-1]...)
+	}
+	enc.stats.IncUncompressedBytes(messagesSize)
+	if enc.dryRun && enc.stream.Len() >= dryRunCompactThreshold {
+		enc.compactDryRunStream()
+	}
+	return nil
+}
+
+// unmarshalAndValidate unmarshals a message into the unmarshaller and validates it if
+// the options require it.
+func (enc *Encoder) unmarshalAndValidate(protoBytes []byte) error {
+	sp := enc.startChildSpan(tracepoint.ProtoEncoderUnmarshal)
+	err := enc.unmarshaller.resetAndUnmarshal(enc.schema, protoBytes)
+	finishSpan(sp, err)
+	if err != nil {
+		return fmt.Errorf(
+			"%s error unmarshalling message: %v", encErrPrefix, err)
+	}
+	if enc.opts.ValidateMessages() {
+		if err := validateMessage(enc.schema, protoBytes); err != nil {
+			return fmt.Errorf("%s invalid message: %v", encErrPrefix, err)
+		}
+	}
 	return nil
 }
 
+// EncodeDelta encodes a protobuf message that is a delta against the previous message rather
+// than a complete message, for callers that already track which fields of their messages
+// changed. The delta contains the fields that changed, with their new values, and
+// clearedFieldNums contains the numbers of the fields that were set to their default value.
+// The other fields keep their value from the previous message, or are unset if it's the first
+// message of the stream. The marshalled fields of the delta are encoded as changes without
+// comparing them against their previous value again, and iterators decode the complete
+// messages. Deltas can't be encoded if map field diffs are enabled since those are computed
+// against the previous entries of the maps, and require RetainLastEncodedMessage to be
+// set since they're applied to the previous message.
+func (enc *Encoder) EncodeDelta(
+	dp ts.Datapoint,
+	timeUnit xtime.Unit,
+	delta ts.Annotation,
+	clearedFieldNums []int32,
+) error {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if enc.enabledStreamFeatures().has(streamFeatureMapFieldDiffs) {
+		return errEncoderDeltaMapFieldDiffs
+	}
+	if !enc.opts.RetainLastEncodedMessage() {
+		return errEncoderLastEncodedMessageNotRetained
+	}
+
+	fieldNums, err := appendMarshalledFieldNums(enc.deltaFieldNums[:0], delta)
+	if err != nil {
+		return fmt.Errorf("%s error reading fields of delta: %v", encErrPrefix, err)
+	}
+	enc.deltaFieldNums = sortAndDedupeFieldNums(append(fieldNums, clearedFieldNums...))
+
+	// Apply the delta to the previous message so that the custom encoded fields are encoded
+	// from the complete message, and so that it's the last encoded message afterwards.
+	var prev []byte
+	if enc.numEncoded > 0 {
+		prev = enc.lastEncodedBytes
+	}
+	enc.deltaBuf, err = appendMarshalledFieldsExcept(enc.deltaBuf[:0], prev, enc.deltaFieldNums)
+	if err != nil {
+		return fmt.Errorf("%s error applying delta to last encoded message: %v", encErrPrefix, err)
+	}
+	enc.deltaBuf = append(enc.deltaBuf, delta...)
+
+	// The marshalled fields are reset along with the schema, in which case every field that's
+	// set is a change regardless of the delta.
+	enc.encodingDelta = enc.hasEncodedSchema
+	err = enc.Encode(dp, timeUnit, enc.deltaBuf)
+	enc.encodingDelta = false
+	return err
+}
+
+// EncodeWithChangeHints encodes a timestamp and a complete protobuf message like Encode, for
+// callers that already track which fields of their messages changed. changedFieldNums contains
+// the numbers of the fields whose value changed since the previous message, including those
+// that were set to their default value. The marshalled fields that are not amongst them are
+// assumed to be unchanged without comparing them against their previous value, and those that
+// are amongst them are encoded as changes.
+//
+// This is an unsafe fast path: the hints are trusted, so a field that changed but is missing
+// from changedFieldNums is not encoded and iterators decode its previous value instead, which
+// corrupts the stream silently. A field that is amongst them but didn't change only costs
+// space. The custom encoded fields are encoded from their values regardless of the hints.
+func (enc *Encoder) EncodeWithChangeHints(
+	dp ts.Datapoint,
+	timeUnit xtime.Unit,
+	protoBytes ts.Annotation,
+	changedFieldNums []int32,
+) error {
+	enc.deltaFieldNums = sortAndDedupeFieldNums(append(enc.deltaFieldNums[:0], changedFieldNums...))
+
+	// The marshalled fields are reset along with the schema, in which case every field that's
+	// set is a change regardless of the hints.
+	enc.encodingDelta = enc.hasEncodedSchema
+	err := enc.Encode(dp, timeUnit, protoBytes)
+	enc.encodingDelta = false
+	return err
+}
+
+// Append encodes the datapoints of other onto the end of the stream of the encoder so that a
+// series whose datapoints were encoded by several encoders (e.g. one per block) can be continued
+// in a single stream. The first datapoint of other must not precede the last datapoint of the
+// encoder. The encoding of every write depends on the state accumulated from all of the writes
+// that precede it (the timestamp delta-of-delta, the XOR of the previous float values, the bytes
+// dictionaries etc.) so the writes of other can't be copied as is, instead they're decoded to
+// their absolute values and encoded relative to the state of the encoder, as if they had been
+// passed to Encode, using the current schema of the encoder. The stream of other is not modified.
+func (enc *Encoder) Append(other *Encoder) error {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if unusableErr := other.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if other.dryRun {
+		return errEncoderAppendDryRun
+	}
+	if other.numEncoded == 0 {
+		return nil
+	}
+
+	reader, ok := other.Snapshot()
+	if !ok {
+		return nil
+	}
+	iter := NewIterator(reader, other.schemaDesc, other.opts)
+	defer iter.Close()
+
+	var batch []ts.Annotation
+	for i := 0; iter.Next(); i++ {
+		dp, unit, annotation := iter.Current()
+		if i == 0 && enc.numEncoded > 0 && dp.Timestamp.Before(enc.lastEncodedDP.Timestamp) {
+			return errEncoderAppendOutOfOrder
+		}
+		var err error
+		if other.streamFeatures.has(streamFeatureMessageBatches) {
+			batch, err = SplitMessageBatch(batch[:0], annotation)
+			if err == nil {
+				err = enc.EncodeMulti(dp, unit, batch)
+			}
+		} else {
+			err = enc.Encode(dp, unit, annotation)
+		}
+		if err != nil {
+			return fmt.Errorf("error appending datapoint %d: %v", i, err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("%s error decoding appended datapoints: %v", encErrPrefix, err)
+	}
+	return nil
+}
+
+func (enc *Encoder) lazyInitUnmarshaller() {
+	if enc.unmarshaller == nil {
+		enc.unmarshaller = newCustomFieldUnmarshaller(customUnmarshallerOptions{
+			skipInvalidCustomFields: enc.opts.InvalidCustomFieldsAsDefault(),
+			oneofFields:             enc.opts.OneofFields(),
+		})
+	}
+	enc.unmarshaller.setNonCustomFieldNums(enc.limitedCustomFieldNums)
+}
+
+// SetDryRun enables or disables dry-run mode. In dry-run mode the encoder
+// performs all of the same work as it otherwise would but does not retain the
+// encoded stream, so Stream and Discard return no data, while Stats still
+// reports the number of bytes the stream would have been compressed to. This
+// makes it possible to estimate the compression ratio of a schema for a sample
+// of data without paying the memory cost of storing it.
+//
+// Dry-run mode can only be changed before any datapoints have been encoded and
+// it is disabled again when the encoder is reset.
+func (enc *Encoder) SetDryRun(dryRun bool) error {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if enc.numEncoded > 0 {
+		return errEncoderDryRunAfterEncode
+	}
+	if dryRun && enc.sharedStream {
+		return errEncoderDryRunSharedStream
+	}
+
+	enc.dryRun = dryRun
+	return nil
+}
+
+// SetByteFieldDictionaryLRUSize overrides the ByteFieldDictionaryLRUSize of the
+// encoding options for this encoder so that pooled encoders can be tuned per
+// series. The size is written into the stream header so it can only be changed
+// before any datapoints have been encoded, the override is retained across
+// calls to Reset and cleared when the encoder is closed.
+func (enc *Encoder) SetByteFieldDictionaryLRUSize(size int) error {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if enc.numEncoded > 0 {
+		return errEncoderLRUSizeAfterEncode
+	}
+	if size <= 0 {
+		return errEncoderInvalidLRUSize
+	}
+
+	enc.byteFieldDictLRUSize = size
+	return nil
+}
+
+// PrimeBytesDict primes the LRU dictionary of a bytes field of the schema with the provided
+// values, ordered from least to most recently used, such that the first occurrence of each
+// of them in the stream can be encoded as a reference into the dictionary rather than in
+// full. This improves the compression at block boundaries of series whose bytes values are
+// known from their historical blocks. Only as many of the most recently used values as fit
+// in the dictionary are retained.
+//
+// The values are not written into the stream, only their hash is, so iterators of the
+// stream must be primed with the exact same values (see BytesDictPrimer) and will fail to
+// decode it otherwise. The dictionaries can only be primed before any datapoints have been
+// encoded and the values are discarded when the encoder is reset.
+func (enc *Encoder) PrimeBytesDict(fieldNum int, values [][]byte) error {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if enc.numEncoded > 0 {
+		return errEncoderPrimeAfterEncode
+	}
+	if enc.schema == nil {
+		return errEncoderSchemaIsRequired
+	}
+
+	isBytesField := false
+	for _, customField := range enc.customFields {
+		if customField.fieldNum == fieldNum && customField.fieldType == bytesField {
+			isBytesField = true
+			break
+		}
+	}
+	if !isBytesField {
+		return fmt.Errorf(
+			"%s cannot prime dictionary of field %d which is not a custom encoded bytes field",
+			encErrPrefix, fieldNum)
+	}
+
+	enc.primedBytesDicts = enc.primedBytesDicts.set(fieldNum, values)
+	return nil
+}
+
+// ResetBytesDictionaries resets the LRU dictionaries and interned values of all the
+// bytes fields, such that the values encountered from then on are encoded as if
+// they were encountered for the first time, without resetting the compression
+// state of the other fields or of the timestamps. This allows the dictionaries to
+// adapt to a new working set of values for series whose bytes values shift over
+// time, at the cost of a marker of 5 bits in the stream. It requires the
+// BytesDictResets option to be enabled.
+func (enc *Encoder) ResetBytesDictionaries() error {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return unusableErr
+	}
+	if !enc.opts.BytesDictResets() {
+		return errEncoderBytesDictResetsDisabled
+	}
+	if enc.sectionClosed {
+		return errEncoderSectionClosed
+	}
+	if enc.numEncoded == 0 {
+		// The dictionaries are empty.
+		return nil
+	}
+
+	enc.snapshotLock.Lock()
+	writeBytesDictResetMarker(enc.stream)
+	enc.snapshotLock.Unlock()
+	for i := range enc.customFields {
+		enc.customFields[i].bytesFieldDict = enc.customFields[i].bytesFieldDict[:0]
+		enc.customFields[i].internedBytes = enc.customFields[i].internedBytes[:0]
+	}
+	return nil
+}
+
+func (enc *Encoder) byteFieldDictionaryLRUSize() int {
+	if enc.byteFieldDictLRUSize > 0 {
+		return enc.byteFieldDictLRUSize
+	}
+	return enc.opts.EncodingOptions().ByteFieldDictionaryLRUSize()
+}
+
+// compactDryRunStream drops all of the bytes in the stream except for the last
+// (potentially partially written) one, which is retained so that any
+// subsequent writes line up with the same bit positions as they would have in
+// the full stream.
+func (enc *Encoder) compactDryRunStream() {
+	rawBytes, pos := enc.stream.Rawbytes()
+	if len(rawBytes) <= 1 {
+		return
+	}
+
+	lastByte := rawBytes[len(rawBytes)-1]
+	enc.dryRunCompactBytes += len(rawBytes) - 1
+	enc.stream.Reset(enc.newBuffer(dryRunCompactThreshold))
+	enc.stream.WriteBits(uint64(lastByte>>uint(8-pos)), pos)
+}
+
 func (enc *Encoder) encodeSchemaAndOrTimeUnit(
 	needToEncodeSchema bool,
 	needToEncodeTimeUnit bool,
@@ -208,19 +792,98 @@ func (enc *Encoder) encodeSchemaAndOrTimeUnit(
 	}
 
 	if needToEncodeSchema {
-		enc.encodeCustomSchemaTypes()
+		// The custom types of the initial schema of a stream with a compact header
+		// are implied to be empty.
+		if !enc.compactHeader || enc.numEncoded > 0 {
+			enc.encodeCustomSchemaTypes()
+		}
+		if enc.streamFeatures.has(streamFeatureOmitEmptyProtoPortion) {
+			if len(enc.nonCustomFields) == 0 {
+				enc.stream.WriteBit(opCodeNoProtoPortion)
+			} else {
+				enc.stream.WriteBit(opCodeHasProtoPortion)
+			}
+		}
+		if enc.streamFeatures.has(streamFeatureLimitedCustomFields) {
+			enc.encodeLimitedCustomFieldNums()
+		}
+		if enc.streamFeatures.has(streamFeatureCustomFieldOrder) {
+			enc.encodeCustomFieldOrderNums()
+		}
 		enc.hasEncodedSchema = true
 	}
 }
 
-// Stream returns a copy of the underlying data stream.
+// Stream returns a copy of the underlying data stream. It references the
+// buffer of the encoder rather than copying it so it must not be called
+// concurrently with Encode, see Snapshot for that.
 func (enc *Encoder) Stream(ctx context.Context) (xio.SegmentReader, bool) {
-	seg := enc.segmentZeroCopy(ctx)
+	return enc.segmentReader(enc.segmentZeroCopy(ctx))
+}
+
+// Snapshot returns a point-in-time copy of the underlying data stream. Unlike
+// Stream it may be called from another goroutine while Encode or
+// ResetBytesDictionaries are running, for example to live-tail a series that
+// is still being written to. The snapshot contains every datapoint that was
+// encoded before it was taken and never a partially encoded one, and it
+// remains valid after the encoder is written to again, reset or closed. It
+// must still not be called concurrently with any of the other methods of the
+// encoder, such as Reset or Close.
+func (enc *Encoder) Snapshot() (xio.SegmentReader, bool) {
+	enc.snapshotLock.Lock()
+	defer enc.snapshotLock.Unlock()
+
+	return enc.segmentReader(enc.segmentCopy())
+}
+
+// Finalize returns the encoded stream together with the number of encoded datapoints,
+// the last encoded datapoint, the length of the stream in bits and the statistics of
+// the encoder. Unlike separate calls to Stream, NumEncoded, LastEncoded and Stats they
+// are all read at the same point in time, even while Encode is running on another
+// goroutine, as with Snapshot. The encoder can still be written to afterwards.
+func (enc *Encoder) Finalize() (EncodedBlock, error) {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return EncodedBlock{}, unusableErr
+	}
+
+	enc.snapshotLock.Lock()
+	defer enc.snapshotLock.Unlock()
+
+	block := EncodedBlock{
+		Segment:     enc.segmentCopy(),
+		NumEncoded:  enc.numEncoded,
+		LastEncoded: enc.lastEncodedDP,
+		Stats:       enc.Stats(),
+	}
+	if length := enc.stream.Len(); length > enc.sectionStart {
+		_, pos := enc.stream.Rawbytes()
+		block.NumBits = 8*(enc.dryRunCompactBytes+length-enc.sectionStart-1) + pos
+	}
+	return block, nil
+}
+
+// segmentCopy returns a copy of the encoded stream, the caller must hold the snapshotLock.
+func (enc *Encoder) segmentCopy() ts.Segment {
+	length := enc.stream.Len()
+	if length == enc.sectionStart || enc.dryRun {
+		return ts.Segment{}
+	}
+
+	rawBuffer, _ := enc.stream.Rawbytes()
+	head := enc.newBuffer(length - 1 - enc.sectionStart)
+	head.IncRef()
+	head.AppendAll(rawBuffer[enc.sectionStart : length-1])
+	head.DecRef()
+
+	return ts.NewSegment(head, enc.tail(rawBuffer[length-1]), ts.FinalizeHead)
+}
+
+func (enc *Encoder) segmentReader(seg ts.Segment) (xio.SegmentReader, bool) {
 	if seg.Len() == 0 {
 		return nil, false
 	}
 
-	if readerPool := enc.opts.SegmentReaderPool(); readerPool != nil {
+	if readerPool := enc.opts.EncodingOptions().SegmentReaderPool(); readerPool != nil {
 		reader := readerPool.Get()
 		reader.Reset(seg)
 		return reader, true
@@ -230,7 +893,7 @@ func (enc *Encoder) Stream(ctx context.Context) (xio.SegmentReader, bool) {
 
 func (enc *Encoder) segmentZeroCopy(ctx context.Context) ts.Segment {
 	length := enc.stream.Len()
-	if enc.stream.Len() == 0 {
+	if length == enc.sectionStart || enc.dryRun {
 		return ts.Segment{}
 	}
 
@@ -240,11 +903,11 @@ func (enc *Encoder) segmentZeroCopy(ctx context.Context) ts.Segment {
 	lastByte := rawBuffer[length-1]
 
 	// Take ref up to last byte.
-	headBytes := rawBuffer[:length-1]
+	headBytes := rawBuffer[enc.sectionStart : length-1]
 
 	// Zero copy from the output stream.
 	var head checked.Bytes
-	if pool := enc.opts.CheckedBytesWrapperPool(); pool != nil {
+	if pool := enc.opts.EncodingOptions().CheckedBytesWrapperPool(); pool != nil {
 		head = pool.Get(headBytes)
 	} else {
 		head = checked.NewBytes(headBytes, nil)
@@ -256,18 +919,82 @@ func (enc *Encoder) segmentZeroCopy(ctx context.Context) ts.Segment {
 	ctx.RegisterCloser(buffer.DelayFinalizer())
 
 	// Take a shared ref to a known good tail.
-	tail := tails[lastByte]
+	tail := enc.tail(lastByte)
 
 	// Only discard the head since tails are shared for process life time.
 	return ts.NewSegment(head, tail, ts.FinalizeHead)
 }
 
+// tail returns the shared tail for the given last byte of the stream.
+func (enc *Encoder) tail(lastByte byte) checked.Bytes {
+	if enc.streamFeatures.has(streamFeatureValueRangesTrailer) {
+		// The trailer is unique to the stream so the tail can't be shared.
+		_, pos := enc.stream.Rawbytes()
+		stream := encoding.NewOStream(nil, true, nil)
+		stream.WriteBits(uint64(lastByte>>uint(8-pos)), pos)
+		enc.writeEndOfStream(stream)
+		tail, _ := stream.Rawbytes()
+		return checked.NewBytes(tail, nil)
+	}
+	if enc.streamFeatures.has(streamFeatureEndOfStreamMarker) {
+		_, pos := enc.stream.Rawbytes()
+		return endOfStreamMarkerTails[pos-1][lastByte]
+	}
+	return tails[lastByte]
+}
+
+// WriteTo writes the encoded stream to w directly from the encoder's buffer,
+// without copying it or transferring ownership of it, so that callers which are
+// writing the stream to disk or the network don't need to first materialize it
+// as a segment. The data written is identical to that of the segment returned
+// by Stream. The encoder must not be written to until WriteTo returns.
+func (enc *Encoder) WriteTo(w io.Writer) (int64, error) {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return 0, unusableErr
+	}
+
+	length := enc.stream.Len()
+	if length == enc.sectionStart || enc.dryRun {
+		return 0, nil
+	}
+
+	rawBuffer, _ := enc.stream.Rawbytes()
+	n, err := w.Write(rawBuffer[enc.sectionStart : length-1])
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	tail := enc.tail(rawBuffer[length-1])
+	tail.IncRef()
+	n, err = w.Write(tail.Bytes())
+	tail.DecRef()
+	return written + int64(n), err
+}
+
 func (enc *Encoder) segmentTakeOwnership() ts.Segment {
 	length := enc.stream.Len()
-	if length == 0 {
+	if length == enc.sectionStart || enc.dryRun {
 		return ts.Segment{}
 	}
 
+	if enc.sharedStream {
+		// The stream is owned by the caller so the section is copied instead.
+		start, end, _ := enc.CloseSection()
+		rawBuffer, _ := enc.stream.Rawbytes()
+		head := enc.newBuffer(end - start)
+		head.IncRef()
+		head.AppendAll(rawBuffer[start:end])
+		head.DecRef()
+		return ts.NewSegment(head, nil, ts.FinalizeHead)
+	}
+
+	if enc.streamFeatures.has(streamFeatureEndOfStreamMarker) {
+		// Safe to write directly into the stream since the encoder will not
+		// be written to again until it is reset.
+		enc.writeEndOfStream(enc.stream)
+	}
+
 	// Take ref from the ostream.
 	head := enc.stream.Discard()
 
@@ -290,29 +1017,376 @@ func (enc *Encoder) LastEncoded() (ts.Datapoint, error) {
 		return ts.Datapoint{}, errNoEncodedDatapoints
 	}
 
-	// Value is meaningless for proto encoder and should already be zero,
-	// but set it again to be safe.
-	enc.lastEncodedDP.Value = 0
-	return enc.lastEncodedDP, nil
+	// Value is meaningless for proto encoder and should already be zero,
+	// but set it again to be safe.
+	enc.lastEncodedDP.Value = 0
+	return enc.lastEncodedDP, nil
+}
+
+// LastEncodedMessage returns the most recently encoded message unmarshalled with
+// the encoder's current schema. A new message is returned on every call so it can
+// be modified freely without affecting the state of the encoder. It requires the
+// RetainLastEncodedMessage of the options to be set.
+func (enc *Encoder) LastEncodedMessage() (*dynamic.Message, error) {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return nil, unusableErr
+	}
+	if !enc.opts.RetainLastEncodedMessage() {
+		return nil, errEncoderLastEncodedMessageNotRetained
+	}
+
+	if enc.numEncoded == 0 {
+		return nil, errNoEncodedDatapoints
+	}
+
+	m := dynamic.NewMessage(enc.schema)
+	if err := m.Unmarshal(enc.lastEncodedBytes); err != nil {
+		return nil, fmt.Errorf(
+			"%s error unmarshalling last encoded message: %v", encErrPrefix, err)
+	}
+	return m, nil
+}
+
+// Len returns the length of the data stream, or of the section of it that the
+// encoder has written to if the stream is shared.
+func (enc *Encoder) Len() int {
+	return enc.stream.Len() - enc.sectionStart
+}
+
+// ShouldFlush returns whether the encoder has reached the number of datapoints configured
+// with FlushMaxDatapoints or the length configured with FlushMaxBytes, so that
+// callers building fixed size blocks all roll them over by the same policy. It returns false
+// if neither is configured.
+func (enc *Encoder) ShouldFlush() bool {
+	if max := enc.opts.FlushMaxDatapoints(); max > 0 && enc.NumEncoded() >= max {
+		return true
+	}
+	if max := enc.opts.FlushMaxBytes(); max > 0 && enc.Len() >= max {
+		return true
+	}
+	return false
+}
+
+// CloseSection terminates the section of the shared stream that the encoder has
+// written to since it was created or last reset and returns the byte range
+// [start, end) that the section occupies within the stream. The bytes in that
+// range can be decoded independently of the rest of the stream. The encoder
+// can't be written to again until it is reset, which begins a new section.
+func (enc *Encoder) CloseSection() (start, end int, err error) {
+	if unusableErr := enc.isUsable(); unusableErr != nil {
+		return 0, 0, unusableErr
+	}
+	if !enc.sharedStream {
+		return 0, 0, errEncoderNotSharingStream
+	}
+
+	if !enc.sectionClosed {
+		if enc.numEncoded > 0 && enc.streamFeatures.has(streamFeatureEndOfStreamMarker) {
+			enc.writeEndOfStream(enc.stream)
+		}
+		enc.sectionClosed = true
+	}
+	return enc.sectionStart, enc.stream.Len(), nil
+}
+
+// writeEndOfStream writes the end-of-stream marker followed by the value ranges trailer,
+// if the stream has one.
+func (enc *Encoder) writeEndOfStream(stream encoding.OStream) {
+	writeEndOfStreamMarker(stream)
+	if enc.streamFeatures.has(streamFeatureValueRangesTrailer) {
+		enc.writeValueRangesTrailer(stream)
+	}
+}
+
+// startSection pads the shared stream to the next byte so that the section the
+// encoder writes next doesn't share its first byte with the previous section.
+func (enc *Encoder) startSection() {
+	enc.padToNextByte()
+	enc.sectionStart = enc.stream.Len()
+	enc.sectionClosed = false
+}
+
+// CustomFields returns the fields of the current schema that are custom encoded,
+// sorted by field number. Fields of the schema that are not included are marshalled
+// as protobuf instead.
+func (enc *Encoder) CustomFields() []CustomFieldInfo {
+	fields := make([]CustomFieldInfo, 0, len(enc.customFields))
+	for _, customField := range enc.customFields {
+		fields = append(fields, CustomFieldInfo{
+			FieldNum:   customField.fieldNum,
+			ProtoType:  customField.protoFieldType,
+			CustomType: customField.fieldType.String(),
+		})
+	}
+	return fields
+}
+
+// Stats returns EncoderStats which contain statistics about the encoders compression
+// ratio.
+func (enc *Encoder) Stats() EncoderStats {
+	stats := EncoderStats{
+		UncompressedBytes: enc.stats.uncompressedBytes,
+		CompressedBytes:   enc.dryRunCompactBytes + enc.Len(),
+	}
+	for _, customField := range enc.customFields {
+		if customField.fieldType != bytesField {
+			continue
+		}
+		if stats.BytesFieldDictionaryEvictions == nil {
+			stats.BytesFieldDictionaryEvictions = make(map[int]int)
+		}
+		stats.BytesFieldDictionaryEvictions[customField.fieldNum] = customField.bytesFieldDictEvictions
+	}
+	return stats
+}
+
+// MemSize returns an estimate of the number of bytes retained by the encoder,
+// based on the capacity of its buffers rather than their length since that's
+// what remains allocated while the encoder sits in a pool. Bytes that are shared
+// with other encoders, such as the static bytes dictionary or a stream provided
+// by the caller, are not included.
+func (enc *Encoder) MemSize() int {
+	size := int(unsafe.Sizeof(*enc))
+	if enc.stream != nil && !enc.sharedStream {
+		rawBytes, _ := enc.stream.Rawbytes()
+		size += cap(rawBytes)
+	}
+	size += cap(enc.lastEncodedBytes)
+	size += cap(enc.marshalBuf)
+	size += cap(enc.deltaBuf)
+	size += cap(enc.fieldsChangedToDefault) * int(unsafe.Sizeof(int32(0)))
+	size += cap(enc.deltaFieldNums) * int(unsafe.Sizeof(int32(0)))
+
+	// Reset truncates the fields rather than releasing them so the whole
+	// capacity is inspected to account for the buffers that are still retained.
+	nonCustomFields := enc.nonCustomFields[:cap(enc.nonCustomFields)]
+	size += len(nonCustomFields) * int(unsafe.Sizeof(marshalledField{}))
+	for _, field := range nonCustomFields {
+		size += cap(field.marshalled)
+	}
+
+	customFields := enc.customFields[:cap(enc.customFields)]
+	size += len(customFields) * int(unsafe.Sizeof(customFieldState{}))
+	for _, field := range customFields {
+		size += cap(field.bytesFieldDict) * int(unsafe.Sizeof(encoderBytesFieldDictState{}))
+		for _, state := range field.bytesFieldDict {
+			size += cap(state.dryRunBytes) + cap(state.deltaBytes)
+		}
+		// Interned values share their bytes with the dictionary entries they were added with.
+		size += cap(field.internedBytes) * int(unsafe.Sizeof(encoderBytesFieldDictState{}))
+		size += cap(field.iteratorBytesFieldDict) * int(unsafe.Sizeof([]byte(nil)))
+		for _, b := range field.iteratorBytesFieldDict {
+			size += cap(b)
+		}
+		size += cap(field.iteratorInternedBytes) * int(unsafe.Sizeof([]byte(nil)))
+		for _, b := range field.iteratorInternedBytes {
+			size += cap(b)
+		}
+	}
+
+	size += enc.mapFieldDiff.memSize()
+	return size
+}
+
+// enabledStreamFeatures returns the optional stream features enabled by the options.
+func (enc *Encoder) enabledStreamFeatures() streamFeatures {
+	var features streamFeatures
+	if enc.opts.EndOfStreamMarker() {
+		features |= streamFeatureEndOfStreamMarker
+	}
+	if enc.valueRangesTrailer {
+		// The trailer follows the end-of-stream marker.
+		features |= streamFeatureEndOfStreamMarker | streamFeatureValueRangesTrailer
+	}
+	if enc.opts.FullNonCustomFields() {
+		// Map field diffs are meaningless if every message is marshalled in full.
+		features |= streamFeatureFullNonCustomFields
+	} else if enc.opts.MapFieldDiffs() {
+		features |= streamFeatureMapFieldDiffs
+	}
+	if enc.staticBytesDict != nil {
+		features |= streamFeatureStaticBytesDict
+	}
+	if enc.opts.OneofFields() {
+		features |= streamFeatureOneofFields
+	}
+	if enc.maxInternedBytesValues() > 0 {
+		features |= streamFeatureInternedBytes
+	}
+	if enc.opts.BytesDictResets() {
+		features |= streamFeatureBytesDictResets
+	}
+	if enc.opts.IntChangesBitset() {
+		features |= streamFeatureIntChangesBitset
+	}
+	if len(enc.opts.IntDeltaOfDeltaFields()) > 0 {
+		features |= streamFeatureIntDeltaOfDelta
+	}
+	if enc.opts.SchemaHash() {
+		features |= streamFeatureSchemaHash
+	}
+	if len(enc.primedBytesDicts) > 0 {
+		features |= streamFeaturePrimedBytesDicts
+	}
+	if enc.opts.OmitEmptyProtoPortion() {
+		features |= streamFeatureOmitEmptyProtoPortion
+	}
+	if enc.opts.MaxCustomFields() > 0 || len(enc.opts.CustomFieldsAllowlist()) > 0 {
+		features |= streamFeatureLimitedCustomFields
+	}
+	if len(enc.opts.CustomFieldOrder()) > 0 {
+		features |= streamFeatureCustomFieldOrder
+	}
+	if enc.opts.IntValuedFloats() {
+		features |= streamFeatureIntValuedFloats
+	}
+	if len(enc.opts.StreamMetadata()) > 0 {
+		features |= streamFeatureStreamMetadata
+	}
+	if len(enc.floatBaselines) > 0 {
+		features |= streamFeatureFloatBaselines
+	}
+	if enc.opts.BytesPrefixDelta() {
+		features |= streamFeatureBytesPrefixDelta
+	}
+	if enc.opts.MessageBatches() {
+		features |= streamFeatureMessageBatches
+	}
+	return features
+}
+
+// validateTargetSchemeVersion returns an error if the options enable a feature that
+// requires a newer version of the encoding scheme than the target version, if any.
+func (enc *Encoder) validateTargetSchemeVersion() error {
+	target := enc.opts.TargetEncodingSchemeVersion()
+	if target == 0 {
+		return nil
+	}
+	if target < baseEncodingSchemeVersion || target > latestEncodingSchemeVersion {
+		return errEncoderUnknownSchemeVersion
+	}
+	if target < streamFeaturesEncodingSchemeVersion && enc.enabledStreamFeatures() != 0 {
+		return fmt.Errorf(
+			"%s optional stream features %b require encoding scheme version %d, target is %d",
+			encErrPrefix, enc.enabledStreamFeatures(), streamFeaturesEncodingSchemeVersion, target)
+	}
+	if target < compactHeaderEncodingSchemeVersion && enc.opts.CompactHeader() {
+		return fmt.Errorf(
+			"%s compact header requires encoding scheme version %d, target is %d",
+			encErrPrefix, compactHeaderEncodingSchemeVersion, target)
+	}
+	return nil
+}
+
+func (enc *Encoder) encodeStreamHeader() {
+	enc.streamFeatures = enc.enabledStreamFeatures()
+	if enc.opts.CompactHeader() && len(enc.customFields) == 0 {
+		enc.compactHeader = true
+		enc.encodeVarInt(compactHeaderEncodingSchemeVersion)
+		enc.encodeVarInt(uint64(enc.streamFeatures))
+		enc.encodeStaticBytesDictHash()
+		enc.encodeMaxInternedBytesValues()
+		enc.encodeSchemaHash()
+		enc.encodePrimedBytesDictsHash()
+		enc.encodeFloatBaselinesHash()
+		enc.encodeStreamMetadata()
+		return
+	}
+
+	if enc.streamFeatures == 0 {
+		enc.encodeVarInt(baseEncodingSchemeVersion)
+		enc.encodeVarInt(uint64(enc.byteFieldDictionaryLRUSize()))
+		return
+	}
+
+	enc.encodeVarInt(currentEncodingSchemeVersion)
+	enc.encodeVarInt(uint64(enc.byteFieldDictionaryLRUSize()))
+	enc.encodeVarInt(uint64(enc.streamFeatures))
+	enc.encodeStaticBytesDictHash()
+	enc.encodeMaxInternedBytesValues()
+	enc.encodeSchemaHash()
+	enc.encodePrimedBytesDictsHash()
+	enc.encodeFloatBaselinesHash()
+	enc.encodeStreamMetadata()
+}
+
+// encodeStaticBytesDictHash encodes the hash of the static dictionary, if any, so that
+// iterators can verify that they use the same dictionary.
+func (enc *Encoder) encodeStaticBytesDictHash() {
+	if enc.streamFeatures.has(streamFeatureStaticBytesDict) {
+		enc.stream.WriteBits(enc.staticBytesDict.hash, 64)
+	}
+}
+
+// encodeMaxInternedBytesValues encodes the maximum number of interned values of each bytes
+// field, if interning is enabled, so that iterators intern the same values.
+func (enc *Encoder) encodeMaxInternedBytesValues() {
+	if enc.streamFeatures.has(streamFeatureInternedBytes) {
+		enc.encodeVarInt(uint64(enc.maxInternedBytesValues()))
+	}
+}
+
+// encodeSchemaHash encodes the hash of the schema the stream begins with, if enabled, so
+// that iterators can verify that they use the same schema.
+func (enc *Encoder) encodeSchemaHash() {
+	if enc.streamFeatures.has(streamFeatureSchemaHash) {
+		enc.stream.WriteBits(schemaHash(enc.schema), 64)
+	}
+}
+
+// encodePrimedBytesDictsHash encodes the hash of the values the bytes dictionaries are
+// primed with, if any, so that iterators can verify that they're primed with the same values.
+func (enc *Encoder) encodePrimedBytesDictsHash() {
+	if enc.streamFeatures.has(streamFeaturePrimedBytesDicts) {
+		enc.stream.WriteBits(enc.primedBytesDicts.hash(), 64)
+	}
+}
+
+// encodeFloatBaselinesHash encodes the hash of the baselines of the float fields, if any, so
+// that iterators can verify that they use the same baselines.
+func (enc *Encoder) encodeFloatBaselinesHash() {
+	if enc.streamFeatures.has(streamFeatureFloatBaselines) {
+		enc.stream.WriteBits(uint64(enc.floatBaselines.hash()), 32)
+	}
 }
 
-// Len returns the length of the data stream.
-func (enc *Encoder) Len() int {
-	return enc.stream.Len()
+// encodeStreamMetadata encodes the length of the metadata of the stream, if any, followed by
+// the metadata itself.
+func (enc *Encoder) encodeStreamMetadata() {
+	if enc.streamFeatures.has(streamFeatureStreamMetadata) {
+		metadata := enc.opts.StreamMetadata()
+		enc.encodeVarInt(uint64(len(metadata)))
+		enc.stream.WriteBytes(metadata)
+	}
 }
 
-// Stats returns EncoderStats which contain statistics about the encoders compression
-// ratio.
-func (enc *Encoder) Stats() EncoderStats {
-	return EncoderStats{
-		UncompressedBytes: enc.stats.uncompressedBytes,
-		CompressedBytes:   enc.Len(),
+// primeBytesDicts adds the values the bytes dictionaries are primed with to the dictionaries
+// of the initial schema. The values are not in the stream so they're compared against the
+// primed values instead.
+func (enc *Encoder) primeBytesDicts() {
+	for i, customField := range enc.customFields {
+		values := enc.primedBytesDicts.values(customField.fieldNum, enc.byteFieldDictionaryLRUSize())
+		for _, value := range values {
+			enc.addToBytesDict(i, encoderBytesFieldDictState{
+				hash:        bytesHash(value),
+				length:      uint32(len(value)),
+				staticBytes: value,
+			})
+		}
 	}
 }
 
-func (enc *Encoder) encodeStreamHeader() {
-	enc.encodeVarInt(currentEncodingSchemeVersion)
-	enc.encodeVarInt(uint64(enc.opts.ByteFieldDictionaryLRUSize()))
+// maxInternedBytesValues returns the maximum number of interned values of each bytes field,
+// capped to maxInternedBytesValues.
+func (enc *Encoder) maxInternedBytesValues() int {
+	max := enc.opts.MaxInternedBytesValues()
+	if max > maxInternedBytesValues {
+		return maxInternedBytesValues
+	}
+	if max < 0 {
+		return 0
+	}
+	return max
 }
 
 func (enc *Encoder) encodeCustomSchemaTypes() {
@@ -332,53 +1406,97 @@ func (enc *Encoder) encodeCustomSchemaTypes() {
 	maxFieldNum := enc.customFields[len(enc.customFields)-1].fieldNum
 	enc.encodeVarInt(uint64(maxFieldNum))
 
+	// Streams with a compact header encode the dictionary compression LRU cache
+	// size the first time they encounter a schema with custom encoded fields.
+	if enc.compactHeader && !enc.hasEncodedLRUSize {
+		enc.encodeVarInt(uint64(enc.byteFieldDictionaryLRUSize()))
+		enc.hasEncodedLRUSize = true
+	}
+
+	// The custom fields are sorted by field number so they can be walked alongside
+	// the field numbers instead of being searched for each of them, which matters
+	// for wide schemas with high field numbers.
+	customFieldIdx := 0
 	// Start at 1 because we're zero-indexed.
 	for i := 1; i <= maxFieldNum; i++ {
 		customTypeBits := uint64(notCustomEncodedField)
-		for _, customField := range enc.customFields {
-			if customField.fieldNum == i {
-				customTypeBits = uint64(customField.fieldType)
-				break
-			}
+		if customField := enc.customFields[customFieldIdx]; customField.fieldNum == i {
+			customTypeBits = uint64(customField.fieldType)
+			customFieldIdx++
 		}
 
 		enc.stream.WriteBits(
 			customTypeBits,
 			numBitsToEncodeCustomType)
 	}
+
+	if enc.streamFeatures.has(streamFeatureIntDeltaOfDelta) {
+		for _, customField := range enc.customFields {
+			if !isCustomIntEncodedField(customField.fieldType) {
+				continue
+			}
+			if customField.intEncAndIter.deltaOfDelta {
+				enc.stream.WriteBit(opCodeIntDeltaOfDelta)
+			} else {
+				enc.stream.WriteBit(opCodeIntDelta)
+			}
+		}
+	}
+}
+
+// encodeLimitedCustomFieldNums encodes the number of fields that are not custom encoded because
+// of the limits on the custom encoded fields followed by the deltas between their field numbers.
+func (enc *Encoder) encodeLimitedCustomFieldNums() {
+	enc.encodeVarInt(uint64(len(enc.limitedCustomFieldNums)))
+	prevFieldNum := int32(0)
+	for _, fieldNum := range enc.limitedCustomFieldNums {
+		enc.encodeVarInt(uint64(fieldNum - prevFieldNum))
+		prevFieldNum = fieldNum
+	}
+}
+
+// encodeCustomFieldOrderNums encodes the number of custom encoded fields whose values are written
+// first followed by their field numbers, in the order that their values are written in.
+func (enc *Encoder) encodeCustomFieldOrderNums() {
+	enc.encodeVarInt(uint64(len(enc.customFieldOrderNums)))
+	for _, fieldNum := range enc.customFieldOrderNums {
+		enc.encodeVarInt(uint64(fieldNum))
+	}
 }
 
 func (enc *Encoder) encodeProto(buf []byte) error {
-	var (
-		sortedTopLevelScalarValues    = enc.unmarshaller.sortedCustomFieldValues()
-		sortedTopLevelScalarValuesIdx = 0
-		lastMarshalledValue           unmarshalValue
-	)
+	sp := enc.startChildSpan(tracepoint.ProtoEncoderEncodeCustomValues)
+	err := enc.encodeCustomValues()
+	finishSpan(sp, err)
+	if err != nil {
+		return err
+	}
 
-	// Loop through the customFields slice and sortedTopLevelScalarValues slice (both
-	// of which are sorted by field number) at the same time and match each customField
-	// to its encoded value in the stream (if any).
-	for i, customField := range enc.customFields {
-		if sortedTopLevelScalarValuesIdx < len(sortedTopLevelScalarValues) {
-			lastMarshalledValue = sortedTopLevelScalarValues[sortedTopLevelScalarValuesIdx]
-		}
+	sp = enc.startChildSpan(tracepoint.ProtoEncoderMarshalNonCustomValues)
+	err = enc.encodeNonCustomValues()
+	finishSpan(sp, err)
+	return err
+}
 
-		lastMarshalledValueFieldNumber := -1
+func (enc *Encoder) encodeCustomValues() error {
+	enc.matchCustomFieldValues(enc.unmarshaller.sortedCustomFieldValues())
 
-		hasNext := sortedTopLevelScalarValuesIdx < len(sortedTopLevelScalarValues)
-		if hasNext {
-			lastMarshalledValueFieldNumber = int(lastMarshalledValue.fieldNumber)
-		}
+	enc.intChangesBitset = false
+	if enc.streamFeatures.has(streamFeatureIntChangesBitset) &&
+		canEncodeIntChangesBitset(enc.customFields) {
+		enc.encodeIntChanges()
+	}
 
-		// Since both the customFields slice and the sortedTopLevelScalarValues slice
-		// are sorted by field number, if the scalar slice contains no more values or
-		// it contains a next value, but the field number is not equal to the field number
-		// of the current customField, it is safe to conclude that the current customField's
-		// value was not encoded in this message which means that it should be interpreted
-		// as the default value for that field according to the proto3 specification.
-		noMarshalledValue := (!hasNext ||
-			customField.fieldNum != lastMarshalledValueFieldNumber)
-		if noMarshalledValue {
+	for pos := range enc.customFields {
+		var (
+			i           = customFieldIdx(enc.customFieldOrder, pos)
+			customField = enc.customFields[i]
+			fieldValue  = enc.customFieldValues[i]
+		)
+		if !fieldValue.isSet {
+			// The field was not set in the marshalled message which means that it should be
+			// interpreted as the default value for that field according to the proto3
+			// specification.
 			err := enc.encodeZeroValue(i)
 			if err != nil {
 				return err
@@ -388,23 +1506,23 @@ func (enc *Encoder) encodeProto(buf []byte) error {
 
 		switch {
 		case isCustomFloatEncodedField(customField.fieldType):
-			enc.encodeTSZValue(i, lastMarshalledValue.asFloat64())
+			enc.encodeTSZValue(i, fieldValue.value.asFloat64())
 
 		case isCustomIntEncodedField(customField.fieldType):
 			if isUnsignedInt(customField.fieldType) {
-				enc.encodeUnsignedIntValue(i, lastMarshalledValue.asUint64())
+				enc.encodeUnsignedIntValue(i, fieldValue.value.asUint64())
 			} else {
-				enc.encodeSignedIntValue(i, lastMarshalledValue.asInt64())
+				enc.encodeSignedIntValue(i, fieldValue.value.asInt64())
 			}
 
 		case customField.fieldType == bytesField:
-			err := enc.encodeBytesValue(i, lastMarshalledValue.asBytes())
+			err := enc.encodeBytesValue(i, fieldValue.value.asBytes())
 			if err != nil {
 				return err
 			}
 
 		case customField.fieldType == boolField:
-			enc.encodeBoolValue(i, lastMarshalledValue.asBool())
+			enc.encodeBoolValue(i, fieldValue.value.asBool())
 
 		default:
 			// This should never happen.
@@ -412,15 +1530,108 @@ func (enc *Encoder) encodeProto(buf []byte) error {
 				"%s error no logic for custom encoding field number: %d",
 				encErrPrefix, customField.fieldNum)
 		}
+	}
+
+	return nil
+}
+
+// matchCustomFieldValues matches each custom field to its value in the marshalled message
+// that is being encoded, if any, by looping through the customFields slice and the
+// sortedValues slice (both of which are sorted by field number) at the same time.
+func (enc *Encoder) matchCustomFieldValues(sortedValues sortedCustomFieldValues) {
+	enc.customFieldValues = enc.customFieldValues[:0]
+	valuesIdx := 0
+	for _, customField := range enc.customFields {
+		for valuesIdx < len(sortedValues) &&
+			int(sortedValues[valuesIdx].fieldNumber) < customField.fieldNum {
+			valuesIdx++
+		}
 
-		sortedTopLevelScalarValuesIdx++
+		var fieldValue customFieldValue
+		if valuesIdx < len(sortedValues) &&
+			int(sortedValues[valuesIdx].fieldNumber) == customField.fieldNum {
+			fieldValue = customFieldValue{value: sortedValues[valuesIdx], isSet: true}
+			valuesIdx++
+		}
+		enc.customFieldValues = append(enc.customFieldValues, fieldValue)
 	}
+}
 
-	if err := enc.encodeNonCustomValues(); err != nil {
-		return err
+// startChildSpan starts a span for one of the phases of the in-progress call to
+// Encode, it returns nil if tracing is disabled.
+func (enc *Encoder) startChildSpan(operationName string) opentracing.Span {
+	if enc.encodeSpan == nil {
+		return nil
 	}
+	return enc.tracer.StartSpan(operationName, opentracing.ChildOf(enc.encodeSpan.Context()))
+}
 
-	return nil
+func (enc *Encoder) finishEncodeSpan() {
+	enc.encodeSpan.Finish()
+	enc.encodeSpan = nil
+}
+
+func finishSpan(sp opentracing.Span, err error) {
+	if sp == nil {
+		return
+	}
+	if err != nil {
+		sp.LogFields(opentracinglog.Error(err))
+		opentracingext.Error.Set(sp, true)
+	}
+	sp.Finish()
+}
+
+// encodeIntChanges determines which of the custom encoded int fields changed since the previous
+// write and encodes a control bit that indicates whether they're encoded as a bitset (in which
+// case the bitset follows and the unchanged int fields are omitted entirely) or whether each
+// int field is preceded by a bit that indicates whether it changed, whichever is smaller.
+func (enc *Encoder) encodeIntChanges() {
+	var numIntFields int32
+	enc.changedIntFields = enc.changedIntFields[:0]
+	for pos := range enc.customFields {
+		var (
+			i           = customFieldIdx(enc.customFieldOrder, pos)
+			customField = enc.customFields[i]
+			fieldValue  = enc.customFieldValues[i]
+		)
+		if !isCustomIntEncodedField(customField.fieldType) {
+			continue
+		}
+		numIntFields++
+
+		// Fields that are not in the marshalled message are encoded as their default value.
+		var vBits uint64
+		if fieldValue.isSet {
+			if isUnsignedInt(customField.fieldType) {
+				vBits = fieldValue.value.asUint64()
+			} else {
+				vBits = uint64(fieldValue.value.asInt64())
+			}
+		}
+
+		if customField.intEncAndIter.hasChanged(vBits) {
+			// The bitset is 1-indexed by the position of the field amongst the int fields,
+			// in the order that their values are written in.
+			enc.changedIntFields = append(enc.changedIntFields, numIntFields)
+		}
+	}
+
+	// The bitset only extends up to the last int field that changed and is preceded
+	// by a varint of its length (see encodeBitset).
+	var bitsetLen int32
+	if n := len(enc.changedIntFields); n > 0 {
+		bitsetLen = enc.changedIntFields[n-1]
+	}
+	bitsetNumBits := 8*binary.PutUvarint(enc.varIntBuf[:], uint64(bitsetLen)) + int(bitsetLen)
+	if bitsetNumBits >= int(numIntFields) {
+		enc.stream.WriteBit(opCodeIntChangesPerField)
+		return
+	}
+
+	enc.stream.WriteBit(opCodeIntChangesBitset)
+	enc.encodeBitset(enc.changedIntFields)
+	enc.intChangesBitset = true
 }
 
 func (enc *Encoder) encodeZeroValue(i int) error {
@@ -484,20 +1695,46 @@ func (enc *Encoder) SetSchema(descr namespace.SchemaDescr) {
 }
 
 func (enc *Encoder) reset(start time.Time, capacity int) {
-	enc.stream.Reset(enc.newBuffer(capacity))
+	if enc.sharedStream {
+		enc.startSection()
+	} else {
+		// The current stream buffer is always released (and returned to the bytes
+		// pool, if any) in favor of a new one of the requested capacity.
+		enc.stream.Reset(enc.newBuffer(capacity))
+	}
 	enc.timestampEncoder = m3tsz.NewTimestampEncoder(
-		start, enc.opts.DefaultTimeUnit(), enc.opts)
+		start, enc.opts.EncodingOptions().DefaultTimeUnit(), enc.opts.EncodingOptions())
 	enc.lastEncodedDP = ts.Datapoint{}
+	enc.lastEncodedBytes = enc.lastEncodedBytes[:0]
+	enc.valueRanges = enc.valueRanges[:0]
 
 	// Prevent this from growing too large and remaining in the pools.
 	enc.marshalBuf = nil
+	if maxCapacity := enc.opts.MaxRetainedBufferCapacity(); maxCapacity > 0 {
+		if cap(enc.lastEncodedBytes) > maxCapacity {
+			enc.lastEncodedBytes = nil
+		}
+		if cap(enc.deltaBuf) > maxCapacity {
+			enc.deltaBuf = nil
+		}
+		enc.mapFieldDiff.trim(maxCapacity)
+	}
 
 	if enc.schema != nil {
-		enc.customFields, enc.nonCustomFields = customAndNonCustomFields(enc.customFields, enc.nonCustomFields, enc.schema)
+		enc.resetCustomAndNonCustomFields()
 	}
 
 	enc.closed = false
 	enc.numEncoded = 0
+	// Every stream must begin with the schema, even if the schema did not change
+	// since the previous stream (in which case SetSchema is a no-op).
+	enc.hasEncodedSchema = false
+	enc.streamFeatures = 0
+	enc.compactHeader = false
+	enc.hasEncodedLRUSize = false
+	enc.dryRun = false
+	enc.dryRunCompactBytes = 0
+	enc.primedBytesDicts = nil
 }
 
 func (enc *Encoder) resetSchema(schema *desc.MessageDescriptor) {
@@ -516,11 +1753,124 @@ func (enc *Encoder) resetSchema(schema *desc.MessageDescriptor) {
 			nonCustomFields[i] = marshalledField{}
 		}
 		enc.nonCustomFields = nonCustomFields[:0]
+		enc.customFieldOrder = enc.customFieldOrder[:0]
 		return
 	}
 
-	enc.customFields, enc.nonCustomFields = customAndNonCustomFields(enc.customFields, enc.nonCustomFields, enc.schema)
+	enc.resetCustomAndNonCustomFields()
 	enc.hasEncodedSchema = false
+	if enc.marshalFallbacksLogLimiter != nil {
+		enc.logMarshalFallbacks()
+	}
+}
+
+// resetCustomAndNonCustomFields resets the state of the fields of the schema, marks the custom
+// encoded int fields that are configured to be encoded as a delta-of-delta, or whose deltas may
+// wrap around, and applies the baselines of the custom encoded float fields.
+func (enc *Encoder) resetCustomAndNonCustomFields() {
+	enc.customFields, enc.nonCustomFields = customAndNonCustomFields(
+		enc.customFields, enc.nonCustomFields, enc.schema, enc.opts.OneofFields())
+	enc.limitCustomFields()
+	enc.orderCustomFields()
+	for _, name := range enc.opts.IntDeltaOfDeltaFields() {
+		fieldDesc := enc.schema.FindFieldByName(name)
+		if fieldDesc == nil {
+			continue
+		}
+		for i := range enc.customFields {
+			customField := &enc.customFields[i]
+			if customField.fieldNum == int(fieldDesc.GetNumber()) &&
+				isCustomIntEncodedField(customField.fieldType) {
+				customField.intEncAndIter.deltaOfDelta = true
+			}
+		}
+	}
+	if enc.opts.UnsignedIntWraparound() {
+		for i := range enc.customFields {
+			customField := &enc.customFields[i]
+			if isUnsignedInt(customField.fieldType) {
+				customField.intEncAndIter.wraparound = true
+			}
+		}
+	}
+	enc.floatBaselines.apply(enc.customFields, enc.schema)
+	if enc.valueRangesTrailer {
+		enc.assignValueRanges()
+	}
+}
+
+// limitCustomFields turns the custom encoded fields that aren't in the CustomFieldsAllowlist,
+// if set, or that exceed the MaxCustomFields into non custom fields. Their numbers are encoded
+// after the schema so that iterators read their values from the Protobuf marshalled portion.
+func (enc *Encoder) limitCustomFields() {
+	enc.limitedCustomFieldNums = enc.limitedCustomFieldNums[:0]
+	var (
+		allowlist       = enc.opts.CustomFieldsAllowlist()
+		maxCustomFields = enc.opts.MaxCustomFields()
+	)
+	if len(allowlist) == 0 && (maxCustomFields <= 0 || len(enc.customFields) <= maxCustomFields) {
+		return
+	}
+
+	allowedFieldNums := make(map[int]struct{}, len(allowlist))
+	for _, name := range allowlist {
+		if fieldDesc := enc.schema.FindFieldByName(name); fieldDesc != nil {
+			allowedFieldNums[int(fieldDesc.GetNumber())] = struct{}{}
+		}
+	}
+
+	customFields := enc.customFields[:0]
+	for _, customField := range enc.customFields {
+		_, allowed := allowedFieldNums[customField.fieldNum]
+		if (allowed || len(allowlist) == 0) &&
+			(maxCustomFields <= 0 || len(customFields) < maxCustomFields) {
+			customFields = append(customFields, customField)
+			continue
+		}
+		enc.limitedCustomFieldNums = append(enc.limitedCustomFieldNums, int32(customField.fieldNum))
+		enc.nonCustomFields = append(enc.nonCustomFields, marshalledField{fieldNum: int32(customField.fieldNum)})
+	}
+	for i := len(customFields); i < len(enc.customFields); i++ {
+		enc.customFields[i] = customFieldState{}
+	}
+	enc.customFields = customFields
+	sort.Sort(sortedMarshalledFields(enc.nonCustomFields))
+}
+
+// orderCustomFields determines the order that the values of the custom fields are written in
+// from the CustomFieldOrder, the names of fields that aren't custom encoded are ignored.
+func (enc *Encoder) orderCustomFields() {
+	enc.customFieldOrderNums = enc.customFieldOrderNums[:0]
+	for _, name := range enc.opts.CustomFieldOrder() {
+		fieldDesc := enc.schema.FindFieldByName(name)
+		if fieldDesc == nil {
+			continue
+		}
+
+		var (
+			fieldNum      = fieldDesc.GetNumber()
+			isCustomField = false
+		)
+		for _, customField := range enc.customFields {
+			if customField.fieldNum == int(fieldNum) {
+				isCustomField = true
+				break
+			}
+		}
+		for _, orderedFieldNum := range enc.customFieldOrderNums {
+			if orderedFieldNum == fieldNum {
+				isCustomField = false
+				break
+			}
+		}
+		if isCustomField {
+			enc.customFieldOrderNums = append(enc.customFieldOrderNums, fieldNum)
+		}
+	}
+
+	// This can't fail since the field numbers are those of distinct custom fields.
+	enc.customFieldOrder, _ = customFieldOrder(
+		enc.customFieldOrder, enc.customFields, enc.customFieldOrderNums)
 }
 
 // Close closes the encoder.
@@ -529,11 +1879,21 @@ func (enc *Encoder) Close() {
 		return
 	}
 
+	if enc.sharedStream {
+		// Detach from the shared stream (which is owned by the caller) so that
+		// it's not written to by the reset below or once the encoder is reused.
+		enc.stream = encoding.NewOStream(nil, false, enc.opts.EncodingOptions().BytesPool())
+		enc.sharedStream = false
+		enc.sectionStart = 0
+		enc.sectionClosed = false
+	}
+
 	enc.Reset(time.Time{}, 0, nil)
 	enc.stream.Reset(nil)
+	enc.byteFieldDictLRUSize = 0
 	enc.closed = true
 
-	if pool := enc.opts.EncoderPool(); pool != nil {
+	if pool := enc.opts.EncodingOptions().EncoderPool(); pool != nil {
 		pool.Put(enc)
 	}
 }
@@ -563,25 +1923,101 @@ func (enc *Encoder) Bytes() ([]byte, error) {
 	}
 
 	bytes, _ := enc.stream.Rawbytes()
-	return bytes, nil
+	return bytes[enc.sectionStart:], nil
 }
 
 func (enc *Encoder) encodeTSZValue(i int, val float64) {
+	if val == 0 {
+		// Normalize negative zero to positive zero. Most marshallers (and the
+		// iterator) treat negative zero as the default value and omit it, so
+		// encoding its distinct bit pattern would only cost an extra write and
+		// decode as positive zero regardless.
+		val = 0
+	}
+	if enc.valueRangesTrailer {
+		enc.valueRanges[enc.customFields[i].valueRangeIdx].addFloat64(val)
+	}
+	if enc.streamFeatures.has(streamFeatureIntValuedFloats) {
+		enc.encodeIntValuedFloatValue(i, val)
+		return
+	}
 	enc.customFields[i].floatEncAndIter.WriteFloat(enc.stream, val)
 }
 
+// encodeIntValuedFloatValue encodes the value of a float field whose previous value is an
+// integer, that can be represented exactly, as a control bit that indicates whether it
+// changed followed by a bit that indicates whether the change is encoded as the delta
+// between the integers, like an int field, or as usual. Other values are encoded as usual.
+func (enc *Encoder) encodeIntValuedFloatValue(i int, val float64) {
+	var (
+		customField = &enc.customFields[i]
+		prevBits    = customField.floatEncAndIter.PrevFloatBits
+		prev        = math.Float64frombits(prevBits)
+	)
+	if !customField.floatEncAndIter.NotFirst || !isIntValuedFloat(prev) {
+		customField.floatEncAndIter.WriteFloat(enc.stream, val)
+		return
+	}
+
+	valBits := math.Float64bits(val)
+	if valBits == prevBits {
+		enc.stream.WriteBit(opCodeNoChange)
+		return
+	}
+
+	enc.stream.WriteBit(opCodeChange)
+	if !isIntValuedFloat(val) {
+		enc.stream.WriteBit(opCodeFloatXOR)
+		customField.floatEncAndIter.WriteFloat(enc.stream, val)
+		return
+	}
+
+	enc.stream.WriteBit(opCodeIntValuedFloatDelta)
+	customField.intEncAndIter.prevIntBits = uint64(int64(prev))
+	customField.intEncAndIter.encodeSignedIntChange(enc.stream, int64(val))
+	// The next value may be encoded as the XOR with this one.
+	customField.floatEncAndIter.PrevXOR = prevBits ^ valBits
+	customField.floatEncAndIter.PrevFloatBits = valBits
+}
+
 func (enc *Encoder) encodeSignedIntValue(i int, val int64) {
-	enc.customFields[i].intEncAndIter.encodeSignedIntValue(enc.stream, val)
+	if enc.valueRangesTrailer {
+		enc.valueRanges[enc.customFields[i].valueRangeIdx].addInt64(val)
+	}
+	intEncAndIter := &enc.customFields[i].intEncAndIter
+	if enc.intChangesBitset {
+		// The bitset already indicates whether the value changed.
+		if intEncAndIter.hasChanged(uint64(val)) {
+			intEncAndIter.encodeSignedIntChange(enc.stream, val)
+		} else {
+			intEncAndIter.advanceUnchanged()
+		}
+		return
+	}
+	intEncAndIter.encodeSignedIntValue(enc.stream, val)
 }
 
 func (enc *Encoder) encodeUnsignedIntValue(i int, val uint64) {
-	enc.customFields[i].intEncAndIter.encodeUnsignedIntValue(enc.stream, val)
+	if enc.valueRangesTrailer {
+		enc.valueRanges[enc.customFields[i].valueRangeIdx].addUint64(val)
+	}
+	intEncAndIter := &enc.customFields[i].intEncAndIter
+	if enc.intChangesBitset {
+		// The bitset already indicates whether the value changed.
+		if intEncAndIter.hasChanged(val) {
+			intEncAndIter.encodeUnsignedIntChange(enc.stream, val)
+		} else {
+			intEncAndIter.advanceUnchanged()
+		}
+		return
+	}
+	intEncAndIter.encodeUnsignedIntValue(enc.stream, val)
 }
 
 func (enc *Encoder) encodeBytesValue(i int, val []byte) error {
 	var (
 		customField      = enc.customFields[i]
-		hash             = xxhash.Sum64(val)
+		hash             = bytesHash(val)
 		numPreviousBytes = len(customField.bytesFieldDict)
 		lastStateIdx     = numPreviousBytes - 1
 		lastState        encoderBytesFieldDictState
@@ -633,7 +2069,7 @@ func (enc *Encoder) encodeBytesValue(i int, val []byte) error {
 		enc.stream.WriteBits(
 			uint64(j),
 			numBitsRequiredForNumUpToN(
-				enc.opts.ByteFieldDictionaryLRUSize()))
+				enc.byteFieldDictionaryLRUSize()))
 		enc.moveToEndOfBytesDict(i, j)
 		return nil
 	}
@@ -642,6 +2078,63 @@ func (enc *Encoder) encodeBytesValue(i int, val []byte) error {
 	// []byte we haven't seen before.
 	enc.stream.WriteBit(opCodeInterpretSubsequentBitsAsBytesLengthVarInt)
 
+	if len(customField.internedBytes) > 0 {
+		// Values that were evicted from the LRU but were interned are encoded as an index into
+		// the interned values, using as many bits as required for the number of values that
+		// have been interned so far.
+		for j, state := range customField.internedBytes {
+			if hash != state.hash {
+				continue
+			}
+
+			match, err := enc.bytesMatchEncodedDictionaryValue(
+				streamBytes, state, val)
+			if err != nil {
+				return fmt.Errorf(
+					"%s error checking if bytes match interned bytes: %v",
+					encErrPrefix, err)
+			}
+			if !match {
+				continue
+			}
+
+			enc.stream.WriteBit(opCodeInterpretSubsequentBitsAsInternedIndex)
+			enc.stream.WriteBits(uint64(j),
+				numBitsRequiredForNumUpToN(len(customField.internedBytes)-1))
+			enc.addToBytesDict(i, state)
+			return nil
+		}
+		enc.stream.WriteBit(opCodeBytesNotInterned)
+	}
+
+	if enc.staticBytesDict != nil {
+		// Values that are in the static dictionary are encoded as an index into it the first
+		// time they're encountered, and are then added to the LRU like any other value.
+		if idx, ok := enc.staticBytesDict.index(hash, val); ok {
+			enc.stream.WriteBit(opCodeInterpretSubsequentBitsAsStaticDictIndex)
+			enc.stream.WriteBits(uint64(idx), enc.staticBytesDict.numIndexBits)
+			state := encoderBytesFieldDictState{
+				hash:        hash,
+				length:      uint32(len(val)),
+				staticBytes: enc.staticBytesDict.values[idx],
+			}
+			enc.addToBytesDict(i, state)
+			enc.addToInternedBytes(i, state)
+			return nil
+		}
+		enc.stream.WriteBit(opCodeBytesNotInStaticDict)
+	}
+
+	if numPreviousBytes > 0 && enc.streamFeatures.has(streamFeatureBytesPrefixDelta) {
+		encoded, err := enc.encodeBytesPrefixDelta(i, hash, lastState, val)
+		if err != nil {
+			return err
+		}
+		if encoded {
+			return nil
+		}
+	}
+
 	length := len(val)
 	enc.encodeVarInt(uint64(length))
 
@@ -668,14 +2161,62 @@ func (enc *Encoder) encodeBytesValue(i int, val []byte) error {
 	// Write the actual bytes.
 	enc.stream.WriteBytes(val)
 
-	enc.addToBytesDict(i, encoderBytesFieldDictState{
+	state := encoderBytesFieldDictState{
 		hash:     hash,
 		startPos: uint32(bytePos),
 		length:   uint32(length),
-	})
+	}
+	if enc.dryRun {
+		state.dryRunBytes = append([]byte(nil), val...)
+	}
+	enc.addToBytesDict(i, state)
+	enc.addToInternedBytes(i, state)
 	return nil
 }
 
+// encodeBytesPrefixDelta encodes a new value of the bytes field at index i as the difference
+// with its previous value, that is the lengths of their longest common prefix and suffix
+// followed by the length of the bytes in between and the bytes themselves, if they have enough
+// bytes in common for it to be more compact than encoding the value in full. A control bit
+// indicates whether it did and it returns whether the value was encoded.
+func (enc *Encoder) encodeBytesPrefixDelta(
+	i int,
+	hash uint64,
+	lastState encoderBytesFieldDictState,
+	val []byte,
+) (bool, error) {
+	streamBytes, _ := enc.stream.Rawbytes()
+	prev, err := enc.encodedDictionaryValue(streamBytes, lastState)
+	if err != nil {
+		return false, fmt.Errorf(
+			"%s error reading previous bytes value: %v", encErrPrefix, err)
+	}
+
+	prefixLen, suffixLen := commonPrefixAndSuffixLen(prev, val)
+	if prefixLen+suffixLen < minBytesPrefixDeltaCommonLen {
+		enc.stream.WriteBit(opCodeBytesNotPrefixDelta)
+		return false, nil
+	}
+
+	// The bytes in between don't need to be aligned on a byte boundary since they're never
+	// compared against, the new value is kept in the dictionaries in full instead.
+	delta := val[prefixLen : len(val)-suffixLen]
+	enc.stream.WriteBit(opCodeBytesPrefixDelta)
+	enc.encodeVarInt(uint64(prefixLen))
+	enc.encodeVarInt(uint64(suffixLen))
+	enc.encodeVarInt(uint64(len(delta)))
+	enc.stream.WriteBytes(delta)
+
+	state := encoderBytesFieldDictState{
+		hash:       hash,
+		length:     uint32(len(val)),
+		deltaBytes: append([]byte(nil), val...),
+	}
+	enc.addToBytesDict(i, state)
+	enc.addToInternedBytes(i, state)
+	return true, nil
+}
+
 func (enc *Encoder) encodeBoolValue(i int, val bool) {
 	if val {
 		enc.stream.WriteBit(opCodeBoolTrue)
@@ -684,19 +2225,48 @@ func (enc *Encoder) encodeBoolValue(i int, val bool) {
 	}
 }
 
+// encodeFullNonCustomValues marshals all of the non custom encoded fields of the message
+// regardless of whether they changed since the previous message. The control bit indicates
+// whether the message has any non custom encoded fields at all, and if it does it's
+// followed by the marshalled fields in the same format as when only changes are encoded
+// except that there is never a bitset of fields that were set to their default values.
+func (enc *Encoder) encodeFullNonCustomValues() error {
+	enc.marshalBuf = enc.marshalBuf[:0] // Reset buf for reuse.
+	for _, field := range enc.unmarshaller.sortedNonCustomFieldValues() {
+		enc.marshalBuf = append(enc.marshalBuf, field.marshalled...)
+	}
+
+	if len(enc.marshalBuf) == 0 {
+		enc.stream.WriteBit(opCodeNoChange)
+		return nil
+	}
+
+	enc.stream.WriteBit(opCodeChange)
+	enc.padToNextByte()
+	enc.encodeVarInt(uint64(len(enc.marshalBuf)))
+	enc.stream.WriteBytes(enc.marshalBuf)
+	return nil
+}
+
 func (enc *Encoder) encodeNonCustomValues() error {
 	if len(enc.nonCustomFields) == 0 {
 		// Fast path, skip all the encoding logic entirely because there are
-		// no fields that require proto encoding.
-		// TODO(rartoul): Note that the encoding scheme could be further optimized
-		// such that if there are no fields that require proto encoding then we don't
-		// need to waste this bit per write.
-		enc.stream.WriteBit(opCodeNoChange)
+		// no fields that require proto encoding. The control bit is omitted
+		// too if the schema was encoded with a bit that indicates so.
+		if !enc.streamFeatures.has(streamFeatureOmitEmptyProtoPortion) {
+			enc.stream.WriteBit(opCodeNoChange)
+		}
 		return nil
 	}
 
+	if enc.streamFeatures.has(streamFeatureFullNonCustomFields) {
+		return enc.encodeFullNonCustomValues()
+	}
+
 	// Reset for re-use.
 	enc.fieldsChangedToDefault = enc.fieldsChangedToDefault[:0]
+	enc.mapFieldDiff.resetRemovals()
+	encodeMapFieldDiffs := enc.streamFeatures.has(streamFeatureMapFieldDiffs)
 
 	var (
 		incomingNonCustomFields = enc.unmarshaller.sortedNonCustomFieldValues()
@@ -720,13 +2290,62 @@ func (enc *Encoder) encodeNonCustomValues() error {
 		}
 
 		prevVal := existingField.marshalled
-		if bytes.Equal(prevVal, curVal) {
+		if enc.encodingDelta {
+			// The caller determined which fields changed.
+			if !isSortedFieldNum(enc.deltaFieldNums, existingField.fieldNum) {
+				continue
+			}
+		} else if bytes.Equal(prevVal, curVal) {
 			// No change, nothing to encode.
 			continue
 		}
 
+		if curVal != nil && isDefaultMarshalledValue(
+			enc.schema.FindFieldByNumber(existingField.fieldNum), curVal) {
+			// Normalize to absent so that it is compared and encoded the same as any other
+			// default value.
+			curVal = nil
+			if len(prevVal) == 0 {
+				continue
+			}
+		}
+
+		if !encodeMapFieldDiffs && !enc.encodingDelta && curVal != nil && len(prevVal) > 0 {
+			field := enc.schema.FindFieldByNumber(existingField.fieldNum)
+			if field != nil && field.IsMap() {
+				// The entries of a map are marshalled in no particular order so an unchanged
+				// map isn't necessarily marshalled the same way as the previous time.
+				equal, err := enc.mapFieldDiff.equal(prevVal, curVal)
+				if err != nil {
+					return fmt.Errorf(
+						"%s error comparing map field %d: %v", encErrPrefix, existingField.fieldNum, err)
+				}
+				if equal {
+					continue
+				}
+			}
+		}
+
+		if encodeMapFieldDiffs && curVal != nil && len(prevVal) > 0 {
+			field := enc.schema.FindFieldByNumber(existingField.fieldNum)
+			if field != nil && field.IsMap() {
+				// Only encode the entries of the map that were added, changed or removed.
+				changed, err := enc.mapFieldDiff.diff(existingField.fieldNum, prevVal, curVal)
+				if err != nil {
+					return fmt.Errorf(
+						"%s error diffing map field %d: %v", encErrPrefix, existingField.fieldNum, err)
+				}
+				enc.nonCustomFields[i].marshalled = append(enc.nonCustomFields[i].marshalled[:0], curVal...)
+				if changed {
+					numChangedValues++
+					enc.marshalBuf = append(enc.marshalBuf, enc.mapFieldDiff.upserts...)
+				}
+				continue
+			}
+		}
+
 		numChangedValues++
-		if curVal == nil {
+		if curVal == nil && !enc.isClearedByOneofMember(existingField.fieldNum, incomingNonCustomFields) {
 			// Interpret as default value.
 			enc.fieldsChangedToDefault = append(enc.fieldsChangedToDefault, existingField.fieldNum)
 		}
@@ -765,9 +2384,40 @@ func (enc *Encoder) encodeNonCustomValues() error {
 	enc.encodeVarInt(uint64(len(enc.marshalBuf)))
 	enc.stream.WriteBytes(enc.marshalBuf)
 
+	if encodeMapFieldDiffs {
+		// Followed by the keys of any map entries that were removed.
+		enc.encodeVarInt(uint64(enc.mapFieldDiff.numRemovals))
+		enc.stream.WriteBytes(enc.mapFieldDiff.removals)
+	}
+
 	return nil
 }
 
+// isClearedByOneofMember returns whether the field is a member of a oneof whose active
+// member is another field of the incoming message, in which case the iterator clears the
+// field implicitly when it sets the other member.
+func (enc *Encoder) isClearedByOneofMember(fieldNum int32, incoming sortedMarshalledFields) bool {
+	if !enc.streamFeatures.has(streamFeatureOneofFields) {
+		return false
+	}
+
+	field := enc.schema.FindFieldByNumber(fieldNum)
+	if field == nil || field.GetOneOf() == nil {
+		return false
+	}
+	for _, member := range field.GetOneOf().GetChoices() {
+		if member.GetNumber() == fieldNum {
+			continue
+		}
+		for _, incomingField := range incoming {
+			if incomingField.fieldNum == member.GetNumber() && len(incomingField.marshalled) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (enc *Encoder) isUsable() error {
 	if enc.closed {
 		return errEncoderClosed
@@ -781,6 +2431,28 @@ func (enc *Encoder) bytesMatchEncodedDictionaryValue(
 	dictState encoderBytesFieldDictState,
 	currBytes []byte,
 ) (bool, error) {
+	prevEncodedBytes, err := enc.encodedDictionaryValue(streamBytes, dictState)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(prevEncodedBytes, currBytes), nil
+}
+
+// encodedDictionaryValue returns the bytes of a value in the dictionary.
+func (enc *Encoder) encodedDictionaryValue(
+	streamBytes []byte,
+	dictState encoderBytesFieldDictState,
+) ([]byte, error) {
+	if dictState.staticBytes != nil {
+		return dictState.staticBytes, nil
+	}
+	if dictState.deltaBytes != nil {
+		return dictState.deltaBytes, nil
+	}
+	if enc.dryRun {
+		return dictState.dryRunBytes, nil
+	}
+
 	var (
 		prevEncodedBytesStart = dictState.startPos
 		prevEncodedBytesEnd   = prevEncodedBytesStart + dictState.length
@@ -788,12 +2460,12 @@ func (enc *Encoder) bytesMatchEncodedDictionaryValue(
 
 	if prevEncodedBytesEnd > uint32(len(streamBytes)) {
 		// Should never happen.
-		return false, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"bytes position in LRU is outside of stream bounds, streamSize: %d, startPos: %d, length: %d",
 			len(streamBytes), prevEncodedBytesStart, dictState.length)
 	}
 
-	return bytes.Equal(streamBytes[prevEncodedBytesStart:prevEncodedBytesEnd], currBytes), nil
+	return streamBytes[prevEncodedBytesStart:prevEncodedBytesEnd], nil
 }
 
 // padToNextByte will add padding bits in the current byte until the ostream
@@ -824,7 +2496,7 @@ func (enc *Encoder) moveToEndOfBytesDict(fieldIdx, i int) {
 
 func (enc *Encoder) addToBytesDict(fieldIdx int, state encoderBytesFieldDictState) {
 	existing := enc.customFields[fieldIdx].bytesFieldDict
-	if len(existing) < enc.opts.ByteFieldDictionaryLRUSize() {
+	if len(existing) < enc.byteFieldDictionaryLRUSize() {
 		enc.customFields[fieldIdx].bytesFieldDict = append(existing, state)
 		return
 	}
@@ -847,11 +2519,25 @@ func (enc *Encoder) addToBytesDict(fieldIdx int, state encoderBytesFieldDictStat
 	}
 
 	existing[len(existing)-1] = state
+	enc.customFields[fieldIdx].bytesFieldDictEvictions++
+}
+
+// addToInternedBytes interns a value that was not interned yet if the maximum number of
+// interned values of the field has not been reached, the state refers to the same bytes as
+// the dictionary entry of the value.
+func (enc *Encoder) addToInternedBytes(fieldIdx int, state encoderBytesFieldDictState) {
+	if !enc.streamFeatures.has(streamFeatureInternedBytes) {
+		return
+	}
+	existing := enc.customFields[fieldIdx].internedBytes
+	if len(existing) < enc.maxInternedBytesValues() {
+		enc.customFields[fieldIdx].internedBytes = append(existing, state)
+	}
 }
 
 // encodeBitset writes out a bitset in the form of:
 //
-//      varint(number of bits)|bitset
+//	varint(number of bits)|bitset
 //
 // I.E first it encodes a varint which specifies the number of following
 // bits to interpret as a bitset and then it encodes the provided values
@@ -904,7 +2590,7 @@ func (enc *Encoder) encodeVarInt(x uint64) {
 }
 
 func (enc *Encoder) newBuffer(capacity int) checked.Bytes {
-	if bytesPool := enc.opts.BytesPool(); bytesPool != nil {
+	if bytesPool := enc.opts.EncodingOptions().BytesPool(); bytesPool != nil {
 		return bytesPool.Get(capacity)
 	}
 	return checked.NewBytes(make([]byte, 0, capacity), nil)
@@ -915,8 +2601,24 @@ func (enc *Encoder) newBuffer(capacity int) checked.Bytes {
 // they are all the same.
 var tails [256]checked.Bytes
 
+// endOfStreamMarkerTails is a list of all possible tails for streams
+// that are terminated with an end-of-stream marker, indexed by the
+// number of bits used in the last byte (minus one) and then by the
+// byte value of the last byte.
+var endOfStreamMarkerTails [8][256]checked.Bytes
+
 func init() {
 	for i := 0; i < 256; i++ {
 		tails[i] = checked.NewBytes([]byte{byte(i)}, nil)
 	}
+
+	for pos := 1; pos <= 8; pos++ {
+		for i := 0; i < 256; i++ {
+			stream := encoding.NewOStream(nil, true, nil)
+			stream.WriteBits(uint64(i>>uint(8-pos)), pos)
+			writeEndOfStreamMarker(stream)
+			tail, _ := stream.Rawbytes()
+			endOfStreamMarkerTails[pos-1][i] = checked.NewBytes(tail, nil)
+		}
+	}
 }
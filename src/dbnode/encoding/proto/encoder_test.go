@@ -21,16 +21,29 @@
 package proto
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/m3db/m3/src/dbnode/encoding"
 	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/tracepoint"
 	"github.com/m3db/m3/src/dbnode/ts"
 	"github.com/m3db/m3/src/x/context"
 	xtime "github.com/m3db/m3/src/x/time"
 
 	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/jhump/protoreflect/dynamic"
+	opentracingext "github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -73,12 +86,129 @@ func TestCustomAndProtoFields(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		tszFields, nonCustomFields := customAndNonCustomFields(nil, nil, tc.schema)
+		tszFields, nonCustomFields := customAndNonCustomFields(nil, nil, tc.schema, false)
 		require.Equal(t, tc.expectedCustomFields, tszFields)
 		require.Equal(t, tc.expectedNonCustomFields, nonCustomFields)
 	}
 }
 
+func TestEncoderCustomFields(t *testing.T) {
+	enc := newTestEncoder(time.Now().Truncate(time.Second))
+	require.Equal(t, []CustomFieldInfo{}, enc.CustomFields())
+
+	enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+	require.Equal(t, []CustomFieldInfo{
+		{FieldNum: 1, ProtoType: dpb.FieldDescriptorProto_TYPE_DOUBLE, CustomType: "float64"},
+		{FieldNum: 2, ProtoType: dpb.FieldDescriptorProto_TYPE_DOUBLE, CustomType: "float64"},
+		{FieldNum: 3, ProtoType: dpb.FieldDescriptorProto_TYPE_INT64, CustomType: "int64"},
+		{FieldNum: 4, ProtoType: dpb.FieldDescriptorProto_TYPE_BYTES, CustomType: "bytes"},
+	}, enc.CustomFields())
+
+	// The returned fields are a copy of the encoder's state.
+	fields := enc.CustomFields()
+	fields[0].FieldNum = 100
+	require.Equal(t, 1, enc.CustomFields()[0].FieldNum)
+}
+
+// newShuffledSchema returns a schema whose fields are declared in a random order.
+func newShuffledSchema(t *testing.T, rng *rand.Rand) *desc.MessageDescriptor {
+	fields := []*builder.FieldBuilder{
+		builder.NewField("latitude", builder.FieldTypeDouble()).SetNumber(1),
+		builder.NewField("count", builder.FieldTypeInt64()).SetNumber(2),
+		builder.NewField("host", builder.FieldTypeString()).SetNumber(3),
+		builder.NewField("ids", builder.FieldTypeInt32()).SetRepeated().SetNumber(4),
+		builder.NewField("ok", builder.FieldTypeBool()).SetNumber(5),
+		builder.NewField("flags", builder.FieldTypeUInt32()).SetNumber(9),
+		builder.NewField("tags", builder.FieldTypeString()).SetRepeated().SetNumber(12),
+		builder.NewField("load", builder.FieldTypeFloat()).SetNumber(20),
+	}
+	rng.Shuffle(len(fields), func(i, j int) {
+		fields[i], fields[j] = fields[j], fields[i]
+	})
+
+	msg := builder.NewMessage("Shuffled")
+	for _, field := range fields {
+		msg.AddField(field)
+	}
+	schema, err := msg.Build()
+	require.NoError(t, err)
+	return schema
+}
+
+func TestCustomAndProtoFieldsIndependentOfDeclarationOrder(t *testing.T) {
+	var (
+		rng                                     = rand.New(rand.NewSource(0))
+		expectedCustomFields, expectedNonCustom = customAndNonCustomFields(
+			nil, nil, newShuffledSchema(t, rng), false)
+	)
+	for i := 0; i < 20; i++ {
+		customFields, nonCustomFields := customAndNonCustomFields(nil, nil, newShuffledSchema(t, rng), false)
+		require.Equal(t, expectedCustomFields, customFields)
+		require.Equal(t, expectedNonCustom, nonCustomFields)
+	}
+
+	var customFieldNums []int
+	for _, customField := range expectedCustomFields {
+		customFieldNums = append(customFieldNums, customField.fieldNum)
+	}
+	require.Equal(t, []int{1, 2, 3, 5, 9, 20}, customFieldNums)
+	require.Equal(t, []marshalledField{{fieldNum: 4}, {fieldNum: 12}}, expectedNonCustom)
+}
+
+func TestEncoderStreamIndependentOfFieldDeclarationOrder(t *testing.T) {
+	var (
+		rng        = rand.New(rand.NewSource(0))
+		start      = time.Now().Truncate(time.Second)
+		newMessage = func(schema *desc.MessageDescriptor, i int) *dynamic.Message {
+			m := dynamic.NewMessage(schema)
+			m.SetFieldByNumber(1, float64(i)+0.5)
+			m.SetFieldByNumber(2, int64(i*i+1))
+			m.SetFieldByNumber(3, fmt.Sprintf("host-%d", i%3))
+			m.SetFieldByNumber(4, []int32{int32(i), 7})
+			m.SetFieldByNumber(5, true)
+			m.SetFieldByNumber(9, uint32(i/4+1))
+			m.SetFieldByNumber(12, []string{"a", fmt.Sprintf("tag-%d", i/5)})
+			m.SetFieldByNumber(20, float32(i+1)/4)
+			return m
+		}
+		encode = func(schema *desc.MessageDescriptor) []byte {
+			enc := NewEncoder(start, testEncodingOptions.SetSchemaHash(true))
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+			for i := 0; i < 10; i++ {
+				marshalled, err := newMessage(schema, i).Marshal()
+				require.NoError(t, err)
+
+				dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+				require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+			}
+			ctx := context.NewContext()
+			defer ctx.Close()
+			return getCurrEncoderBytes(ctx, t, enc)
+		}
+		expected = encode(newShuffledSchema(t, rng))
+	)
+	for i := 0; i < 20; i++ {
+		require.Equal(t, expected, encode(newShuffledSchema(t, rng)), "shuffle %d", i)
+	}
+
+	// The stream can be decoded with the schema declared in any order too.
+	var (
+		schema = newShuffledSchema(t, rng)
+		iter   = NewIterator(bytes.NewReader(expected), namespace.GetTestSchemaDescr(schema), testEncodingOptions)
+		i      = 0
+	)
+	defer iter.Close()
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		decoded := dynamic.NewMessage(schema)
+		require.NoError(t, decoded.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(newMessage(schema, i), decoded), "write %d", i)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, 10, i)
+}
+
 func TestClosedEncoderIsNotUsable(t *testing.T) {
 	enc := newTestEncoder(time.Now().Truncate(time.Second))
 	enc.Close()
@@ -88,6 +218,9 @@ func TestClosedEncoderIsNotUsable(t *testing.T) {
 
 	_, err = enc.LastEncoded()
 	require.Equal(t, errEncoderClosed, err)
+
+	_, err = enc.LastEncodedMessage()
+	require.Equal(t, errEncoderClosed, err)
 }
 
 func TestEncoderIsNotCorruptedByInvalidWrites(t *testing.T) {
@@ -118,6 +251,644 @@ func TestEncoderIsNotCorruptedByInvalidWrites(t *testing.T) {
 	require.Equal(t, bytesBeforeBadWrite, bytesAfterBadWrite)
 }
 
+func TestEncoderInvalidCustomFieldsAsDefault(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	vl := newVL(1.0, 2.0, 3, []byte("some-delivery-id"), nil)
+	vlBytes, err := vl.Marshal()
+	require.NoError(t, err)
+	// Latitude (double) with a length-delimited value and deliveryID (bytes) with a
+	// varint value, neither of which can be interpreted according to the schema.
+	invalidBytes := append(append([]byte(nil), vlBytes...), 1<<3|2, 1, 'x', 4<<3|0, 5)
+	// The length of the value extends beyond the end of the message.
+	truncatedBytes := append(append([]byte(nil), vlBytes...), 1<<3|2, 5, 'x')
+
+	var (
+		start       = time.Now().Truncate(time.Second)
+		schemaDescr = namespace.GetTestSchemaDescr(testVLSchema)
+		dp          = ts.Datapoint{Timestamp: start.Add(time.Second)}
+	)
+	enc := newTestEncoder(start)
+	enc.SetSchema(schemaDescr)
+	require.Error(t, enc.Encode(dp, xtime.Second, invalidBytes))
+
+	opts := testEncodingOptions.SetInvalidCustomFieldsAsDefault(true)
+	enc = NewEncoder(start, opts)
+	enc.Reset(start, 0, schemaDescr)
+	require.Error(t, enc.Encode(dp, xtime.Second, truncatedBytes))
+	require.NoError(t, enc.Encode(dp, xtime.Second, invalidBytes))
+
+	stream, ok := enc.Stream(ctx)
+	require.True(t, ok)
+	iter := NewIterator(stream, schemaDescr, opts)
+	require.True(t, iter.Next())
+	_, _, annotation := iter.Current()
+	decoded := dynamic.NewMessage(testVLSchema)
+	require.NoError(t, decoded.Unmarshal(annotation))
+	require.True(t, dynamic.Equal(newVL(0, 2.0, 3, nil, nil), decoded))
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+}
+
+func TestEncoderStatsBytesFieldDictionaryEvictions(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	enc := newTestEncoder(start)
+	enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+
+	lruSize := testEncodingOptions.EncodingOptions().ByteFieldDictionaryLRUSize()
+	numUniqueValues := lruSize + 3
+	for i := 0; i < numUniqueValues; i++ {
+		vl := newVL(1.0, 2.0, 3, []byte(fmt.Sprintf("delivery-id-%d", i)), nil)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+	}
+
+	// Field number 4 is deliveryID which is the only bytes field in the schema.
+	stats := enc.Stats()
+	require.Equal(t, map[int]int{4: numUniqueValues - lruSize}, stats.BytesFieldDictionaryEvictions)
+
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	require.Equal(t, map[int]int{4: 0}, enc.Stats().BytesFieldDictionaryEvictions)
+}
+
+func TestEncoderMemSize(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	enc := NewEncoder(start, testEncodingOptions.SetRetainLastEncodedMessage(true))
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	emptySize := enc.MemSize()
+
+	largeAttributes := map[string]string{"key": strings.Repeat("a", 4096)}
+	for i := 0; i < 10; i++ {
+		vl := newVL(1.0, 2.0, 3, []byte(fmt.Sprintf("delivery-id-%d", i)), largeAttributes)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+	}
+
+	// The stream, the last encoded message and the marshalled attributes are all
+	// retained by the encoder.
+	encodedSize := enc.MemSize()
+	require.True(t, encodedSize >= emptySize+enc.Len()+2*4096,
+		"empty: %d, encoded: %d, stream: %d", emptySize, encodedSize, enc.Len())
+
+	// The stream buffer is replaced on reset, but the buffers of the fields are
+	// truncated and kept for reuse.
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	resetSize := enc.MemSize()
+	require.True(t, resetSize < encodedSize, "encoded: %d, reset: %d", encodedSize, resetSize)
+	require.True(t, resetSize > emptySize+4096, "empty: %d, reset: %d", emptySize, resetSize)
+}
+
+func TestEncoderResetTrimsOversizedBuffers(t *testing.T) {
+	var (
+		start           = time.Now().Truncate(time.Second)
+		largeAttributes = map[string]string{"key": strings.Repeat("a", 4096)}
+		smallAttributes = map[string]string{"key": "a"}
+	)
+	for _, maxCapacity := range []int{0, 1024} {
+		t.Run(fmt.Sprintf("maxCapacity=%d", maxCapacity), func(t *testing.T) {
+			opts := testEncodingOptions.
+				SetMaxRetainedBufferCapacity(maxCapacity).
+				SetMapFieldDiffs(true).
+				SetRetainLastEncodedMessage(true)
+			enc := NewEncoder(start, opts)
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+			for i, attributes := range []map[string]string{smallAttributes, largeAttributes} {
+				vl := newVL(1.0, 2.0, 3, []byte("delivery-id"), attributes)
+				vlBytes, err := vl.Marshal()
+				require.NoError(t, err)
+
+				dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+				require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+			}
+
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+			if maxCapacity == 0 {
+				require.True(t, cap(enc.lastEncodedBytes) > 4096)
+				require.True(t, cap(enc.mapFieldDiff.upserts) > 4096)
+				return
+			}
+			require.True(t, cap(enc.lastEncodedBytes) <= maxCapacity)
+			require.True(t, enc.mapFieldDiff.memSize() <= 4*maxCapacity)
+		})
+	}
+}
+
+func TestEncoderSetByteFieldDictionaryLRUSize(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		enc     = newTestEncoder(start)
+		lruSize = testEncodingOptions.EncodingOptions().ByteFieldDictionaryLRUSize() + 2
+		schema  = namespace.GetTestSchemaDescr(testVLSchema)
+	)
+	require.Equal(t, errEncoderInvalidLRUSize, enc.SetByteFieldDictionaryLRUSize(0))
+	require.NoError(t, enc.SetByteFieldDictionaryLRUSize(lruSize))
+	// Should be retained across resets.
+	enc.Reset(start, 0, schema)
+
+	var expected []string
+	numUniqueValues := lruSize + 3
+	for i := 0; i < numUniqueValues; i++ {
+		vl := newVL(1.0, 2.0, 3, []byte(fmt.Sprintf("delivery-id-%d", i)), nil)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+		expected = append(expected, fmt.Sprintf("delivery-id-%d", i))
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+	}
+	require.Equal(t, errEncoderLRUSizeAfterEncode, enc.SetByteFieldDictionaryLRUSize(lruSize))
+	require.Equal(t, map[int]int{4: numUniqueValues - lruSize}, enc.Stats().BytesFieldDictionaryEvictions)
+
+	stream, ok := enc.Stream(ctx)
+	require.True(t, ok)
+	iter := NewIterator(stream, schema, testEncodingOptions)
+	var i int
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.Equal(t, []byte(expected[i]), m.GetFieldByNumber(4))
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, numUniqueValues, i)
+	require.Equal(t, lruSize, iter.(*iterator).byteFieldDictLRUSize)
+}
+
+func TestIsDefaultMarshalledValue(t *testing.T) {
+	nestedBuilder := builder.NewMessage("Nested").
+		AddField(builder.NewField("payload", builder.FieldTypeString()).SetNumber(1))
+	schema, err := builder.NewMessage("Defaults").
+		AddField(builder.NewField("ints", builder.FieldTypeInt64()).SetRepeated().SetNumber(1)).
+		AddField(builder.NewField("strs", builder.FieldTypeString()).SetRepeated().SetNumber(2)).
+		AddField(builder.NewMapField("m", builder.FieldTypeString(), builder.FieldTypeInt64()).SetNumber(3)).
+		AddField(builder.NewField("nested", builder.FieldTypeMessage(nestedBuilder)).SetNumber(4)).
+		Build()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		title      string
+		fieldNum   int32
+		marshalled []byte
+		expected   bool
+	}{
+		{title: "absent repeated", fieldNum: 1, expected: true},
+		{title: "empty packed repeated", fieldNum: 1, marshalled: []byte{1<<3 | 2, 0}, expected: true},
+		{title: "multiple empty packed repeated", fieldNum: 1, marshalled: []byte{1<<3 | 2, 0, 1<<3 | 2, 0}, expected: true},
+		{title: "non-empty packed repeated", fieldNum: 1, marshalled: []byte{1<<3 | 2, 1, 1}},
+		{title: "unpacked repeated zero", fieldNum: 1, marshalled: []byte{1 << 3, 0}},
+		{title: "truncated packed repeated", fieldNum: 1, marshalled: []byte{1<<3 | 2}},
+		{title: "repeated empty string", fieldNum: 2, marshalled: []byte{2<<3 | 2, 0}},
+		{title: "absent map", fieldNum: 3, expected: true},
+		{title: "map with zero value entry", fieldNum: 3, marshalled: []byte{3<<3 | 2, 0}},
+		{title: "absent nested message", fieldNum: 4, expected: true},
+		{title: "set but empty nested message", fieldNum: 4, marshalled: []byte{4<<3 | 2, 0}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.title, func(t *testing.T) {
+			field := schema.FindFieldByNumber(tc.fieldNum)
+			require.Equal(t, tc.expected, isDefaultMarshalledValue(field, tc.marshalled))
+		})
+	}
+}
+
+func TestEncoderOnlyEncodesChangedNonCustomFields(t *testing.T) {
+	nestedBuilder := builder.NewMessage("Blob").
+		AddField(builder.NewField("payload", builder.FieldTypeString()).SetNumber(1))
+	schema, err := builder.NewMessage("MixedVolatility").
+		AddField(builder.NewField("blob", builder.FieldTypeMessage(nestedBuilder)).SetNumber(1)).
+		AddField(builder.NewField("counters", builder.FieldTypeInt64()).SetRepeated().SetNumber(2)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		enc     = newTestEncoder(start)
+		payload = strings.Repeat("a", 1024)
+		blob    = dynamic.NewMessage(schema.FindFieldByNumber(1).GetMessageType())
+	)
+	enc.SetSchema(namespace.GetTestSchemaDescr(schema))
+	blob.SetFieldByNumber(1, payload)
+
+	var prevLen int
+	for i := 0; i < 10; i++ {
+		m := dynamic.NewMessage(schema)
+		m.SetFieldByNumber(1, blob)
+		m.SetFieldByNumber(2, []int64{int64(i)})
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+
+		if i > 0 {
+			// Only the changed repeated field should have been written, not the
+			// (unchanged) large nested message.
+			require.True(t, enc.Len()-prevLen < len(payload)/10,
+				"expected small delta but stream grew by %d bytes", enc.Len()-prevLen)
+		}
+		prevLen = enc.Len()
+	}
+}
+
+func TestEncoderUnchangedMapInDifferentOrder(t *testing.T) {
+	var (
+		start   = time.Now().Truncate(time.Second)
+		ordered = newTestEncoder(start)
+		swapped = newTestEncoder(start)
+		schema  = namespace.GetTestSchemaDescr(testVLSchema)
+	)
+	ordered.SetSchema(schema)
+	swapped.SetSchema(schema)
+
+	marshalAttrs := func(attrs map[string]string) []byte {
+		m := dynamic.NewMessage(testVLSchema)
+		m.SetFieldByName("attributes", attrs)
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+		return marshalled
+	}
+	base, err := newVL(1.0, 2.0, 3, []byte("delivery-id"), nil).Marshal()
+	require.NoError(t, err)
+	var (
+		a  = marshalAttrs(map[string]string{"a": "1"})
+		b  = marshalAttrs(map[string]string{"b": "2"})
+		ab = append(append(append([]byte(nil), base...), a...), b...)
+		ba = append(append(append([]byte(nil), base...), b...), a...)
+	)
+
+	for i, marshalled := range [][]byte{ab, ba} {
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, ordered.Encode(dp, xtime.Second, ab))
+		require.NoError(t, swapped.Encode(dp, xtime.Second, marshalled))
+	}
+	// The same entries in a different order are not a change.
+	require.Equal(t, ordered.Len(), swapped.Len())
+}
+
+func TestEncoderDryRun(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	var (
+		start  = time.Now().Truncate(time.Second)
+		enc    = newTestEncoder(start)
+		dryRun = newTestEncoder(start)
+	)
+	enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+	dryRun.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+	require.NoError(t, dryRun.SetDryRun(true))
+
+	// Encode enough data for the dry-run stream to be compacted multiple times and
+	// make sure that the bytes dictionary is exercised along the way.
+	for i := 0; i < 1000; i++ {
+		deliveryID := []byte(fmt.Sprintf("delivery-id-%d", i%7))
+		if i%3 == 0 {
+			deliveryID = []byte(fmt.Sprintf("unique-delivery-id-%d", i))
+		}
+		vl := newVL(float64(i), float64(i%5), int64(i/10), deliveryID, nil)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+		require.NoError(t, dryRun.Encode(dp, xtime.Second, vlBytes))
+	}
+
+	require.Equal(t, enc.Stats(), dryRun.Stats())
+	require.True(t, dryRun.Len() < enc.Len()/2,
+		"dry-run stream was not compacted: %d bytes", dryRun.Len())
+	require.Equal(t, errEncoderDryRunAfterEncode, dryRun.SetDryRun(false))
+
+	_, ok := dryRun.Stream(ctx)
+	require.False(t, ok)
+	seg := dryRun.Discard()
+	require.Equal(t, 0, seg.Len())
+
+	// The encoder must be usable as normal after being reset.
+	dryRun = newTestEncoder(start)
+	dryRun.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+	require.NoError(t, dryRun.SetDryRun(true))
+	dryRun.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	vlBytes, err := newVL(1.0, 2.0, 3, []byte("some-delivery-id"), nil).Marshal()
+	require.NoError(t, err)
+	require.NoError(t, dryRun.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+	_, ok = dryRun.Stream(ctx)
+	require.True(t, ok)
+}
+
+func TestEncoderWriteTo(t *testing.T) {
+	for _, endOfStreamMarker := range []bool{false, true} {
+		t.Run(fmt.Sprintf("endOfStreamMarker=%v", endOfStreamMarker), func(t *testing.T) {
+			ctx := context.NewContext()
+			defer ctx.Close()
+
+			var (
+				start = time.Now().Truncate(time.Second)
+				opts  = testEncodingOptions.SetEndOfStreamMarker(endOfStreamMarker)
+				enc   = NewEncoder(start, opts)
+				buf   bytes.Buffer
+			)
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+			n, err := enc.WriteTo(&buf)
+			require.NoError(t, err)
+			require.Equal(t, int64(0), n)
+
+			for i := 0; i < 10; i++ {
+				vl := newVL(float64(i), 2.0, int64(i), []byte(fmt.Sprintf("delivery-id-%d", i%3)), nil)
+				vlBytes, err := vl.Marshal()
+				require.NoError(t, err)
+
+				dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+				require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+
+				buf.Reset()
+				n, err := enc.WriteTo(&buf)
+				require.NoError(t, err)
+				require.Equal(t, int64(buf.Len()), n)
+				require.Equal(t, getCurrEncoderBytes(ctx, t, enc), buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestEncoderSnapshotWhileEncoding(t *testing.T) {
+	var (
+		start = time.Now().Truncate(time.Second)
+		opts  = testEncodingOptions.
+			SetEndOfStreamMarker(true).
+			SetBytesDictResets(true)
+		schema  = namespace.GetTestSchemaDescr(testVLSchema)
+		enc     = NewEncoder(start, opts)
+		written []*dynamic.Message
+		encoded [][]byte
+	)
+	enc.Reset(start, 0, schema)
+	_, ok := enc.Snapshot()
+	require.False(t, ok)
+
+	for i := 0; i < 500; i++ {
+		vl := newVL(float64(i+1), 2, int64(i+1), []byte(fmt.Sprintf("delivery-id-%d", i%7)), nil)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+		encoded = append(encoded, vlBytes)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		for i, vlBytes := range encoded {
+			if i > 0 && i%50 == 0 {
+				if err := enc.ResetBytesDictionaries(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			if err := enc.Encode(dp, xtime.Second, vlBytes); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	// Every snapshot must be a valid stream that contains a prefix of the writes.
+	var (
+		prevNumDecoded int
+		done           bool
+	)
+	for !done {
+		select {
+		case err := <-errCh:
+			require.NoError(t, err)
+			done = true
+		default:
+		}
+
+		reader, ok := enc.Snapshot()
+		if !ok {
+			continue
+		}
+		iter := NewIterator(reader, schema, opts)
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.True(t, i >= prevNumDecoded)
+		prevNumDecoded = i
+		iter.Close()
+		reader.Finalize()
+	}
+	require.Equal(t, len(written), prevNumDecoded)
+}
+
+func TestEncoderPrimeBytesDict(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	enc := NewEncoder(start, testEncodingOptions)
+	require.Equal(t, errEncoderSchemaIsRequired, enc.PrimeBytesDict(4, nil))
+
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	// Only custom encoded bytes fields have a dictionary.
+	for _, fieldNum := range []int{1, 5, 6} {
+		require.Error(t, enc.PrimeBytesDict(fieldNum, [][]byte{[]byte("a")}))
+	}
+	require.NoError(t, enc.PrimeBytesDict(4, [][]byte{[]byte("a")}))
+	require.NotEmpty(t, enc.primedBytesDicts)
+
+	// Primed values are discarded on reset.
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	require.Empty(t, enc.primedBytesDicts)
+}
+
+func TestEncoderTracing(t *testing.T) {
+	var (
+		start  = time.Now().Truncate(time.Second)
+		tracer = mocktracer.New()
+		enc    = NewEncoder(start, testEncodingOptions.SetTracer(tracer))
+	)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+	vl := newVL(1.5, 2, 3, []byte("some-delivery-id"), nil)
+	vlBytes, err := vl.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 4)
+	parent := spans[len(spans)-1]
+	require.Equal(t, tracepoint.ProtoEncoderEncode, parent.OperationName)
+	for i, operationName := range []string{
+		tracepoint.ProtoEncoderUnmarshal,
+		tracepoint.ProtoEncoderEncodeCustomValues,
+		tracepoint.ProtoEncoderMarshalNonCustomValues,
+	} {
+		require.Equal(t, operationName, spans[i].OperationName)
+		require.Equal(t, parent.SpanContext.SpanID, spans[i].ParentID)
+	}
+
+	require.Empty(t, parent.Logs())
+	require.Equal(t, map[string]interface{}{
+		"messageSize":     len(vlBytes),
+		"numCustomFields": len(enc.customFields),
+	}, parent.Tags())
+
+	// Errors are logged and tagged on the span of the phase that failed.
+	tracer.Reset()
+	require.Error(t, enc.Encode(ts.Datapoint{Timestamp: start.Add(time.Second)}, xtime.Second, []byte{0xff}))
+	spans = tracer.FinishedSpans()
+	require.Len(t, spans, 2)
+	require.Equal(t, tracepoint.ProtoEncoderUnmarshal, spans[0].OperationName)
+	require.Len(t, spans[0].Logs(), 1)
+	require.Equal(t, "error", spans[0].Logs()[0].Fields[0].Key)
+	require.Equal(t, true, spans[0].Tag(string(opentracingext.Error)))
+	require.Equal(t, tracepoint.ProtoEncoderEncode, spans[1].OperationName)
+
+	// No spans are created once the tracer is unset.
+	tracer.Reset()
+	enc = NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+	require.Empty(t, tracer.FinishedSpans())
+}
+
+func TestEncoderTargetEncodingSchemeVersion(t *testing.T) {
+	vlBytes, err := newVL(1.5, 2, 3, []byte("some-delivery-id"), nil).Marshal()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		opts            Options
+		expectedVersion int
+		expectErr       bool
+	}{
+		{
+			name:            "latest",
+			opts:            testEncodingOptions.SetEndOfStreamMarker(true),
+			expectedVersion: streamFeaturesEncodingSchemeVersion,
+		},
+		{
+			name:            "base version without stream features",
+			opts:            testEncodingOptions.SetTargetEncodingSchemeVersion(baseEncodingSchemeVersion),
+			expectedVersion: baseEncodingSchemeVersion,
+		},
+		{
+			name: "base version with stream features",
+			opts: testEncodingOptions.
+				SetTargetEncodingSchemeVersion(baseEncodingSchemeVersion).
+				SetEndOfStreamMarker(true),
+			expectErr: true,
+		},
+		{
+			name: "stream features version with stream features",
+			opts: testEncodingOptions.
+				SetTargetEncodingSchemeVersion(streamFeaturesEncodingSchemeVersion).
+				SetEndOfStreamMarker(true),
+			expectedVersion: streamFeaturesEncodingSchemeVersion,
+		},
+		{
+			name: "stream features version with compact header",
+			opts: testEncodingOptions.
+				SetTargetEncodingSchemeVersion(streamFeaturesEncodingSchemeVersion).
+				SetCompactHeader(true),
+			expectErr: true,
+		},
+		{
+			name: "compact header version with compact header",
+			opts: testEncodingOptions.
+				SetTargetEncodingSchemeVersion(compactHeaderEncodingSchemeVersion).
+				SetCompactHeader(true),
+			expectedVersion: baseEncodingSchemeVersion,
+		},
+		{
+			name:      "unknown version",
+			opts:      testEncodingOptions.SetTargetEncodingSchemeVersion(latestEncodingSchemeVersion + 1),
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now().Truncate(time.Second)
+			enc := NewEncoder(start, tt.opts)
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+			err := enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes)
+			if tt.expectErr {
+				require.Error(t, err)
+				require.Equal(t, 0, enc.NumEncoded())
+				return
+			}
+			require.NoError(t, err)
+
+			b, err := enc.Bytes()
+			require.NoError(t, err)
+			header, err := ReadStreamHeader(bytes.NewReader(b), tt.opts)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedVersion, header.Version)
+		})
+	}
+}
+
+func TestEncoderLastEncodedMessage(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	enc := NewEncoder(start, testEncodingOptions.SetRetainLastEncodedMessage(true))
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+	_, err := enc.LastEncodedMessage()
+	require.Equal(t, errNoEncodedDatapoints, err)
+
+	for i := 0; i < 5; i++ {
+		vl := newVL(float64(i), 2.0, int64(i), []byte(fmt.Sprintf("delivery-id-%d", i%2)),
+			map[string]string{"key": fmt.Sprintf("val-%d", i)})
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+
+		lastEncoded, err := enc.LastEncodedMessage()
+		require.NoError(t, err)
+		require.True(t, dynamic.Equal(vl, lastEncoded))
+
+		// Mutating the returned message must not affect the encoder.
+		lastEncoded.SetFieldByName("latitude", float64(-1))
+		lastEncoded.SetFieldByName("attributes", map[string]string{"other": "val"})
+		lastEncoded, err = enc.LastEncodedMessage()
+		require.NoError(t, err)
+		require.True(t, dynamic.Equal(vl, lastEncoded))
+	}
+
+	// Invalid writes do not change the last encoded message.
+	vl := newVL(4.0, 2.0, 4, []byte("delivery-id-0"), map[string]string{"key": "val-4"})
+	require.Error(t, enc.Encode(ts.Datapoint{Timestamp: start.Add(time.Minute)}, xtime.Second, []byte("not a proto")))
+	lastEncoded, err := enc.LastEncodedMessage()
+	require.NoError(t, err)
+	require.True(t, dynamic.Equal(vl, lastEncoded))
+
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	_, err = enc.LastEncodedMessage()
+	require.Equal(t, errNoEncodedDatapoints, err)
+}
+
 func getCurrEncoderBytes(ctx context.Context, t *testing.T, enc *Encoder) []byte {
 	stream, ok := enc.Stream(ctx)
 	require.True(t, ok)
@@ -131,3 +902,545 @@ func getCurrEncoderBytes(ctx context.Context, t *testing.T, enc *Encoder) []byte
 	}
 	return result
 }
+
+func TestEncoderEncodeDelta(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	start := time.Now().Truncate(time.Second)
+	var (
+		fullEnc  = newTestEncoder(start)
+		deltaEnc = NewEncoder(start, testEncodingOptions.SetRetainLastEncodedMessage(true))
+		schema   = namespace.GetTestSchemaDescr(testVLSchema)
+		messages = []*dynamic.Message{
+			newVL(1.5, 2.5, 10, []byte("delivery-1"), map[string]string{"a": "b"}),
+			newVL(1.5, 3.5, 10, []byte("delivery-1"), map[string]string{"a": "b"}),
+			newVL(2.5, 3.5, 11, nil, map[string]string{"a": "b", "c": "d"}),
+			newVL(2.5, 3.5, 11, nil, nil),
+			newVL(2.5, 3.5, 11, []byte("delivery-2"), map[string]string{"e": "f"}),
+			newVL(2.5, 3.5, 11, []byte("delivery-2"), map[string]string{"e": "f"}),
+		}
+	)
+	fullEnc.SetSchema(schema)
+	deltaEnc.Reset(start, 0, schema)
+
+	prev := dynamic.NewMessage(testVLSchema)
+	for i, m := range messages {
+		var (
+			delta   = dynamic.NewMessage(testVLSchema)
+			cleared []int32
+		)
+		for _, field := range testVLSchema.GetFields() {
+			switch {
+			case m.HasField(field) &&
+				(!prev.HasField(field) || !reflect.DeepEqual(prev.GetField(field), m.GetField(field))):
+				delta.SetField(field, m.GetField(field))
+			case prev.HasField(field) && !m.HasField(field):
+				cleared = append(cleared, field.GetNumber())
+			}
+		}
+		if i == 1 {
+			// Fields that are part of the delta even though they didn't change are
+			// encoded as changes rather than being compared against their previous value.
+			delta.SetFieldByName("attributes", map[string]string{"a": "b"})
+		}
+
+		fullBytes, err := m.Marshal()
+		require.NoError(t, err)
+		deltaBytes, err := delta.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, fullEnc.Encode(dp, xtime.Second, fullBytes))
+		require.NoError(t, deltaEnc.EncodeDelta(dp, xtime.Second, deltaBytes, cleared))
+
+		lastEncoded, err := deltaEnc.LastEncodedMessage()
+		require.NoError(t, err)
+		require.True(t, dynamic.MessagesEqual(m, lastEncoded))
+
+		prev = m
+	}
+
+	iter := NewIterator(bytes.NewReader(getCurrEncoderBytes(ctx, t, deltaEnc)), schema, testEncodingOptions)
+	for i, expected := range messages {
+		require.True(t, iter.Next(), "iter err: %v", iter.Err())
+		dp, _, annotation := iter.Current()
+		require.Equal(t, start.Add(time.Duration(i)*time.Second), dp.Timestamp)
+
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(expected, m), "message %d", i)
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+
+	// The attributes that were part of the second delta without changing were encoded
+	// again whereas they were compared against their previous value for the complete messages.
+	require.True(t, len(getCurrEncoderBytes(ctx, t, deltaEnc)) > len(getCurrEncoderBytes(ctx, t, fullEnc)))
+}
+
+func TestEncoderEncodeDeltaMapFieldDiffs(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	enc := NewEncoder(start, testEncodingOptions.SetMapFieldDiffs(true))
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+	delta, err := newVL(1.5, 2.5, 10, nil, nil).Marshal()
+	require.NoError(t, err)
+	err = enc.EncodeDelta(ts.Datapoint{Timestamp: start}, xtime.Second, delta, nil)
+	require.Equal(t, errEncoderDeltaMapFieldDiffs, err)
+}
+
+func TestEncoderLastEncodedMessageNotRetainedByDefault(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	enc := newTestEncoder(start)
+	enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+
+	vlBytes, err := newVL(1.5, 2.5, 10, nil, nil).Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+	require.Nil(t, enc.lastEncodedBytes)
+
+	_, err = enc.LastEncodedMessage()
+	require.Equal(t, errEncoderLastEncodedMessageNotRetained, err)
+	err = enc.EncodeDelta(ts.Datapoint{Timestamp: start.Add(time.Second)}, xtime.Second, vlBytes, nil)
+	require.Equal(t, errEncoderLastEncodedMessageNotRetained, err)
+}
+
+func TestEncoderEncodeWithChangeHints(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	start := time.Now().Truncate(time.Second)
+	messages := []*dynamic.Message{
+		newVL(1.5, 2.5, 10, []byte("delivery-1"), map[string]string{"a": "b"}),
+		newVL(1.5, 3.5, 10, []byte("delivery-1"), map[string]string{"a": "b"}),
+		newVL(2.5, 3.5, 11, nil, map[string]string{"a": "b", "c": "d"}),
+		newVL(2.5, 3.5, 11, nil, nil),
+		newVL(2.5, 3.5, 11, []byte("delivery-2"), map[string]string{"e": "f"}),
+	}
+	for _, mapFieldDiffs := range []bool{false, true} {
+		var (
+			opts     = testEncodingOptions.SetMapFieldDiffs(mapFieldDiffs)
+			schema   = namespace.GetTestSchemaDescr(testVLSchema)
+			fullEnc  = NewEncoder(start, opts)
+			hintsEnc = NewEncoder(start, opts)
+			prev     = dynamic.NewMessage(testVLSchema)
+		)
+		fullEnc.Reset(start, 0, schema)
+		hintsEnc.Reset(start, 0, schema)
+		for i, m := range messages {
+			var changed []int32
+			for _, field := range testVLSchema.GetFields() {
+				if m.HasField(field) != prev.HasField(field) ||
+					!reflect.DeepEqual(prev.GetField(field), m.GetField(field)) {
+					changed = append(changed, field.GetNumber())
+				}
+			}
+
+			mBytes, err := m.Marshal()
+			require.NoError(t, err)
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, fullEnc.Encode(dp, xtime.Second, mBytes))
+			require.NoError(t, hintsEnc.EncodeWithChangeHints(dp, xtime.Second, mBytes, changed))
+			prev = m
+		}
+
+		// Accurate hints produce the same stream as comparing the fields.
+		hintsBytes := getCurrEncoderBytes(ctx, t, hintsEnc)
+		require.Equal(t, getCurrEncoderBytes(ctx, t, fullEnc), hintsBytes)
+		iter := NewIterator(bytes.NewReader(hintsBytes), schema, opts)
+		for i, expected := range messages {
+			require.True(t, iter.Next(), "iter err: %v", iter.Err())
+			dp, _, annotation := iter.Current()
+			require.Equal(t, start.Add(time.Duration(i)*time.Second), dp.Timestamp)
+
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(expected, m), "message %d", i)
+		}
+		require.False(t, iter.Next())
+		require.NoError(t, iter.Err())
+	}
+}
+
+func TestEncoderEncodeWithChangeHintsTrustsHints(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	start := time.Now().Truncate(time.Second)
+	enc := newTestEncoder(start)
+	enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+
+	for i, attrs := range []map[string]string{{"a": "b"}, {"a": "c"}} {
+		vlBytes, err := newVL(1.5, 2.5, 10, nil, attrs).Marshal()
+		require.NoError(t, err)
+		// The attributes changed for the second message but aren't amongst the hints.
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.EncodeWithChangeHints(dp, xtime.Second, vlBytes, nil))
+	}
+
+	// Both messages are decoded with the attributes of the first one.
+	iter := NewIterator(bytes.NewReader(getCurrEncoderBytes(ctx, t, enc)),
+		namespace.GetTestSchemaDescr(testVLSchema), testEncodingOptions)
+	for i := 0; i < 2; i++ {
+		require.True(t, iter.Next(), "iter err: %v", iter.Err())
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.Equal(t, map[interface{}]interface{}{"a": "b"}, m.GetFieldByName("attributes"))
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+}
+
+func TestEncoderFinalize(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	start := time.Now().Truncate(time.Second)
+	enc := newTestEncoder(start)
+	enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+
+	block, err := enc.Finalize()
+	require.NoError(t, err)
+	require.Equal(t, EncodedBlock{Stats: enc.Stats()}, block)
+
+	var lastTime time.Time
+	for i := 0; i < 5; i++ {
+		vl := newVL(float64(i), 2.0, int64(i), []byte(fmt.Sprintf("event-%d", i)), nil)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+		lastTime = start.Add(time.Duration(i) * time.Second)
+		require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: lastTime}, xtime.Second, vlBytes))
+	}
+
+	block, err = enc.Finalize()
+	require.NoError(t, err)
+	require.Equal(t, 5, block.NumEncoded)
+	require.Equal(t, ts.Datapoint{Timestamp: lastTime}, block.LastEncoded)
+	require.Equal(t, enc.Stats(), block.Stats)
+
+	streamBytes := getCurrEncoderBytes(ctx, t, enc)
+	require.Equal(t, streamBytes, append(block.Segment.Head.Bytes(), block.Segment.Tail.Bytes()...))
+	require.True(t, block.NumBits > 8*(len(streamBytes)-1) && block.NumBits <= 8*len(streamBytes),
+		"unexpected number of bits %d for %d bytes", block.NumBits, len(streamBytes))
+	block.Segment.Finalize()
+
+	enc.Close()
+	_, err = enc.Finalize()
+	require.Equal(t, errEncoderClosed, err)
+}
+
+func TestEncoderShouldFlush(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	encodeUntilFlush := func(opts Options) *Encoder {
+		enc := NewEncoder(start, opts)
+		enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+		for i := 0; !enc.ShouldFlush(); i++ {
+			require.True(t, i < 100, "encoder did not need flushing after %d datapoints", i)
+			vl := newVL(float64(i), 2.0, int64(i), []byte(fmt.Sprintf("event-%d", i)), nil)
+			vlBytes, err := vl.Marshal()
+			require.NoError(t, err)
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+		}
+		return enc
+	}
+
+	enc := NewEncoder(start, testEncodingOptions)
+	require.False(t, enc.ShouldFlush())
+
+	enc = encodeUntilFlush(testEncodingOptions.SetFlushMaxDatapoints(5))
+	require.Equal(t, 5, enc.NumEncoded())
+
+	enc = encodeUntilFlush(testEncodingOptions.SetFlushMaxBytes(64))
+	require.True(t, enc.Len() >= 64)
+	require.True(t, enc.NumEncoded() > 1)
+
+	// Whichever threshold is reached first triggers the flush.
+	enc = encodeUntilFlush(testEncodingOptions.
+		SetFlushMaxDatapoints(5).
+		SetFlushMaxBytes(1))
+	require.Equal(t, 1, enc.NumEncoded())
+}
+
+func TestEncoderAppend(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	var (
+		start    = time.Now().Truncate(time.Second)
+		opts     = testEncodingOptions.SetEndOfStreamMarker(true)
+		schema   = namespace.GetTestSchemaDescr(testVLSchema)
+		marshals []ts.Annotation
+	)
+	for i := 0; i < 20; i++ {
+		vl := newVL(float64(i%4), float64(i)*1.5, int64(i*i), []byte(fmt.Sprintf("event-%d", i%3)), nil)
+		vlBytes, err := vl.Marshal()
+		require.NoError(t, err)
+		marshals = append(marshals, vlBytes)
+	}
+	encode := func(from, to int) *Encoder {
+		blockStart := start.Add(time.Duration(from) * time.Second)
+		enc := NewEncoder(blockStart, opts)
+		enc.Reset(blockStart, 0, schema)
+		for i := from; i < to; i++ {
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, marshals[i]))
+		}
+		return enc
+	}
+
+	var (
+		expected = getCurrEncoderBytes(ctx, t, encode(0, 20))
+		enc      = encode(0, 10)
+		other    = encode(10, 20)
+	)
+	otherBytes := getCurrEncoderBytes(ctx, t, other)
+	require.NoError(t, enc.Append(other))
+	require.Equal(t, 20, enc.NumEncoded())
+	// The appended datapoints are encoded as if they had all been encoded by one encoder.
+	require.Equal(t, expected, getCurrEncoderBytes(ctx, t, enc))
+	require.Equal(t, otherBytes, getCurrEncoderBytes(ctx, t, other))
+
+	// Appending an empty encoder is a no-op.
+	require.NoError(t, enc.Append(encode(20, 20)))
+	require.Equal(t, expected, getCurrEncoderBytes(ctx, t, enc))
+
+	// The appended datapoints can't precede the datapoints of the encoder.
+	require.Equal(t, errEncoderAppendOutOfOrder, enc.Append(encode(0, 1)))
+	require.Equal(t, expected, getCurrEncoderBytes(ctx, t, enc))
+
+	dryRun := NewEncoder(start, opts)
+	dryRun.Reset(start, 0, schema)
+	require.NoError(t, dryRun.SetDryRun(true))
+	require.Equal(t, errEncoderAppendDryRun, enc.Append(dryRun))
+}
+
+func TestEncoderWithStream(t *testing.T) {
+	for _, endOfStreamMarker := range []bool{false, true} {
+		t.Run(fmt.Sprintf("endOfStreamMarker=%v", endOfStreamMarker), func(t *testing.T) {
+			var (
+				start    = time.Now().Truncate(time.Second)
+				opts     = testEncodingOptions.SetEndOfStreamMarker(endOfStreamMarker)
+				schema   = namespace.GetTestSchemaDescr(testVLSchema)
+				stream   = encoding.NewOStream(nil, true, nil)
+				sections [][2]int
+				written  [][]*dynamic.Message
+			)
+			// Sections begin on their own byte, regardless of what precedes them.
+			stream.WriteBits(0x5, 3)
+
+			encodeSection := func(enc *Encoder, numWrites int) {
+				var messages []*dynamic.Message
+				for i := 0; i < numWrites; i++ {
+					vl := newVL(float64(i), 2.0, int64(i), []byte(fmt.Sprintf("delivery-id-%d", i%3)), nil)
+					vlBytes, err := vl.Marshal()
+					require.NoError(t, err)
+
+					dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+					require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+					messages = append(messages, vl)
+				}
+
+				sectionStart, sectionEnd, err := enc.CloseSection()
+				require.NoError(t, err)
+				require.Equal(t, sectionEnd-sectionStart, enc.Len())
+				sections = append(sections, [2]int{sectionStart, sectionEnd})
+				written = append(written, messages)
+
+				err = enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, nil)
+				require.Equal(t, errEncoderSectionClosed, err)
+			}
+
+			enc := NewEncoderWithStream(start, stream, opts)
+			enc.Reset(start, 0, schema)
+			encodeSection(enc, 5)
+			// Resetting the encoder begins a new section of the same stream.
+			enc.Reset(start, 0, schema)
+			encodeSection(enc, 3)
+			// Closing the encoder doesn't release the shared stream.
+			enc.Close()
+
+			other := NewEncoderWithStream(start, stream, opts)
+			other.Reset(start, 0, schema)
+			encodeSection(other, 7)
+
+			rawBytes, _ := stream.Rawbytes()
+			require.Equal(t, 1, sections[0][0])
+			for i, section := range sections {
+				if i > 0 {
+					require.Equal(t, sections[i-1][1], section[0])
+				}
+
+				iter := NewIterator(bytes.NewReader(rawBytes[section[0]:section[1]]), schema, opts)
+				j := 0
+				for iter.Next() {
+					_, _, annotation := iter.Current()
+					m := dynamic.NewMessage(testVLSchema)
+					require.NoError(t, m.Unmarshal(annotation))
+					require.True(t, dynamic.MessagesEqual(written[i][j], m))
+					j++
+				}
+				require.NoError(t, iter.Err())
+				require.Equal(t, len(written[i]), j)
+				iter.Close()
+			}
+
+			// Segments of a shared stream contain only the section of the encoder.
+			segment := other.Discard()
+			require.Equal(t, rawBytes[sections[2][0]:sections[2][1]], segment.Head.Bytes())
+			segment.Finalize()
+		})
+	}
+}
+
+func TestEncoderCloseSectionRequiresSharedStream(t *testing.T) {
+	enc := newTestEncoder(time.Now().Truncate(time.Second))
+	_, _, err := enc.CloseSection()
+	require.Equal(t, errEncoderNotSharingStream, err)
+}
+
+func TestEncoderEmptyAnnotation(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	var (
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(testVLSchema)
+		vl     = newVL(1.0, 2.0, 3, []byte("delivery-id"), nil)
+	)
+	vlBytes, err := vl.Marshal()
+	require.NoError(t, err)
+
+	// By default an empty annotation is encoded as a message whose fields all
+	// have their default values.
+	enc := NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, schema)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start.Add(time.Second)}, xtime.Second, nil))
+
+	iter := NewIterator(bytes.NewReader(getCurrEncoderBytes(ctx, t, enc)), schema, testEncodingOptions)
+	defer iter.Close()
+	for _, expected := range []*dynamic.Message{vl, dynamic.NewMessage(testVLSchema)} {
+		require.True(t, iter.Next(), "iter err: %v", iter.Err())
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(expected, m),
+			"expected %s but got %s", expected.String(), m.String())
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+
+	// Strict encoders reject empty annotations without writing any data.
+	enc = NewEncoder(start, testEncodingOptions.SetRejectEmptyAnnotations(true))
+	enc.Reset(start, 0, schema)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+	bytesBeforeBadWrite := getCurrEncoderBytes(ctx, t, enc)
+
+	err = enc.Encode(ts.Datapoint{Timestamp: start.Add(time.Second)}, xtime.Second, ts.Annotation{})
+	require.Equal(t, errEncoderEmptyAnnotation, err)
+	require.Equal(t, bytesBeforeBadWrite, getCurrEncoderBytes(ctx, t, enc))
+	require.Equal(t, 1, enc.NumEncoded())
+}
+
+func TestEncoderVarIntBounds(t *testing.T) {
+	enc := NewEncoder(time.Time{}, testEncodingOptions)
+	for _, x := range []uint64{0, 1 << 56, math.MaxUint64} {
+		enc.Reset(time.Time{}, 0, nil)
+		enc.encodeVarInt(x)
+
+		rawBytes, _ := enc.stream.Rawbytes()
+		it := NewIterator(bytes.NewReader(rawBytes), nil, testEncodingOptions).(*iterator)
+		actual, err := it.readVarInt()
+		require.NoError(t, err)
+		require.Equal(t, x, actual)
+	}
+
+	// Var ints that are longer than any 64 bit integer can only be read from corrupt streams.
+	for _, corrupt := range [][]byte{
+		bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1),
+		append(bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64-1), 0x7f),
+	} {
+		it := NewIterator(bytes.NewReader(corrupt), nil, testEncodingOptions).(*iterator)
+		_, err := it.readVarInt()
+		require.Error(t, err)
+	}
+}
+
+func TestEncoderMessageTooLarge(t *testing.T) {
+	var (
+		start    = time.Now().Truncate(time.Second)
+		schema   = namespace.GetTestSchemaDescr(testVLSchema)
+		tooLarge = make([]byte, maxMarshalledProtoMessageSize+1)
+	)
+	enc := NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, schema)
+	require.Equal(t, errEncoderMessageTooLarge,
+		enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, tooLarge))
+	require.Equal(t, 0, enc.NumEncoded())
+	require.Equal(t, 0, enc.Len())
+}
+
+func TestEncoderBytesDictHashCollisions(t *testing.T) {
+	var (
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(testVLSchema)
+		opts   = withByteFieldDictionaryLRUSize(testEncodingOptions, 2).
+			SetMaxInternedBytesValues(3).
+			SetStaticBytesDictionary([][]byte{
+				[]byte("static-delivery-id-0"),
+				[]byte("static-delivery-id-1"),
+			})
+		written []*dynamic.Message
+	)
+	for i := 0; i < 100; i++ {
+		// Cycle through more values than fit in the LRU so that values are looked up
+		// in the LRU, the interned values and the static dictionary.
+		deliveryID := []byte(fmt.Sprintf("delivery-id-%d", i%5))
+		if i%4 == 0 {
+			deliveryID = []byte(fmt.Sprintf("static-delivery-id-%d", i%3))
+		}
+		written = append(written, newVL(float64(i), 2.0, int64(i), deliveryID, nil))
+	}
+
+	encode := func() []byte {
+		ctx := context.NewContext()
+		defer ctx.Close()
+
+		enc := NewEncoder(start, opts)
+		enc.Reset(start, 0, schema)
+		for i, vl := range written {
+			vlBytes, err := vl.Marshal()
+			require.NoError(t, err)
+
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+		}
+		return getCurrEncoderBytes(ctx, t, enc)
+	}
+
+	expected := encode()
+
+	// Make every value collide so that the encoder has to fall back to comparing the
+	// bytes of every value in the dictionaries, which must produce the same stream.
+	defer func(hash func([]byte) uint64) { bytesHash = hash }(bytesHash)
+	bytesHash = func([]byte) uint64 { return 0 }
+	stream := encode()
+	require.Equal(t, expected, stream)
+
+	iter := NewIterator(bytes.NewReader(stream), schema, opts)
+	defer iter.Close()
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+}
@@ -22,7 +22,7 @@ package proto
 
 import (
 	"bytes"
-	"fmt"
+	"encoding/binary"
 	"reflect"
 
 	"github.com/golang/protobuf/proto"
@@ -31,47 +31,58 @@ import (
 	"github.com/jhump/protoreflect/dynamic"
 )
 
-// isDefaultValue returns whether the provided value is the same as the default value for
-// a given field. For the most part we can rely on the fieldsEqual function and the
-// GetDefaultValue() method on the field descriptor, but repeated, map and nested message
-// fields require slightly more care.
-func isDefaultValue(field *desc.FieldDescriptor, curVal interface{}) (bool, error) {
-	if field.IsMap() {
-		// If its a repeated field then its a default value if it looks like a zero-length slice.
-		mapVal, ok := curVal.(map[interface{}]interface{})
-		if !ok {
-			// Should never happen.
-			return false, fmt.Errorf("current value for repeated field: %s wasn't a slice", field.String())
-		}
-
-		return len(mapVal) == 0, nil
+// isDefaultMarshalledValue returns whether the marshalled bytes of a non-custom field
+// (as produced by the custom unmarshaller) represent the default value of the field.
+//
+// For the most part the default value of a non-custom field is simply its absence from
+// the marshalled message:
+//   - repeated and map fields are not marshalled at all when they're empty.
+//   - nested message fields are only absent when unset, a set but empty nested message
+//     is still marshalled (with a zero length) and is not considered a default value
+//     because message fields track presence.
+//
+// The exception is packed repeated scalar fields which some marshallers encode as a
+// zero-length packed entry when they're empty. Those are considered default values so
+// that the encoder treats them the same as an absent field rather than encoding a
+// (meaningless) change.
+func isDefaultMarshalledValue(field *desc.FieldDescriptor, marshalled []byte) bool {
+	if len(marshalled) == 0 {
+		return true
+	}
+	if field == nil || !field.IsRepeated() || field.IsMap() {
+		return false
+	}
+	switch field.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE,
+		dpb.FieldDescriptorProto_TYPE_GROUP,
+		dpb.FieldDescriptorProto_TYPE_STRING,
+		dpb.FieldDescriptorProto_TYPE_BYTES:
+		// Zero-length entries for these types are values in their own right.
+		return false
 	}
 
-	if field.IsRepeated() {
-		// If its a repeated field then its a default value if it looks like a zero-length slice.
-		sliceVal, ok := curVal.([]interface{})
-		if !ok {
-			// Should never happen.
-			return false, fmt.Errorf("current value for repeated field: %s wasn't a slice", field.String())
+	for len(marshalled) > 0 {
+		tagAndWireType, n := binary.Uvarint(marshalled)
+		if n <= 0 || tagAndWireType&0x7 != proto.WireBytes {
+			return false
 		}
+		marshalled = marshalled[n:]
 
-		return len(sliceVal) == 0, nil
-	}
-
-	if field.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE {
-		// If its a nested message then its a default value if it looks the same as a new
-		// empty message with the same schema.
-		messageSchema := field.GetMessageType()
-		// TODO(rartoul): Don't allocate new message.
-		return fieldsEqual(dynamic.NewMessage(messageSchema), curVal), nil
+		length, n := binary.Uvarint(marshalled)
+		if n <= 0 || length != 0 {
+			return false
+		}
+		marshalled = marshalled[n:]
 	}
-
-	return fieldsEqual(field.GetDefaultValue(), curVal), nil
+	return true
 }
 
 // Mostly copy-pasta of a non-exported helper method from the protoreflect
 // library.
 // https://github.com/jhump/protoreflect/blob/87f824e0b908132b2501fe5652f8ee75a2e8cf06/dynamic/equal.go#L60
+//
+// Scalars are compared with ==, so positive and negative zero are considered equal
+// which matches how the encoder treats custom encoded float fields.
 func fieldsEqual(aVal, bVal interface{}) bool {
 	// Handle nil cases first since reflect.ValueOf will not handle untyped
 	// nils gracefully.
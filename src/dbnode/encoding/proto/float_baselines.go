@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/cespare/xxhash"
+	"github.com/jhump/protoreflect/desc"
+)
+
+// floatBaselines contains the values that the first value of custom encoded float fields
+// is XOR'd with, instead of being encoded in full, sorted by field name. The values are not
+// part of the stream, only a 32 bit hash of them is encoded into the stream header so that
+// iterators can verify that they were configured with the same values. The hash is shorter
+// than the other hashes of the header so that it doesn't outweigh the bits saved.
+type floatBaselines []floatBaseline
+
+type floatBaseline struct {
+	fieldName string
+	value     float64
+}
+
+func newFloatBaselines(values map[string]float64) floatBaselines {
+	if len(values) == 0 {
+		return nil
+	}
+
+	b := make(floatBaselines, 0, len(values))
+	for fieldName, value := range values {
+		b = append(b, floatBaseline{fieldName: fieldName, value: value})
+	}
+	sort.Slice(b, func(i, j int) bool {
+		return b[i].fieldName < b[j].fieldName
+	})
+	return b
+}
+
+// apply sets the previous value of the custom encoded float fields that have a baseline to
+// the baseline, such that their first value is encoded as the XOR with it.
+func (b floatBaselines) apply(customFields []customFieldState, schema *desc.MessageDescriptor) {
+	if len(b) == 0 || schema == nil {
+		return
+	}
+
+	for _, baseline := range b {
+		fieldDesc := schema.FindFieldByName(baseline.fieldName)
+		if fieldDesc == nil {
+			continue
+		}
+		for i := range customFields {
+			customField := &customFields[i]
+			if customField.fieldNum != int(fieldDesc.GetNumber()) ||
+				!isCustomFloatEncodedField(customField.fieldType) {
+				continue
+			}
+			// Mimic the state after the baseline was encoded in full.
+			valueBits := math.Float64bits(baseline.value)
+			customField.floatEncAndIter.PrevFloatBits = valueBits
+			customField.floatEncAndIter.PrevXOR = valueBits
+			customField.floatEncAndIter.NotFirst = true
+		}
+	}
+}
+
+func (b floatBaselines) hash() uint32 {
+	var (
+		digest = xxhash.New()
+		buf    [binary.MaxVarintLen64]byte
+	)
+	for _, baseline := range b {
+		n := binary.PutUvarint(buf[:], uint64(len(baseline.fieldName)))
+		digest.Write(buf[:n])
+		digest.Write([]byte(baseline.fieldName))
+		binary.LittleEndian.PutUint64(buf[:8], math.Float64bits(baseline.value))
+		digest.Write(buf[:8])
+	}
+	return uint32(digest.Sum64())
+}
@@ -36,6 +36,16 @@ type intEncoderAndIterator struct {
 	intSigBitsTracker m3tsz.IntSigBitsTracker
 	unsigned          bool
 	hasEncodedFirst   bool
+	// deltaOfDelta is whether each value is encoded as the difference between its delta
+	// and the previous delta (prevDeltaBits) rather than as its delta, in which case the
+	// value is unchanged if it changed by the same amount as the previous value. All of
+	// the arithmetic wraps around so it's the same for signed and unsigned values.
+	deltaOfDelta  bool
+	prevDeltaBits uint64
+	// wraparound is whether the change of an unsigned value is encoded as the delta that
+	// wraps around the 64 bit boundary when it's smaller than the delta that doesn't, only
+	// used by the encoder since the iterator applies either delta with wrapping arithmetic.
+	wraparound bool
 }
 
 func (eit *intEncoderAndIterator) encodeSignedIntValue(stream encoding.OStream, v int64) {
@@ -80,16 +90,29 @@ func (eit *intEncoderAndIterator) encodeFirstUnsignedIntValue(stream encoding.OS
 }
 
 func (eit *intEncoderAndIterator) encodeNextSignedIntValue(stream encoding.OStream, next int64) {
-	prev := int64(eit.prevIntBits)
-	diff := next - prev
-	if diff == 0 {
+	if !eit.hasChanged(uint64(next)) {
 		stream.WriteBit(opCodeNoChange)
+		eit.advanceUnchanged()
 		return
 	}
 
 	stream.WriteBit(opCodeChange)
+	eit.encodeSignedIntChange(stream, next)
+}
 
-	neg := false
+// encodeSignedIntChange encodes the difference between next and the previous value without
+// the preceding control bit that indicates whether the value changed.
+func (eit *intEncoderAndIterator) encodeSignedIntChange(stream encoding.OStream, next int64) {
+	if eit.deltaOfDelta {
+		eit.encodeDeltaOfDeltaChange(stream, uint64(next))
+		return
+	}
+
+	var (
+		prev = int64(eit.prevIntBits)
+		diff = next - prev
+		neg  = false
+	)
 	if diff < 0 {
 		neg = true
 		diff = -1 * diff
@@ -107,6 +130,24 @@ func (eit *intEncoderAndIterator) encodeNextSignedIntValue(stream encoding.OStre
 }
 
 func (eit *intEncoderAndIterator) encodeNextUnsignedIntValue(stream encoding.OStream, next uint64) {
+	if !eit.hasChanged(next) {
+		stream.WriteBit(opCodeNoChange)
+		eit.advanceUnchanged()
+		return
+	}
+
+	stream.WriteBit(opCodeChange)
+	eit.encodeUnsignedIntChange(stream, next)
+}
+
+// encodeUnsignedIntChange encodes the difference between next and the previous value without
+// the preceding control bit that indicates whether the value changed.
+func (eit *intEncoderAndIterator) encodeUnsignedIntChange(stream encoding.OStream, next uint64) {
+	if eit.deltaOfDelta {
+		eit.encodeDeltaOfDeltaChange(stream, next)
+		return
+	}
+
 	var (
 		neg  = false
 		prev = eit.prevIntBits
@@ -120,14 +161,13 @@ func (eit *intEncoderAndIterator) encodeNextUnsignedIntValue(stream encoding.OSt
 		neg = true
 		diff = prev - next
 	}
-
-	if diff == 0 {
-		stream.WriteBit(opCodeNoChange)
-		return
+	if eit.wraparound && -diff < diff {
+		// The value wrapped around, e.g. a counter that overflowed, so the delta in the
+		// opposite direction (which overflows) is smaller.
+		neg = !neg
+		diff = -diff
 	}
 
-	stream.WriteBit(opCodeChange)
-
 	numSig := encoding.NumSig(diff)
 	newSig := eit.intSigBitsTracker.TrackNewSig(numSig)
 
@@ -136,6 +176,49 @@ func (eit *intEncoderAndIterator) encodeNextUnsignedIntValue(stream encoding.OSt
 	eit.prevIntBits = next
 }
 
+// encodeDeltaOfDeltaChange encodes the difference between the delta of next and the previous
+// delta without the preceding control bit that indicates whether the value changed.
+func (eit *intEncoderAndIterator) encodeDeltaOfDeltaChange(stream encoding.OStream, nextBits uint64) {
+	var (
+		delta        = nextBits - eit.prevIntBits
+		deltaOfDelta = delta - eit.prevDeltaBits
+		neg          = int64(deltaOfDelta) < 0
+	)
+	if neg {
+		deltaOfDelta = -deltaOfDelta
+	}
+
+	var (
+		numSig = encoding.NumSig(deltaOfDelta)
+		newSig = eit.intSigBitsTracker.TrackNewSig(numSig)
+	)
+
+	eit.intSigBitsTracker.WriteIntSig(stream, newSig)
+	eit.encodeIntValDiff(stream, deltaOfDelta, neg, newSig)
+	eit.prevIntBits = nextBits
+	eit.prevDeltaBits = delta
+}
+
+// hasChanged returns whether the value with the provided bits differs from the previous value
+// of the field (or, for delta-of-delta fields, whether the delta differs from the previous
+// delta), the first value of a field is always considered a change.
+func (eit *intEncoderAndIterator) hasChanged(vBits uint64) bool {
+	if !eit.hasEncodedFirst {
+		return true
+	}
+	if eit.deltaOfDelta {
+		return vBits-eit.prevIntBits != eit.prevDeltaBits
+	}
+	return vBits != eit.prevIntBits
+}
+
+// advanceUnchanged advances the state of the field past a value that is unchanged.
+func (eit *intEncoderAndIterator) advanceUnchanged() {
+	if eit.deltaOfDelta {
+		eit.prevIntBits += eit.prevDeltaBits
+	}
+}
+
 func (eit *intEncoderAndIterator) encodeIntValDiff(stream encoding.OStream, valBits uint64, neg bool, numSig uint8) {
 	if neg {
 		// opCodeNegative
@@ -159,10 +242,17 @@ func (eit *intEncoderAndIterator) readIntValue(stream encoding.IStream) error {
 
 		if changeExistsControlBit == opCodeNoChange {
 			// No change.
+			eit.advanceUnchanged()
 			return nil
 		}
 	}
 
+	return eit.readIntChange(stream)
+}
+
+// readIntChange does the inverse of encodeSignedIntChange and encodeUnsignedIntChange, or
+// reads the first value of the field if none has been read yet.
+func (eit *intEncoderAndIterator) readIntChange(stream encoding.IStream) error {
 	if err := eit.readIntSig(stream); err != nil {
 		return fmt.Errorf(
 			"%s error trying to read number of significant digits: %v",
@@ -232,6 +322,16 @@ func (eit *intEncoderAndIterator) readIntValDiff(stream encoding.IStream) error
 			itErrPrefix, err)
 	}
 
+	if eit.deltaOfDelta && eit.hasEncodedFirst {
+		deltaOfDelta := diffSigBits
+		if negativeControlBit == opCodeIntDeltaNegative {
+			deltaOfDelta = -deltaOfDelta
+		}
+		eit.prevDeltaBits += deltaOfDelta
+		eit.prevIntBits += eit.prevDeltaBits
+		return nil
+	}
+
 	if eit.unsigned {
 		diff := diffSigBits
 		shouldSubtract := false
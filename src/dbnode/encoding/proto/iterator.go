@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 
 	"github.com/m3db/m3/src/dbnode/encoding"
 	"github.com/m3db/m3/src/dbnode/encoding/m3tsz"
@@ -37,6 +38,7 @@ import (
 
 	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
 )
 
 const (
@@ -47,55 +49,193 @@ const (
 var (
 	itErrPrefix                 = "proto iterator:"
 	errIteratorSchemaIsRequired = fmt.Errorf("%s schema is required", itErrPrefix)
+	errIteratorStreamTruncated  = fmt.Errorf(
+		"%s stream ended without an end-of-stream marker, stream may have been truncated", itErrPrefix)
+	errIteratorStaticBytesDictMismatch = fmt.Errorf(
+		"%s stream was encoded with a different static bytes dictionary", itErrPrefix)
+	errIteratorSchemaMismatch = fmt.Errorf(
+		"%s stream was encoded with a different schema", itErrPrefix)
+	errIteratorPrimedBytesDictsMismatch = fmt.Errorf(
+		"%s stream was encoded with bytes dictionaries primed with different values", itErrPrefix)
+	errIteratorFloatBaselinesMismatch = fmt.Errorf(
+		"%s stream was encoded with different float baselines", itErrPrefix)
+	errIteratorPrimeAfterNext = fmt.Errorf(
+		"%s cannot prime bytes dictionaries after iterating", itErrPrefix)
+	errIteratorEmptyMessageBatch = fmt.Errorf(
+		"%s stream contains an empty message batch", itErrPrefix)
+	errIteratorMessageBatch = fmt.Errorf(
+		"%s cannot unmarshal a batch of messages into a single message", itErrPrefix)
 )
 
+// CorruptionReporter is implemented by the iterators returned by NewIterator. When
+// lenient decoding is enabled an iterator that encounters a corrupt datapoint after the
+// stream header stops without an error, CorruptionErr then returns the error that caused
+// the rest of the stream to be skipped, or nil if the whole stream was decoded. Errors in
+// the stream header, including mismatches between the stream and the configuration of the
+// iterator, are always returned by Err. SkippedBytes returns the number of bytes of the
+// stream that followed the corrupt datapoint and were skipped, the number of skipped
+// datapoints is unknown since the stream doesn't record how many datapoints it contains.
+type CorruptionReporter interface {
+	CorruptionErr() error
+	SkippedBytes() int
+}
+
+// MessageReader is implemented by the iterators returned by NewIterator. CurrentMessage is
+// like Current except that the current message is unmarshalled into the provided message,
+// which must have the same schema as the iterator. The provided message is reset first so
+// that no fields of a previously unmarshalled message remain set, and it can be reused for
+// every datapoint to avoid allocating a message per datapoint when iterating long series.
+//
+// CachedMessage is like CurrentMessage except that the current message is unmarshalled into a
+// message owned by the iterator, the first time it is called for a datapoint only, so that
+// readers that make several passes over the fields of the same datapoint don't unmarshal it
+// again for every pass. The returned message must not be modified and is only valid until the
+// next call to Next.
+//
+// Both fail for streams of message batches since a datapoint contains several messages, their
+// annotations can be split into the messages with SplitMessageBatch instead.
+type MessageReader interface {
+	CurrentMessage(m *dynamic.Message) (ts.Datapoint, xtime.Unit, error)
+	CachedMessage() (ts.Datapoint, xtime.Unit, *dynamic.Message, error)
+}
+
+// StreamMetadataReader is implemented by the iterators returned by NewIterator. StreamMetadata
+// returns the opaque metadata that the encoder wrote in the header of the stream (see
+// StreamMetadata), or nil if there is none. The header is read by the first call to Next
+// so the metadata is only available afterwards, and it's valid until the iterator is reset.
+type StreamMetadataReader interface {
+	StreamMetadata() []byte
+}
+
+// BytesDictPrimer is implemented by the iterators returned by NewIterator. The iterators
+// of streams whose encoder was primed with Encoder.PrimeBytesDict must be primed with the
+// exact same values before the first call to Next, the values are discarded when the
+// iterator is reset.
+type BytesDictPrimer interface {
+	PrimeBytesDict(fieldNum int, values [][]byte) error
+}
+
 type iterator struct {
-	nsID                 ident.ID
-	opts                 encoding.Options
-	err                  error
-	schema               *desc.MessageDescriptor
-	schemaDesc           namespace.SchemaDescr
-	stream               encoding.IStream
-	marshaller           customFieldMarshaller
-	byteFieldDictLRUSize int
+	nsID                   ident.ID
+	opts                   Options
+	err                    error
+	corruptionErr          error
+	skippedBytes           int
+	schema                 *desc.MessageDescriptor
+	schemaDesc             namespace.SchemaDescr
+	stream                 encoding.IStream
+	marshaller             customFieldMarshaller
+	byteFieldDictLRUSize   int
+	version                uint64
+	streamFeatures         streamFeatures
+	staticBytesDictHash    uint64
+	schemaHash             uint64
+	primedBytesDictsHash   uint64
+	floatBaselinesHash     uint32
+	streamMetadata         []byte
+	staticBytesDict        *staticBytesDict
+	primedBytesDicts       primedBytesDicts
+	floatBaselines         floatBaselines
+	maxInternedBytesValues int
+	compactHeader          bool
+	hasReadLRUSize         bool
 	// TODO(rartoul): Update these as we traverse the stream if we encounter
 	// a mid-stream schema change: https://github.com/m3db/m3/issues/1471
 	customFields    []customFieldState
 	nonCustomFields []marshalledField
+	// Whether the int fields that changed are encoded as a bitset for the current write,
+	// in which case changedIntFields contains their (1-indexed) positions amongst the
+	// int fields and changedIntFieldsIdx is the next one that is yet to be read.
+	intChangesBitset    bool
+	changedIntFields    []int
+	changedIntFieldsIdx int
+	// Whether the writes with the current schema have no Protobuf marshalled portion.
+	noProtoPortion bool
+	// The fields of the schema that could be custom encoded but that aren't custom encoded
+	// in the stream, because they were repeated in the schema of the encoder, sorted.
+	repeatedInStreamFieldNums []int32
+	// The fields that the encoder didn't custom encode because it limits the number of custom
+	// encoded fields, sorted (see streamFeatureLimitedCustomFields).
+	limitedCustomFieldNums []int32
+	// The numbers of the custom encoded fields whose values are written first and the indexes
+	// of the custom fields in the order that their values are written in, empty if they're
+	// written in field number order (see streamFeatureCustomFieldOrder).
+	customFieldOrderNums []int32
+	customFieldOrder     []int
+	// The sorted union of the repeated in stream and limited custom fields, which are read
+	// from the Protobuf marshalled portion.
+	nonCustomSchemaFieldNums []int32
 
 	tsIterator m3tsz.TimestampIterator
 
 	// Fields that are reused between function calls to
 	// avoid allocations.
-	varIntBuf         [8]byte
+	varIntBuf         [binary.MaxVarintLen64]byte
 	bitsetValues      []int
 	unmarshalProtoBuf checked.Bytes
 	unmarshaller      customFieldUnmarshaller
+	unmarshallerOpts  customUnmarshallerOptions
+	mapFieldDiff      mapFieldDiff
+	mapFieldBuf       []byte
+	mapRemovedKeyBuf  []byte
+	mapRemovedKeys    [][]byte
+
+	// The messages of the current write, each preceded by its length, if the stream
+	// contains message batches.
+	batch []byte
+
+	// The message returned by CachedMessage, which is only unmarshalled once per datapoint.
+	cachedMessage      *dynamic.Message
+	cachedMessageValid bool
 
+	readHeader           bool
 	consumedFirstMessage bool
 	done                 bool
 	closed               bool
 }
 
-// NewIterator creates a new iterator.
+// NewIterator creates a new iterator. The annotation of each datapoint returned by the
+// iterator is the marshalled protobuf message that was reconstructed from the stream
+// (without ever materializing a dynamic.Message) so it can be forwarded as is, for example
+// to another encoder. The annotation is only valid until the next call to Next.
 func NewIterator(
 	reader io.Reader,
 	descr namespace.SchemaDescr,
-	opts encoding.Options,
+	opts Options,
 ) encoding.ReaderIterator {
-	stream := encoding.NewIStream(reader, opts.IStreamReaderSizeProto())
+	stream := encoding.NewIStream(reader, opts.EncodingOptions().IStreamReaderSizeProto())
 
 	i := &iterator{
 		opts:       opts,
 		stream:     stream,
 		marshaller: newCustomMarshaller(),
-		tsIterator: m3tsz.NewTimestampIterator(opts, true),
+		tsIterator: m3tsz.NewTimestampIterator(opts.EncodingOptions(), true),
+		staticBytesDict: newStaticBytesDict(
+			opts.StaticBytesDictionary(), false),
+		floatBaselines: newFloatBaselines(opts.FloatBaselines()),
 	}
 	i.resetSchema(descr)
 	return i
 }
 
 func (it *iterator) Next() bool {
+	it.cachedMessageValid = false
+	if it.next() {
+		return true
+	}
+	if it.err != nil && it.readHeader && it.opts.LenientDecoding() {
+		// The stream has no checkpoints that decoding could resume from since every
+		// datapoint is encoded relative to the previous ones so the rest of it is
+		// skipped, but the datapoints that were already returned remain valid.
+		it.corruptionErr = it.err
+		it.skippedBytes = it.skipRemainingBytes()
+		it.err = nil
+		it.done = true
+	}
+	return false
+}
+
+func (it *iterator) next() bool {
 	if it.schema == nil {
 		// It is a programmatic error that schema is not set at all prior to iterating, panic to fix it asap.
 		it.err = instrument.InvariantErrorf(errIteratorSchemaIsRequired.Error())
@@ -115,11 +255,36 @@ func (it *iterator) Next() bool {
 				itErrPrefix, err)
 			return false
 		}
+		if it.streamFeatures.has(streamFeatureStaticBytesDict) &&
+			(it.staticBytesDict == nil || it.staticBytesDict.hash != it.staticBytesDictHash) {
+			it.err = errIteratorStaticBytesDictMismatch
+			return false
+		}
+		if it.streamFeatures.has(streamFeatureSchemaHash) && schemaHash(it.schema) != it.schemaHash {
+			it.err = errIteratorSchemaMismatch
+			return false
+		}
+		if it.streamFeatures.has(streamFeaturePrimedBytesDicts) &&
+			(len(it.primedBytesDicts) == 0 || it.primedBytesDicts.hash() != it.primedBytesDictsHash) {
+			it.err = errIteratorPrimedBytesDictsMismatch
+			return false
+		}
+		if it.streamFeatures.has(streamFeatureFloatBaselines) &&
+			(len(it.floatBaselines) == 0 || it.floatBaselines.hash() != it.floatBaselinesHash) {
+			it.err = errIteratorFloatBaselinesMismatch
+			return false
+		}
+		if it.streamFeatures.has(streamFeatureOneofFields) {
+			// The members of oneofs are non custom fields in streams with oneof fields.
+			it.customFields, it.nonCustomFields = customAndNonCustomFields(
+				it.customFields, it.nonCustomFields, it.schema, true)
+		}
+		it.readHeader = true
 	}
 
 	moreDataControlBit, err := it.stream.ReadBit()
 	if err == io.EOF {
-		it.done = true
+		it.endOfStream(false)
 		return false
 	}
 	if err != nil {
@@ -134,7 +299,7 @@ func (it *iterator) Next() bool {
 		// or that the time unit and/or schema has changed.
 		noMoreDataControlBit, err := it.stream.ReadBit()
 		if err == io.EOF {
-			it.done = true
+			it.endOfStream(false)
 			return false
 		}
 		if err != nil {
@@ -145,7 +310,7 @@ func (it *iterator) Next() bool {
 		}
 
 		if noMoreDataControlBit == opCodeNoMoreData {
-			it.done = true
+			it.endOfStream(false)
 			return false
 		}
 
@@ -167,6 +332,30 @@ func (it *iterator) Next() bool {
 			return false
 		}
 
+		if timeUnitHasChangedControlBit == opCodeTimeUnitUnchanged &&
+			schemaHasChangedControlBit == opCodeSchemaUnchanged {
+			if it.streamFeatures.has(streamFeatureBytesDictResets) {
+				// The end-of-stream marker is followed by padding zero bits, or the end of the
+				// stream, unless it's the bytes dictionaries reset marker.
+				bytesDictResetControlBit, err := it.stream.ReadBit()
+				if err != nil && err != io.EOF {
+					it.err = fmt.Errorf(
+						"%s error reading bytes dictionary reset control bit: %v",
+						itErrPrefix, err)
+					return false
+				}
+				if err == nil && bytesDictResetControlBit == opCodeBytesDictReset {
+					it.resetBytesDicts()
+					// The control bits of the next write follow the marker.
+					return it.next()
+				}
+			}
+			if it.streamFeatures.has(streamFeatureEndOfStreamMarker) {
+				it.endOfStream(true)
+				return false
+			}
+		}
+
 		if timeUnitHasChangedControlBit == opCodeTimeUnitChange {
 			if err := it.tsIterator.ReadTimeUnit(it.stream); err != nil {
 				it.err = fmt.Errorf("%s error reading new time unit: %v", itErrPrefix, err)
@@ -187,6 +376,10 @@ func (it *iterator) Next() bool {
 				// Reslice instead of setting to nil to reuse existing capacity if possible.
 				it.nonCustomFields[i].marshalled = it.nonCustomFields[i].marshalled[:0]
 			}
+
+			if !it.consumedFirstMessage && it.streamFeatures.has(streamFeaturePrimedBytesDicts) {
+				it.primeBytesDicts()
+			}
 		}
 	}
 
@@ -201,14 +394,49 @@ func (it *iterator) Next() bool {
 		return false
 	}
 
-	if err := it.readCustomValues(); err != nil {
-		it.err = err
+	if !it.streamFeatures.has(streamFeatureMessageBatches) {
+		if err := it.readMessage(); err != nil {
+			it.err = err
+			return false
+		}
+		it.consumedFirstMessage = true
+		return it.hasNext()
+	}
+
+	numMessages, err := it.readVarInt()
+	if err != nil {
+		it.err = fmt.Errorf("%s error reading number of messages: %v", itErrPrefix, err)
+		return false
+	}
+	if numMessages == 0 {
+		it.err = errIteratorEmptyMessageBatch
 		return false
 	}
+	it.batch = it.batch[:0]
+	for i := uint64(0); i < numMessages; i++ {
+		if i > 0 {
+			it.marshaller.reset()
+		}
+		if err := it.readMessage(); err != nil {
+			it.err = err
+			return false
+		}
+		it.batch = appendMessageBatch(it.batch, it.marshaller.bytes())
+	}
+
+	it.consumedFirstMessage = true
+	return it.hasNext()
+}
+
+// readMessage reads the custom encoded and the Protobuf marshalled fields of a message into
+// the marshaller.
+func (it *iterator) readMessage() error {
+	if err := it.readCustomValues(); err != nil {
+		return err
+	}
 
 	if err := it.readNonCustomValues(); err != nil {
-		it.err = err
-		return false
+		return err
 	}
 
 	// Update the marshaller bytes (which will be returned by Current()) with the latest value
@@ -216,9 +444,7 @@ func (it *iterator) Next() bool {
 	for _, marshalledField := range it.nonCustomFields {
 		it.marshaller.encPartialProto(marshalledField.marshalled)
 	}
-
-	it.consumedFirstMessage = true
-	return it.hasNext()
+	return nil
 }
 
 func (it *iterator) Current() (ts.Datapoint, xtime.Unit, ts.Annotation) {
@@ -229,23 +455,130 @@ func (it *iterator) Current() (ts.Datapoint, xtime.Unit, ts.Annotation) {
 		unit = it.tsIterator.TimeUnit
 	)
 
+	if it.streamFeatures.has(streamFeatureMessageBatches) {
+		return dp, unit, it.batch
+	}
 	return dp, unit, it.marshaller.bytes()
 }
 
+func (it *iterator) CurrentMessage(m *dynamic.Message) (ts.Datapoint, xtime.Unit, error) {
+	dp, unit, annotation := it.Current()
+	if it.streamFeatures.has(streamFeatureMessageBatches) {
+		return dp, unit, errIteratorMessageBatch
+	}
+	if name := m.GetMessageDescriptor().GetFullyQualifiedName(); name != it.schema.GetFullyQualifiedName() {
+		return dp, unit, fmt.Errorf(
+			"%s cannot unmarshal current message into message of type %s, expected %s",
+			itErrPrefix, name, it.schema.GetFullyQualifiedName())
+	}
+
+	// Unmarshal resets the message before unmarshalling into it.
+	if err := m.Unmarshal(annotation); err != nil {
+		return dp, unit, fmt.Errorf(
+			"%s error unmarshalling current message: %v", itErrPrefix, err)
+	}
+	return dp, unit, nil
+}
+
+func (it *iterator) CachedMessage() (ts.Datapoint, xtime.Unit, *dynamic.Message, error) {
+	if it.cachedMessageValid {
+		dp, unit, _ := it.Current()
+		return dp, unit, it.cachedMessage, nil
+	}
+
+	if it.cachedMessage == nil || it.cachedMessage.GetMessageDescriptor() != it.schema {
+		it.cachedMessage = dynamic.NewMessage(it.schema)
+	}
+	dp, unit, err := it.CurrentMessage(it.cachedMessage)
+	if err != nil {
+		return dp, unit, nil, err
+	}
+	it.cachedMessageValid = true
+	return dp, unit, it.cachedMessage, nil
+}
+
 func (it *iterator) Err() error {
 	return it.err
 }
 
+// StreamMetadata returns the metadata of the stream, see StreamMetadata.
+func (it *iterator) StreamMetadata() []byte {
+	if !it.streamFeatures.has(streamFeatureStreamMetadata) {
+		return nil
+	}
+	return it.streamMetadata
+}
+
+// CorruptionErr returns the error that caused the rest of the stream to be skipped
+// when lenient decoding is enabled.
+func (it *iterator) CorruptionErr() error {
+	return it.corruptionErr
+}
+
+// SkippedBytes returns the number of bytes of the stream that were skipped after
+// the corrupt datapoint when lenient decoding is enabled.
+func (it *iterator) SkippedBytes() int {
+	return it.skippedBytes
+}
+
+func (it *iterator) skipRemainingBytes() int {
+	skipped := 0
+	for {
+		if _, err := it.stream.ReadByte(); err != nil {
+			return skipped
+		}
+		skipped++
+	}
+}
+
+// PrimeBytesDict primes the LRU dictionary of a bytes field with the same values that
+// the encoder of the stream was primed with, see Encoder.PrimeBytesDict.
+func (it *iterator) PrimeBytesDict(fieldNum int, values [][]byte) error {
+	if it.consumedFirstMessage {
+		return errIteratorPrimeAfterNext
+	}
+	it.primedBytesDicts = it.primedBytesDicts.set(fieldNum, values)
+	return nil
+}
+
+// primeBytesDicts adds the values the bytes dictionaries are primed with to the dictionaries
+// of the initial schema, in the same order as the encoder.
+func (it *iterator) primeBytesDicts() {
+	for i, customField := range it.customFields {
+		values := it.primedBytesDicts.values(customField.fieldNum, it.byteFieldDictLRUSize)
+		for _, value := range values {
+			it.addToBytesDict(i, value)
+		}
+	}
+}
+
 func (it *iterator) Reset(reader io.Reader, descr namespace.SchemaDescr) {
 	it.resetSchema(descr)
 	it.stream.Reset(reader)
-	it.tsIterator = m3tsz.NewTimestampIterator(it.opts, true)
+	it.tsIterator = m3tsz.NewTimestampIterator(it.opts.EncodingOptions(), true)
 
 	it.err = nil
+	it.corruptionErr = nil
+	it.skippedBytes = 0
+	it.readHeader = false
 	it.consumedFirstMessage = false
+	it.cachedMessageValid = false
 	it.done = false
 	it.closed = false
 	it.byteFieldDictLRUSize = 0
+	it.version = 0
+	it.streamFeatures = 0
+	it.staticBytesDictHash = 0
+	it.schemaHash = 0
+	it.primedBytesDictsHash = 0
+	it.floatBaselinesHash = 0
+	it.streamMetadata = it.streamMetadata[:0]
+	it.primedBytesDicts = nil
+	it.noProtoPortion = false
+	it.customFieldOrder = it.customFieldOrder[:0]
+	it.maxInternedBytesValues = 0
+	it.compactHeader = false
+	it.hasReadLRUSize = false
 }
 
 // setSchema sets the schema for the iterator.
@@ -253,6 +586,7 @@ func (it *iterator) resetSchema(schemaDesc namespace.SchemaDescr) {
 	if schemaDesc == nil {
 		it.schemaDesc = nil
 		it.schema = nil
+		it.cachedMessage = nil
 
 		// Clear but don't set to nil so they don't need to be reallocated
 		// next time.
@@ -272,7 +606,7 @@ func (it *iterator) resetSchema(schemaDesc namespace.SchemaDescr) {
 
 	it.schemaDesc = schemaDesc
 	it.schema = schemaDesc.Get().MessageDescriptor
-	it.customFields, it.nonCustomFields = customAndNonCustomFields(it.customFields, nil, it.schema)
+	it.customFields, it.nonCustomFields = customAndNonCustomFields(it.customFields, nil, it.schema, false)
 }
 
 func (it *iterator) Close() {
@@ -292,31 +626,149 @@ func (it *iterator) Close() {
 		it.unmarshalProtoBuf = nil
 	}
 
-	if pool := it.opts.ReaderIteratorPool(); pool != nil {
+	if pool := it.opts.EncodingOptions().ReaderIteratorPool(); pool != nil {
 		pool.Put(it)
 	}
 }
 
+// endOfStream marks the iterator as done, unless the stream is expected to be
+// terminated with an end-of-stream marker that was not encountered in which case
+// the stream is assumed to have been truncated.
+func (it *iterator) endOfStream(readEndOfStreamMarker bool) {
+	if it.streamFeatures.has(streamFeatureEndOfStreamMarker) && !readEndOfStreamMarker {
+		it.err = errIteratorStreamTruncated
+		return
+	}
+	it.done = true
+}
+
 func (it *iterator) readStreamHeader() error {
-	// Can ignore the version number for now because we only have one.
-	_, err := it.readVarInt()
+	version, err := it.readVarInt()
 	if err != nil {
 		return err
 	}
+	if version != baseEncodingSchemeVersion &&
+		version != streamFeaturesEncodingSchemeVersion &&
+		version != compactHeaderEncodingSchemeVersion {
+		return fmt.Errorf("unsupported encoding scheme version: %d", version)
+	}
+	it.version = version
 
-	byteFieldDictLRUSize, err := it.readVarInt()
+	// Compact headers defer the dictionary compression LRU cache size until the
+	// first schema with custom encoded fields.
+	it.compactHeader = version == compactHeaderEncodingSchemeVersion
+	if !it.compactHeader {
+		if err := it.readByteFieldDictLRUSize(); err != nil {
+			return err
+		}
+	}
+
+	it.streamFeatures = 0
+	if version >= streamFeaturesEncodingSchemeVersion {
+		features, err := it.readVarInt()
+		if err != nil {
+			return err
+		}
+		if unsupported := streamFeatures(features) &^ supportedStreamFeatures; unsupported != 0 {
+			return fmt.Errorf("stream header contains unsupported features: %b", uint64(unsupported))
+		}
+		it.streamFeatures = streamFeatures(features)
+	}
+
+	if it.streamFeatures.has(streamFeatureStaticBytesDict) {
+		hash, err := it.stream.ReadBits(64)
+		if err != nil {
+			return err
+		}
+		it.staticBytesDictHash = hash
+	}
+
+	if it.streamFeatures.has(streamFeatureInternedBytes) {
+		maxInterned, err := it.readVarInt()
+		if err != nil {
+			return err
+		}
+		if maxInterned > maxInternedBytesValues {
+			return fmt.Errorf(
+				"stream header contains max interned bytes values: %d, which exceeds the maximum: %d",
+				maxInterned, maxInternedBytesValues)
+		}
+		it.maxInternedBytesValues = int(maxInterned)
+	}
+
+	if it.streamFeatures.has(streamFeatureSchemaHash) {
+		hash, err := it.stream.ReadBits(64)
+		if err != nil {
+			return err
+		}
+		it.schemaHash = hash
+	}
+
+	if it.streamFeatures.has(streamFeaturePrimedBytesDicts) {
+		hash, err := it.stream.ReadBits(64)
+		if err != nil {
+			return err
+		}
+		it.primedBytesDictsHash = hash
+	}
+
+	if it.streamFeatures.has(streamFeatureFloatBaselines) {
+		hash, err := it.stream.ReadBits(32)
+		if err != nil {
+			return err
+		}
+		it.floatBaselinesHash = uint32(hash)
+	}
+
+	if it.streamFeatures.has(streamFeatureStreamMetadata) {
+		if err := it.readStreamMetadata(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readStreamMetadata does the inverse of encodeStreamMetadata.
+func (it *iterator) readStreamMetadata() error {
+	metadataLen, err := it.readVarInt()
 	if err != nil {
 		return err
 	}
+	if metadataLen > maxMarshalledProtoMessageSize {
+		return fmt.Errorf(
+			"stream metadata size is %d which is larger than the maximum of %d",
+			metadataLen, maxMarshalledProtoMessageSize)
+	}
 
+	if cap(it.streamMetadata) < int(metadataLen) {
+		it.streamMetadata = make([]byte, metadataLen)
+	}
+	it.streamMetadata = it.streamMetadata[:metadataLen]
+	_, err = io.ReadFull(it.stream, it.streamMetadata)
+	return err
+}
+
+func (it *iterator) readByteFieldDictLRUSize() error {
+	byteFieldDictLRUSize, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
 	it.byteFieldDictLRUSize = int(byteFieldDictLRUSize)
+	it.hasReadLRUSize = true
 	return nil
 }
 
 func (it *iterator) readCustomFieldsSchema() error {
-	numCustomFields, err := it.readVarInt()
-	if err != nil {
-		return err
+	// The custom types of the initial schema of a stream with a compact header
+	// are omitted because there are none.
+	var numCustomFields uint64
+	if !it.compactHeader || it.consumedFirstMessage {
+		var err error
+		numCustomFields, err = it.readVarInt()
+		if err != nil {
+			return err
+		}
 	}
 
 	if numCustomFields > maxCustomFieldNum {
@@ -325,6 +777,12 @@ func (it *iterator) readCustomFieldsSchema() error {
 			numCustomFields, maxCustomFieldNum)
 	}
 
+	if numCustomFields > 0 && !it.hasReadLRUSize {
+		if err := it.readByteFieldDictLRUSize(); err != nil {
+			return err
+		}
+	}
+
 	if it.customFields != nil {
 		for i := range it.customFields {
 			it.customFields[i] = customFieldState{}
@@ -357,18 +815,227 @@ func (it *iterator) readCustomFieldsSchema() error {
 		it.customFields = append(it.customFields, customFieldState)
 	}
 
+	if it.streamFeatures.has(streamFeatureIntDeltaOfDelta) {
+		for i := range it.customFields {
+			if !isCustomIntEncodedField(it.customFields[i].fieldType) {
+				continue
+			}
+			deltaOfDeltaBit, err := it.stream.ReadBit()
+			if err != nil {
+				return fmt.Errorf("%s error reading int delta of delta bit: %v", itErrPrefix, err)
+			}
+			it.customFields[i].intEncAndIter.deltaOfDelta = deltaOfDeltaBit == opCodeIntDeltaOfDelta
+		}
+	}
+
+	if it.streamFeatures.has(streamFeatureFloatBaselines) {
+		it.floatBaselines.apply(it.customFields, it.schema)
+	}
+
+	it.noProtoPortion = false
+	if it.streamFeatures.has(streamFeatureOmitEmptyProtoPortion) {
+		protoPortionBit, err := it.stream.ReadBit()
+		if err != nil {
+			return fmt.Errorf("%s error reading proto portion bit: %v", itErrPrefix, err)
+		}
+		it.noProtoPortion = protoPortionBit == opCodeNoProtoPortion
+	}
+
+	if err := it.readLimitedCustomFieldNums(); err != nil {
+		return fmt.Errorf("%s error reading limited custom fields: %v", itErrPrefix, err)
+	}
+
+	if err := it.readCustomFieldOrder(); err != nil {
+		return fmt.Errorf("%s error reading custom field order: %v", itErrPrefix, err)
+	}
+
+	it.resetRepeatedInStreamFields()
 	return nil
 }
 
+// readLimitedCustomFieldNums does the inverse of encodeLimitedCustomFieldNums.
+func (it *iterator) readLimitedCustomFieldNums() error {
+	it.limitedCustomFieldNums = it.limitedCustomFieldNums[:0]
+	if !it.streamFeatures.has(streamFeatureLimitedCustomFields) {
+		return nil
+	}
+
+	numFields, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+	if numFields > maxCustomFieldNum {
+		return fmt.Errorf(
+			"num limited custom fields is %d but maximum allowed is %d", numFields, maxCustomFieldNum)
+	}
+
+	fieldNum := uint64(0)
+	for i := uint64(0); i < numFields; i++ {
+		delta, err := it.readVarInt()
+		if err != nil {
+			return err
+		}
+		fieldNum += delta
+		if delta == 0 || fieldNum > maxCustomFieldNum {
+			return fmt.Errorf("invalid limited custom field number %d", fieldNum)
+		}
+		it.limitedCustomFieldNums = append(it.limitedCustomFieldNums, int32(fieldNum))
+	}
+	return nil
+}
+
+// readCustomFieldOrder does the inverse of encodeCustomFieldOrderNums.
+func (it *iterator) readCustomFieldOrder() error {
+	it.customFieldOrderNums = it.customFieldOrderNums[:0]
+	if !it.streamFeatures.has(streamFeatureCustomFieldOrder) {
+		it.customFieldOrder = it.customFieldOrder[:0]
+		return nil
+	}
+
+	numFields, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+	if numFields > uint64(len(it.customFields)) {
+		return fmt.Errorf(
+			"num ordered custom fields is %d but there are only %d custom fields",
+			numFields, len(it.customFields))
+	}
+
+	for i := uint64(0); i < numFields; i++ {
+		fieldNum, err := it.readVarInt()
+		if err != nil {
+			return err
+		}
+		if fieldNum > maxCustomFieldNum {
+			return fmt.Errorf("invalid ordered custom field number %d", fieldNum)
+		}
+		it.customFieldOrderNums = append(it.customFieldOrderNums, int32(fieldNum))
+	}
+
+	it.customFieldOrder, err = customFieldOrder(
+		it.customFieldOrder, it.customFields, it.customFieldOrderNums)
+	return err
+}
+
+// resetRepeatedInStreamFields determines the fields of the schema that could be custom
+// encoded but that aren't custom encoded in the stream, which happens when a field was
+// repeated in the schema of the encoder and is singular in the schema of the iterator, or
+// when the encoder limits the number of custom encoded fields (see MaxCustomFields).
+// Their values are read from the Protobuf marshalled portion of the stream instead, like
+// the values of any other field that isn't custom encoded.
+func (it *iterator) resetRepeatedInStreamFields() {
+	it.repeatedInStreamFieldNums = it.repeatedInStreamFieldNums[:0]
+	it.nonCustomSchemaFieldNums = it.nonCustomSchemaFieldNums[:0]
+	numNonCustomFields := len(it.nonCustomFields)
+	oneofFields := it.streamFeatures.has(streamFeatureOneofFields)
+	for _, field := range it.schema.GetFields() {
+		if _, ok := isCustomSchemaField(field, oneofFields); !ok {
+			continue
+		}
+
+		fieldNum := field.GetNumber()
+		isStreamCustomField := false
+		for _, customField := range it.customFields {
+			if customField.fieldNum == int(fieldNum) {
+				isStreamCustomField = true
+				break
+			}
+		}
+		if isStreamCustomField {
+			continue
+		}
+
+		it.nonCustomSchemaFieldNums = append(it.nonCustomSchemaFieldNums, fieldNum)
+		if !isSortedFieldNum(it.limitedCustomFieldNums, fieldNum) {
+			it.repeatedInStreamFieldNums = append(it.repeatedInStreamFieldNums, fieldNum)
+		}
+		hasNonCustomField := false
+		for _, nonCustomField := range it.nonCustomFields[:numNonCustomFields] {
+			if nonCustomField.fieldNum == fieldNum {
+				hasNonCustomField = true
+				break
+			}
+		}
+		if !hasNonCustomField {
+			// The value is read from the Protobuf marshalled portion so it needs a slot
+			// amongst the non custom fields.
+			it.nonCustomFields = append(it.nonCustomFields, marshalledField{fieldNum: fieldNum})
+		}
+	}
+	// The non custom fields are sorted by field number.
+	if len(it.nonCustomFields) > numNonCustomFields {
+		sort.Sort(sortedMarshalledFields(it.nonCustomFields))
+	}
+	sort.Slice(it.repeatedInStreamFieldNums, func(i, j int) bool {
+		return it.repeatedInStreamFieldNums[i] < it.repeatedInStreamFieldNums[j]
+	})
+	sort.Slice(it.nonCustomSchemaFieldNums, func(i, j int) bool {
+		return it.nonCustomSchemaFieldNums[i] < it.nonCustomSchemaFieldNums[j]
+	})
+}
+
+// isSortedFieldNum returns whether the sorted field numbers include fieldNum.
+func isSortedFieldNum(fieldNums []int32, fieldNum int32) bool {
+	i := sort.Search(len(fieldNums), func(i int) bool {
+		return fieldNums[i] >= fieldNum
+	})
+	return i < len(fieldNums) && fieldNums[i] == fieldNum
+}
+
+func (it *iterator) isRepeatedInStream(fieldNum int32) bool {
+	for _, repeatedFieldNum := range it.repeatedInStreamFieldNums {
+		if repeatedFieldNum == fieldNum {
+			return true
+		}
+	}
+	return false
+}
+
+// setRepeatedInStreamValue sets the value of a field that was repeated in the schema of the
+// encoder but is singular in the schema of the iterator according to the configured strategy.
+func (it *iterator) setRepeatedInStreamValue(i int, marshalled []byte) error {
+	fieldNum := it.nonCustomFields[i].fieldNum
+	switch it.opts.RepeatedToSingularStrategy() {
+	case RepeatedToSingularPassThrough:
+		it.nonCustomFields[i].marshalled = append(it.nonCustomFields[i].marshalled[:0], marshalled...)
+		return nil
+	case RepeatedToSingularError:
+		return fmt.Errorf(
+			"%s field %d is repeated in the stream but singular in the schema", itErrPrefix, fieldNum)
+	default:
+		field := it.schema.FindFieldByNumber(fieldNum)
+		lastValue, err := lastRepeatedValue(
+			fieldNum, field.GetType(), marshalled, it.nonCustomFields[i].marshalled[:0])
+		if err != nil {
+			return fmt.Errorf(
+				"%s error reading last value of field %d which is repeated in the stream: %v",
+				itErrPrefix, fieldNum, err)
+		}
+		it.nonCustomFields[i].marshalled = lastValue
+		return nil
+	}
+}
+
 func (it *iterator) readCustomValues() error {
-	for i, customField := range it.customFields {
+	if err := it.readIntChanges(); err != nil {
+		return err
+	}
+
+	intFieldPos := 0
+	for pos := range it.customFields {
+		var (
+			i           = customFieldIdx(it.customFieldOrder, pos)
+			customField = it.customFields[i]
+		)
 		switch {
 		case isCustomFloatEncodedField(customField.fieldType):
 			if err := it.readFloatValue(i); err != nil {
 				return err
 			}
 		case isCustomIntEncodedField(customField.fieldType):
-			if err := it.readIntValue(i); err != nil {
+			intFieldPos++
+			if err := it.readIntValue(i, intFieldPos); err != nil {
 				return err
 			}
 		case customField.fieldType == bytesField:
@@ -388,20 +1055,60 @@ func (it *iterator) readCustomValues() error {
 	return nil
 }
 
+// readIntChanges does the inverse of encodeIntChanges on the encoder struct.
+func (it *iterator) readIntChanges() error {
+	it.intChangesBitset = false
+	if !it.streamFeatures.has(streamFeatureIntChangesBitset) ||
+		!canEncodeIntChangesBitset(it.customFields) {
+		return nil
+	}
+
+	intChangesControlBit, err := it.stream.ReadBit()
+	if err != nil {
+		return fmt.Errorf("%s err reading int changes control bit: %v", itErrPrefix, err)
+	}
+	if intChangesControlBit == opCodeIntChangesPerField {
+		return nil
+	}
+
+	if err := it.readBitset(); err != nil {
+		return fmt.Errorf("%s error reading changed int fields bitset: %v", itErrPrefix, err)
+	}
+	it.changedIntFields = append(it.changedIntFields[:0], it.bitsetValues...)
+	it.changedIntFieldsIdx = 0
+	it.intChangesBitset = true
+	return nil
+}
+
 func (it *iterator) readNonCustomValues() error {
+	if it.noProtoPortion {
+		return nil
+	}
+
 	protoChangesControlBit, err := it.stream.ReadBit()
 	if err != nil {
 		return fmt.Errorf("%s err reading proto changes control bit: %v", itErrPrefix, err)
 	}
 
+	fullNonCustomFields := it.streamFeatures.has(streamFeatureFullNonCustomFields)
+	if fullNonCustomFields {
+		// Every message replaces all of the non custom fields of the previous one.
+		for i := range it.nonCustomFields {
+			it.nonCustomFields[i].marshalled = it.nonCustomFields[i].marshalled[:0]
+		}
+	}
+
 	if protoChangesControlBit == opCodeNoChange {
 		// No changes since previous message.
 		return nil
 	}
 
-	fieldsSetToDefaultControlBit, err := it.stream.ReadBit()
-	if err != nil {
-		return fmt.Errorf("%s err reading field set to default control bit: %v", itErrPrefix, err)
+	var fieldsSetToDefaultControlBit encoding.Bit = opCodeNoFieldsSetToDefaultProtoMarshal
+	if !fullNonCustomFields {
+		fieldsSetToDefaultControlBit, err = it.stream.ReadBit()
+		if err != nil {
+			return fmt.Errorf("%s err reading field set to default control bit: %v", itErrPrefix, err)
+		}
 	}
 
 	if fieldsSetToDefaultControlBit == opCodeFieldsSetToDefaultProtoMarshal {
@@ -437,15 +1144,20 @@ func (it *iterator) readNonCustomValues() error {
 			itErrPrefix, int(marshalLen), n)
 	}
 
-	if it.unmarshaller == nil {
-		// Lazy init.
-		it.unmarshaller = newCustomFieldUnmarshaller(customUnmarshallerOptions{
-			// Skip over unknown fields when unmarshalling because its possible that the stream was
-			// encoded with a newer schema.
-			skipUnknownFields: true,
-		})
+	unmarshallerOpts := customUnmarshallerOptions{
+		// Skip over unknown fields when unmarshalling because its possible that the stream was
+		// encoded with a newer schema.
+		skipUnknownFields: true,
+		keepUnknownFields: it.opts.UnknownFieldsPassthrough(),
+		oneofFields:       it.streamFeatures.has(streamFeatureOneofFields),
+	}
+	if it.unmarshaller == nil || it.unmarshallerOpts != unmarshallerOpts {
+		// Lazy init, or re-init if the stream features differ from those of the previous stream.
+		it.unmarshaller = newCustomFieldUnmarshaller(unmarshallerOpts)
+		it.unmarshallerOpts = unmarshallerOpts
 	}
 
+	it.unmarshaller.setNonCustomFieldNums(it.nonCustomSchemaFieldNums)
 	if err := it.unmarshaller.resetAndUnmarshal(it.schema, unmarshalBytes); err != nil {
 		return fmt.Errorf(
 			"%s error unmarshalling message: %v", itErrPrefix, err)
@@ -458,6 +1170,12 @@ func (it *iterator) readNonCustomValues() error {
 			"%s encoded protobuf portion of message had custom fields", itErrPrefix)
 	}
 
+	if unmarshallerOpts.keepUnknownFields {
+		if err := it.addUnknownNonCustomFields(it.unmarshaller.sortedNonCustomFieldValues()); err != nil {
+			return err
+		}
+	}
+
 	// Update any non custom fields that have explicitly changed (they were explicitly included
 	// in the marshalled stream).
 	var (
@@ -474,17 +1192,39 @@ func (it *iterator) readNonCustomValues() error {
 				continue
 			}
 
+			lastMatchIdx = i
+			if it.streamFeatures.has(streamFeatureOneofFields) && len(nonCustomField.marshalled) > 0 {
+				it.clearOtherOneofMembers(nonCustomField.fieldNum)
+			}
+			if it.isMapFieldDiff(existingNonCustomField) {
+				// The marshalled entries are the entries of the map that were added or changed.
+				if err := it.applyMapFieldDiff(i, nonCustomField.marshalled, nil); err != nil {
+					return err
+				}
+				break
+			}
+			if it.isRepeatedInStream(nonCustomField.fieldNum) {
+				if err := it.setRepeatedInStreamValue(i, nonCustomField.marshalled); err != nil {
+					return err
+				}
+				break
+			}
+
 			// Copy because the underlying bytes get reused between reads. Also try and reuse the existing
 			// capacity to prevent an allocation if possible.
 			it.nonCustomFields[i].marshalled = append(
 				it.nonCustomFields[i].marshalled[:0],
 				nonCustomField.marshalled...)
-
-			lastMatchIdx = i
 			break
 		}
 	}
 
+	if it.streamFeatures.has(streamFeatureMapFieldDiffs) {
+		if err := it.readMapFieldRemovals(); err != nil {
+			return err
+		}
+	}
+
 	// Update any non custom fields that have been explicitly set to their default value as determined
 	// by the bitset.
 	if fieldsSetToDefaultControlBit == opCodeFieldsSetToDefaultProtoMarshal {
@@ -508,8 +1248,144 @@ func (it *iterator) readNonCustomValues() error {
 	return nil
 }
 
+// addUnknownNonCustomFields adds slots amongst the non custom fields for the unmarshalled
+// fields that aren't in the schema, if they don't have one already, so that their values are
+// tracked like those of the other non custom fields and passed through as raw bytes (see
+// UnknownFieldsPassthrough). Whether the values of map fields are diffs and whether
+// setting a field clears another depends on the schema, so the unknown fields of streams with
+// map field diffs or oneof fields can't be passed through.
+func (it *iterator) addUnknownNonCustomFields(unmarshalled sortedMarshalledFields) error {
+	numNonCustomFields := len(it.nonCustomFields)
+	for _, field := range unmarshalled {
+		if it.schema.FindFieldByNumber(field.fieldNum) != nil {
+			continue
+		}
+		if it.streamFeatures.has(streamFeatureMapFieldDiffs) || it.streamFeatures.has(streamFeatureOneofFields) {
+			return fmt.Errorf(
+				"%s cannot pass through unknown field %d of a stream with map field diffs or oneof fields",
+				itErrPrefix, field.fieldNum)
+		}
+
+		hasNonCustomField := false
+		for _, nonCustomField := range it.nonCustomFields[:numNonCustomFields] {
+			if nonCustomField.fieldNum == field.fieldNum {
+				hasNonCustomField = true
+				break
+			}
+		}
+		if !hasNonCustomField {
+			it.nonCustomFields = append(it.nonCustomFields, marshalledField{fieldNum: field.fieldNum})
+		}
+	}
+	// The non custom fields are sorted by field number.
+	if len(it.nonCustomFields) > numNonCustomFields {
+		sort.Sort(sortedMarshalledFields(it.nonCustomFields))
+	}
+	return nil
+}
+
+// clearOtherOneofMembers clears the other members of the oneof that the field belongs
+// to, if any, since the encoder doesn't explicitly set them to their default value when
+// the active member of a oneof changes (see streamFeatureOneofFields).
+func (it *iterator) clearOtherOneofMembers(fieldNum int32) {
+	field := it.schema.FindFieldByNumber(fieldNum)
+	if field == nil || field.GetOneOf() == nil {
+		return
+	}
+	for _, member := range field.GetOneOf().GetChoices() {
+		if member.GetNumber() == fieldNum {
+			continue
+		}
+		for i := range it.nonCustomFields {
+			if it.nonCustomFields[i].fieldNum == member.GetNumber() {
+				it.nonCustomFields[i].marshalled = it.nonCustomFields[i].marshalled[:0]
+				break
+			}
+		}
+	}
+}
+
+// isMapFieldDiff returns whether the marshalled value for the field in the stream is a diff
+// against its existing value rather than a replacement of it.
+func (it *iterator) isMapFieldDiff(field marshalledField) bool {
+	if !it.streamFeatures.has(streamFeatureMapFieldDiffs) || len(field.marshalled) == 0 {
+		return false
+	}
+	fd := it.schema.FindFieldByNumber(field.fieldNum)
+	return fd != nil && fd.IsMap()
+}
+
+func (it *iterator) applyMapFieldDiff(i int, upserts []byte, removedKeys [][]byte) error {
+	merged, err := it.mapFieldDiff.apply(
+		it.mapFieldBuf[:0], it.nonCustomFields[i].marshalled, upserts, removedKeys)
+	if err != nil {
+		return fmt.Errorf(
+			"%s error applying diff to map field %d: %v",
+			itErrPrefix, it.nonCustomFields[i].fieldNum, err)
+	}
+	it.mapFieldBuf = merged
+	it.nonCustomFields[i].marshalled = append(it.nonCustomFields[i].marshalled[:0], merged...)
+	return nil
+}
+
+// readMapFieldRemovals reads the keys of the map entries that were removed (see
+// mapFieldDiff.appendRemoval) and removes them from the existing map values.
+func (it *iterator) readMapFieldRemovals() error {
+	numRemovals, err := it.readVarInt()
+	if err != nil {
+		return fmt.Errorf("%s err reading number of map field removals: %v", itErrPrefix, err)
+	}
+
+	for j := uint64(0); j < numRemovals; j++ {
+		fieldNum, err := it.readVarInt()
+		if err != nil {
+			return fmt.Errorf("%s err reading map field removal field number: %v", itErrPrefix, err)
+		}
+		keyLen, err := it.readVarInt()
+		if err != nil {
+			return fmt.Errorf("%s err reading map field removal key length: %v", itErrPrefix, err)
+		}
+		if keyLen > maxMarshalledProtoMessageSize {
+			return fmt.Errorf(
+				"%s map field removal key size was %d which is larger than the maximum of %d",
+				itErrPrefix, keyLen, maxMarshalledProtoMessageSize)
+		}
+
+		if cap(it.mapRemovedKeyBuf) < int(keyLen) {
+			it.mapRemovedKeyBuf = make([]byte, keyLen)
+		}
+		key := it.mapRemovedKeyBuf[:keyLen]
+		if _, err := io.ReadFull(it.stream, key); err != nil {
+			return fmt.Errorf("%s err reading map field removal key: %v", itErrPrefix, err)
+		}
+		it.mapRemovedKeys = append(it.mapRemovedKeys[:0], key)
+
+		idx := -1
+		for i := range it.nonCustomFields {
+			if it.nonCustomFields[i].fieldNum == int32(fieldNum) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 || !it.isMapFieldDiff(it.nonCustomFields[idx]) {
+			return fmt.Errorf(
+				"%s map field removal for field %d which is not a non-empty map field",
+				itErrPrefix, fieldNum)
+		}
+		if err := it.applyMapFieldDiff(idx, nil, it.mapRemovedKeys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (it *iterator) readFloatValue(i int) error {
-	if err := it.customFields[i].floatEncAndIter.ReadFloat(it.stream); err != nil {
+	if it.streamFeatures.has(streamFeatureIntValuedFloats) {
+		if err := it.readIntValuedFloatValue(i); err != nil {
+			return err
+		}
+	} else if err := it.customFields[i].floatEncAndIter.ReadFloat(it.stream); err != nil {
 		return err
 	}
 
@@ -517,6 +1393,45 @@ func (it *iterator) readFloatValue(i int) error {
 	return it.updateMarshallerWithCustomValues(updateArg)
 }
 
+// readIntValuedFloatValue does the inverse of encodeIntValuedFloatValue.
+func (it *iterator) readIntValuedFloatValue(i int) error {
+	var (
+		customField = &it.customFields[i]
+		prevBits    = customField.floatEncAndIter.PrevFloatBits
+		prev        = math.Float64frombits(prevBits)
+	)
+	if !customField.floatEncAndIter.NotFirst || !isIntValuedFloat(prev) {
+		return customField.floatEncAndIter.ReadFloat(it.stream)
+	}
+
+	changedControlBit, err := it.stream.ReadBit()
+	if err != nil {
+		return fmt.Errorf(
+			"%s: error trying to read float change exists control bit: %v", itErrPrefix, err)
+	}
+	if changedControlBit == opCodeNoChange {
+		return nil
+	}
+
+	deltaControlBit, err := it.stream.ReadBit()
+	if err != nil {
+		return fmt.Errorf(
+			"%s: error trying to read int valued float delta control bit: %v", itErrPrefix, err)
+	}
+	if deltaControlBit == opCodeFloatXOR {
+		return customField.floatEncAndIter.ReadFloat(it.stream)
+	}
+
+	customField.intEncAndIter.prevIntBits = uint64(int64(prev))
+	if err := customField.intEncAndIter.readIntChange(it.stream); err != nil {
+		return err
+	}
+	valBits := math.Float64bits(float64(int64(customField.intEncAndIter.prevIntBits)))
+	customField.floatEncAndIter.PrevXOR = prevBits ^ valBits
+	customField.floatEncAndIter.PrevFloatBits = valBits
+	return nil
+}
+
 func (it *iterator) readBytesValue(i int, customField customFieldState) error {
 	bytesChangedControlBit, err := it.stream.ReadBit()
 	if err != nil {
@@ -566,6 +1481,43 @@ func (it *iterator) readBytesValue(i int, customField customFieldState) error {
 		return it.updateMarshallerWithCustomValues(updateArg)
 	}
 
+	if len(customField.iteratorInternedBytes) > 0 {
+		internedControlBit, err := it.stream.ReadBit()
+		if err != nil {
+			return fmt.Errorf(
+				"%s error trying to read bytes interned control bit: %v",
+				itErrPrefix, err)
+		}
+		if internedControlBit == opCodeInterpretSubsequentBitsAsInternedIndex {
+			return it.readInternedBytesValue(i)
+		}
+	}
+
+	if it.streamFeatures.has(streamFeatureStaticBytesDict) {
+		inStaticDictControlBit, err := it.stream.ReadBit()
+		if err != nil {
+			return fmt.Errorf(
+				"%s error trying to read bytes in static dict control bit: %v",
+				itErrPrefix, err)
+		}
+		if inStaticDictControlBit == opCodeInterpretSubsequentBitsAsStaticDictIndex {
+			return it.readStaticBytesDictValue(i)
+		}
+	}
+
+	if len(customField.iteratorBytesFieldDict) > 0 &&
+		it.streamFeatures.has(streamFeatureBytesPrefixDelta) {
+		prefixDeltaControlBit, err := it.stream.ReadBit()
+		if err != nil {
+			return fmt.Errorf(
+				"%s error trying to read bytes prefix delta control bit: %v",
+				itErrPrefix, err)
+		}
+		if prefixDeltaControlBit == opCodeBytesPrefixDelta {
+			return it.readBytesPrefixDeltaValue(i)
+		}
+	}
+
 	// New value that was not in the dict already.
 	bytesLen, err := it.readVarInt()
 	if err != nil {
@@ -599,16 +1551,89 @@ func (it *iterator) readBytesValue(i int, customField customFieldState) error {
 	}
 
 	it.addToBytesDict(i, buf)
+	it.addToInternedBytes(i, buf)
 
 	updateArg := updateLastIterArg{i: i, bytesFieldBuf: buf}
 	return it.updateMarshallerWithCustomValues(updateArg)
 }
 
-func (it *iterator) readIntValue(i int) error {
-	if err := it.customFields[i].intEncAndIter.readIntValue(it.stream); err != nil {
+// readBytesPrefixDeltaValue reads a value of the bytes field at index i that was encoded as
+// the difference with its previous value, see encodeBytesPrefixDelta.
+func (it *iterator) readBytesPrefixDeltaValue(i int) error {
+	prev, err := it.lastValueBytesDict(i)
+	if err != nil {
 		return err
 	}
 
+	var lens [3]uint64
+	for j := range lens {
+		if lens[j], err = it.readVarInt(); err != nil {
+			return fmt.Errorf(
+				"%s error trying to read bytes prefix delta length: %v", itErrPrefix, err)
+		}
+	}
+	prefixLen, suffixLen, deltaLen := lens[0], lens[1], lens[2]
+	if prefixLen+suffixLen > uint64(len(prev)) {
+		return fmt.Errorf(
+			"%s bytes prefix delta with prefix length %d and suffix length %d for previous value of length %d",
+			itErrPrefix, prefixLen, suffixLen, len(prev))
+	}
+	if deltaLen > maxMarshalledProtoMessageSize {
+		return fmt.Errorf(
+			"%s bytes prefix delta length %d is larger than the maximum size of %d bytes",
+			itErrPrefix, deltaLen, maxMarshalledProtoMessageSize)
+	}
+
+	// Reuse the byte slice that is about to be evicted, unless it's the previous value.
+	var buf []byte
+	if len(it.customFields[i].iteratorBytesFieldDict) > 1 {
+		buf = it.nextToBeEvicted(i)
+	}
+	bytesLen := int(prefixLen + deltaLen + suffixLen)
+	if cap(buf) < bytesLen {
+		buf = make([]byte, bytesLen)
+	}
+	buf = buf[:bytesLen]
+
+	copy(buf, prev[:prefixLen])
+	delta := buf[prefixLen : prefixLen+deltaLen]
+	n, err := it.stream.Read(delta)
+	if err != nil {
+		return fmt.Errorf(
+			"%s error trying to read bytes prefix delta: %v", itErrPrefix, err)
+	}
+	if n != len(delta) {
+		return fmt.Errorf(
+			"%s tried to read %d bytes but only read: %d", itErrPrefix, len(delta), n)
+	}
+	copy(buf[prefixLen+deltaLen:], prev[uint64(len(prev))-suffixLen:])
+
+	it.addToBytesDict(i, buf)
+	it.addToInternedBytes(i, buf)
+
+	updateArg := updateLastIterArg{i: i, bytesFieldBuf: buf}
+	return it.updateMarshallerWithCustomValues(updateArg)
+}
+
+// readIntValue reads the value of the int field at index i of the custom fields, which is
+// the intFieldPos'th (1-indexed) int field.
+func (it *iterator) readIntValue(i, intFieldPos int) error {
+	intEncAndIter := &it.customFields[i].intEncAndIter
+	if !it.intChangesBitset {
+		if err := intEncAndIter.readIntValue(it.stream); err != nil {
+			return err
+		}
+	} else if it.changedIntFieldsIdx < len(it.changedIntFields) &&
+		it.changedIntFields[it.changedIntFieldsIdx] == intFieldPos {
+		// The bitset is sorted so the changed fields are consumed in order.
+		it.changedIntFieldsIdx++
+		if err := intEncAndIter.readIntChange(it.stream); err != nil {
+			return err
+		}
+	} else {
+		intEncAndIter.advanceUnchanged()
+	}
+
 	updateArg := updateLastIterArg{i: i}
 	return it.updateMarshallerWithCustomValues(updateArg)
 }
@@ -663,59 +1688,8 @@ func (it *iterator) updateMarshallerWithCustomValues(arg updateLastIterArg) erro
 		return err
 
 	case isCustomIntEncodedField(fieldType):
-		switch fieldType {
-		case signedInt64Field:
-			val := int64(it.customFields[arg.i].intEncAndIter.prevIntBits)
-			if protoFieldType == dpb.FieldDescriptorProto_TYPE_SINT64 {
-				// The encoding / compression schema in this package treats Protobuf int32 and sint32 the same,
-				// however, Protobuf unmarshallers assume that fields of type sint are zigzag encoded. As a result,
-				// the iterator needs to check the fields protobuf type so that it can perform the correct encoding.
-				it.marshaller.encSInt64(fieldNum, val)
-			} else if protoFieldType == dpb.FieldDescriptorProto_TYPE_SFIXED64 {
-				it.marshaller.encSFixedInt64(fieldNum, val)
-			} else {
-				it.marshaller.encInt64(fieldNum, val)
-			}
-			return nil
-
-		case unsignedInt64Field:
-			val := it.customFields[arg.i].intEncAndIter.prevIntBits
-			it.marshaller.encUInt64(fieldNum, val)
-			return nil
-
-		case signedInt32Field:
-			var (
-				val   = int32(it.customFields[arg.i].intEncAndIter.prevIntBits)
-				field = it.schema.FindFieldByNumber(fieldNum)
-			)
-			if field == nil {
-				return fmt.Errorf(
-					"updating last iterated with value, could not find field number %d in schema", fieldNum)
-			}
-
-			fieldType := field.GetType()
-			if fieldType == dpb.FieldDescriptorProto_TYPE_SINT32 {
-				// The encoding / compression schema in this package treats Protobuf int32 and sint32 the same,
-				// however, Protobuf unmarshallers assume that fields of type sint are zigzag encoded. As a result,
-				// the iterator needs to check the fields protobuf type so that it can perform the correct encoding.
-				it.marshaller.encSInt32(fieldNum, val)
-			} else if fieldType == dpb.FieldDescriptorProto_TYPE_SFIXED32 {
-				it.marshaller.encSFixedInt32(fieldNum, val)
-			} else {
-				it.marshaller.encInt32(fieldNum, val)
-			}
-			return nil
-
-		case unsignedInt32Field:
-			val := uint32(it.customFields[arg.i].intEncAndIter.prevIntBits)
-			it.marshaller.encUInt32(fieldNum, val)
-			return nil
-
-		default:
-			return fmt.Errorf(
-				"%s expected custom int encoded field but field type was: %v",
-				itErrPrefix, fieldType)
-		}
+		return it.marshalIntValue(
+			fieldNum, fieldType, protoFieldType, it.customFields[arg.i].intEncAndIter.prevIntBits)
 
 	case fieldType == bytesField:
 		it.marshaller.encBytes(fieldNum, arg.bytesFieldBuf)
@@ -731,6 +1705,68 @@ func (it *iterator) updateMarshallerWithCustomValues(arg updateLastIterArg) erro
 	}
 }
 
+// marshalIntValue marshals the current value of a custom int encoded field. The
+// custom type recorded in the stream header (fieldType) is the sole authority on
+// how the stored bits should be interpreted (signed vs unsigned and 32 vs 64 bit)
+// since that is how they were encoded. The value is then converted to the protobuf
+// type of the field in the iterator's schema (protoFieldType), the same way a Go
+// conversion between the integer types would, and marshalled with the wire encoding
+// of that type (I.E zigzag encoded for sint32 and sint64 fields) so that it can be
+// unmarshalled with that schema. This means that a schema evolution which changes a
+// field's signedness (I.E int64 -> sint64) preserves its values rather than producing
+// whatever reinterpreting the original wire bytes would. An error is returned if the
+// field is no longer an integer or a bool in the iterator's schema.
+func (it *iterator) marshalIntValue(
+	fieldNum int32,
+	fieldType customFieldType,
+	protoFieldType dpb.FieldDescriptorProto_Type,
+	bits uint64,
+) error {
+	var val uint64
+	switch fieldType {
+	case signedInt32Field:
+		// Sign extend.
+		val = uint64(int64(int32(bits)))
+	case unsignedInt32Field:
+		val = uint64(uint32(bits))
+	default:
+		val = bits
+	}
+
+	switch protoFieldType {
+	case dpb.FieldDescriptorProto_TYPE_INT32, dpb.FieldDescriptorProto_TYPE_ENUM:
+		it.marshaller.encInt32(fieldNum, int32(val))
+	case dpb.FieldDescriptorProto_TYPE_SINT32:
+		// The encoding / compression schema in this package treats Protobuf int32 and sint32 the same,
+		// however, Protobuf unmarshallers assume that fields of type sint are zigzag encoded. As a result,
+		// the iterator needs to check the fields protobuf type so that it can perform the correct encoding.
+		it.marshaller.encSInt32(fieldNum, int32(val))
+	case dpb.FieldDescriptorProto_TYPE_UINT32:
+		it.marshaller.encUInt32(fieldNum, uint32(val))
+	case dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		it.marshaller.encSFixedInt32(fieldNum, int32(val))
+	case dpb.FieldDescriptorProto_TYPE_FIXED32:
+		it.marshaller.encFixedUInt32(fieldNum, uint32(val))
+	case dpb.FieldDescriptorProto_TYPE_INT64:
+		it.marshaller.encInt64(fieldNum, int64(val))
+	case dpb.FieldDescriptorProto_TYPE_SINT64:
+		it.marshaller.encSInt64(fieldNum, int64(val))
+	case dpb.FieldDescriptorProto_TYPE_UINT64:
+		it.marshaller.encUInt64(fieldNum, val)
+	case dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		it.marshaller.encSFixedInt64(fieldNum, int64(val))
+	case dpb.FieldDescriptorProto_TYPE_FIXED64:
+		it.marshaller.encFixedUInt64(fieldNum, val)
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		it.marshaller.encBool(fieldNum, val != 0)
+	default:
+		return fmt.Errorf(
+			"%s int encoded field %d has non integer type %v in the schema",
+			itErrPrefix, fieldNum, protoFieldType)
+	}
+	return nil
+}
+
 // readBitset does the inverse of encodeBitset on the encoder struct.
 func (it *iterator) readBitset() error {
 	it.bitsetValues = it.bitsetValues[:0]
@@ -767,6 +1803,11 @@ func (it *iterator) readVarInt() (uint64, error) {
 			return 0, fmt.Errorf("%s error reading var int: %v", itErrPrefix, err)
 		}
 
+		if numBytes == binary.MaxVarintLen64 {
+			// Only possible if the stream is corrupt.
+			return 0, fmt.Errorf("%s error reading var int: longer than %d bytes",
+				itErrPrefix, binary.MaxVarintLen64)
+		}
 		buf = append(buf, b)
 		numBytes++
 
@@ -776,7 +1817,10 @@ func (it *iterator) readVarInt() (uint64, error) {
 	}
 
 	buf = buf[:numBytes]
-	varInt, _ := binary.Uvarint(buf)
+	varInt, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("%s error reading var int: overflows a 64 bit integer", itErrPrefix)
+	}
 	return varInt, nil
 }
 
@@ -811,6 +1855,77 @@ func (it *iterator) moveToEndOfBytesDict(fieldIdx, i int) {
 	}
 }
 
+// readStaticBytesDictValue reads a bytes value that was encoded as an index into the static
+// dictionary and adds a copy of it to the LRU dictionary, a copy is required since the
+// buffers of the values that are evicted from the LRU are reused.
+func (it *iterator) readStaticBytesDictValue(i int) error {
+	dictIdxBits, err := it.stream.ReadBits(it.staticBytesDict.numIndexBits)
+	if err != nil {
+		return fmt.Errorf(
+			"%s error trying to read static bytes dict idx: %v",
+			itErrPrefix, err)
+	}
+
+	dictIdx := int(dictIdxBits)
+	if dictIdx >= len(it.staticBytesDict.values) {
+		return fmt.Errorf(
+			"%s read static bytes dictionary index: %d, but dictionary is size: %d",
+			itErrPrefix, dictIdx, len(it.staticBytesDict.values))
+	}
+
+	buf := append(it.nextToBeEvicted(i)[:0], it.staticBytesDict.values[dictIdx]...)
+	it.addToBytesDict(i, buf)
+	it.addToInternedBytes(i, buf)
+
+	updateArg := updateLastIterArg{i: i, bytesFieldBuf: buf}
+	return it.updateMarshallerWithCustomValues(updateArg)
+}
+
+// resetBytesDicts resets the LRU dictionaries and interned values of all the bytes fields,
+// mirroring the encoder at a bytes dictionaries reset marker.
+func (it *iterator) resetBytesDicts() {
+	for i := range it.customFields {
+		it.customFields[i].iteratorBytesFieldDict = it.customFields[i].iteratorBytesFieldDict[:0]
+		it.customFields[i].iteratorInternedBytes = it.customFields[i].iteratorInternedBytes[:0]
+	}
+}
+
+// readInternedBytesValue reads a bytes value that was encoded as an index into the interned
+// values of the field and adds a copy of it to the LRU dictionary.
+func (it *iterator) readInternedBytesValue(i int) error {
+	interned := it.customFields[i].iteratorInternedBytes
+	internedIdxBits, err := it.stream.ReadBits(numBitsRequiredForNumUpToN(len(interned) - 1))
+	if err != nil {
+		return fmt.Errorf(
+			"%s error trying to read interned bytes idx: %v",
+			itErrPrefix, err)
+	}
+
+	internedIdx := int(internedIdxBits)
+	if internedIdx >= len(interned) {
+		return fmt.Errorf(
+			"%s read interned bytes index: %d, but number of interned values is: %d",
+			itErrPrefix, internedIdx, len(interned))
+	}
+
+	buf := append(it.nextToBeEvicted(i)[:0], interned[internedIdx]...)
+	it.addToBytesDict(i, buf)
+
+	updateArg := updateLastIterArg{i: i, bytesFieldBuf: buf}
+	return it.updateMarshallerWithCustomValues(updateArg)
+}
+
+// addToInternedBytes interns a copy of a value that was not interned yet if the maximum
+// number of interned values of the field has not been reached, a copy is required since
+// the buffers of the values that are evicted from the LRU are reused.
+func (it *iterator) addToInternedBytes(fieldIdx int, b []byte) {
+	existing := it.customFields[fieldIdx].iteratorInternedBytes
+	if len(existing) < it.maxInternedBytesValues {
+		it.customFields[fieldIdx].iteratorInternedBytes = append(
+			existing, append([]byte(nil), b...))
+	}
+}
+
 func (it *iterator) addToBytesDict(fieldIdx int, b []byte) {
 	existing := it.customFields[fieldIdx].iteratorBytesFieldDict
 	if len(existing) < it.byteFieldDictLRUSize {
@@ -907,7 +2022,7 @@ func (it *iterator) isClosed() bool {
 }
 
 func (it *iterator) newBuffer(capacity int) checked.Bytes {
-	if bytesPool := it.opts.BytesPool(); bytesPool != nil {
+	if bytesPool := it.opts.EncodingOptions().BytesPool(); bytesPool != nil {
 		return bytesPool.Get(capacity)
 	}
 	return checked.NewBytes(make([]byte, 0, capacity), nil)
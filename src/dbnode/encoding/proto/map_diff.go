@@ -0,0 +1,270 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// mapEntry is a single marshalled entry of a map field along with the marshalled
+// key field (the tag and value of field number 1 of the entry message) within it
+// that identifies the entry.
+type mapEntry struct {
+	key   []byte
+	entry []byte
+}
+
+// parseMapEntries appends the entries of the marshalled map field, which is a
+// sequence of length delimited entry messages, to entries. The returned entries
+// reference the provided marshalled bytes.
+func parseMapEntries(entries []mapEntry, marshalled []byte) ([]mapEntry, error) {
+	var (
+		cb      = newCodedBuffer(marshalled)
+		entryCb = newCodedBuffer(nil)
+	)
+	for !cb.eof() {
+		start := cb.index
+		_, wireType, err := cb.decodeTagAndWireType()
+		if err != nil {
+			return nil, err
+		}
+		if wireType != proto.WireBytes {
+			return nil, fmt.Errorf("map entry has unexpected wire type: %d", wireType)
+		}
+		payload, err := cb.decodeRawBytes(false)
+		if err != nil {
+			return nil, err
+		}
+
+		// Map entries are messages with the key as field number 1 and the value as
+		// field number 2, the key is absent if it's the default value.
+		var key []byte
+		entryCb.reset(payload)
+		for !entryCb.eof() {
+			fieldStart := entryCb.index
+			fieldNum, wireType, err := entryCb.decodeTagAndWireType()
+			if err != nil {
+				return nil, err
+			}
+			if err := skipMapEntryField(entryCb, wireType); err != nil {
+				return nil, err
+			}
+			if fieldNum == 1 {
+				key = payload[fieldStart:entryCb.index]
+			}
+		}
+
+		entries = append(entries, mapEntry{key: key, entry: marshalled[start:cb.index]})
+	}
+	return entries, nil
+}
+
+func skipMapEntryField(cb *buffer, wireType int8) error {
+	switch wireType {
+	case proto.WireVarint:
+		_, err := cb.decodeVarint()
+		return err
+	case proto.WireFixed64:
+		if _, ok := cb.skip(8); !ok {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	case proto.WireFixed32:
+		if _, ok := cb.skip(4); !ok {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	case proto.WireBytes:
+		_, err := cb.decodeRawBytes(false)
+		return err
+	default:
+		return fmt.Errorf("map entry field has unsupported wire type: %d", wireType)
+	}
+}
+
+// findMapEntry returns the index of the last entry with the given key (since
+// the last entry for a key takes precedence) or -1 if there is none.
+func findMapEntry(entries []mapEntry, key []byte) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if bytes.Equal(entries[i].key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// mapFieldDiff computes the diff between two marshalled values of a map field,
+// it is reused between calls to avoid allocations.
+type mapFieldDiff struct {
+	prev []mapEntry
+	curr []mapEntry
+
+	// upserts are the marshalled entries that were added or changed.
+	upserts []byte
+	// removals are the encoded (see appendRemoval) keys of the entries that
+	// were removed.
+	removals    []byte
+	numRemovals int
+}
+
+// memSize returns the number of bytes retained by the diff, the entries reference
+// marshalled fields that are owned by the encoder so only their headers count.
+func (d *mapFieldDiff) memSize() int {
+	entrySize := int(unsafe.Sizeof(mapEntry{}))
+	return (cap(d.prev)+cap(d.curr))*entrySize + cap(d.upserts) + cap(d.removals)
+}
+
+// trim releases the buffers of the diff whose capacity exceeds maxCapacity bytes.
+func (d *mapFieldDiff) trim(maxCapacity int) {
+	entrySize := int(unsafe.Sizeof(mapEntry{}))
+	if cap(d.prev)*entrySize > maxCapacity {
+		d.prev = nil
+	}
+	if cap(d.curr)*entrySize > maxCapacity {
+		d.curr = nil
+	}
+	if cap(d.upserts) > maxCapacity {
+		d.upserts = nil
+	}
+	if cap(d.removals) > maxCapacity {
+		d.removals = nil
+	}
+}
+
+func (d *mapFieldDiff) resetRemovals() {
+	d.removals = d.removals[:0]
+	d.numRemovals = 0
+}
+
+// diff sets upserts to the entries of curr that are not in prev and appends the
+// keys of the entries of prev that are not in curr to the removals, it returns
+// whether there were any differences.
+func (d *mapFieldDiff) diff(fieldNum int32, prev, curr []byte) (bool, error) {
+	var err error
+	d.upserts = d.upserts[:0]
+	if d.prev, err = parseMapEntries(d.prev[:0], prev); err != nil {
+		return false, err
+	}
+	if d.curr, err = parseMapEntries(d.curr[:0], curr); err != nil {
+		return false, err
+	}
+
+	numRemovals := d.numRemovals
+	for _, entry := range d.curr {
+		idx := findMapEntry(d.prev, entry.key)
+		if idx >= 0 && bytes.Equal(d.prev[idx].entry, entry.entry) {
+			continue
+		}
+		d.upserts = append(d.upserts, entry.entry...)
+	}
+	for i, entry := range d.prev {
+		if findMapEntry(d.prev[i+1:], entry.key) >= 0 {
+			// Only consider the last entry for any given key.
+			continue
+		}
+		if findMapEntry(d.curr, entry.key) < 0 {
+			d.appendRemoval(fieldNum, entry.key)
+		}
+	}
+	return len(d.upserts) > 0 || d.numRemovals > numRemovals, nil
+}
+
+// equal returns whether two marshalled values of a map field have the same entries,
+// regardless of the order they're in.
+func (d *mapFieldDiff) equal(prev, curr []byte) (bool, error) {
+	var err error
+	if d.prev, err = parseMapEntries(d.prev[:0], prev); err != nil {
+		return false, err
+	}
+	if d.curr, err = parseMapEntries(d.curr[:0], curr); err != nil {
+		return false, err
+	}
+	return mapEntriesContain(d.prev, d.curr) && mapEntriesContain(d.curr, d.prev), nil
+}
+
+// mapEntriesContain returns whether the entries of b have the same value in a, only
+// considering the last entry of any given key.
+func mapEntriesContain(a, b []mapEntry) bool {
+	for _, entry := range b {
+		var (
+			aIdx = findMapEntry(a, entry.key)
+			bIdx = findMapEntry(b, entry.key)
+		)
+		if aIdx < 0 || !bytes.Equal(a[aIdx].entry, b[bIdx].entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendRemoval appends the removal of a key in the form of:
+//
+//      varint(field number)|varint(key length)|key
+func (d *mapFieldDiff) appendRemoval(fieldNum int32, key []byte) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(fieldNum))
+	d.removals = append(d.removals, buf[:n]...)
+	n = binary.PutUvarint(buf[:], uint64(len(key)))
+	d.removals = append(d.removals, buf[:n]...)
+	d.removals = append(d.removals, key...)
+	d.numRemovals++
+}
+
+// apply applies the upserted entries and removed keys to the existing marshalled
+// value of a map field and returns the result appended to dst.
+func (d *mapFieldDiff) apply(
+	dst []byte,
+	existing []byte,
+	upserts []byte,
+	removedKeys [][]byte,
+) ([]byte, error) {
+	var err error
+	if d.prev, err = parseMapEntries(d.prev[:0], existing); err != nil {
+		return nil, err
+	}
+	if d.curr, err = parseMapEntries(d.curr[:0], upserts); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range d.curr {
+		if idx := findMapEntry(d.prev, entry.key); idx >= 0 {
+			d.prev[idx] = entry
+			continue
+		}
+		d.prev = append(d.prev, entry)
+	}
+	for _, key := range removedKeys {
+		if idx := findMapEntry(d.prev, key); idx >= 0 {
+			d.prev = append(d.prev[:idx], d.prev[idx+1:]...)
+		}
+	}
+
+	for _, entry := range d.prev {
+		dst = append(dst, entry.entry...)
+	}
+	return dst, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/x/clock"
+
+	"go.uber.org/zap"
+)
+
+const marshalFallbacksLogInterval = time.Minute
+
+// defaultMarshalFallbacksLogLimiter is shared by all of the encoders since many of them are
+// typically reset with the same schema.
+var defaultMarshalFallbacksLogLimiter = newMarshalFallbacksLogLimiter(
+	marshalFallbacksLogInterval, time.Now)
+
+// marshalFallbacksLogLimiter limits how often the marshal fallbacks of each schema are logged.
+type marshalFallbacksLogLimiter struct {
+	sync.Mutex
+
+	interval   time.Duration
+	nowFn      clock.NowFn
+	lastLogged map[string]time.Time
+}
+
+func newMarshalFallbacksLogLimiter(
+	interval time.Duration,
+	nowFn clock.NowFn,
+) *marshalFallbacksLogLimiter {
+	return &marshalFallbacksLogLimiter{
+		interval:   interval,
+		nowFn:      nowFn,
+		lastLogged: make(map[string]time.Time),
+	}
+}
+
+// allow returns whether the marshal fallbacks of the schema with the given name can be logged,
+// in which case they can't be again for the interval.
+func (l *marshalFallbacksLogLimiter) allow(schemaName string) bool {
+	now := l.nowFn()
+	l.Lock()
+	defer l.Unlock()
+
+	if lastLogged, ok := l.lastLogged[schemaName]; ok && now.Sub(lastLogged) < l.interval {
+		return false
+	}
+	l.lastLogged[schemaName] = now
+	return true
+}
+
+// marshalFallbacks contains the numbers of the fields of a schema that are ProtoBuf marshalled
+// rather than custom encoded, by reason.
+type marshalFallbacks struct {
+	// The type of the field isn't custom encodable, or the field is repeated.
+	unsupportedType []int32
+	// The field is a member of a oneof and OneofFields is set.
+	oneofMember []int32
+	// The field isn't in the CustomFieldsAllowlist.
+	notAllowlisted []int32
+	// The field exceeds the MaxCustomFields.
+	maxCustomFields []int32
+}
+
+// marshalFallbacks returns the fields of the encoder's schema that are ProtoBuf marshalled
+// rather than custom encoded.
+func (enc *Encoder) marshalFallbacks() marshalFallbacks {
+	var (
+		fallbacks   marshalFallbacks
+		oneofFields = enc.opts.OneofFields()
+		allowlist   = enc.opts.CustomFieldsAllowlist()
+	)
+	for _, nonCustomField := range enc.nonCustomFields {
+		var (
+			fieldNum = nonCustomField.fieldNum
+			field    = enc.schema.FindFieldByNumber(fieldNum)
+		)
+		if field == nil {
+			continue
+		}
+		switch {
+		case isSortedFieldNum(enc.limitedCustomFieldNums, fieldNum):
+			if len(allowlist) > 0 && !stringsContain(allowlist, field.GetName()) {
+				fallbacks.notAllowlisted = append(fallbacks.notAllowlisted, fieldNum)
+			} else {
+				fallbacks.maxCustomFields = append(fallbacks.maxCustomFields, fieldNum)
+			}
+		case oneofFields && field.GetOneOf() != nil:
+			if _, ok := isCustomField(field.GetType(), field.IsRepeated()); ok {
+				fallbacks.oneofMember = append(fallbacks.oneofMember, fieldNum)
+			} else {
+				fallbacks.unsupportedType = append(fallbacks.unsupportedType, fieldNum)
+			}
+		default:
+			fallbacks.unsupportedType = append(fallbacks.unsupportedType, fieldNum)
+		}
+	}
+	return fallbacks
+}
+
+// logMarshalFallbacks logs the fields of the encoder's schema that are ProtoBuf marshalled
+// rather than custom encoded, if any, unless they were logged for the schema recently.
+func (enc *Encoder) logMarshalFallbacks() {
+	if len(enc.nonCustomFields) == 0 {
+		return
+	}
+	schemaName := enc.schema.GetFullyQualifiedName()
+	if !enc.marshalFallbacksLogLimiter.allow(schemaName) {
+		return
+	}
+
+	fallbacks := enc.marshalFallbacks()
+	fields := []zap.Field{zap.String("schema", schemaName)}
+	for _, reason := range []struct {
+		key       string
+		fieldNums []int32
+	}{
+		{key: "unsupportedType", fieldNums: fallbacks.unsupportedType},
+		{key: "oneofMember", fieldNums: fallbacks.oneofMember},
+		{key: "notAllowlisted", fieldNums: fallbacks.notAllowlisted},
+		{key: "maxCustomFields", fieldNums: fallbacks.maxCustomFields},
+	} {
+		if len(reason.fieldNums) > 0 {
+			fields = append(fields, zap.Int32s(reason.key, reason.fieldNums))
+		}
+	}
+	enc.opts.InstrumentOptions().Logger().Info(
+		"proto encoder marshals fields rather than custom encoding them", fields...)
+}
+
+func stringsContain(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
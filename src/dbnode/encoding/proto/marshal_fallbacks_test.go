@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/namespace"
+
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestEncoderLogMarshalFallbacks(t *testing.T) {
+	schema, err := builder.NewMessage("Fallbacks").
+		AddField(builder.NewField("a", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("b", builder.FieldTypeInt64()).SetNumber(2)).
+		AddField(builder.NewField("c", builder.FieldTypeInt64()).SetRepeated().SetNumber(3)).
+		AddField(builder.NewMapField("d", builder.FieldTypeString(), builder.FieldTypeString()).SetNumber(4)).
+		AddOneOf(builder.NewOneOf("choice").
+			AddChoice(builder.NewField("e", builder.FieldTypeInt64()).SetNumber(5))).
+		AddField(builder.NewField("f", builder.FieldTypeString()).SetNumber(6)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		core, logs = observer.New(zapcore.InfoLevel)
+		opts       = testEncodingOptions.
+				SetInstrumentOptions(testEncodingOptions.InstrumentOptions().SetLogger(zap.New(core))).
+				SetOneofFields(true).
+				SetCustomFieldsAllowlist([]string{"a", "f"}).
+				SetMaxCustomFields(1)
+		now   = time.Now()
+		start = now.Truncate(time.Second)
+		descr = namespace.GetTestSchemaDescr(schema)
+	)
+	enc := NewEncoder(start, opts)
+	require.Nil(t, enc.marshalFallbacksLogLimiter)
+	enc.Reset(start, 0, descr)
+	require.Equal(t, 0, logs.Len())
+
+	enc = NewEncoder(start, opts.SetLogMarshalFallbacks(true))
+	enc.marshalFallbacksLogLimiter = newMarshalFallbacksLogLimiter(time.Minute, func() time.Time {
+		return now
+	})
+	enc.Reset(start, 0, descr)
+	require.Equal(t, []observer.LoggedEntry{{
+		Entry: zapcore.Entry{
+			Level:   zapcore.InfoLevel,
+			Message: "proto encoder marshals fields rather than custom encoding them",
+		},
+		Context: []zapcore.Field{
+			zap.String("schema", "Fallbacks"),
+			zap.Int32s("unsupportedType", []int32{3, 4}),
+			zap.Int32s("oneofMember", []int32{5}),
+			zap.Int32s("notAllowlisted", []int32{2}),
+			zap.Int32s("maxCustomFields", []int32{6}),
+		},
+	}}, logs.AllUntimed())
+
+	// The fields are only logged once per interval for each schema.
+	enc.Reset(start, 0, descr)
+	require.Equal(t, 1, logs.Len())
+	now = now.Add(time.Minute)
+	enc.Reset(start, 0, descr)
+	require.Equal(t, 2, logs.Len())
+}
+
+func TestMarshalFallbacksLogLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newMarshalFallbacksLogLimiter(time.Minute, func() time.Time {
+		return now
+	})
+	require.True(t, limiter.allow("a"))
+	require.False(t, limiter.allow("a"))
+	require.True(t, limiter.allow("b"))
+
+	now = now.Add(time.Minute - 1)
+	require.False(t, limiter.allow("a"))
+	now = now.Add(1)
+	require.True(t, limiter.allow("a"))
+	require.False(t, limiter.allow("a"))
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/m3db/m3/src/dbnode/ts"
+)
+
+// SplitMessageBatch appends the marshalled messages of the annotation of a datapoint of a
+// stream of message batches (see Encoder.EncodeMulti) to dst. The messages reference the
+// annotation rather than copies of it so they're only valid as long as it is.
+func SplitMessageBatch(dst []ts.Annotation, batch ts.Annotation) ([]ts.Annotation, error) {
+	for len(batch) > 0 {
+		size, n := binary.Uvarint(batch)
+		if n <= 0 {
+			return dst, fmt.Errorf("%s invalid message batch: error reading message length", itErrPrefix)
+		}
+		batch = batch[n:]
+		if size > uint64(len(batch)) {
+			return dst, fmt.Errorf(
+				"%s invalid message batch: message length %d exceeds remaining %d bytes",
+				itErrPrefix, size, len(batch))
+		}
+		dst = append(dst, batch[:size])
+		batch = batch[size:]
+	}
+	return dst, nil
+}
+
+// appendMessageBatch appends a marshalled message, preceded by its length, to a batch.
+func appendMessageBatch(batch []byte, message []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(message)))
+	batch = append(batch, buf[:n]...)
+	return append(batch, message...)
+}
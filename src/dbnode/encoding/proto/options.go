@@ -0,0 +1,455 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/x/instrument"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+var (
+	// default proto encoding options
+	defaultOptions = newOptions()
+)
+
+type options struct {
+	encodingOpts                 encoding.Options
+	endOfStreamMarker            bool
+	mapFieldDiffs                bool
+	invalidCustomFieldsAsDefault bool
+	compactHeader                bool
+	fullNonCustomFields          bool
+	lenientDecoding              bool
+	staticBytesDictionary        [][]byte
+	maxRetainedBufferCapacity    int
+	rejectEmptyAnnotations       bool
+	oneofFields                  bool
+	maxInternedBytesValues       int
+	bytesDictResets              bool
+	intChangesBitset             bool
+	intDeltaOfDeltaFields        []string
+	validateMessages             bool
+	schemaHash                   bool
+	omitEmptyProtoPortion        bool
+	repeatedToSingularStrategy   RepeatedToSingularStrategy
+	tracer                       opentracing.Tracer
+	targetEncodingSchemeVersion  int
+	valueRangesTrailer           bool
+	unsignedIntWraparound        bool
+	maxCustomFields              int
+	customFieldsAllowlist        []string
+	flushMaxDatapoints           int
+	flushMaxBytes                int
+	customFieldOrder             []string
+	intValuedFloats              bool
+	streamMetadata               []byte
+	floatBaselines               map[string]float64
+	unknownFieldsPassthrough     bool
+	bytesPrefixDelta             bool
+	messageBatches               bool
+	instrumentOpts               instrument.Options
+	logMarshalFallbacks          bool
+	retainLastEncodedMessage     bool
+}
+
+func newOptions() Options {
+	return &options{
+		encodingOpts:   encoding.NewOptions(),
+		instrumentOpts: instrument.NewOptions(),
+	}
+}
+
+// NewOptions creates a new options.
+func NewOptions() Options {
+	return defaultOptions
+}
+
+func (o *options) SetEncodingOptions(value encoding.Options) Options {
+	opts := *o
+	opts.encodingOpts = value
+	return &opts
+}
+
+func (o *options) EncodingOptions() encoding.Options {
+	return o.encodingOpts
+}
+
+func (o *options) SetEndOfStreamMarker(value bool) Options {
+	opts := *o
+	opts.endOfStreamMarker = value
+	return &opts
+}
+
+func (o *options) EndOfStreamMarker() bool {
+	return o.endOfStreamMarker
+}
+
+func (o *options) SetMapFieldDiffs(value bool) Options {
+	opts := *o
+	opts.mapFieldDiffs = value
+	return &opts
+}
+
+func (o *options) MapFieldDiffs() bool {
+	return o.mapFieldDiffs
+}
+
+func (o *options) SetInvalidCustomFieldsAsDefault(value bool) Options {
+	opts := *o
+	opts.invalidCustomFieldsAsDefault = value
+	return &opts
+}
+
+func (o *options) InvalidCustomFieldsAsDefault() bool {
+	return o.invalidCustomFieldsAsDefault
+}
+
+func (o *options) SetCompactHeader(value bool) Options {
+	opts := *o
+	opts.compactHeader = value
+	return &opts
+}
+
+func (o *options) CompactHeader() bool {
+	return o.compactHeader
+}
+
+func (o *options) SetFullNonCustomFields(value bool) Options {
+	opts := *o
+	opts.fullNonCustomFields = value
+	return &opts
+}
+
+func (o *options) FullNonCustomFields() bool {
+	return o.fullNonCustomFields
+}
+
+func (o *options) SetLenientDecoding(value bool) Options {
+	opts := *o
+	opts.lenientDecoding = value
+	return &opts
+}
+
+func (o *options) LenientDecoding() bool {
+	return o.lenientDecoding
+}
+
+func (o *options) SetStaticBytesDictionary(value [][]byte) Options {
+	opts := *o
+	opts.staticBytesDictionary = value
+	return &opts
+}
+
+func (o *options) StaticBytesDictionary() [][]byte {
+	return o.staticBytesDictionary
+}
+
+func (o *options) SetMaxRetainedBufferCapacity(value int) Options {
+	opts := *o
+	opts.maxRetainedBufferCapacity = value
+	return &opts
+}
+
+func (o *options) MaxRetainedBufferCapacity() int {
+	return o.maxRetainedBufferCapacity
+}
+
+func (o *options) SetRejectEmptyAnnotations(value bool) Options {
+	opts := *o
+	opts.rejectEmptyAnnotations = value
+	return &opts
+}
+
+func (o *options) RejectEmptyAnnotations() bool {
+	return o.rejectEmptyAnnotations
+}
+
+func (o *options) SetOneofFields(value bool) Options {
+	opts := *o
+	opts.oneofFields = value
+	return &opts
+}
+
+func (o *options) OneofFields() bool {
+	return o.oneofFields
+}
+
+func (o *options) SetMaxInternedBytesValues(value int) Options {
+	opts := *o
+	opts.maxInternedBytesValues = value
+	return &opts
+}
+
+func (o *options) MaxInternedBytesValues() int {
+	return o.maxInternedBytesValues
+}
+
+func (o *options) SetBytesDictResets(value bool) Options {
+	opts := *o
+	opts.bytesDictResets = value
+	return &opts
+}
+
+func (o *options) BytesDictResets() bool {
+	return o.bytesDictResets
+}
+
+func (o *options) SetIntChangesBitset(value bool) Options {
+	opts := *o
+	opts.intChangesBitset = value
+	return &opts
+}
+
+func (o *options) IntChangesBitset() bool {
+	return o.intChangesBitset
+}
+
+func (o *options) SetIntDeltaOfDeltaFields(value []string) Options {
+	opts := *o
+	opts.intDeltaOfDeltaFields = value
+	return &opts
+}
+
+func (o *options) IntDeltaOfDeltaFields() []string {
+	return o.intDeltaOfDeltaFields
+}
+
+func (o *options) SetValidateMessages(value bool) Options {
+	opts := *o
+	opts.validateMessages = value
+	return &opts
+}
+
+func (o *options) ValidateMessages() bool {
+	return o.validateMessages
+}
+
+func (o *options) SetSchemaHash(value bool) Options {
+	opts := *o
+	opts.schemaHash = value
+	return &opts
+}
+
+func (o *options) SchemaHash() bool {
+	return o.schemaHash
+}
+
+func (o *options) SetOmitEmptyProtoPortion(value bool) Options {
+	opts := *o
+	opts.omitEmptyProtoPortion = value
+	return &opts
+}
+
+func (o *options) OmitEmptyProtoPortion() bool {
+	return o.omitEmptyProtoPortion
+}
+
+func (o *options) SetRepeatedToSingularStrategy(value RepeatedToSingularStrategy) Options {
+	opts := *o
+	opts.repeatedToSingularStrategy = value
+	return &opts
+}
+
+func (o *options) RepeatedToSingularStrategy() RepeatedToSingularStrategy {
+	return o.repeatedToSingularStrategy
+}
+
+func (o *options) SetTracer(value opentracing.Tracer) Options {
+	opts := *o
+	opts.tracer = value
+	return &opts
+}
+
+func (o *options) Tracer() opentracing.Tracer {
+	return o.tracer
+}
+
+func (o *options) SetTargetEncodingSchemeVersion(value int) Options {
+	opts := *o
+	opts.targetEncodingSchemeVersion = value
+	return &opts
+}
+
+func (o *options) TargetEncodingSchemeVersion() int {
+	return o.targetEncodingSchemeVersion
+}
+
+func (o *options) SetValueRangesTrailer(value bool) Options {
+	opts := *o
+	opts.valueRangesTrailer = value
+	return &opts
+}
+
+func (o *options) ValueRangesTrailer() bool {
+	return o.valueRangesTrailer
+}
+
+func (o *options) SetUnsignedIntWraparound(value bool) Options {
+	opts := *o
+	opts.unsignedIntWraparound = value
+	return &opts
+}
+
+func (o *options) UnsignedIntWraparound() bool {
+	return o.unsignedIntWraparound
+}
+
+func (o *options) SetMaxCustomFields(value int) Options {
+	opts := *o
+	opts.maxCustomFields = value
+	return &opts
+}
+
+func (o *options) MaxCustomFields() int {
+	return o.maxCustomFields
+}
+
+func (o *options) SetCustomFieldsAllowlist(value []string) Options {
+	opts := *o
+	opts.customFieldsAllowlist = value
+	return &opts
+}
+
+func (o *options) CustomFieldsAllowlist() []string {
+	return o.customFieldsAllowlist
+}
+
+func (o *options) SetFlushMaxDatapoints(value int) Options {
+	opts := *o
+	opts.flushMaxDatapoints = value
+	return &opts
+}
+
+func (o *options) FlushMaxDatapoints() int {
+	return o.flushMaxDatapoints
+}
+
+func (o *options) SetFlushMaxBytes(value int) Options {
+	opts := *o
+	opts.flushMaxBytes = value
+	return &opts
+}
+
+func (o *options) FlushMaxBytes() int {
+	return o.flushMaxBytes
+}
+
+func (o *options) SetCustomFieldOrder(value []string) Options {
+	opts := *o
+	opts.customFieldOrder = value
+	return &opts
+}
+
+func (o *options) CustomFieldOrder() []string {
+	return o.customFieldOrder
+}
+
+func (o *options) SetIntValuedFloats(value bool) Options {
+	opts := *o
+	opts.intValuedFloats = value
+	return &opts
+}
+
+func (o *options) IntValuedFloats() bool {
+	return o.intValuedFloats
+}
+
+func (o *options) SetStreamMetadata(value []byte) Options {
+	opts := *o
+	opts.streamMetadata = value
+	return &opts
+}
+
+func (o *options) StreamMetadata() []byte {
+	return o.streamMetadata
+}
+
+func (o *options) SetFloatBaselines(value map[string]float64) Options {
+	opts := *o
+	opts.floatBaselines = value
+	return &opts
+}
+
+func (o *options) FloatBaselines() map[string]float64 {
+	return o.floatBaselines
+}
+
+func (o *options) SetUnknownFieldsPassthrough(value bool) Options {
+	opts := *o
+	opts.unknownFieldsPassthrough = value
+	return &opts
+}
+
+func (o *options) UnknownFieldsPassthrough() bool {
+	return o.unknownFieldsPassthrough
+}
+
+func (o *options) SetBytesPrefixDelta(value bool) Options {
+	opts := *o
+	opts.bytesPrefixDelta = value
+	return &opts
+}
+
+func (o *options) BytesPrefixDelta() bool {
+	return o.bytesPrefixDelta
+}
+
+func (o *options) SetMessageBatches(value bool) Options {
+	opts := *o
+	opts.messageBatches = value
+	return &opts
+}
+
+func (o *options) MessageBatches() bool {
+	return o.messageBatches
+}
+
+func (o *options) SetInstrumentOptions(value instrument.Options) Options {
+	opts := *o
+	opts.instrumentOpts = value
+	return &opts
+}
+
+func (o *options) InstrumentOptions() instrument.Options {
+	return o.instrumentOpts
+}
+
+func (o *options) SetLogMarshalFallbacks(value bool) Options {
+	opts := *o
+	opts.logMarshalFallbacks = value
+	return &opts
+}
+
+func (o *options) LogMarshalFallbacks() bool {
+	return o.logMarshalFallbacks
+}
+
+func (o *options) SetRetainLastEncodedMessage(value bool) Options {
+	opts := *o
+	opts.retainLastEncodedMessage = value
+	return &opts
+}
+
+func (o *options) RetainLastEncodedMessage() bool {
+	return o.retainLastEncodedMessage
+}
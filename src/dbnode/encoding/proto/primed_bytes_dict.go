@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cespare/xxhash"
+)
+
+// primedBytesDicts contains the values that the LRU dictionaries of bytes fields are
+// primed with before the first write of a stream, sorted by field number. The values
+// themselves are not part of the stream, only their hash is encoded into the stream
+// header so that iterators can verify that they were primed with the same values.
+type primedBytesDicts []primedBytesDict
+
+type primedBytesDict struct {
+	fieldNum int
+	// Ordered from least to most recently used.
+	values [][]byte
+}
+
+// set returns the dictionaries with the values of the field replaced by a copy of the
+// provided values.
+func (d primedBytesDicts) set(fieldNum int, values [][]byte) primedBytesDicts {
+	copied := make([][]byte, 0, len(values))
+	for _, value := range values {
+		copied = append(copied, append(make([]byte, 0, len(value)), value...))
+	}
+
+	idx := sort.Search(len(d), func(i int) bool {
+		return d[i].fieldNum >= fieldNum
+	})
+	if idx < len(d) && d[idx].fieldNum == fieldNum {
+		d[idx].values = copied
+		return d
+	}
+
+	d = append(d, primedBytesDict{})
+	copy(d[idx+1:], d[idx:])
+	d[idx] = primedBytesDict{fieldNum: fieldNum, values: copied}
+	return d
+}
+
+// values returns the values the dictionary of the field is primed with, only the most
+// recently used values are returned if there are more than fit in the dictionary.
+func (d primedBytesDicts) values(fieldNum int, lruSize int) [][]byte {
+	for _, dict := range d {
+		if dict.fieldNum != fieldNum {
+			continue
+		}
+		if len(dict.values) > lruSize {
+			return dict.values[len(dict.values)-lruSize:]
+		}
+		return dict.values
+	}
+	return nil
+}
+
+func (d primedBytesDicts) hash() uint64 {
+	var (
+		digest = xxhash.New()
+		buf    [binary.MaxVarintLen64]byte
+	)
+	for _, dict := range d {
+		n := binary.PutUvarint(buf[:], uint64(dict.fieldNum))
+		digest.Write(buf[:n])
+		n = binary.PutUvarint(buf[:], uint64(len(dict.values)))
+		digest.Write(buf[:n])
+		for _, value := range dict.values {
+			n := binary.PutUvarint(buf[:], uint64(len(value)))
+			digest.Write(buf[:n])
+			digest.Write(value)
+		}
+	}
+	return digest.Sum64()
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// lastRepeatedValue returns the marshalled values of a repeated field (one or more
+// <fieldNum, wireType, value> tuples, each of which may be a packed list of values) as a
+// single tuple with only the last value, which is how Protobuf parsers interpret repeated
+// values of a singular field. The result is appended to dst.
+func lastRepeatedValue(
+	fieldNum int32,
+	fieldType dpb.FieldDescriptorProto_Type,
+	marshalled []byte,
+	dst []byte,
+) ([]byte, error) {
+	var (
+		buf           = newCodedBuffer(marshalled)
+		valueWireType = wireTypeOf(fieldType)
+		lastValue     []byte
+	)
+	for !buf.eof() {
+		tupleFieldNum, wireType, err := buf.decodeTagAndWireType()
+		if err != nil {
+			return nil, err
+		}
+		if tupleFieldNum != fieldNum {
+			return nil, fmt.Errorf(
+				"encountered field number %d in the values of field %d", tupleFieldNum, fieldNum)
+		}
+
+		if wireType == proto.WireBytes && valueWireType != proto.WireBytes {
+			// A packed list of values.
+			packed, err := buf.decodeRawBytes(false)
+			if err != nil {
+				return nil, err
+			}
+			packedBuf := newCodedBuffer(packed)
+			for !packedBuf.eof() {
+				start := packedBuf.index
+				if err := skipValue(packedBuf, valueWireType); err != nil {
+					return nil, err
+				}
+				lastValue = packed[start:packedBuf.index]
+			}
+			continue
+		}
+
+		if wireType != valueWireType {
+			return nil, fmt.Errorf(
+				"field %d of type %s has wire type %d, expected %d",
+				fieldNum, fieldType, wireType, valueWireType)
+		}
+		start := buf.index
+		if err := skipValue(buf, wireType); err != nil {
+			return nil, err
+		}
+		lastValue = marshalled[start:buf.index]
+	}
+
+	if lastValue == nil {
+		return dst, nil
+	}
+
+	out := newCodedBuffer(dst)
+	out.encodeTagAndWireType(fieldNum, valueWireType)
+	out.append(lastValue)
+	return out.buf, nil
+}
+
+// wireTypeOf returns the wire type of the (unpacked) values of a scalar field type.
+func wireTypeOf(fieldType dpb.FieldDescriptorProto_Type) int8 {
+	switch fieldType {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE,
+		dpb.FieldDescriptorProto_TYPE_FIXED64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return proto.WireFixed64
+	case dpb.FieldDescriptorProto_TYPE_FLOAT,
+		dpb.FieldDescriptorProto_TYPE_FIXED32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return proto.WireFixed32
+	case dpb.FieldDescriptorProto_TYPE_STRING,
+		dpb.FieldDescriptorProto_TYPE_BYTES,
+		dpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return proto.WireBytes
+	default:
+		return proto.WireVarint
+	}
+}
+
+// skipValue skips over a value of the wire type, including its length prefix if any.
+func skipValue(buf *buffer, wireType int8) error {
+	switch wireType {
+	case proto.WireFixed64:
+		_, err := buf.decodeFixed64()
+		return err
+	case proto.WireFixed32:
+		_, err := buf.decodeFixed32()
+		return err
+	case proto.WireVarint:
+		_, err := buf.decodeVarint()
+		return err
+	case proto.WireBytes:
+		_, err := buf.decodeRawBytes(false)
+		return err
+	default:
+		return proto.ErrInternalBadWireType
+	}
+}
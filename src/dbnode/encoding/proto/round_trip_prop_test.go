@@ -383,6 +383,233 @@ func TestBijectivityProp(t *testing.T) {
 	}
 }
 
+// TestRoundTripOscillationProp exercises the round-trip of sequences of messages in which
+// every field oscillates between its default value and a small pool of non-default values
+// with a tiny bytes dictionary. This aggressively exercises the change / no-change control
+// bits, the default value bitsets and the bytes dictionary LRU (including evictions).
+//
+// Unlike TestRoundTripProp the sequence of messages is shrinkable so a failure will be
+// reported with a minimal sequence of values (0 being the default value for a field and
+// N being the value of the Nth message in the pool) for the (printed) schema.
+func TestRoundTripOscillationProp(t *testing.T) {
+	var (
+		parameters = gopter.DefaultTestParameters()
+		seed       = time.Now().UnixNano()
+		props      = gopter.NewProperties(parameters)
+		reporter   = gopter.NewFormatedReporter(true, 160, os.Stdout)
+	)
+	parameters.MinSuccessfulTests = 300
+	parameters.Rng.Seed(seed)
+
+	iter := NewIterator(nil, nil, testEncodingOptions).(*iterator)
+	props.Property("Oscillating fields should round-trip", prop.ForAll(
+		func(input oscillationPropTestInput, sequence [][]int) (bool, error) {
+			opts := testEncodingOptions.
+				SetMapFieldDiffs(input.mapFieldDiffs).
+				SetCompactHeader(input.compactHeader).
+				SetFullNonCustomFields(input.fullNonCustomFields).
+				SetMaxInternedBytesValues(input.maxInternedBytesValues).
+				SetOmitEmptyProtoPortion(input.omitEmptyProtoPortion).
+				SetBytesPrefixDelta(input.bytesPrefixDelta)
+			if input.intDeltaOfDelta {
+				var fieldNames []string
+				for _, field := range input.schema.GetFields() {
+					fieldNames = append(fieldNames, field.GetName())
+				}
+				opts = opts.SetIntDeltaOfDeltaFields(fieldNames)
+			}
+			iter := iter
+			if input.staticBytesDict {
+				// Only the values of the first message of the pool are in the static dictionary
+				// so that values that are and aren't in it are both exercised.
+				opts = opts.SetStaticBytesDictionary(
+					newTestStaticBytesDict(input.schema, input.pool[0]))
+				iter = NewIterator(nil, nil, opts).(*iterator)
+			}
+			var (
+				start       = time.Now().Truncate(time.Second)
+				schemaDescr = namespace.GetTestSchemaDescr(input.schema)
+				fields      = input.schema.GetFields()
+				messages    = make([]*dynamic.Message, 0, len(sequence))
+				enc         = NewEncoder(start, opts)
+			)
+			enc.Reset(start, 0, schemaDescr)
+			if err := enc.SetByteFieldDictionaryLRUSize(input.lruSize); err != nil {
+				return false, err
+			}
+
+			for i, choices := range sequence {
+				m := dynamic.NewMessage(input.schema)
+				for j, field := range fields {
+					if j >= len(choices) || choices[j] == 0 {
+						continue
+					}
+					fieldNum := int(field.GetNumber())
+					poolMessage := input.pool[(choices[j]-1)%len(input.pool)]
+					m.SetFieldByNumber(fieldNum, poolMessage.GetFieldByNumber(fieldNum))
+				}
+				messages = append(messages, m)
+
+				mBytes, err := m.Marshal()
+				if err != nil {
+					return false, fmt.Errorf("error marshalling proto message: %v", err)
+				}
+				dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+				if err := enc.Encode(dp, xtime.Second, mBytes); err != nil {
+					return false, fmt.Errorf(
+						"error encoding message: %v, schema: %s", err, input.schema.String())
+				}
+			}
+
+			ctx := context.NewContext()
+			defer ctx.Close()
+
+			stream, ok := enc.Stream(ctx)
+			if !ok {
+				if len(sequence) == 0 {
+					return true, nil
+				}
+				return false, fmt.Errorf("encoder returned empty stream")
+			}
+
+			iter.Reset(stream, schemaDescr)
+			i := 0
+			for iter.Next() {
+				_, _, annotation := iter.Current()
+				decodedM := dynamic.NewMessage(input.schema)
+				if err := decodedM.Unmarshal(annotation); err != nil {
+					return false, fmt.Errorf("error unmarshalling decoded message: %v", err)
+				}
+				for _, field := range fields {
+					var (
+						fieldNum    = int(field.GetNumber())
+						expectedVal = messages[i].GetFieldByNumber(fieldNum)
+						actualVal   = decodedM.GetFieldByNumber(fieldNum)
+					)
+					if !fieldsEqual(expectedVal, actualVal) {
+						return false, fmt.Errorf(
+							"expected %v but got %v on iteration number %d and fieldNum %d, schema %s",
+							expectedVal, actualVal, i, fieldNum, input.schema)
+					}
+				}
+				i++
+			}
+			if iter.Err() != nil {
+				return false, fmt.Errorf(
+					"iteration error: %v, schema: %s", iter.Err(), input.schema.String())
+			}
+			if i != len(sequence) {
+				return false, fmt.Errorf("expected %d messages but got %d", len(sequence), i)
+			}
+
+			return true, nil
+		},
+		genOscillationPropTestInput(),
+		gen.SliceOf(gen.SliceOfN(maxNumFields, gen.IntRange(0, oscillationPoolSize))),
+	))
+
+	if !props.Run(reporter) {
+		t.Errorf("failed with initial seed: %d", seed)
+	}
+}
+
+const oscillationPoolSize = 3
+
+type oscillationPropTestInput struct {
+	schema              *desc.MessageDescriptor
+	pool                []*dynamic.Message
+	lruSize             int
+	mapFieldDiffs       bool
+	compactHeader       bool
+	fullNonCustomFields bool
+	staticBytesDict     bool
+	// Smaller than the pool size so that values that are and aren't interned are both
+	// exercised.
+	maxInternedBytesValues int
+	// Whether all of the int fields are encoded as a delta-of-delta.
+	intDeltaOfDelta       bool
+	omitEmptyProtoPortion bool
+	bytesPrefixDelta      bool
+}
+
+func (i oscillationPropTestInput) String() string {
+	return fmt.Sprintf(
+		"schema: %s, lruSize: %d, mapFieldDiffs: %v, compactHeader: %v, fullNonCustomFields: %v, staticBytesDict: %v, maxInternedBytesValues: %d, intDeltaOfDelta: %v, omitEmptyProtoPortion: %v, bytesPrefixDelta: %v",
+		i.schema.String(), i.lruSize, i.mapFieldDiffs, i.compactHeader, i.fullNonCustomFields, i.staticBytesDict,
+		i.maxInternedBytesValues, i.intDeltaOfDelta, i.omitEmptyProtoPortion, i.bytesPrefixDelta)
+}
+
+// newTestStaticBytesDict returns a static bytes dictionary with the non empty bytes and
+// string values of the message, as well as a value that's never used.
+func newTestStaticBytesDict(schema *desc.MessageDescriptor, m *dynamic.Message) [][]byte {
+	dict := [][]byte{[]byte("never-used")}
+	for _, field := range schema.GetFields() {
+		switch v := m.GetFieldByNumber(int(field.GetNumber())).(type) {
+		case string:
+			if v != "" {
+				dict = append(dict, []byte(v))
+			}
+		case []byte:
+			if len(v) > 0 {
+				dict = append(dict, v)
+			}
+		}
+	}
+	return dict
+}
+
+func genOscillationPropTestInput() gopter.Gen {
+	return gopter.CombineGens(
+		gen.IntRange(1, maxNumFields),
+		gen.IntRange(1, oscillationPoolSize),
+		gen.Bool(),
+		gen.Bool(),
+		gen.Bool(),
+		gen.Bool(),
+		gen.IntRange(0, oscillationPoolSize-1),
+		gen.Bool(),
+		gen.Bool(),
+		gen.Bool(),
+	).FlatMap(func(input interface{}) gopter.Gen {
+		var (
+			inputs              = input.([]interface{})
+			numFields           = inputs[0].(int)
+			lruSize             = inputs[1].(int)
+			mapFieldDiffs       = inputs[2].(bool)
+			compactHeader       = inputs[3].(bool)
+			fullNonCustomFields = inputs[4].(bool)
+			staticBytesDict     = inputs[5].(bool)
+			maxInterned         = inputs[6].(int)
+			intDeltaOfDelta     = inputs[7].(bool)
+			omitEmptyProto      = inputs[8].(bool)
+			bytesPrefixDelta    = inputs[9].(bool)
+		)
+		return genSchema(numFields).FlatMap(func(input interface{}) gopter.Gen {
+			schema := input.(*desc.MessageDescriptor)
+			return gen.SliceOfN(oscillationPoolSize, genMessage(schema)).Map(
+				func(messages []messageAndTimeUnit) oscillationPropTestInput {
+					pool := make([]*dynamic.Message, 0, len(messages))
+					for _, m := range messages {
+						pool = append(pool, m.message)
+					}
+					return oscillationPropTestInput{
+						schema:                 schema,
+						pool:                   pool,
+						lruSize:                lruSize,
+						mapFieldDiffs:          mapFieldDiffs,
+						compactHeader:          compactHeader,
+						fullNonCustomFields:    fullNonCustomFields,
+						staticBytesDict:        staticBytesDict,
+						maxInternedBytesValues: maxInterned,
+						intDeltaOfDelta:        intDeltaOfDelta,
+						omitEmptyProtoPortion:  omitEmptyProto,
+						bytesPrefixDelta:       bytesPrefixDelta,
+					}
+				})
+		}, reflect.TypeOf(oscillationPropTestInput{}))
+	}, reflect.TypeOf(oscillationPropTestInput{}))
+}
+
 type propTestInput struct {
 	schema   *desc.MessageDescriptor
 	messages []messageAndTimeUnit
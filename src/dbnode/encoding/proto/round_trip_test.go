@@ -22,18 +22,25 @@ package proto
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/m3db/m3/src/dbnode/encoding"
 	"github.com/m3db/m3/src/dbnode/namespace"
 	"github.com/m3db/m3/src/dbnode/ts"
+	"github.com/m3db/m3/src/x/context"
 	"github.com/m3db/m3/src/x/pool"
 	xtime "github.com/m3db/m3/src/x/time"
 
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
 	"github.com/jhump/protoreflect/desc/protoparse"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/stretchr/testify/require"
@@ -45,9 +52,10 @@ var (
 	bytesPool     = pool.NewCheckedBytesPool(nil, nil, func(s []pool.Bucket) pool.BytesPool {
 		return pool.NewBytesPool(s, nil)
 	})
-	testEncodingOptions = encoding.NewOptions().
-				SetDefaultTimeUnit(xtime.Second).
-				SetBytesPool(bytesPool)
+	testEncodingOptions = NewOptions().
+				SetEncodingOptions(encoding.NewOptions().
+					SetDefaultTimeUnit(xtime.Second).
+					SetBytesPool(bytesPool))
 )
 
 func init() {
@@ -305,6 +313,190 @@ func TestRoundTripMidStreamSchemaChanges(t *testing.T) {
 	require.NoError(t, iter.Err())
 }
 
+func TestRoundTripIntSignednessDeterminedByHeader(t *testing.T) {
+	var (
+		encodeSchema = newIntSignednessTestSchema(t,
+			dpb.FieldDescriptorProto_TYPE_INT64,
+			dpb.FieldDescriptorProto_TYPE_INT32,
+			dpb.FieldDescriptorProto_TYPE_UINT32)
+		// Same wire types (varint), different signedness interpretation.
+		decodeSchema = newIntSignednessTestSchema(t,
+			dpb.FieldDescriptorProto_TYPE_UINT64,
+			dpb.FieldDescriptorProto_TYPE_SINT32,
+			dpb.FieldDescriptorProto_TYPE_SINT32)
+		start = time.Now().Truncate(time.Second)
+		enc   = newTestEncoder(start)
+	)
+	enc.SetSchema(namespace.GetTestSchemaDescr(encodeSchema))
+
+	values := []int64{-5, 10, -1 << 31}
+	for i, v := range values {
+		m := dynamic.NewMessage(encodeSchema)
+		m.SetFieldByNumber(1, v)
+		m.SetFieldByNumber(2, int32(v))
+		m.SetFieldByNumber(3, uint32(v))
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+
+	rawBytes, err := enc.Bytes()
+	require.NoError(t, err)
+
+	iter := NewIterator(
+		bytes.NewBuffer(rawBytes), namespace.GetTestSchemaDescr(decodeSchema), testEncodingOptions)
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(decodeSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+
+		// The stored bits must be interpreted according to the type recorded in
+		// the header and then converted to the type in the decoding schema.
+		v := values[i]
+		require.Equal(t, uint64(v), m.GetFieldByNumber(1))
+		require.Equal(t, int32(v), m.GetFieldByNumber(2))
+		require.Equal(t, int32(uint32(v)), m.GetFieldByNumber(3))
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(values), i)
+}
+
+func TestRoundTripEndOfStreamMarker(t *testing.T) {
+	var (
+		start = time.Now().Truncate(time.Second)
+		opts  = testEncodingOptions.SetEndOfStreamMarker(true)
+		enc   = NewEncoder(start, opts)
+		ctx   = context.NewContext()
+	)
+	defer ctx.Close()
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+	numWrites := 10
+	for i := 0; i < numWrites; i++ {
+		vl := newVL(float64(i), float64(i)*2, int64(i), []byte(fmt.Sprintf("%d", i%3)), nil)
+		marshalledVL, err := vl.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalledVL))
+	}
+
+	var (
+		streamBytes  = getCurrEncoderBytes(ctx, t, enc)
+		discarded    = enc.Discard()
+		discardBytes = append([]byte(nil), discarded.Head.Bytes()...)
+	)
+	require.Equal(t, streamBytes, discardBytes)
+
+	iterate := func(b []byte) (int, error) {
+		iter := NewIterator(bytes.NewReader(b), namespace.GetTestSchemaDescr(testVLSchema), opts)
+		numRead := 0
+		for iter.Next() {
+			numRead++
+		}
+		return numRead, iter.Err()
+	}
+
+	numRead, err := iterate(streamBytes)
+	require.NoError(t, err)
+	require.Equal(t, numWrites, numRead)
+
+	// Every possible truncation of the stream should be detected.
+	for i := 1; i < len(streamBytes); i++ {
+		_, err := iterate(streamBytes[:i])
+		require.Error(t, err, "expected error for stream truncated to %d bytes", i)
+	}
+}
+
+func TestRoundTripIntWireTypeDeterminedBySchema(t *testing.T) {
+	var (
+		encodeSchema = newIntSignednessTestSchema(t,
+			dpb.FieldDescriptorProto_TYPE_INT64,
+			dpb.FieldDescriptorProto_TYPE_INT64,
+			dpb.FieldDescriptorProto_TYPE_INT64,
+			dpb.FieldDescriptorProto_TYPE_INT64,
+			dpb.FieldDescriptorProto_TYPE_INT64)
+		// Different wire types than the varint that the fields were marshalled with.
+		decodeSchema = newIntSignednessTestSchema(t,
+			dpb.FieldDescriptorProto_TYPE_SINT64,
+			dpb.FieldDescriptorProto_TYPE_FIXED64,
+			dpb.FieldDescriptorProto_TYPE_SFIXED32,
+			dpb.FieldDescriptorProto_TYPE_FIXED32,
+			dpb.FieldDescriptorProto_TYPE_BOOL)
+		start = time.Now().Truncate(time.Second)
+		enc   = newTestEncoder(start)
+	)
+	enc.SetSchema(namespace.GetTestSchemaDescr(encodeSchema))
+
+	values := []int64{-5, 10, 0, 1 << 40}
+	for i, v := range values {
+		m := dynamic.NewMessage(encodeSchema)
+		for fieldNum := 1; fieldNum <= 5; fieldNum++ {
+			m.SetFieldByNumber(fieldNum, v)
+		}
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+
+	rawBytes, err := enc.Bytes()
+	require.NoError(t, err)
+
+	iter := NewIterator(
+		bytes.NewBuffer(rawBytes), namespace.GetTestSchemaDescr(decodeSchema), testEncodingOptions)
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(decodeSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+
+		v := values[i]
+		require.Equal(t, v, m.GetFieldByNumber(1))
+		require.Equal(t, uint64(v), m.GetFieldByNumber(2))
+		require.Equal(t, int32(v), m.GetFieldByNumber(3))
+		require.Equal(t, uint32(v), m.GetFieldByNumber(4))
+		require.Equal(t, v != 0, m.GetFieldByNumber(5))
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(values), i)
+
+	// A field that is no longer an integer can't be decoded.
+	decodeSchema = newIntSignednessTestSchema(t, dpb.FieldDescriptorProto_TYPE_STRING)
+	iter = NewIterator(
+		bytes.NewBuffer(rawBytes), namespace.GetTestSchemaDescr(decodeSchema), testEncodingOptions)
+	require.False(t, iter.Next())
+	require.Error(t, iter.Err())
+}
+
+func newIntSignednessTestSchema(
+	t *testing.T,
+	types ...dpb.FieldDescriptorProto_Type,
+) *desc.MessageDescriptor {
+	schemaBuilder := builder.NewMessage("IntSignedness")
+	for i, fieldType := range types {
+		fieldNum := int32(i + 1)
+		schemaBuilder.AddField(
+			builder.NewField(fmt.Sprintf("_%d", fieldNum), builder.FieldTypeScalar(fieldType)).
+				SetNumber(fieldNum))
+	}
+	schema, err := schemaBuilder.Build()
+	require.NoError(t, err)
+	return schema
+}
+
+// withByteFieldDictionaryLRUSize returns the options with the ByteFieldDictionaryLRUSize of
+// their encoding options set to size.
+func withByteFieldDictionaryLRUSize(opts Options, size int) Options {
+	return opts.SetEncodingOptions(opts.EncodingOptions().SetByteFieldDictionaryLRUSize(size))
+}
+
 func newTestEncoder(t time.Time) *Encoder {
 	e := NewEncoder(t, testEncodingOptions)
 	e.Reset(t, 0, nil)
@@ -312,6 +504,36 @@ func newTestEncoder(t time.Time) *Encoder {
 	return e
 }
 
+// encodeTestMessages encodes the messages with a new encoder that's created with opts and
+// reset with schema, see appendTestMessages.
+func encodeTestMessages(
+	t *testing.T,
+	start time.Time,
+	opts Options,
+	schema *desc.MessageDescriptor,
+	messages []*dynamic.Message,
+) []byte {
+	enc := NewEncoder(start, opts)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+	return appendTestMessages(t, enc, start, messages)
+}
+
+// appendTestMessages encodes the messages with the encoder one second apart, the first of
+// them at start, and returns a copy of the stream of the encoder.
+func appendTestMessages(t *testing.T, enc *Encoder, start time.Time, messages []*dynamic.Message) []byte {
+	for i, m := range messages {
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+
+	ctx := context.NewContext()
+	defer ctx.Close()
+	return getCurrEncoderBytes(ctx, t, enc)
+}
+
 func newVL(
 	lat, long float64,
 	epoch int64,
@@ -373,3 +595,2668 @@ func assertAttributesEqual(t *testing.T, expected map[string]string, actual map[
 		require.Equal(t, v, actual[k].(string))
 	}
 }
+
+func TestRoundTripNonCustomFieldsChangedToDefault(t *testing.T) {
+	nestedBuilder := builder.NewMessage("Nested").
+		AddField(builder.NewField("payload", builder.FieldTypeString()).SetNumber(1))
+	schema, err := builder.NewMessage("Defaults").
+		AddField(builder.NewField("ints", builder.FieldTypeInt64()).SetRepeated().SetNumber(1)).
+		AddField(builder.NewField("strs", builder.FieldTypeString()).SetRepeated().SetNumber(2)).
+		AddField(builder.NewMapField("m", builder.FieldTypeString(), builder.FieldTypeInt64()).SetNumber(3)).
+		AddField(builder.NewField("nested", builder.FieldTypeMessage(nestedBuilder)).SetNumber(4)).
+		Build()
+	require.NoError(t, err)
+
+	newNested := func(payload string) *dynamic.Message {
+		m := dynamic.NewMessage(schema.FindFieldByNumber(4).GetMessageType())
+		if payload != "" {
+			m.SetFieldByNumber(1, payload)
+		}
+		return m
+	}
+	newAllSet := func() *dynamic.Message {
+		m := dynamic.NewMessage(schema)
+		m.SetFieldByNumber(1, []int64{1, 2})
+		m.SetFieldByNumber(2, []string{"a"})
+		m.PutMapFieldByNumber(3, "k", int64(1))
+		m.SetFieldByNumber(4, newNested("x"))
+		return m
+	}
+	// A set but empty nested message, a repeated string containing an empty string and
+	// an empty packed repeated field (which some marshallers emit) that must be treated
+	// as a default value.
+	emptyValues := dynamic.NewMessage(schema)
+	emptyValues.SetFieldByNumber(2, []string{""})
+	emptyValues.SetFieldByNumber(4, newNested(""))
+	emptyValuesBytes, err := emptyValues.Marshal()
+	require.NoError(t, err)
+	emptyValuesBytes = append(emptyValuesBytes, 1<<3|2, 0)
+
+	type write struct {
+		marshalled []byte
+		expected   *dynamic.Message
+		hasNested  bool
+	}
+	var writes []write
+	for _, m := range []*dynamic.Message{newAllSet(), dynamic.NewMessage(schema), newAllSet()} {
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+		writes = append(writes, write{
+			marshalled: marshalled,
+			expected:   m,
+			hasNested:  m.HasFieldNumber(4),
+		})
+	}
+	writes = append(writes, write{
+		marshalled: emptyValuesBytes,
+		expected:   emptyValues,
+		hasNested:  true,
+	}, write{
+		marshalled: nil,
+		expected:   dynamic.NewMessage(schema),
+		hasNested:  false,
+	})
+
+	var (
+		start       = time.Now().Truncate(time.Second)
+		schemaDescr = namespace.GetTestSchemaDescr(schema)
+		enc         = newTestEncoder(start)
+		ctx         = context.NewContext()
+	)
+	defer ctx.Close()
+	enc.SetSchema(schemaDescr)
+	for i, w := range writes {
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, w.marshalled))
+	}
+
+	stream, ok := enc.Stream(ctx)
+	require.True(t, ok)
+	iter := NewIterator(stream, schemaDescr, testEncodingOptions)
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		decoded := dynamic.NewMessage(schema)
+		require.NoError(t, decoded.Unmarshal(annotation))
+
+		w := writes[i]
+		for _, field := range schema.GetFields() {
+			fieldNum := int(field.GetNumber())
+			require.True(t,
+				fieldsEqual(w.expected.GetFieldByNumber(fieldNum), decoded.GetFieldByNumber(fieldNum)),
+				"write %d field %d: expected %v but got %v", i, fieldNum,
+				w.expected.GetFieldByNumber(fieldNum), decoded.GetFieldByNumber(fieldNum))
+		}
+		require.Equal(t, w.hasNested, decoded.HasFieldNumber(4), "write %d", i)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(writes), i)
+}
+
+func TestRoundTripNonCustomFieldsTogglingPresence(t *testing.T) {
+	sparseBuilder := builder.NewMessage("Sparse").
+		AddField(builder.NewField("payload", builder.FieldTypeString()).SetNumber(1))
+	schema, err := builder.NewMessage("Toggling").
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("labels", builder.FieldTypeString()).SetRepeated().SetNumber(2)).
+		AddField(builder.NewField("sparse", builder.FieldTypeMessage(sparseBuilder)).SetNumber(3)).
+		Build()
+	require.NoError(t, err)
+
+	var labels []string
+	for i := 0; i < 10; i++ {
+		labels = append(labels, fmt.Sprintf("a-fairly-long-label-%d", i))
+	}
+	newMessage := func(i int, hasSparse bool) *dynamic.Message {
+		m := dynamic.NewMessage(schema)
+		m.SetFieldByNumber(1, float64(i+1))
+		m.SetFieldByNumber(2, labels)
+		if hasSparse {
+			sparse := dynamic.NewMessage(schema.FindFieldByNumber(3).GetMessageType())
+			sparse.SetFieldByNumber(1, "payload")
+			m.SetFieldByNumber(3, sparse)
+		}
+		return m
+	}
+
+	var (
+		start       = time.Now().Truncate(time.Second)
+		schemaDescr = namespace.GetTestSchemaDescr(schema)
+		enc         = newTestEncoder(start)
+		ctx         = context.NewContext()
+		written     []*dynamic.Message
+	)
+	defer ctx.Close()
+	enc.SetSchema(schemaDescr)
+	for i := 0; i < 20; i++ {
+		// The sparse field toggles between present and absent every couple of writes.
+		m := newMessage(i, i%4 < 2)
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+		written = append(written, m)
+
+		prevLen := enc.Len()
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+		if i == 0 {
+			continue
+		}
+
+		// The unchanged labels (over 200 bytes marshalled) must not be re-marshalled
+		// when the sparse field becomes present or absent, only the sparse field
+		// itself is encoded or, when it becomes absent, its entry in the bitset of
+		// fields set to their default values.
+		maxLen := 8
+		if m.HasFieldNumber(3) && !written[i-1].HasFieldNumber(3) {
+			maxLen = 16
+		}
+		require.True(t, enc.Len()-prevLen <= maxLen,
+			"write %d grew the stream by %d bytes", i, enc.Len()-prevLen)
+	}
+
+	stream, ok := enc.Stream(ctx)
+	require.True(t, ok)
+	iter := NewIterator(stream, schemaDescr, testEncodingOptions)
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		decoded := dynamic.NewMessage(schema)
+		require.NoError(t, decoded.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], decoded),
+			"write %d: expected %s but got %s", i, written[i].String(), decoded.String())
+		require.Equal(t, written[i].HasFieldNumber(3), decoded.HasFieldNumber(3), "write %d", i)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+}
+
+func TestRoundTripResetWithUnchangedSchemaEncodesSchema(t *testing.T) {
+	var (
+		start       = time.Now().Truncate(time.Second)
+		schemaDescr = namespace.GetTestSchemaDescrWithDeployID(testVLSchema, "first")
+		enc         = newTestEncoder(start)
+		ctx         = context.NewContext()
+	)
+	defer ctx.Close()
+
+	vl := newVL(1.0, 2.0, 3, []byte("some-delivery-id"), nil)
+	vlBytes, err := vl.Marshal()
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		// Resetting with a schema that has the same deploy ID doesn't change the
+		// schema, but the new stream must still contain it so that it can be read
+		// with a different (evolved) schema.
+		enc.Reset(start, 0, schemaDescr)
+		require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, vlBytes))
+
+		stream := getCurrEncoderBytes(ctx, t, enc)
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(testVL2Schema), testEncodingOptions)
+		require.True(t, iter.Next(), "iteration %d: %v", i, iter.Err())
+		_, _, annotation := iter.Current()
+		decoded := dynamic.NewMessage(testVL2Schema)
+		require.NoError(t, decoded.Unmarshal(annotation))
+		require.Equal(t, vl.GetFieldByName("latitude"), decoded.GetFieldByName("latitude"))
+		require.Equal(t, vl.GetFieldByName("longitude"), decoded.GetFieldByName("longitude"))
+		require.Equal(t, "", decoded.GetFieldByName("new_custom_field"))
+		require.False(t, iter.Next())
+		require.NoError(t, iter.Err())
+	}
+}
+
+func TestRoundTripIgnoresZeroPadding(t *testing.T) {
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	decode := func(opts Options, stream []byte) []ts.Annotation {
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(testVLSchema), opts)
+		var annotations []ts.Annotation
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			annotations = append(annotations, append(ts.Annotation(nil), annotation...))
+		}
+		require.NoError(t, iter.Err())
+		return annotations
+	}
+
+	for _, endOfStreamMarker := range []bool{false, true} {
+		var (
+			start = time.Now().Truncate(time.Second)
+			opts  = testEncodingOptions.SetEndOfStreamMarker(endOfStreamMarker)
+			enc   = NewEncoder(start, opts)
+		)
+		enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+		// Encode a varying number of writes so the last write ends at various
+		// bit offsets within the final byte.
+		for i := 0; i < 16; i++ {
+			vl := newVL(float64(i)*1.5, 2.0, int64(i%3), []byte(fmt.Sprintf("id-%d", i%2)), nil)
+			vlBytes, err := vl.Marshal()
+			require.NoError(t, err)
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, vlBytes))
+
+			stream := getCurrEncoderBytes(ctx, t, enc)
+			expected := decode(opts, stream)
+			require.Equal(t, i+1, len(expected))
+			for numPadding := 1; numPadding <= 9; numPadding++ {
+				padded := append(append([]byte(nil), stream...), make([]byte, numPadding)...)
+				require.Equal(t, expected, decode(opts, padded),
+					"endOfStreamMarker: %v, writes: %d, padding: %d", endOfStreamMarker, i+1, numPadding)
+			}
+		}
+	}
+}
+
+func TestRoundTripSignedZeroFloats(t *testing.T) {
+	schema, err := builder.NewMessage("SignedZero").
+		AddField(builder.NewField("d", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("f", builder.FieldTypeFloat()).SetNumber(2)).
+		Build()
+	require.NoError(t, err)
+
+	// Marshal by hand since some marshallers omit negative zero entirely while
+	// others encode its bit pattern.
+	marshal := func(d float64, f float32) []byte {
+		var b []byte
+		if math.Float64bits(d) != 0 {
+			b = append(b, 1<<3|1)
+			b = append(b, make([]byte, 8)...)
+			binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(d))
+		}
+		if math.Float32bits(f) != 0 {
+			b = append(b, 2<<3|5)
+			b = append(b, make([]byte, 4)...)
+			binary.LittleEndian.PutUint32(b[len(b)-4:], math.Float32bits(f))
+		}
+		return b
+	}
+
+	var (
+		negZero64   = math.Copysign(0, -1)
+		negZero32   = float32(negZero64)
+		values      = []float64{1.5, negZero64, 0, negZero64, 2.5, negZero64}
+		start       = time.Now().Truncate(time.Second)
+		schemaDescr = namespace.GetTestSchemaDescr(schema)
+		ctx         = context.NewContext()
+	)
+	defer ctx.Close()
+	require.True(t, fieldsEqual(negZero64, float64(0)))
+	require.True(t, fieldsEqual(negZero32, float32(0)))
+
+	encode := func(normalize bool) []byte {
+		enc := newTestEncoder(start)
+		enc.SetSchema(schemaDescr)
+		for i, v := range values {
+			if normalize && v == 0 {
+				v = 0
+			}
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, marshal(v, float32(v))))
+		}
+		return getCurrEncoderBytes(ctx, t, enc)
+	}
+
+	// Negative and positive zero produce identical streams.
+	withNegZero := encode(false)
+	require.Equal(t, encode(true), withNegZero)
+
+	iter := NewIterator(bytes.NewReader(withNegZero), schemaDescr, testEncodingOptions)
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		decoded := dynamic.NewMessage(schema)
+		require.NoError(t, decoded.Unmarshal(annotation))
+
+		d := decoded.GetFieldByNumber(1).(float64)
+		f := decoded.GetFieldByNumber(2).(float32)
+		require.Equal(t, values[i], d, "write %d", i)
+		require.Equal(t, float32(values[i]), f, "write %d", i)
+		require.False(t, math.Signbit(d), "write %d", i)
+		require.False(t, math.Signbit(float64(f)), "write %d", i)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(values), i)
+}
+
+func TestRoundTripMapFieldDiffs(t *testing.T) {
+	largeAttributes := func(overrides map[string]string) map[string]string {
+		attrs := make(map[string]string, 50)
+		for i := 0; i < 50; i++ {
+			attrs[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("value-%d", i)
+		}
+		for k, v := range overrides {
+			if v == "" {
+				delete(attrs, k)
+				continue
+			}
+			attrs[k] = v
+		}
+		return attrs
+	}
+	attributes := []map[string]string{
+		{"a": "1", "b": "2"},
+		{"a": "1", "b": "3"},
+		{"a": "1", "b": "3", "c": "4"},
+		{"a": "1"},
+		nil,
+		{"x": "1"},
+		{"a": "1", "x": "1"},
+		{"": "empty-key", "a": ""},
+		{"a": "1"},
+		largeAttributes(nil),
+		largeAttributes(map[string]string{"key-7": "changed"}),
+		largeAttributes(map[string]string{"key-7": "changed", "key-8": ""}),
+		largeAttributes(map[string]string{"key-7": "changed", "new-key": "new"}),
+	}
+
+	writes := make([]*dynamic.Message, 0, len(attributes))
+	for _, attrs := range attributes {
+		writes = append(writes, newVL(1.0, 2.0, 3, []byte("delivery-id"), attrs))
+	}
+
+	var (
+		start        = time.Now().Truncate(time.Second)
+		withDiffs    = encodeTestMessages(t, start, testEncodingOptions.SetMapFieldDiffs(true), testVLSchema, writes)
+		withoutDiffs = encodeTestMessages(t, start, testEncodingOptions, testVLSchema, writes)
+	)
+	for _, stream := range [][]byte{withDiffs, withoutDiffs} {
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(testVLSchema), testEncodingOptions)
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+
+			actual := m.GetFieldByName("attributes").(map[interface{}]interface{})
+			require.Equal(t, len(attributes[i]), len(actual), "write %d", i)
+			for k, v := range attributes[i] {
+				require.Equal(t, v, actual[k], "write %d key %s", i, k)
+			}
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, len(attributes), i)
+	}
+
+	// Only encoding the changed entries of the large map should be a significant win.
+	require.True(t, len(withDiffs) < len(withoutDiffs)*2/3,
+		"expected %d bytes with diffs to be much smaller than %d bytes without",
+		len(withDiffs), len(withoutDiffs))
+}
+
+func TestRoundTripCompactHeader(t *testing.T) {
+	// The attributes schema is a subset of the vehicle location schema that
+	// has no custom encoded fields.
+	attributesSchema, err := builder.NewMessage("VehicleLocation").
+		AddField(builder.NewMapField("attributes", builder.FieldTypeString(), builder.FieldTypeString()).SetNumber(5)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		lruSize = 2
+		writes  = []*dynamic.Message{
+			newVL(0, 0, 0, nil, map[string]string{"a": "1"}),
+			newVL(0, 0, 0, nil, map[string]string{"a": "2"}),
+			newVL(1.0, 2.0, 3, []byte("id-1"), map[string]string{"a": "2"}),
+			newVL(1.0, 2.0, 4, []byte("id-2"), map[string]string{"a": "2"}),
+			newVL(1.0, 2.0, 5, []byte("id-3"), nil),
+			newVL(1.0, 2.0, 6, []byte("id-1"), nil),
+			newVL(1.0, 2.0, 7, []byte("id-3"), nil),
+		}
+	)
+	encode := func(opts Options, numWrites int) []byte {
+		opts = withByteFieldDictionaryLRUSize(opts, lruSize)
+		if numWrites <= 2 {
+			return encodeTestMessages(t, start, opts, attributesSchema, writes[:numWrites])
+		}
+
+		enc := NewEncoder(start, opts)
+		enc.Reset(start, 0, namespace.GetTestSchemaDescr(attributesSchema))
+		appendTestMessages(t, enc, start, writes[:2])
+		// Change to a schema with custom encoded fields mid-stream.
+		enc.SetSchema(namespace.GetTestSchemaDescr(testVLSchema))
+		return appendTestMessages(t, enc, start.Add(2*time.Second), writes[2:numWrites])
+	}
+
+	for _, features := range []Options{
+		testEncodingOptions,
+		testEncodingOptions.SetEndOfStreamMarker(true).SetMapFieldDiffs(true),
+	} {
+		var (
+			compactOpts = features.SetCompactHeader(true)
+			compact     = encode(compactOpts, 2)
+			standard    = encode(features, 2)
+		)
+		require.Equal(t, byte(compactHeaderEncodingSchemeVersion), compact[0])
+		require.True(t, len(compact) < len(standard),
+			"compact: %d bytes, standard: %d bytes", len(compact), len(standard))
+
+		for _, numWrites := range []int{2, len(writes)} {
+			stream := encode(compactOpts, numWrites)
+			iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(testVLSchema), compactOpts)
+			for i := 0; i < numWrites; i++ {
+				require.True(t, iter.Next(), "iter err: %v", iter.Err())
+				dp, _, annotation := iter.Current()
+				require.Equal(t, start.Add(time.Duration(i)*time.Second), dp.Timestamp)
+
+				m := dynamic.NewMessage(testVLSchema)
+				require.NoError(t, m.Unmarshal(annotation))
+				require.True(t, dynamic.MessagesEqual(writes[i], m),
+					"expected: %s, actual: %s", writes[i].String(), m.String())
+			}
+			require.False(t, iter.Next())
+			require.NoError(t, iter.Err())
+		}
+	}
+
+	// Schemas with custom encoded fields still use the standard header.
+	ctx := context.NewContext()
+	defer ctx.Close()
+	enc := NewEncoder(start, testEncodingOptions.SetCompactHeader(true))
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	marshalled, err := writes[2].Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, marshalled))
+	require.Equal(t, byte(baseEncodingSchemeVersion), getCurrEncoderBytes(ctx, t, enc)[0])
+}
+
+func TestRoundTripFullNonCustomFields(t *testing.T) {
+	attributes := []map[string]string{
+		{"a": "1", "b": "2"},
+		{"a": "1", "b": "2"},
+		{"a": "1"},
+		nil,
+		nil,
+		{"x": "1"},
+		{"a": "1", "x": "1"},
+	}
+
+	writes := make([]*dynamic.Message, 0, len(attributes))
+	for i, attrs := range attributes {
+		writes = append(writes, newVL(1.0, 2.0, int64(i), []byte("delivery-id"), attrs))
+	}
+
+	var (
+		start = time.Now().Truncate(time.Second)
+		full  = encodeTestMessages(t, start, testEncodingOptions.
+			SetFullNonCustomFields(true).
+			SetMapFieldDiffs(true), testVLSchema, writes)
+		diffs = encodeTestMessages(t, start, testEncodingOptions, testVLSchema, writes)
+	)
+	// Unchanged attributes are re-encoded every time they're present.
+	require.True(t, len(full) > len(diffs), "full: %d bytes, diffs: %d bytes", len(full), len(diffs))
+
+	iter := NewIterator(bytes.NewReader(full), namespace.GetTestSchemaDescr(testVLSchema), testEncodingOptions)
+	for i, attrs := range attributes {
+		require.True(t, iter.Next(), "iter err: %v", iter.Err())
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.Equal(t, int64(i), m.GetFieldByName("epoch"))
+		assertAttributesEqual(t, attrs, m.GetFieldByName("attributes").(map[interface{}]interface{}))
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+}
+
+func TestRoundTripForwardDecodedAnnotations(t *testing.T) {
+	var (
+		start = time.Now().Truncate(time.Second)
+		ctx   = context.NewContext()
+	)
+	defer ctx.Close()
+
+	encode := func(annotations []ts.Annotation) []byte {
+		enc := NewEncoder(start, testEncodingOptions)
+		enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+		for i, annotation := range annotations {
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, annotation))
+		}
+		return getCurrEncoderBytes(ctx, t, enc)
+	}
+	decode := func(stream []byte) []ts.Annotation {
+		var (
+			iter        = NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(testVLSchema), testEncodingOptions)
+			annotations []ts.Annotation
+		)
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			// The annotation is only valid until the next call to Next.
+			annotations = append(annotations, append(ts.Annotation(nil), annotation...))
+		}
+		require.NoError(t, iter.Err())
+		return annotations
+	}
+
+	var (
+		written     []*dynamic.Message
+		annotations []ts.Annotation
+	)
+	for i := 0; i < 10; i++ {
+		attrs := map[string]string{"key": fmt.Sprintf("val-%d", i%2)}
+		vl := newVL(float64(i), float64(i%3), int64(i*10), []byte(fmt.Sprintf("id-%d", i%4)), attrs)
+		marshalled, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+		annotations = append(annotations, marshalled)
+	}
+
+	// Forward the decoded annotations (without unmarshalling them) to a new encoder
+	// as a proxy that re-shards the data would.
+	decoded := decode(encode(annotations))
+	forwarded := decode(encode(decoded))
+	require.Equal(t, decoded, forwarded)
+	require.Equal(t, len(written), len(forwarded))
+	for i, annotation := range forwarded {
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"expected: %s, actual: %s", written[i].String(), m.String())
+	}
+}
+
+func TestRoundTripSubSecondTimestamps(t *testing.T) {
+	var (
+		start = time.Now().Truncate(time.Second)
+		ctx   = context.NewContext()
+	)
+	defer ctx.Close()
+
+	vlBytes, err := newVL(1.0, 2.0, 3, []byte("delivery-id"), nil).Marshal()
+	require.NoError(t, err)
+
+	encode := func(unit xtime.Unit, timestamps []time.Time) []byte {
+		enc := NewEncoder(start, testEncodingOptions)
+		enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+		for _, timestamp := range timestamps {
+			dp := ts.Datapoint{Timestamp: timestamp}
+			require.NoError(t, enc.Encode(dp, unit, vlBytes))
+		}
+		return getCurrEncoderBytes(ctx, t, enc)
+	}
+	regularTimestamps := func(unit xtime.Unit, n int) []time.Time {
+		step, err := unit.Value()
+		require.NoError(t, err)
+		timestamps := make([]time.Time, 0, n)
+		for i := 0; i < n; i++ {
+			timestamps = append(timestamps, start.Add(time.Duration(i)*step))
+		}
+		return timestamps
+	}
+
+	const numPoints = 1000
+	secondsStream := encode(xtime.Second, regularTimestamps(xtime.Second, numPoints))
+	for _, unit := range []xtime.Unit{xtime.Microsecond, xtime.Nanosecond} {
+		t.Run(unit.String(), func(t *testing.T) {
+			// Regularly spaced timestamps have a delta-of-delta of zero whatever the
+			// unit so they should compress as well as second spaced timestamps, only
+			// the first delta takes a few more bits.
+			regular := regularTimestamps(unit, numPoints)
+			regularStream := encode(unit, regular)
+			require.True(t, len(regularStream) <= len(secondsStream)+16,
+				"%s stream: %d bytes, seconds stream: %d bytes",
+				unit.String(), len(regularStream), len(secondsStream))
+
+			// Irregularly spaced timestamps must round trip at full precision too.
+			step, err := unit.Value()
+			require.NoError(t, err)
+			irregular := []time.Time{start}
+			for i := 1; i < numPoints; i++ {
+				jitter := time.Duration(i*i%7) * step
+				irregular = append(irregular, irregular[i-1].Add(step+jitter))
+			}
+
+			for _, timestamps := range [][]time.Time{regular, irregular} {
+				stream := encode(unit, timestamps)
+				iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(testVLSchema), testEncodingOptions)
+				for i := range timestamps {
+					require.True(t, iter.Next(), "iter err: %v", iter.Err())
+					dp, decodedUnit, _ := iter.Current()
+					require.Equal(t, unit, decodedUnit)
+					require.True(t, timestamps[i].Equal(dp.Timestamp),
+						"expected: %v, actual: %v", timestamps[i], dp.Timestamp)
+				}
+				require.False(t, iter.Next())
+				require.NoError(t, iter.Err())
+			}
+		})
+	}
+}
+
+func TestRoundTripLenientDecoding(t *testing.T) {
+	var (
+		start = time.Now().Truncate(time.Second)
+		opts  = testEncodingOptions.SetEndOfStreamMarker(true)
+		enc   = NewEncoder(start, opts)
+		ctx   = context.NewContext()
+	)
+	defer ctx.Close()
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+	var written []*dynamic.Message
+	for i := 0; i < 10; i++ {
+		vl := newVL(float64(i), float64(i)*2, int64(i), []byte(fmt.Sprintf("%d", i%3)), nil)
+		marshalledVL, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalledVL))
+	}
+	streamBytes := getCurrEncoderBytes(ctx, t, enc)
+
+	type iterateResult struct {
+		numRead       int
+		err           error
+		corruptionErr error
+		skippedBytes  int
+	}
+	iterate := func(b []byte, opts Options) iterateResult {
+		iter := NewIterator(bytes.NewReader(b), namespace.GetTestSchemaDescr(testVLSchema), opts)
+		defer iter.Close()
+
+		var result iterateResult
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[result.numRead], m))
+			result.numRead++
+		}
+		result.err = iter.Err()
+		result.corruptionErr = iter.(CorruptionReporter).CorruptionErr()
+		result.skippedBytes = iter.(CorruptionReporter).SkippedBytes()
+		return result
+	}
+
+	lenientOpts := opts.SetLenientDecoding(true)
+	require.Equal(t, iterateResult{numRead: len(written)}, iterate(streamBytes, lenientOpts))
+
+	// Every possible truncation of the stream is a corrupt stream, the lenient
+	// iterator should return the same datapoints as the strict one but without
+	// failing, unless the stream header itself was truncated.
+	for i := 1; i < len(streamBytes); i++ {
+		strict := iterate(streamBytes[:i], opts)
+		require.Error(t, strict.err)
+		require.NoError(t, strict.corruptionErr)
+
+		lenient := iterate(streamBytes[:i], lenientOpts)
+		if strings.Contains(strict.err.Error(), "error reading stream header") {
+			require.Equal(t, strict, lenient)
+			continue
+		}
+		require.Equal(t, iterateResult{numRead: strict.numRead, corruptionErr: strict.err}, lenient)
+	}
+
+	// The bytes that follow a corrupt datapoint are skipped, how many depends on how
+	// much of the stream was read before the corruption was detected.
+	var skipped bool
+	for i := len(streamBytes) / 2; i < len(streamBytes); i++ {
+		corrupt := append([]byte(nil), streamBytes...)
+		corrupt[i] = 0xff
+		iter := NewIterator(bytes.NewReader(corrupt), namespace.GetTestSchemaDescr(testVLSchema), lenientOpts)
+		for iter.Next() {
+		}
+		require.NoError(t, iter.Err())
+		reporter := iter.(CorruptionReporter)
+		if reporter.CorruptionErr() != nil {
+			require.True(t, reporter.SkippedBytes() < len(corrupt)-i)
+			skipped = skipped || reporter.SkippedBytes() > 0
+		}
+		iter.Close()
+	}
+	require.True(t, skipped)
+}
+
+func TestLenientDecodingHeaderMismatch(t *testing.T) {
+	var (
+		start     = time.Now().Truncate(time.Second)
+		staticOpt = [][]byte{[]byte("a"), []byte("b")}
+		opts      = testEncodingOptions.
+				SetStaticBytesDictionary(staticOpt).
+				SetSchemaHash(true).
+				SetLenientDecoding(true)
+		enc = NewEncoder(start, opts)
+		ctx = context.NewContext()
+	)
+	defer ctx.Close()
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+
+	vl := newVL(1, 2, 3, []byte("a"), nil)
+	marshalledVL, err := vl.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, marshalledVL))
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	// Mismatches between the stream header and the iterator are configuration errors
+	// rather than corrupt datapoints so they fail even when decoding leniently.
+	for _, tc := range []struct {
+		schema *desc.MessageDescriptor
+		opts   Options
+		err    error
+	}{
+		{schema: testVLSchema, opts: opts.SetStaticBytesDictionary(nil), err: errIteratorStaticBytesDictMismatch},
+		{schema: testVL2Schema, opts: opts, err: errIteratorSchemaMismatch},
+	} {
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(tc.schema), tc.opts)
+		require.False(t, iter.Next())
+		require.Equal(t, tc.err, iter.Err())
+		require.NoError(t, iter.(CorruptionReporter).CorruptionErr())
+		require.Equal(t, 0, iter.(CorruptionReporter).SkippedBytes())
+		iter.Close()
+	}
+}
+
+func TestRoundTripStaticBytesDictionary(t *testing.T) {
+	var (
+		start     = time.Now().Truncate(time.Second)
+		schema    = namespace.GetTestSchemaDescr(testVLSchema)
+		staticOpt = [][]byte{[]byte("delivery-a"), []byte("delivery-b"), []byte("delivery-c")}
+		ids       = []string{"delivery-a", "delivery-b", "not-in-dict", "delivery-c", "delivery-d", "delivery-e"}
+		written   []*dynamic.Message
+	)
+	for i := 0; i < 30; i++ {
+		written = append(written, newVL(float64(i), 0, int64(i), []byte(ids[(i*i)%len(ids)]), nil))
+	}
+	encode := func(opts Options) []byte {
+		// A tiny LRU so that values are evicted and encoded again.
+		return encodeTestMessages(t, start, withByteFieldDictionaryLRUSize(opts, 2), testVLSchema, written)
+	}
+	decode := func(stream []byte, opts Options) error {
+		iter := NewIterator(bytes.NewReader(stream), schema, opts)
+		defer iter.Close()
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		require.Equal(t, len(written), i)
+		return nil
+	}
+
+	var (
+		withoutDict = encode(testEncodingOptions)
+		opts        = testEncodingOptions.SetStaticBytesDictionary(staticOpt)
+		withDict    = encode(opts)
+	)
+	require.True(t, len(withDict) < len(withoutDict),
+		"with dict: %d bytes, without dict: %d bytes", len(withDict), len(withoutDict))
+	require.NoError(t, decode(withDict, opts))
+
+	header, err := ReadStreamHeader(bytes.NewReader(withDict), testEncodingOptions)
+	require.NoError(t, err)
+	require.True(t, header.StaticBytesDict)
+
+	// Iterators must be configured with the exact same dictionary.
+	for _, dict := range [][][]byte{
+		nil,
+		staticOpt[:2],
+		{staticOpt[0], staticOpt[2], staticOpt[1]},
+	} {
+		err := decode(withDict, testEncodingOptions.SetStaticBytesDictionary(dict))
+		require.Equal(t, errIteratorStaticBytesDictMismatch, err)
+	}
+}
+
+func TestRoundTripInternedBytes(t *testing.T) {
+	var (
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(testVLSchema)
+		// More distinct values than can be interned so that some of them are always
+		// encoded in full once evicted from the LRU.
+		statuses = []string{"pending", "running", "succeeded", "failed", "cancelled", "unknown"}
+		written  []*dynamic.Message
+	)
+	for i := 0; i < 60; i++ {
+		written = append(written, newVL(float64(i), 0, int64(i), []byte(statuses[(i*i)%len(statuses)]), nil))
+	}
+	encode := func(opts Options) []byte {
+		// A tiny LRU so that values are evicted and encoded again.
+		return encodeTestMessages(t, start, withByteFieldDictionaryLRUSize(opts, 2), testVLSchema, written)
+	}
+	decode := func(stream []byte, opts Options) {
+		iter := NewIterator(bytes.NewReader(stream), schema, opts)
+		defer iter.Close()
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, len(written), i)
+	}
+
+	withoutInterning := encode(testEncodingOptions)
+	for _, opts := range []Options{
+		testEncodingOptions.SetMaxInternedBytesValues(4),
+		testEncodingOptions.SetMaxInternedBytesValues(4).
+			SetStaticBytesDictionary([][]byte{[]byte("failed"), []byte("unknown")}),
+	} {
+		withInterning := encode(opts)
+		require.True(t, len(withInterning) < len(withoutInterning),
+			"with interning: %d bytes, without interning: %d bytes",
+			len(withInterning), len(withoutInterning))
+
+		// The iterator interns the same values regardless of its own options.
+		decode(withInterning, testEncodingOptions.
+			SetStaticBytesDictionary(opts.StaticBytesDictionary()))
+
+		header, err := ReadStreamHeader(bytes.NewReader(withInterning), testEncodingOptions)
+		require.NoError(t, err)
+		require.Equal(t, 4, header.MaxInternedBytesValues)
+	}
+}
+
+func TestRoundTripBytesDictResets(t *testing.T) {
+	var (
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(testVLSchema)
+	)
+	for _, endOfStreamMarker := range []bool{false, true} {
+		opts := testEncodingOptions.
+			SetBytesDictResets(true).
+			SetEndOfStreamMarker(endOfStreamMarker).
+			SetMaxInternedBytesValues(2)
+
+		enc := NewEncoder(start, opts)
+		enc.Reset(start, 0, schema)
+		// Resetting before anything was encoded is a no-op.
+		require.NoError(t, enc.ResetBytesDictionaries())
+
+		var written []*dynamic.Message
+		for i := 0; i < 40; i++ {
+			// The working set of bytes values changes halfway through the stream, at which
+			// point the dictionaries are reset.
+			if i == 20 {
+				require.NoError(t, enc.ResetBytesDictionaries())
+			}
+			id := fmt.Sprintf("working-set-%d-value-%d", i/20, i%3)
+			vl := newVL(float64(i), float64(i)*2, int64(i), []byte(id), nil)
+			marshalled, err := vl.Marshal()
+			require.NoError(t, err)
+			written = append(written, vl)
+
+			dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+		}
+		// A reset marker may also be the last thing in the stream.
+		require.NoError(t, enc.ResetBytesDictionaries())
+
+		ctx := context.NewContext()
+		stream := getCurrEncoderBytes(ctx, t, enc)
+		ctx.Close()
+
+		iter := NewIterator(bytes.NewReader(stream), schema, opts)
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, len(written), i)
+		iter.Close()
+
+		header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+		require.NoError(t, err)
+		require.True(t, header.BytesDictResets)
+	}
+
+	enc := NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, schema)
+	require.Equal(t, errEncoderBytesDictResetsDisabled, enc.ResetBytesDictionaries())
+}
+
+func TestRoundTripIntChangesBitset(t *testing.T) {
+	const numIntFields = 24
+	msgBuilder := builder.NewMessage("Counters").
+		AddField(builder.NewField("host", builder.FieldTypeString()).SetNumber(1)).
+		AddField(builder.NewField("load", builder.FieldTypeDouble()).SetNumber(2))
+	for i := 0; i < numIntFields; i++ {
+		fieldType := builder.FieldTypeInt64()
+		switch i % 3 {
+		case 1:
+			fieldType = builder.FieldTypeUInt32()
+		case 2:
+			fieldType = builder.FieldTypeSInt32()
+		}
+		msgBuilder.AddField(
+			builder.NewField(fmt.Sprintf("counter_%d", i), fieldType).SetNumber(int32(i + 3)))
+	}
+	md, err := msgBuilder.Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		schema  = namespace.GetTestSchemaDescr(md)
+		written []*dynamic.Message
+	)
+	for i := 0; i < 200; i++ {
+		m := dynamic.NewMessage(md)
+		m.SetFieldByNumber(1, "host-1")
+		m.SetFieldByNumber(2, float64(i%7+1))
+		for j := 0; j < numIntFields; j++ {
+			// Most fields rarely change but every few writes all of them change at once
+			// so that both formats are exercised, fields are also reset to their default
+			// value from time to time.
+			v := i / (j + 5)
+			if i%50 == 49 {
+				v = i * j
+			} else if i%40 == 39 {
+				v = 0
+			}
+			if v == 0 {
+				// Leave the field unset since that's how it round trips.
+				continue
+			}
+			switch md.FindFieldByNumber(int32(j + 3)).GetType() {
+			case dpb.FieldDescriptorProto_TYPE_UINT32:
+				m.SetFieldByNumber(j+3, uint32(v))
+			case dpb.FieldDescriptorProto_TYPE_SINT32:
+				m.SetFieldByNumber(j+3, int32(-v))
+			default:
+				m.SetFieldByNumber(j+3, int64(v)*1000)
+			}
+		}
+		written = append(written, m)
+	}
+
+	var (
+		opts           = testEncodingOptions.SetIntChangesBitset(true)
+		stream         = encodeTestMessages(t, start, opts, md, written)
+		perFieldStream = encodeTestMessages(t, start, testEncodingOptions, md, written)
+	)
+	require.True(t, len(stream) < len(perFieldStream),
+		"expected %d to be less than %d", len(stream), len(perFieldStream))
+
+	iter := NewIterator(bytes.NewReader(stream), schema, opts)
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(md)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+	iter.Close()
+
+	header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+	require.NoError(t, err)
+	require.True(t, header.IntChangesBitset)
+}
+
+func TestRoundTripIntDeltaOfDelta(t *testing.T) {
+	md, err := builder.NewMessage("Counters").
+		AddField(builder.NewField("requests", builder.FieldTypeInt64()).SetNumber(1)).
+		AddField(builder.NewField("bytes", builder.FieldTypeUInt64()).SetNumber(2)).
+		AddField(builder.NewField("errors", builder.FieldTypeSInt32()).SetNumber(3)).
+		AddField(builder.NewField("gauge", builder.FieldTypeInt64()).SetNumber(4)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		schema  = namespace.GetTestSchemaDescr(md)
+		written []*dynamic.Message
+	)
+	for i := 0; i < 200; i++ {
+		m := dynamic.NewMessage(md)
+		// Counters that increase at a (mostly) steady rate, including one that wraps around
+		// and one that decreases.
+		m.SetFieldByNumber(1, int64(1000+i*37+(i/50)))
+		m.SetFieldByNumber(2, uint64(math.MaxUint64-5000)+uint64(i*101))
+		m.SetFieldByNumber(3, int32(-(i+1)*3))
+		m.SetFieldByNumber(4, int64((i*7919)%13+1))
+		written = append(written, m)
+	}
+
+	for _, intChangesBitset := range []bool{false, true} {
+		var (
+			deltaOpts = testEncodingOptions.SetIntChangesBitset(intChangesBitset)
+			opts      = deltaOpts.SetIntDeltaOfDeltaFields(
+				[]string{"requests", "bytes", "errors", "unknown"})
+			stream      = encodeTestMessages(t, start, opts, md, written)
+			deltaStream = encodeTestMessages(t, start, deltaOpts, md, written)
+		)
+		require.True(t, len(stream) < len(deltaStream),
+			"expected %d to be less than %d", len(stream), len(deltaStream))
+
+		iter := NewIterator(bytes.NewReader(stream), schema, opts)
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(md)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, len(written), i)
+		iter.Close()
+
+		header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+		require.NoError(t, err)
+		require.True(t, header.IntDeltaOfDelta)
+	}
+}
+
+func TestRoundTripSchemaHash(t *testing.T) {
+	renamed, err := builder.FromMessage(testVLSchema)
+	require.NoError(t, err)
+	renamed.GetField("epoch").SetName("epochSeconds")
+	renamedSchema, err := renamed.Build()
+	require.NoError(t, err)
+
+	retyped, err := builder.FromMessage(testVLSchema)
+	require.NoError(t, err)
+	retyped.GetField("epoch").SetType(builder.FieldTypeSInt64())
+	retypedSchema, err := retyped.Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		opts    = testEncodingOptions.SetSchemaHash(true)
+		enc     = NewEncoder(start, opts)
+		written []*dynamic.Message
+	)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+	for i := 0; i < 10; i++ {
+		vl := newVL(float64(i+1), 2, int64(i+1), []byte("some-delivery-id"), nil)
+		marshalled, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+	ctx := context.NewContext()
+	defer ctx.Close()
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+	require.NoError(t, err)
+	require.Equal(t, schemaHash(testVLSchema), header.SchemaHash)
+	require.NotEqual(t, uint64(0), header.SchemaHash)
+
+	// Renaming fields doesn't change how they're encoded so it doesn't change the hash.
+	for _, schema := range []*desc.MessageDescriptor{testVLSchema, renamedSchema} {
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), opts)
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, len(written), i)
+		iter.Close()
+	}
+
+	for _, schema := range []*desc.MessageDescriptor{retypedSchema, testVL2Schema} {
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), opts)
+		require.False(t, iter.Next())
+		require.Equal(t, errIteratorSchemaMismatch, iter.Err())
+		iter.Close()
+	}
+}
+
+func TestRoundTripPrimedBytesDicts(t *testing.T) {
+	var (
+		start   = time.Now().Truncate(time.Second)
+		schema  = namespace.GetTestSchemaDescr(testVLSchema)
+		primed  = [][]byte{[]byte("delivery-a"), []byte("delivery-b"), []byte("delivery-c")}
+		ids     = []string{"delivery-a", "delivery-b", "delivery-c", "delivery-d"}
+		written []*dynamic.Message
+	)
+	for i := 0; i < 20; i++ {
+		written = append(written, newVL(float64(i+1), 2, int64(i+1), []byte(ids[i%len(ids)]), nil))
+	}
+	encode := func(prime bool) []byte {
+		enc := NewEncoder(start, testEncodingOptions)
+		enc.Reset(start, 0, schema)
+		if prime {
+			require.NoError(t, enc.PrimeBytesDict(4, primed))
+		}
+		stream := appendTestMessages(t, enc, start, written)
+		require.Equal(t, errEncoderPrimeAfterEncode, enc.PrimeBytesDict(4, primed))
+		return stream
+	}
+	decode := func(stream []byte, values [][]byte) error {
+		iter := NewIterator(bytes.NewReader(stream), schema, testEncodingOptions)
+		defer iter.Close()
+		if values != nil {
+			require.NoError(t, iter.(BytesDictPrimer).PrimeBytesDict(4, values))
+		}
+		i := 0
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testVLSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, dynamic.MessagesEqual(written[i], m),
+				"write %d: expected %s but got %s", i, written[i].String(), m.String())
+			i++
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		require.Equal(t, len(written), i)
+		require.Equal(t, errIteratorPrimeAfterNext, iter.(BytesDictPrimer).PrimeBytesDict(4, values))
+		return nil
+	}
+
+	var (
+		withoutPriming = encode(false)
+		withPriming    = encode(true)
+	)
+	require.True(t, len(withPriming) < len(withoutPriming),
+		"with priming: %d bytes, without priming: %d bytes", len(withPriming), len(withoutPriming))
+	require.NoError(t, decode(withoutPriming, nil))
+	require.NoError(t, decode(withPriming, primed))
+
+	header, err := ReadStreamHeader(bytes.NewReader(withPriming), testEncodingOptions)
+	require.NoError(t, err)
+	require.True(t, header.PrimedBytesDicts)
+
+	// Iterators must be primed with the exact same values.
+	for _, values := range [][][]byte{
+		nil,
+		primed[:2],
+		{primed[0], primed[2], primed[1]},
+	} {
+		require.Equal(t, errIteratorPrimedBytesDictsMismatch, decode(withPriming, values))
+	}
+}
+
+func TestRoundTripCurrentMessage(t *testing.T) {
+	otherSchema, err := builder.NewMessage("Other").
+		AddField(builder.NewField("latitude", builder.FieldTypeDouble()).SetNumber(1)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		schema  = namespace.GetTestSchemaDescr(testVLSchema)
+		enc     = NewEncoder(start, testEncodingOptions)
+		written []*dynamic.Message
+	)
+	enc.Reset(start, 0, schema)
+	for i := 0; i < 10; i++ {
+		// Alternate between setting and not setting some of the fields so that fields that
+		// remain set in the reused message from the previous datapoint are detected.
+		var (
+			deliveryID []byte
+			attributes map[string]string
+		)
+		if i%2 == 0 {
+			deliveryID = []byte(fmt.Sprintf("delivery-%d", i))
+			attributes = map[string]string{"key": fmt.Sprintf("value-%d", i)}
+		}
+		vl := newVL(float64(i+1), 2, int64(i+1), deliveryID, attributes)
+		marshalled, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+	ctx := context.NewContext()
+	defer ctx.Close()
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	var (
+		iter = NewIterator(bytes.NewReader(stream), schema, testEncodingOptions)
+		m    = dynamic.NewMessage(testVLSchema)
+		i    = 0
+	)
+	defer iter.Close()
+	for iter.Next() {
+		dp, unit, err := iter.(MessageReader).CurrentMessage(m)
+		require.NoError(t, err)
+		require.True(t, start.Add(time.Duration(i)*time.Second).Equal(dp.Timestamp))
+		require.Equal(t, xtime.Second, unit)
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+
+		_, _, err = iter.(MessageReader).CurrentMessage(dynamic.NewMessage(otherSchema))
+		require.Error(t, err)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+}
+
+func TestRoundTripCachedMessage(t *testing.T) {
+	var (
+		start   = time.Now().Truncate(time.Second)
+		schema  = namespace.GetTestSchemaDescr(testVLSchema)
+		enc     = NewEncoder(start, testEncodingOptions)
+		written []*dynamic.Message
+	)
+	enc.Reset(start, 0, schema)
+	for i := 0; i < 10; i++ {
+		vl := newVL(float64(i+1), 2, int64(i+1), []byte(fmt.Sprintf("delivery-%d", i)), nil)
+		marshalled, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+	ctx := context.NewContext()
+	defer ctx.Close()
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	iter := NewIterator(bytes.NewReader(stream), schema, testEncodingOptions)
+	defer iter.Close()
+	i := 0
+	for iter.Next() {
+		dp, unit, first, err := iter.(MessageReader).CachedMessage()
+		require.NoError(t, err)
+		require.True(t, start.Add(time.Duration(i)*time.Second).Equal(dp.Timestamp))
+		require.Equal(t, xtime.Second, unit)
+		require.True(t, dynamic.MessagesEqual(written[i], first),
+			"write %d: expected %s but got %s", i, written[i].String(), first.String())
+
+		// Reading the same datapoint again returns the same message without unmarshalling
+		// it again, which is detected by modifying the cached message.
+		first.SetFieldByNumber(1, float64(-1))
+		_, _, second, err := iter.(MessageReader).CachedMessage()
+		require.NoError(t, err)
+		require.True(t, first == second)
+		require.Equal(t, float64(-1), second.GetFieldByNumber(1))
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+}
+
+func TestRoundTripOmitEmptyProtoPortion(t *testing.T) {
+	numericSchema, err := builder.NewMessage("Metrics").
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("count", builder.FieldTypeInt64()).SetNumber(2)).
+		Build()
+	require.NoError(t, err)
+	// The same schema with a field that isn't custom encoded.
+	taggedSchema, err := builder.NewMessage("Metrics").
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("count", builder.FieldTypeInt64()).SetNumber(2)).
+		AddField(builder.NewField("tags", builder.FieldTypeString()).SetRepeated().SetNumber(3)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		written []*dynamic.Message
+	)
+	for i := 0; i < 100; i++ {
+		m := dynamic.NewMessage(taggedSchema)
+		m.SetFieldByNumber(1, float64(i%7+1))
+		m.SetFieldByNumber(2, int64(i/3+1))
+		if i >= 80 && i%2 == 0 {
+			m.SetFieldByNumber(3, []string{fmt.Sprintf("tag-%d", i)})
+		}
+		written = append(written, m)
+	}
+	encode := func(opts Options) []byte {
+		enc := NewEncoder(start, opts)
+		enc.Reset(start, 0, namespace.GetTestSchemaDescr(numericSchema))
+		appendTestMessages(t, enc, start, written[:80])
+		// Switch to a schema with a Protobuf marshalled portion mid-stream.
+		enc.SetSchema(namespace.GetTestSchemaDescr(taggedSchema))
+		return appendTestMessages(t, enc, start.Add(80*time.Second), written[80:])
+	}
+
+	var (
+		opts       = testEncodingOptions.SetOmitEmptyProtoPortion(true)
+		stream     = encode(opts)
+		fullStream = encode(testEncodingOptions)
+		iter       = NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(taggedSchema), opts)
+		i          = 0
+	)
+	// One bit is saved for each of the first 80 writes.
+	require.True(t, len(stream) < len(fullStream),
+		"expected %d to be less than %d", len(stream), len(fullStream))
+
+	defer iter.Close()
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(taggedSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+
+	header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+	require.NoError(t, err)
+	require.True(t, header.OmitEmptyProtoPortion)
+}
+
+func TestRoundTripLimitedCustomFields(t *testing.T) {
+	var (
+		schemaBuilder = builder.NewMessage("Wide")
+		numFields     = 40
+	)
+	for i := 1; i <= numFields; i++ {
+		fieldType := builder.FieldTypeInt64()
+		switch i % 4 {
+		case 1:
+			fieldType = builder.FieldTypeDouble()
+		case 2:
+			fieldType = builder.FieldTypeUInt32()
+		case 3:
+			fieldType = builder.FieldTypeBool()
+		}
+		schemaBuilder.AddField(builder.NewField(fmt.Sprintf("_%d", i), fieldType).SetNumber(int32(i)))
+	}
+	schemaBuilder.AddField(builder.NewField("host", builder.FieldTypeString()).SetNumber(int32(numFields + 1)))
+	schema, err := schemaBuilder.Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		written []*dynamic.Message
+	)
+	for i := 0; i < 50; i++ {
+		m := dynamic.NewMessage(schema)
+		for _, field := range schema.GetFields() {
+			fieldNum := field.GetNumber()
+			// Every field is unset every so often, the values that are set are never the
+			// default value of the field.
+			if (i+int(fieldNum))%5 == 0 {
+				continue
+			}
+			switch field.GetType() {
+			case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+				m.SetFieldByNumber(int(fieldNum), float64(i*int(fieldNum))/8+0.5)
+			case dpb.FieldDescriptorProto_TYPE_UINT32:
+				m.SetFieldByNumber(int(fieldNum), uint32(i+int(fieldNum)))
+			case dpb.FieldDescriptorProto_TYPE_BOOL:
+				m.SetFieldByNumber(int(fieldNum), true)
+			case dpb.FieldDescriptorProto_TYPE_INT64:
+				m.SetFieldByNumber(int(fieldNum), int64(i-int(fieldNum)-100))
+			default:
+				m.SetFieldByNumber(int(fieldNum), fmt.Sprintf("host-%d", i%3))
+			}
+		}
+		written = append(written, m)
+	}
+
+	tests := []struct {
+		name                 string
+		opts                 Options
+		expectedCustomFields []int
+	}{
+		{
+			name:                 "max",
+			opts:                 testEncodingOptions.SetMaxCustomFields(10),
+			expectedCustomFields: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		{
+			name:                 "allowlist",
+			opts:                 testEncodingOptions.SetCustomFieldsAllowlist([]string{"_40", "_3", "_17", "host", "_1"}),
+			expectedCustomFields: []int{1, 3, 17, 40, 41},
+		},
+		{
+			name: "max and allowlist",
+			opts: testEncodingOptions.
+				SetMaxCustomFields(2).
+				SetCustomFieldsAllowlist([]string{"_40", "_3", "_17"}),
+			expectedCustomFields: []int{3, 17},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := NewEncoder(start, tt.opts)
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+			var customFieldNums []int
+			for _, field := range enc.CustomFields() {
+				customFieldNums = append(customFieldNums, field.FieldNum)
+			}
+			require.Equal(t, tt.expectedCustomFields, customFieldNums)
+
+			for i, m := range written {
+				marshalled, err := m.Marshal()
+				require.NoError(t, err)
+				dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+				require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+			}
+			ctx := context.NewContext()
+			defer ctx.Close()
+			stream := getCurrEncoderBytes(ctx, t, enc)
+
+			header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+			require.NoError(t, err)
+			require.True(t, header.LimitedCustomFields)
+
+			// The limited fields are not mistaken for fields that were repeated in the
+			// schema of the encoder.
+			iterOpts := testEncodingOptions.SetRepeatedToSingularStrategy(
+				RepeatedToSingularError)
+			iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), iterOpts)
+			defer iter.Close()
+			i := 0
+			for iter.Next() {
+				_, _, annotation := iter.Current()
+				m := dynamic.NewMessage(schema)
+				require.NoError(t, m.Unmarshal(annotation))
+				require.True(t, dynamic.MessagesEqual(written[i], m),
+					"write %d: expected %s but got %s", i, written[i].String(), m.String())
+				i++
+			}
+			require.NoError(t, iter.Err())
+			require.Equal(t, len(written), i)
+		})
+	}
+}
+
+func TestRoundTripCustomFieldOrder(t *testing.T) {
+	var (
+		schemaBuilder = builder.NewMessage("Ordered")
+		numFields     = 30
+	)
+	for i := 1; i <= numFields; i++ {
+		fieldType := builder.FieldTypeInt64()
+		switch i % 3 {
+		case 1:
+			fieldType = builder.FieldTypeDouble()
+		case 2:
+			fieldType = builder.FieldTypeUInt32()
+		}
+		schemaBuilder.AddField(builder.NewField(fmt.Sprintf("_%d", i), fieldType).SetNumber(int32(i)))
+	}
+	schemaBuilder.AddField(builder.NewField("host", builder.FieldTypeString()).SetNumber(int32(numFields + 1)))
+	schema, err := schemaBuilder.Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		written []*dynamic.Message
+	)
+	for i := 0; i < 50; i++ {
+		m := dynamic.NewMessage(schema)
+		for _, field := range schema.GetFields() {
+			fieldNum := field.GetNumber()
+			// Every field is unset every so often and most of the int fields rarely change
+			// so that the int changes bitset is used for some of the writes.
+			if (i+int(fieldNum))%7 == 0 {
+				continue
+			}
+			switch field.GetType() {
+			case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+				m.SetFieldByNumber(int(fieldNum), float64(i*int(fieldNum))/8+0.5)
+			case dpb.FieldDescriptorProto_TYPE_UINT32:
+				m.SetFieldByNumber(int(fieldNum), uint32(i/10+int(fieldNum)))
+			case dpb.FieldDescriptorProto_TYPE_INT64:
+				m.SetFieldByNumber(int(fieldNum), int64(i-int(fieldNum)-100))
+			default:
+				m.SetFieldByNumber(int(fieldNum), fmt.Sprintf("host-%d", i%3))
+			}
+		}
+		written = append(written, m)
+	}
+
+	encode := func(opts Options) []byte {
+		return encodeTestMessages(t, start, opts, schema, written)
+	}
+
+	baseOpts := testEncodingOptions.SetIntChangesBitset(true)
+	unordered := encode(baseOpts)
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{
+			name: "order",
+			// Fields that don't exist, aren't custom encoded or that are repeated are ignored.
+			opts: baseOpts.SetCustomFieldOrder([]string{"_30", "_3", "host", "_20", "unknown", "_3", "_1"}),
+		},
+		{
+			name: "order and allowlist",
+			opts: baseOpts.
+				SetCustomFieldOrder([]string{"_30", "_3", "_21", "_6"}).
+				SetCustomFieldsAllowlist([]string{"_3", "_6", "_9", "_12", "_18", "_21", "_24", "_27", "_30"}),
+		},
+		{
+			name: "no ordered fields",
+			opts: baseOpts.SetCustomFieldOrder([]string{"unknown"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := encode(tt.opts)
+			require.NotEqual(t, unordered, stream)
+
+			header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+			require.NoError(t, err)
+			require.True(t, header.CustomFieldOrder)
+
+			iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), testEncodingOptions)
+			defer iter.Close()
+			i := 0
+			for iter.Next() {
+				_, _, annotation := iter.Current()
+				m := dynamic.NewMessage(schema)
+				require.NoError(t, m.Unmarshal(annotation))
+				require.True(t, dynamic.MessagesEqual(written[i], m),
+					"write %d: expected %s but got %s", i, written[i].String(), m.String())
+				i++
+			}
+			require.NoError(t, iter.Err())
+			require.Equal(t, len(written), i)
+		})
+	}
+}
+
+func TestRoundTripPartialSchema(t *testing.T) {
+	// A schema assembled at runtime in which some fields are opaque: a message without any
+	// fields whose values are only known as unknown fields, and a proto2 group. Only the well
+	// typed fields are custom encoded and the rest are marshalled as Protobuf.
+	var (
+		opaque = builder.NewMessage("Opaque")
+		group  = builder.NewMessage("Group").
+			AddField(builder.NewField("g", builder.FieldTypeInt32()).SetNumber(7))
+		partial = builder.NewMessage("Partial").
+			AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+			AddField(builder.NewField("opaque", builder.FieldTypeMessage(opaque)).SetNumber(2)).
+			AddField(builder.NewField("count", builder.FieldTypeSFixed64()).SetNumber(3)).
+			AddField(builder.NewGroupField(group).SetNumber(4)).
+			AddField(builder.NewField("host", builder.FieldTypeString()).SetNumber(5))
+	)
+	file, err := builder.NewFile("partial.proto").
+		SetProto3(false).
+		AddMessage(opaque).
+		AddMessage(partial).
+		Build()
+	require.NoError(t, err)
+	schema := file.FindMessage("Partial")
+	opaqueSchema := file.FindMessage("Opaque")
+
+	richSchema, err := builder.NewMessage("Rich").
+		AddField(builder.NewField("a", builder.FieldTypeString()).SetNumber(1)).
+		AddField(builder.NewField("b", builder.FieldTypeInt64()).SetNumber(2)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start = time.Now().Truncate(time.Second)
+		enc   = NewEncoder(start, testEncodingOptions)
+	)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+	require.Equal(t, []CustomFieldInfo{
+		{FieldNum: 1, ProtoType: dpb.FieldDescriptorProto_TYPE_DOUBLE, CustomType: "float64"},
+		{FieldNum: 3, ProtoType: dpb.FieldDescriptorProto_TYPE_SFIXED64, CustomType: "int64"},
+		{FieldNum: 5, ProtoType: dpb.FieldDescriptorProto_TYPE_STRING, CustomType: "bytes"},
+	}, enc.CustomFields())
+
+	var written []*dynamic.Message
+	for i := 0; i < 20; i++ {
+		rich := dynamic.NewMessage(richSchema)
+		rich.SetFieldByNumber(1, fmt.Sprintf("rich-%d", i%3))
+		rich.SetFieldByNumber(2, int64(i+1))
+		richBytes, err := rich.Marshal()
+		require.NoError(t, err)
+		opaqueMsg := dynamic.NewMessage(opaqueSchema)
+		require.NoError(t, opaqueMsg.Unmarshal(richBytes))
+
+		groupMsg := dynamic.NewMessage(schema.FindFieldByNumber(4).GetMessageType())
+		groupMsg.SetFieldByNumber(7, int32(i/4+1))
+
+		m := dynamic.NewMessage(schema)
+		m.SetFieldByNumber(1, float64(i)+0.5)
+		m.SetFieldByNumber(2, opaqueMsg)
+		m.SetFieldByNumber(3, int64(i-100))
+		m.SetFieldByNumber(4, groupMsg)
+		m.SetFieldByNumber(5, fmt.Sprintf("host-%d", i%2))
+		written = append(written, m)
+
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+	ctx := context.NewContext()
+	defer ctx.Close()
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), testEncodingOptions)
+	defer iter.Close()
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(schema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+}
+
+func TestRoundTripStreamMetadata(t *testing.T) {
+	var (
+		start    = time.Now().Truncate(time.Second)
+		schema   = namespace.GetTestSchemaDescr(testVLSchema)
+		metadata = []byte("source=host-a,pipeline=v2")
+		opts     = testEncodingOptions.SetStreamMetadata(metadata)
+		enc      = NewEncoder(start, opts)
+		written  []*dynamic.Message
+	)
+	enc.Reset(start, 0, schema)
+	for i := 0; i < 5; i++ {
+		vl := newVL(float64(i+1), 2, int64(i+1), []byte(fmt.Sprintf("delivery-%d", i)), nil)
+		marshalled, err := vl.Marshal()
+		require.NoError(t, err)
+		written = append(written, vl)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+	ctx := context.NewContext()
+	defer ctx.Close()
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	iter := NewIterator(bytes.NewReader(stream), schema, testEncodingOptions)
+	defer iter.Close()
+	// The metadata is read along with the rest of the stream header.
+	require.Nil(t, iter.(StreamMetadataReader).StreamMetadata())
+	i := 0
+	for iter.Next() {
+		require.Equal(t, metadata, iter.(StreamMetadataReader).StreamMetadata())
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(testVLSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+
+	// Streams without metadata don't have any, even when the iterator is reused.
+	enc = NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, schema)
+	marshalled, err := written[0].Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, marshalled))
+	iter.Reset(bytes.NewReader(getCurrEncoderBytes(ctx, t, enc)), schema)
+	require.True(t, iter.Next())
+	require.Nil(t, iter.(StreamMetadataReader).StreamMetadata())
+}
+
+func TestRoundTripBoolFieldsAreSingleBits(t *testing.T) {
+	var (
+		start       = time.Now().Truncate(time.Second)
+		numWrites   = 80
+		intSchema   = newIntSignednessTestSchema(t, dpb.FieldDescriptorProto_TYPE_INT64)
+		flagsSchema = newIntSignednessTestSchema(t,
+			dpb.FieldDescriptorProto_TYPE_INT64, dpb.FieldDescriptorProto_TYPE_BOOL)
+	)
+	encode := func(schema *desc.MessageDescriptor) []byte {
+		messages := make([]*dynamic.Message, 0, numWrites)
+		for i := 0; i < numWrites; i++ {
+			m := dynamic.NewMessage(schema)
+			m.SetFieldByNumber(1, int64(i))
+			if len(schema.GetFields()) > 1 && i%3 == 0 {
+				m.SetFieldByNumber(2, true)
+			}
+			messages = append(messages, m)
+		}
+		return encodeTestMessages(t, start, testEncodingOptions, schema, messages)
+	}
+
+	enc := NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(flagsSchema))
+	require.Equal(t, "bool", enc.CustomFields()[1].CustomType)
+
+	// A bool field costs a single bit per write whether or not it changed, plus its
+	// custom type in the schema.
+	var (
+		intStream   = encode(intSchema)
+		flagsStream = encode(flagsSchema)
+		extraBits   = 8 * (len(flagsStream) - len(intStream))
+	)
+	require.True(t, extraBits >= numWrites && extraBits <= numWrites+16,
+		"expected about %d extra bits but got %d", numWrites, extraBits)
+}
+
+func TestRoundTripUnsignedIntWraparound(t *testing.T) {
+	schema := newIntSignednessTestSchema(t, dpb.FieldDescriptorProto_TYPE_UINT64)
+	// A counter that overflows a couple of times.
+	values := []uint64{
+		math.MaxUint64 - 5,
+		math.MaxUint64 - 1,
+		math.MaxUint64,
+		2,
+		7,
+		7,
+		math.MaxUint64 - 3,
+		0,
+		1,
+		math.MaxUint64,
+		1 << 63,
+		0,
+	}
+
+	var (
+		start  = time.Now().Truncate(time.Second)
+		encode = func(opts Options) []byte {
+			messages := make([]*dynamic.Message, 0, len(values))
+			for _, v := range values {
+				m := dynamic.NewMessage(schema)
+				m.SetFieldByNumber(1, v)
+				messages = append(messages, m)
+			}
+			return encodeTestMessages(t, start, opts, schema, messages)
+		}
+		opts          = testEncodingOptions.SetUnsignedIntWraparound(true)
+		stream        = encode(opts)
+		defaultStream = encode(testEncodingOptions)
+	)
+	require.True(t, len(stream) < len(defaultStream),
+		"expected %d to be less than %d", len(stream), len(defaultStream))
+
+	// The wrapped deltas don't require any support from the iterator.
+	iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), testEncodingOptions)
+	defer iter.Close()
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(schema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.Equal(t, values[i], m.GetFieldByNumber(1), "write %d", i)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(values), i)
+}
+
+func TestRoundTripIntValuedFloats(t *testing.T) {
+	schema, err := builder.NewMessage("Counts").
+		AddField(builder.NewField("count", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("ratio", builder.FieldTypeFloat()).SetNumber(2)).
+		Build()
+	require.NoError(t, err)
+
+	// Counts stored as floats, with the occasional value that isn't an integer or that is
+	// too large to be represented exactly.
+	var values []float64
+	for i := 0; i < 100; i++ {
+		values = append(values, float64(i*i-500))
+	}
+	values = append(values,
+		0,
+		0.5,
+		3,
+		math.NaN(),
+		7,
+		math.Inf(-1),
+		-7,
+		1<<53,
+		-(1 << 53),
+		1<<53+2,
+		1<<60,
+		12,
+		12,
+		math.MaxFloat64,
+		-1,
+	)
+
+	var (
+		start  = time.Now().Truncate(time.Second)
+		encode = func(opts Options) []byte {
+			messages := make([]*dynamic.Message, 0, len(values))
+			for _, v := range values {
+				m := dynamic.NewMessage(schema)
+				m.SetFieldByNumber(1, v)
+				m.SetFieldByNumber(2, float32(v))
+				messages = append(messages, m)
+			}
+			return encodeTestMessages(t, start, opts, schema, messages)
+		}
+		opts          = testEncodingOptions.SetIntValuedFloats(true)
+		stream        = encode(opts)
+		defaultStream = encode(testEncodingOptions)
+	)
+	require.True(t, len(stream) < len(defaultStream),
+		"expected %d to be less than %d", len(stream), len(defaultStream))
+
+	header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+	require.NoError(t, err)
+	require.True(t, header.IntValuedFloats)
+
+	iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), testEncodingOptions)
+	defer iter.Close()
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(schema)
+		require.NoError(t, m.Unmarshal(annotation))
+		// Compare the bits so that NaNs are equal.
+		require.Equal(t, math.Float64bits(values[i]), math.Float64bits(m.GetFieldByNumber(1).(float64)),
+			"write %d", i)
+		require.Equal(t, math.Float32bits(float32(values[i])), math.Float32bits(m.GetFieldByNumber(2).(float32)),
+			"write %d", i)
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(values), i)
+}
+
+func TestRoundTripUnknownFieldsPassthrough(t *testing.T) {
+	attrs := builder.NewMessage("Attrs").
+		AddField(builder.NewField("zone", builder.FieldTypeString()).SetNumber(1))
+	fullSchema, err := builder.NewMessage("Full").
+		AddField(builder.NewField("latitude", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("count", builder.FieldTypeInt64()).SetNumber(2)).
+		AddField(builder.NewField("tags", builder.FieldTypeString()).SetRepeated().SetNumber(3)).
+		AddField(builder.NewField("attrs", builder.FieldTypeMessage(attrs)).SetNumber(4)).
+		Build()
+	require.NoError(t, err)
+	// The schema of a reader that only cares about some of the fields.
+	subsetSchema, err := builder.NewMessage("Full").
+		AddField(builder.NewField("latitude", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("tags", builder.FieldTypeString()).SetRepeated().SetNumber(3)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start    = time.Now().Truncate(time.Second)
+		messages []*dynamic.Message
+	)
+	for i := 0; i < 20; i++ {
+		m := dynamic.NewMessage(fullSchema)
+		m.SetFieldByNumber(1, float64(i)+0.5)
+		m.SetFieldByNumber(2, int64(i+1))
+		if i%5 != 4 {
+			m.SetFieldByNumber(3, []string{"a", fmt.Sprintf("tag-%d", i/2)})
+		}
+		if i%7 != 6 {
+			attrsMsg := dynamic.NewMessage(fullSchema.FindFieldByNumber(4).GetMessageType())
+			attrsMsg.SetFieldByNumber(1, fmt.Sprintf("zone-%d", i/3))
+			m.SetFieldByNumber(4, attrsMsg)
+		}
+		messages = append(messages, m)
+	}
+
+	encode := func(opts Options) []byte {
+		return encodeTestMessages(t, start, opts, fullSchema, messages)
+	}
+
+	for _, passthrough := range []bool{false, true} {
+		t.Run(fmt.Sprintf("passthrough %v", passthrough), func(t *testing.T) {
+			var (
+				stream = encode(testEncodingOptions)
+				opts   = testEncodingOptions.SetUnknownFieldsPassthrough(passthrough)
+				iter   = NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(subsetSchema), opts)
+				i      = 0
+			)
+			defer iter.Close()
+			for iter.Next() {
+				_, _, annotation := iter.Current()
+				decoded := dynamic.NewMessage(fullSchema)
+				require.NoError(t, decoded.Unmarshal(annotation))
+
+				// The custom encoded field that isn't in the schema of the reader is skipped,
+				// the marshalled field that isn't in it is only skipped without passthrough.
+				expected := dynamic.NewMessage(fullSchema)
+				require.NoError(t, expected.MergeFrom(messages[i]))
+				expected.ClearFieldByNumber(2)
+				if !passthrough {
+					expected.ClearFieldByNumber(4)
+				}
+				require.True(t, dynamic.MessagesEqual(expected, decoded),
+					"write %d: expected %s, got %s", i, expected.String(), decoded.String())
+				i++
+			}
+			require.NoError(t, iter.Err())
+			require.Equal(t, len(messages), i)
+		})
+	}
+
+	t.Run("map field diffs", func(t *testing.T) {
+		var (
+			stream = encode(testEncodingOptions.SetMapFieldDiffs(true))
+			opts   = testEncodingOptions.SetUnknownFieldsPassthrough(true)
+			iter   = NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(subsetSchema), opts)
+		)
+		defer iter.Close()
+		require.False(t, iter.Next())
+		require.Error(t, iter.Err())
+		require.Contains(t, iter.Err().Error(), "cannot pass through unknown field 4")
+	})
+}
+
+func TestRoundTripFloatBaselines(t *testing.T) {
+	schema, err := builder.NewMessage("Sensor").
+		AddField(builder.NewField("temperature", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("load", builder.FieldTypeFloat()).SetNumber(2)).
+		AddField(builder.NewField("count", builder.FieldTypeInt64()).SetNumber(3)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start  = time.Now().Truncate(time.Second)
+		values = []float64{21.25, 21.5, 21.5, 22, -3.5}
+		encode = func(opts Options) []byte {
+			messages := make([]*dynamic.Message, 0, len(values))
+			for i, v := range values {
+				m := dynamic.NewMessage(schema)
+				m.SetFieldByNumber(1, v)
+				m.SetFieldByNumber(2, float32(v/20))
+				m.SetFieldByNumber(3, int64(i+1))
+				messages = append(messages, m)
+			}
+			return encodeTestMessages(t, start, opts, schema, messages)
+		}
+		decode = func(stream []byte, opts Options) error {
+			iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), opts)
+			defer iter.Close()
+			i := 0
+			for iter.Next() {
+				_, _, annotation := iter.Current()
+				m := dynamic.NewMessage(schema)
+				require.NoError(t, m.Unmarshal(annotation))
+				require.Equal(t, values[i], m.GetFieldByNumber(1).(float64), "write %d", i)
+				require.Equal(t, float32(values[i]/20), m.GetFieldByNumber(2).(float32), "write %d", i)
+				require.Equal(t, int64(i+1), m.GetFieldByNumber(3).(int64), "write %d", i)
+				i++
+			}
+			if err := iter.Err(); err != nil {
+				return err
+			}
+			require.Equal(t, len(values), i)
+			return nil
+		}
+		// The baselines of fields that don't exist or that aren't float fields are ignored.
+		baselines = map[string]float64{
+			"temperature": 21,
+			"load":        float64(float32(21.0 / 20)),
+			"count":       1,
+			"missing":     2,
+		}
+		defaultStream = encode(testEncodingOptions)
+	)
+
+	for _, intValuedFloats := range []bool{false, true} {
+		t.Run(fmt.Sprintf("int valued floats %v", intValuedFloats), func(t *testing.T) {
+			opts := testEncodingOptions.
+				SetIntValuedFloats(intValuedFloats).
+				SetFloatBaselines(baselines)
+			stream := encode(opts)
+			require.True(t, len(stream) < len(defaultStream),
+				"expected %d to be less than %d", len(stream), len(defaultStream))
+
+			header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+			require.NoError(t, err)
+			require.True(t, header.FloatBaselines)
+
+			require.NoError(t, decode(stream, opts))
+			require.Equal(t, errIteratorFloatBaselinesMismatch, decode(stream, testEncodingOptions))
+			require.Equal(t, errIteratorFloatBaselinesMismatch, decode(stream, opts.SetFloatBaselines(
+				map[string]float64{"temperature": 22})))
+		})
+	}
+}
+
+func TestRoundTripBytesPrefixDelta(t *testing.T) {
+	schema, err := builder.NewMessage("Request").
+		AddField(builder.NewField("path", builder.FieldTypeString()).SetNumber(1)).
+		AddField(builder.NewField("id", builder.FieldTypeBytes()).SetNumber(2)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start = time.Now().Truncate(time.Second)
+		paths = []string{
+			"/api/v1/users/1001/profile",
+			"/api/v1/users/1002/profile",
+			"/api/v1/users/1002/profile",
+			"/api/v1/users/1002",
+			"/api/v1/users/1002/settings/notifications",
+			"x",
+			"",
+			"/api/v1/users/1001/profile",
+			"/api/v1/users/1001/profile/avatar",
+			"aaa",
+			"aaaa",
+		}
+		idFor = func(i int) []byte {
+			return []byte(fmt.Sprintf("request-2020-01-01-%06d", 17*i))
+		}
+		encode = func(opts Options) []byte {
+			messages := make([]*dynamic.Message, 0, len(paths))
+			for i, path := range paths {
+				m := dynamic.NewMessage(schema)
+				m.SetFieldByNumber(1, path)
+				m.SetFieldByNumber(2, idFor(i))
+				messages = append(messages, m)
+			}
+			return encodeTestMessages(t, start, opts, schema, messages)
+		}
+	)
+
+	for _, lruSize := range []int{1, 4} {
+		for _, maxInterned := range []int{0, 8} {
+			t.Run(fmt.Sprintf("lru size %d max interned %d", lruSize, maxInterned), func(t *testing.T) {
+				opts := withByteFieldDictionaryLRUSize(testEncodingOptions, lruSize).
+					SetMaxInternedBytesValues(maxInterned)
+				var (
+					defaultStream = encode(opts)
+					stream        = encode(opts.SetBytesPrefixDelta(true))
+				)
+				require.True(t, len(stream) < len(defaultStream),
+					"expected %d to be less than %d", len(stream), len(defaultStream))
+
+				header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+				require.NoError(t, err)
+				require.True(t, header.BytesPrefixDelta)
+
+				iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), opts)
+				defer iter.Close()
+				i := 0
+				for iter.Next() {
+					_, _, annotation := iter.Current()
+					m := dynamic.NewMessage(schema)
+					require.NoError(t, m.Unmarshal(annotation))
+					require.Equal(t, paths[i], m.GetFieldByNumber(1).(string), "write %d", i)
+					require.Equal(t, idFor(i), m.GetFieldByNumber(2).([]byte), "write %d", i)
+					i++
+				}
+				require.NoError(t, iter.Err())
+				require.Equal(t, len(paths), i)
+			})
+		}
+	}
+}
+
+func TestRoundTripMessageBatches(t *testing.T) {
+	var (
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(testVLSchema)
+		opts   = testEncodingOptions.SetMessageBatches(true)
+		ctx    = context.NewContext()
+		// The messages of a batch are encoded relative to each other, including
+		// the deliveryID field that repeats across batches and the attributes that
+		// change within one.
+		batches = [][]*dynamic.Message{
+			{
+				newVL(1, 2, 1, []byte("event-a"), nil),
+				newVL(1.5, 2, 1, []byte("event-b"), map[string]string{"k": "v"}),
+				newVL(1.5, 3, 2, []byte("event-a"), nil),
+			},
+			{
+				newVL(1.5, 3, 2, []byte("event-a"), nil),
+			},
+			{
+				newVL(0, 0, 0, nil, nil),
+				newVL(2, 4, 3, []byte("event-b"), map[string]string{"k": "v2"}),
+			},
+		}
+	)
+	defer ctx.Close()
+
+	marshalBatch := func(batch []*dynamic.Message) []ts.Annotation {
+		var marshalled []ts.Annotation
+		for _, m := range batch {
+			b, err := m.Marshal()
+			require.NoError(t, err)
+			marshalled = append(marshalled, b)
+		}
+		return marshalled
+	}
+
+	enc := NewEncoder(start, opts)
+	enc.Reset(start, 0, schema)
+	for i, batch := range batches {
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if len(batch) == 1 {
+			// Encode writes batches of a single message.
+			require.NoError(t, enc.Encode(dp, xtime.Second, marshalBatch(batch)[0]))
+			continue
+		}
+		require.NoError(t, enc.EncodeMulti(dp, xtime.Second, marshalBatch(batch)))
+	}
+
+	// An invalid message anywhere in the batch fails the entire batch without
+	// writing any data, as does an empty batch.
+	var (
+		stream   = getCurrEncoderBytes(ctx, t, enc)
+		dp       = ts.Datapoint{Timestamp: start.Add(time.Minute)}
+		badBatch = append(marshalBatch(batches[0]), []byte("not a proto message"))
+	)
+	err := enc.EncodeMulti(dp, xtime.Second, badBatch)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "message 3 of batch")
+	require.Equal(t, errEncoderEmptyMessageBatch, enc.EncodeMulti(dp, xtime.Second, nil))
+	require.Equal(t, stream, getCurrEncoderBytes(ctx, t, enc))
+
+	header, err := ReadStreamHeader(bytes.NewReader(stream), testEncodingOptions)
+	require.NoError(t, err)
+	require.True(t, header.MessageBatches)
+
+	// Iterators return every batch as a single datapoint, also once it has been
+	// appended to another stream.
+	appended := NewEncoder(start, opts)
+	appended.Reset(start, 0, schema)
+	require.NoError(t, appended.Append(enc))
+	for _, stream := range [][]byte{stream, getCurrEncoderBytes(ctx, t, appended)} {
+		iter := NewIterator(bytes.NewReader(stream), schema, testEncodingOptions)
+		i := 0
+		for iter.Next() {
+			dp, _, annotation := iter.Current()
+			require.True(t, i < len(batches))
+			require.Equal(t, start.Add(time.Duration(i)*time.Second), dp.Timestamp)
+
+			messages, err := SplitMessageBatch(nil, annotation)
+			require.NoError(t, err)
+			require.Equal(t, len(batches[i]), len(messages), "batch %d", i)
+			for j, expected := range batches[i] {
+				m := dynamic.NewMessage(testVLSchema)
+				require.NoError(t, m.Unmarshal(messages[j]))
+				require.True(t, dynamic.MessagesEqual(expected, m),
+					"batch %d message %d: expected %s but got %s", i, j, expected.String(), m.String())
+			}
+
+			_, _, err = iter.(MessageReader).CurrentMessage(dynamic.NewMessage(testVLSchema))
+			require.Equal(t, errIteratorMessageBatch, err)
+			i++
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, len(batches), i)
+		iter.Close()
+	}
+
+	// Batches must be enabled upfront since every write of the stream then
+	// contains the number of its messages.
+	enc = NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, schema)
+	require.Equal(t, errEncoderMessageBatchesDisabled,
+		enc.EncodeMulti(dp, xtime.Second, marshalBatch(batches[0])))
+}
+
+func TestSplitMessageBatch(t *testing.T) {
+	var batch []byte
+	for _, message := range []string{"a", "", "bcd"} {
+		batch = appendMessageBatch(batch, []byte(message))
+	}
+	messages, err := SplitMessageBatch(nil, batch)
+	require.NoError(t, err)
+	require.Equal(t, []ts.Annotation{ts.Annotation("a"), ts.Annotation(""), ts.Annotation("bcd")}, messages)
+
+	_, err = SplitMessageBatch(nil, batch[:len(batch)-1])
+	require.Error(t, err)
+	_, err = SplitMessageBatch(nil, []byte{0x80})
+	require.Error(t, err)
+}
+
+func TestCommonPrefixAndSuffixLen(t *testing.T) {
+	testCases := []struct {
+		a, b              string
+		prefixLen, suffix int
+	}{
+		{a: "", b: "abc", prefixLen: 0, suffix: 0},
+		{a: "abc", b: "abc", prefixLen: 3, suffix: 0},
+		{a: "abc/1/def", b: "abc/22/def", prefixLen: 4, suffix: 4},
+		{a: "aaa", b: "aaaa", prefixLen: 3, suffix: 0},
+		{a: "xaaa", b: "aaa", prefixLen: 0, suffix: 3},
+		{a: "abcd", b: "xyz", prefixLen: 0, suffix: 0},
+	}
+	for _, tc := range testCases {
+		prefixLen, suffixLen := commonPrefixAndSuffixLen([]byte(tc.a), []byte(tc.b))
+		require.Equal(t, tc.prefixLen, prefixLen, "%s %s", tc.a, tc.b)
+		require.Equal(t, tc.suffix, suffixLen, "%s %s", tc.a, tc.b)
+	}
+}
+
+func TestRoundTripValueRangesTrailer(t *testing.T) {
+	schema, err := builder.NewMessage("Metrics").
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("delta", builder.FieldTypeInt64()).SetNumber(2)).
+		AddField(builder.NewField("count", builder.FieldTypeUInt32()).SetNumber(3)).
+		AddField(builder.NewField("host", builder.FieldTypeString()).SetNumber(4)).
+		Build()
+	require.NoError(t, err)
+	// The same schema without the count field.
+	evolvedSchema, err := builder.NewMessage("Metrics").
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("delta", builder.FieldTypeInt64()).SetNumber(2)).
+		AddField(builder.NewField("host", builder.FieldTypeString()).SetNumber(4)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		opts    = testEncodingOptions.SetValueRangesTrailer(true).SetBytesDictResets(true)
+		enc     = NewEncoder(start, opts)
+		written []*dynamic.Message
+	)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+	for i := 0; i < 100; i++ {
+		if i == 60 {
+			// The ranges of the fields are retained across schema changes.
+			enc.SetSchema(namespace.GetTestSchemaDescr(evolvedSchema))
+		}
+		if i == 30 {
+			require.NoError(t, enc.ResetBytesDictionaries())
+		}
+
+		m := dynamic.NewMessage(evolvedSchema)
+		if i < 60 {
+			m = dynamic.NewMessage(schema)
+			m.SetFieldByNumber(3, uint32(i+10))
+		}
+		if i == 50 {
+			m.SetFieldByNumber(1, math.NaN())
+		} else {
+			m.SetFieldByNumber(1, float64(i)/4+1.5)
+		}
+		if delta := int64(20 - i); delta != 0 {
+			m.SetFieldByNumber(2, delta)
+		}
+		m.SetFieldByNumber(4, fmt.Sprintf("host-%d", i%3))
+		written = append(written, m)
+
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+
+	ctx := context.NewContext()
+	defer ctx.Close()
+	var (
+		stream       = getCurrEncoderBytes(ctx, t, enc)
+		discarded    = enc.Discard()
+		discardBytes = append([]byte(nil), discarded.Head.Bytes()...)
+	)
+	require.Equal(t, stream, discardBytes)
+
+	ranges, ok, err := ReadValueRanges(stream, opts)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, ranges, 3)
+
+	require.Equal(t, 1, ranges[0].FieldNum)
+	require.Equal(t, ValueRangeFloat, ranges[0].Kind)
+	minFloat, maxFloat := ranges[0].Float64()
+	require.Equal(t, 1.5, minFloat)
+	require.Equal(t, 99.0/4+1.5, maxFloat)
+
+	require.Equal(t, 2, ranges[1].FieldNum)
+	require.Equal(t, ValueRangeSignedInt, ranges[1].Kind)
+	minInt, maxInt := ranges[1].Int64()
+	require.Equal(t, int64(-79), minInt)
+	require.Equal(t, int64(20), maxInt)
+
+	require.Equal(t, 3, ranges[2].FieldNum)
+	require.Equal(t, ValueRangeUnsignedInt, ranges[2].Kind)
+	minUint, maxUint := ranges[2].Uint64()
+	require.Equal(t, uint64(10), minUint)
+	require.Equal(t, uint64(69), maxUint)
+
+	iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(schema), opts)
+	defer iter.Close()
+	i := 0
+	for iter.Next() {
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(written[i].GetMessageDescriptor())
+		require.NoError(t, m.Unmarshal(annotation))
+		expected := written[i]
+		if i == 50 {
+			// NaN is never equal to itself so it's compared separately.
+			require.True(t, math.IsNaN(m.GetFieldByNumber(1).(float64)))
+			expected = dynamic.NewMessage(expected.GetMessageDescriptor())
+			require.NoError(t, expected.MergeFrom(written[i]))
+			expected.ClearFieldByNumber(1)
+			m.ClearFieldByNumber(1)
+		}
+		require.True(t, dynamic.MessagesEqual(expected, m),
+			"write %d: expected %s but got %s", i, expected.String(), m.String())
+		i++
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, len(written), i)
+
+	header, err := ReadStreamHeader(bytes.NewReader(stream), opts)
+	require.NoError(t, err)
+	require.True(t, header.EndOfStreamMarker)
+	require.True(t, header.ValueRangesTrailer)
+
+	_, _, err = ReadValueRanges(stream[:len(stream)-1], opts)
+	require.Error(t, err)
+
+	// Streams without a trailer are reported as such.
+	enc = NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+	marshalled, err := written[0].Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, marshalled))
+	_, ok, err = ReadValueRanges(getCurrEncoderBytes(ctx, t, enc), testEncodingOptions)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRoundTripRepeatedToSingularEvolution(t *testing.T) {
+	newSchema := func(file string, repeated ...int32) *desc.MessageDescriptor {
+		isRepeated := func(fieldNum int32) bool {
+			for _, n := range repeated {
+				if n == fieldNum {
+					return true
+				}
+			}
+			return false
+		}
+		fields := []*builder.FieldBuilder{
+			builder.NewField("latitude", builder.FieldTypeDouble()).SetNumber(1),
+			builder.NewField("counts", builder.FieldTypeInt64()).SetNumber(2),
+			builder.NewField("names", builder.FieldTypeString()).SetNumber(3),
+			builder.NewField("epochs", builder.FieldTypeInt64()).SetNumber(4),
+			builder.NewField("ratios", builder.FieldTypeFloat()).SetNumber(5),
+		}
+		mb := builder.NewMessage("Evolving")
+		for _, field := range fields {
+			if isRepeated(field.GetNumber()) {
+				field.SetRepeated()
+			}
+			mb.AddField(field)
+		}
+		fd, err := builder.NewFile(file).SetProto3(true).AddMessage(mb).Build()
+		require.NoError(t, err)
+		return fd.FindMessage("Evolving")
+	}
+	var (
+		// Repeated numeric fields are packed in proto3.
+		writerSchema = newSchema("writer.proto", 2, 3, 5)
+		readerSchema = newSchema("reader.proto", 4)
+		start        = time.Now().Truncate(time.Second)
+		written      []*dynamic.Message
+	)
+	for i := 0; i < 20; i++ {
+		m := dynamic.NewMessage(writerSchema)
+		m.SetFieldByNumber(1, float64(i+1))
+		if i%4 != 3 {
+			m.SetFieldByNumber(2, []int64{int64(i + 1), int64(i*10 + 1)})
+			m.SetFieldByNumber(3, []string{"first", fmt.Sprintf("name-%d", i%3)})
+			m.SetFieldByNumber(5, []float32{1.5, float32(i+1) / 4})
+		}
+		m.SetFieldByNumber(4, int64(i/2+1))
+		written = append(written, m)
+	}
+
+	enc := NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, namespace.GetTestSchemaDescr(writerSchema))
+	for i, m := range written {
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+	}
+	ctx := context.NewContext()
+	defer ctx.Close()
+	stream := getCurrEncoderBytes(ctx, t, enc)
+
+	decode := func(strategy RepeatedToSingularStrategy) ([]ts.Annotation, error) {
+		opts := testEncodingOptions.SetRepeatedToSingularStrategy(strategy)
+		iter := NewIterator(bytes.NewReader(stream), namespace.GetTestSchemaDescr(readerSchema), opts)
+		defer iter.Close()
+		var annotations []ts.Annotation
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			annotations = append(annotations, append(ts.Annotation(nil), annotation...))
+		}
+		return annotations, iter.Err()
+	}
+
+	// The repeated fields are decoded as their last value and the singular field that is
+	// now repeated is decoded as a single value.
+	annotations, err := decode(RepeatedToSingularLastValue)
+	require.NoError(t, err)
+	require.Equal(t, len(written), len(annotations))
+	for i, annotation := range annotations {
+		expected := dynamic.NewMessage(readerSchema)
+		expected.SetFieldByNumber(1, float64(i+1))
+		if i%4 != 3 {
+			expected.SetFieldByNumber(2, int64(i*10+1))
+			expected.SetFieldByNumber(3, fmt.Sprintf("name-%d", i%3))
+			expected.SetFieldByNumber(5, float32(i+1)/4)
+		}
+		expected.SetFieldByNumber(4, []int64{int64(i/2 + 1)})
+
+		m := dynamic.NewMessage(readerSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(expected, m),
+			"write %d: expected %s but got %s", i, expected.String(), m.String())
+	}
+
+	// The values are passed through as they were encoded.
+	annotations, err = decode(RepeatedToSingularPassThrough)
+	require.NoError(t, err)
+	require.Equal(t, len(written), len(annotations))
+	for i, annotation := range annotations {
+		m := dynamic.NewMessage(writerSchema)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(written[i], m),
+			"write %d: expected %s but got %s", i, written[i].String(), m.String())
+	}
+
+	_, err = decode(RepeatedToSingularError)
+	require.Error(t, err)
+}
+
+func TestRoundTripOneofFields(t *testing.T) {
+	nestedBuilder := builder.NewMessage("Payload").
+		AddField(builder.NewField("payload", builder.FieldTypeString()).SetNumber(1))
+	md, err := builder.NewMessage("Reading").
+		AddField(builder.NewField("sensor", builder.FieldTypeString()).SetNumber(1)).
+		AddOneOf(builder.NewOneOf("value").
+			AddChoice(builder.NewField("double_value", builder.FieldTypeDouble()).SetNumber(2)).
+			AddChoice(builder.NewField("int_value", builder.FieldTypeInt64()).SetNumber(3)).
+			AddChoice(builder.NewField("string_value", builder.FieldTypeString()).SetNumber(4)).
+			AddChoice(builder.NewField("payload_value", builder.FieldTypeMessage(nestedBuilder)).SetNumber(5))).
+		AddField(builder.NewField("temperature", builder.FieldTypeDouble()).SetNumber(6)).
+		Build()
+	require.NoError(t, err)
+
+	var (
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(md)
+		opts   = testEncodingOptions.SetOneofFields(true)
+		values = []struct {
+			fieldNum int
+			value    interface{}
+		}{
+			{fieldNum: 2, value: 1.5},
+			// The active member of a oneof is preserved even if its value is the
+			// default value of the field.
+			{fieldNum: 2, value: 0.0},
+			{fieldNum: 3, value: int64(7)},
+			{fieldNum: 3, value: int64(7)},
+			{fieldNum: 4, value: ""},
+			{},
+			{fieldNum: 5},
+			{fieldNum: 2, value: 2.5},
+			{fieldNum: 4, value: "foo"},
+		}
+		written []*dynamic.Message
+	)
+
+	ctx := context.NewContext()
+	defer ctx.Close()
+
+	enc := NewEncoder(start, opts)
+	enc.Reset(start, 0, schema)
+	for i, v := range values {
+		m := dynamic.NewMessage(md)
+		m.SetFieldByNumber(1, "sensor-1")
+		m.SetFieldByNumber(6, float64(20+i))
+		switch v.fieldNum {
+		case 0:
+		case 5:
+			payload := dynamic.NewMessage(md.FindFieldByNumber(5).GetMessageType())
+			payload.SetFieldByNumber(1, fmt.Sprintf("payload-%d", i))
+			m.SetFieldByNumber(5, payload)
+		default:
+			m.SetFieldByNumber(v.fieldNum, v.value)
+		}
+		marshalled, err := m.Marshal()
+		require.NoError(t, err)
+		written = append(written, m)
+
+		dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+		if i > 0 && v.fieldNum != 0 && v.fieldNum != values[i-1].fieldNum {
+			// Switching the active member of the oneof is encoded as a single change
+			// rather than as the previous member being set to its default value.
+			require.Empty(t, enc.fieldsChangedToDefault, "write %d", i)
+		}
+	}
+
+	// The scalar members of the oneof are not custom encoded.
+	var customFieldNums []int
+	for _, field := range enc.CustomFields() {
+		customFieldNums = append(customFieldNums, field.FieldNum)
+	}
+	require.Equal(t, []int{1, 6}, customFieldNums)
+
+	stream := getCurrEncoderBytes(ctx, t, enc)
+	header, err := ReadStreamHeader(bytes.NewReader(stream), opts)
+	require.NoError(t, err)
+	require.True(t, header.OneofFields)
+
+	activeFieldNum := func(m *dynamic.Message) int32 {
+		field, _ := m.GetOneOfField(md.GetOneOfs()[0])
+		if field == nil {
+			return 0
+		}
+		return field.GetNumber()
+	}
+	iter := NewIterator(bytes.NewReader(stream), schema, opts)
+	defer iter.Close()
+	for i, expected := range written {
+		require.True(t, iter.Next(), "iter err: %v", iter.Err())
+		_, _, annotation := iter.Current()
+		m := dynamic.NewMessage(md)
+		require.NoError(t, m.Unmarshal(annotation))
+		require.True(t, dynamic.MessagesEqual(expected, m),
+			"write %d: expected %s but got %s", i, expected.String(), m.String())
+		require.Equal(t, activeFieldNum(expected), activeFieldNum(m), "write %d", i)
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+}
+
+// endiannessTestStream is the hex encoded stream of the writes of
+// TestRoundTripEndiannessIndependent as encoded on a little-endian host. Encoders on
+// hosts of either byte order must produce exactly the same stream, and iterators must
+// decode it to the same values. It needs to be updated if the encoding of the writes
+// changes intentionally.
+const endiannessTestStream = "0104504551716345785d8a00000200490fdaa22168c1ffb504f333f9de6e03850064656c69766572" +
+	"792d61603999e4f78efa83d38bd18000000000e14064656c69766572792d62581f400650d96d7fe9" +
+	"3bc1f600cafb0ccc06219ff7fffff8000000000c00"
+
+func TestRoundTripEndiannessIndependent(t *testing.T) {
+	type write struct {
+		// The in-memory representation of the float64 values in the byte order of a host.
+		lat, long []byte
+		epoch     int64
+		id        string
+	}
+	// Values whose bytes are all distinct so that reading them in the wrong byte
+	// order would produce a different value.
+	var (
+		latBits  = []uint64{0x400921fb54442d18, 0x4005bf0a8b145769, 0xc0091eb851eb851f}
+		longBits = []uint64{0x3ff6a09e667f3bcd, 0x3ff6a09e667f3bcd, 0x7fefffffffffffff}
+		epochs   = []int64{1, -1 << 40, math.MaxInt64}
+		ids      = []string{"delivery-a", "delivery-b", "delivery-a"}
+	)
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(byteOrder.String(), func(t *testing.T) {
+			// Simulate the writes of a host with the byte order.
+			writes := make([]write, 0, len(latBits))
+			for i := range latBits {
+				w := write{
+					lat:   make([]byte, 8),
+					long:  make([]byte, 8),
+					epoch: epochs[i],
+					id:    ids[i],
+				}
+				byteOrder.PutUint64(w.lat, latBits[i])
+				byteOrder.PutUint64(w.long, longBits[i])
+				writes = append(writes, w)
+			}
+
+			var (
+				start   = time.Unix(1600000000, 0)
+				enc     = NewEncoder(start, testEncodingOptions)
+				written []*dynamic.Message
+			)
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(testVLSchema))
+			for i, w := range writes {
+				vl := newVL(
+					math.Float64frombits(byteOrder.Uint64(w.lat)),
+					math.Float64frombits(byteOrder.Uint64(w.long)),
+					w.epoch, []byte(w.id), nil)
+				marshalled, err := vl.Marshal()
+				require.NoError(t, err)
+				written = append(written, vl)
+
+				dp := ts.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+				require.NoError(t, enc.Encode(dp, xtime.Second, marshalled))
+			}
+			ctx := context.NewContext()
+			defer ctx.Close()
+			stream := getCurrEncoderBytes(ctx, t, enc)
+			require.Equal(t, endiannessTestStream, hex.EncodeToString(stream))
+
+			expectedStream, err := hex.DecodeString(endiannessTestStream)
+			require.NoError(t, err)
+			iter := NewIterator(bytes.NewReader(expectedStream),
+				namespace.GetTestSchemaDescr(testVLSchema), testEncodingOptions)
+			defer iter.Close()
+			i := 0
+			for iter.Next() {
+				_, _, annotation := iter.Current()
+				m := dynamic.NewMessage(testVLSchema)
+				require.NoError(t, m.Unmarshal(annotation))
+				require.True(t, dynamic.MessagesEqual(written[i], m),
+					"write %d: expected %s but got %s", i, written[i].String(), m.String())
+				require.Equal(t, latBits[i], math.Float64bits(m.GetFieldByName("latitude").(float64)))
+				i++
+			}
+			require.NoError(t, iter.Err())
+			require.Equal(t, len(written), i)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"encoding/binary"
+	"hash"
+	"sort"
+
+	"github.com/cespare/xxhash"
+	"github.com/jhump/protoreflect/desc"
+)
+
+// schemaHash returns a hash of the number, type and label of every field of the schema,
+// including the fields of nested messages, so that iterators can verify that they decode a
+// stream with the schema it was encoded with. Names are intentionally excluded since
+// renaming a field or message doesn't change how it's encoded.
+func schemaHash(schema *desc.MessageDescriptor) uint64 {
+	digest := xxhash.New()
+	writeSchemaHash(digest, schema, make(map[string]struct{}))
+	return digest.Sum64()
+}
+
+func writeSchemaHash(
+	digest hash.Hash64,
+	schema *desc.MessageDescriptor,
+	visited map[string]struct{},
+) {
+	// Recursive messages are only hashed once, their fields are already part of the hash.
+	visited[schema.GetFullyQualifiedName()] = struct{}{}
+
+	fields := append([]*desc.FieldDescriptor(nil), schema.GetFields()...)
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].GetNumber() < fields[j].GetNumber()
+	})
+
+	var buf [binary.MaxVarintLen64]byte
+	for _, field := range fields {
+		for _, v := range []uint64{
+			uint64(field.GetNumber()),
+			uint64(field.GetType()),
+			uint64(field.GetLabel()),
+		} {
+			n := binary.PutUvarint(buf[:], v)
+			digest.Write(buf[:n])
+		}
+
+		messageType := field.GetMessageType()
+		if messageType == nil {
+			continue
+		}
+		if _, ok := visited[messageType.GetFullyQualifiedName()]; ok {
+			continue
+		}
+		writeSchemaHash(digest, messageType, visited)
+	}
+}
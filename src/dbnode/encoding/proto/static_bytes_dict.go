@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cespare/xxhash"
+)
+
+// staticBytesDict is a static dictionary of bytes values that is shared by many streams
+// so that the first occurrence of each of its values in a stream can be encoded as an
+// index into it. Only its hash is encoded into the stream header so that iterators can
+// verify that they were configured with the same dictionary as the encoder.
+type staticBytesDict struct {
+	values       [][]byte
+	hash         uint64
+	numIndexBits int
+	// indexesByHash is only populated for encoders.
+	indexesByHash map[uint64][]int
+}
+
+func newStaticBytesDict(values [][]byte, forEncoder bool) *staticBytesDict {
+	if len(values) == 0 {
+		return nil
+	}
+
+	var (
+		digest = xxhash.New()
+		buf    [binary.MaxVarintLen64]byte
+	)
+	for _, value := range values {
+		n := binary.PutUvarint(buf[:], uint64(len(value)))
+		digest.Write(buf[:n])
+		digest.Write(value)
+	}
+
+	d := &staticBytesDict{
+		values:       values,
+		hash:         digest.Sum64(),
+		numIndexBits: numBitsRequiredForNumUpToN(len(values) - 1),
+	}
+	if forEncoder {
+		d.indexesByHash = make(map[uint64][]int, len(values))
+		for i, value := range values {
+			hash := bytesHash(value)
+			d.indexesByHash[hash] = append(d.indexesByHash[hash], i)
+		}
+	}
+	return d
+}
+
+// index returns the index of the value with the provided hash in the dictionary.
+func (d *staticBytesDict) index(hash uint64, value []byte) (int, bool) {
+	for _, idx := range d.indexesByHash[hash] {
+		if bytes.Equal(d.values[idx], value) {
+			return idx, true
+		}
+	}
+	return -1, false
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/m3db/m3/src/dbnode/encoding"
+)
+
+// StreamHeader describes the header of an encoded stream.
+type StreamHeader struct {
+	// Version is the version of the encoding scheme the stream was encoded with.
+	Version int `json:"version"`
+	// ByteFieldDictLRUSize is the size of the LRU cache used to compress bytes
+	// fields. It's not part of compact headers, in which case it's encoded along
+	// with the first schema that has custom encoded fields instead.
+	ByteFieldDictLRUSize int `json:"byteFieldDictLRUSize"`
+	// CompactHeader is whether the stream has a compact header.
+	CompactHeader bool `json:"compactHeader"`
+	// EndOfStreamMarker is whether the stream is terminated with an end-of-stream
+	// marker.
+	EndOfStreamMarker bool `json:"endOfStreamMarker"`
+	// MapFieldDiffs is whether changes to map fields are encoded as diffs.
+	MapFieldDiffs bool `json:"mapFieldDiffs"`
+	// FullNonCustomFields is whether the non custom encoded fields of every
+	// message are encoded in full.
+	FullNonCustomFields bool `json:"fullNonCustomFields"`
+	// StaticBytesDict is whether bytes values may be encoded as indexes into a
+	// static dictionary shared by many streams.
+	StaticBytesDict bool `json:"staticBytesDict"`
+	// OneofFields is whether the members of oneof fields are encoded as marshalled
+	// Protobuf with the active member of each oneof replacing the previous one.
+	OneofFields bool `json:"oneofFields"`
+	// MaxInternedBytesValues is the maximum number of distinct values of each bytes
+	// field that are interned, zero if interning is disabled.
+	MaxInternedBytesValues int `json:"maxInternedBytesValues"`
+	// BytesDictResets is whether the stream may contain markers at which the bytes
+	// dictionaries are reset.
+	BytesDictResets bool `json:"bytesDictResets"`
+	// IntChangesBitset is whether the int fields that changed may be encoded as a bitset.
+	IntChangesBitset bool `json:"intChangesBitset"`
+	// IntDeltaOfDelta is whether some int fields may be encoded as a delta-of-delta.
+	IntDeltaOfDelta bool `json:"intDeltaOfDelta"`
+	// SchemaHash is the hash of the schema the stream begins with, zero if the stream
+	// header doesn't include it.
+	SchemaHash uint64 `json:"schemaHash"`
+	// PrimedBytesDicts is whether the bytes dictionaries are primed with values that
+	// are not part of the stream.
+	PrimedBytesDicts bool `json:"primedBytesDicts"`
+	// OmitEmptyProtoPortion is whether the Protobuf marshalled portion of the writes
+	// is omitted for schemas whose fields are all custom encoded.
+	OmitEmptyProtoPortion bool `json:"omitEmptyProtoPortion"`
+	// ValueRangesTrailer is whether the end-of-stream marker is followed by a trailer
+	// that contains the ranges of the values of the custom encoded numeric fields.
+	ValueRangesTrailer bool `json:"valueRangesTrailer"`
+	// LimitedCustomFields is whether the encoder may marshal some of the fields that could
+	// be custom encoded as Protobuf because it limits the number of custom encoded fields.
+	LimitedCustomFields bool `json:"limitedCustomFields"`
+	// CustomFieldOrder is whether the values of some custom encoded fields may be written
+	// before the others rather than in field number order.
+	CustomFieldOrder bool `json:"customFieldOrder"`
+	// IntValuedFloats is whether the change of a float field from an integer value may be
+	// encoded as the delta between integers.
+	IntValuedFloats bool `json:"intValuedFloats"`
+	// FloatBaselines is whether the first value of some float fields is encoded as the XOR
+	// with a baseline that is not part of the stream.
+	FloatBaselines bool `json:"floatBaselines"`
+	// BytesPrefixDelta is whether a new value of a bytes field may be encoded as the difference
+	// with its previous value.
+	BytesPrefixDelta bool `json:"bytesPrefixDelta"`
+	// MessageBatches is whether every write of the stream is a batch of messages that
+	// share its timestamp.
+	MessageBatches bool `json:"messageBatches"`
+	// Metadata is the opaque metadata of the stream, nil if the stream header doesn't
+	// include any.
+	Metadata []byte `json:"metadata"`
+}
+
+// ReadStreamHeader reads the header of an encoded stream, it's useful to inspect
+// streams without having to decode them.
+func ReadStreamHeader(reader io.Reader, opts Options) (StreamHeader, error) {
+	it := &iterator{
+		opts:   opts,
+		stream: encoding.NewIStream(reader, opts.EncodingOptions().IStreamReaderSizeProto()),
+	}
+	if err := it.readStreamHeader(); err != nil {
+		return StreamHeader{}, fmt.Errorf(
+			"%s error reading stream header: %v", itErrPrefix, err)
+	}
+
+	return StreamHeader{
+		Version:                int(it.version),
+		ByteFieldDictLRUSize:   it.byteFieldDictLRUSize,
+		CompactHeader:          it.compactHeader,
+		EndOfStreamMarker:      it.streamFeatures.has(streamFeatureEndOfStreamMarker),
+		MapFieldDiffs:          it.streamFeatures.has(streamFeatureMapFieldDiffs),
+		FullNonCustomFields:    it.streamFeatures.has(streamFeatureFullNonCustomFields),
+		StaticBytesDict:        it.streamFeatures.has(streamFeatureStaticBytesDict),
+		OneofFields:            it.streamFeatures.has(streamFeatureOneofFields),
+		MaxInternedBytesValues: it.maxInternedBytesValues,
+		BytesDictResets:        it.streamFeatures.has(streamFeatureBytesDictResets),
+		IntChangesBitset:       it.streamFeatures.has(streamFeatureIntChangesBitset),
+		IntDeltaOfDelta:        it.streamFeatures.has(streamFeatureIntDeltaOfDelta),
+		SchemaHash:             it.schemaHash,
+		PrimedBytesDicts:       it.streamFeatures.has(streamFeaturePrimedBytesDicts),
+		OmitEmptyProtoPortion:  it.streamFeatures.has(streamFeatureOmitEmptyProtoPortion),
+		ValueRangesTrailer:     it.streamFeatures.has(streamFeatureValueRangesTrailer),
+		LimitedCustomFields:    it.streamFeatures.has(streamFeatureLimitedCustomFields),
+		CustomFieldOrder:       it.streamFeatures.has(streamFeatureCustomFieldOrder),
+		IntValuedFloats:        it.streamFeatures.has(streamFeatureIntValuedFloats),
+		FloatBaselines:         it.streamFeatures.has(streamFeatureFloatBaselines),
+		BytesPrefixDelta:       it.streamFeatures.has(streamFeatureBytesPrefixDelta),
+		MessageBatches:         it.streamFeatures.has(streamFeatureMessageBatches),
+		Metadata:               it.StreamMetadata(),
+	}, nil
+}
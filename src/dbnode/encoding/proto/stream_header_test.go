@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/ts"
+	"github.com/m3db/m3/src/x/context"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadStreamHeader(t *testing.T) {
+	noCustomFieldsSchema, err := builder.NewMessage("NoCustomFields").
+		AddField(builder.NewField("strs", builder.FieldTypeString()).SetRepeated().SetNumber(1)).
+		Build()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		opts     Options
+		noCustom bool
+		expected StreamHeader
+	}{
+		{
+			name: "base",
+			opts: testEncodingOptions,
+			expected: StreamHeader{
+				Version:              baseEncodingSchemeVersion,
+				ByteFieldDictLRUSize: 4,
+			},
+		},
+		{
+			name: "stream features",
+			opts: withByteFieldDictionaryLRUSize(testEncodingOptions, 8).
+				SetEndOfStreamMarker(true).
+				SetMapFieldDiffs(true),
+			expected: StreamHeader{
+				Version:              streamFeaturesEncodingSchemeVersion,
+				ByteFieldDictLRUSize: 8,
+				EndOfStreamMarker:    true,
+				MapFieldDiffs:        true,
+			},
+		},
+		{
+			name: "full non custom fields",
+			opts: testEncodingOptions.SetFullNonCustomFields(true),
+			expected: StreamHeader{
+				Version:              streamFeaturesEncodingSchemeVersion,
+				ByteFieldDictLRUSize: 4,
+				FullNonCustomFields:  true,
+			},
+		},
+		{
+			name:     "compact header",
+			opts:     testEncodingOptions.SetCompactHeader(true),
+			noCustom: true,
+			expected: StreamHeader{
+				Version:       compactHeaderEncodingSchemeVersion,
+				CompactHeader: true,
+			},
+		},
+		{
+			name:     "compact header with schema hash",
+			opts:     testEncodingOptions.SetCompactHeader(true).SetSchemaHash(true),
+			noCustom: true,
+			expected: StreamHeader{
+				Version:       compactHeaderEncodingSchemeVersion,
+				CompactHeader: true,
+				SchemaHash:    schemaHash(noCustomFieldsSchema),
+			},
+		},
+		{
+			name: "stream metadata",
+			opts: testEncodingOptions.
+				SetSchemaHash(true).
+				SetStreamMetadata([]byte("host=a,pipeline=v2")),
+			expected: StreamHeader{
+				Version:              streamFeaturesEncodingSchemeVersion,
+				ByteFieldDictLRUSize: 4,
+				SchemaHash:           schemaHash(testVLSchema),
+				Metadata:             []byte("host=a,pipeline=v2"),
+			},
+		},
+		{
+			name:     "compact header with stream metadata",
+			opts:     testEncodingOptions.SetCompactHeader(true).SetStreamMetadata([]byte{0xff}),
+			noCustom: true,
+			expected: StreamHeader{
+				Version:       compactHeaderEncodingSchemeVersion,
+				CompactHeader: true,
+				Metadata:      []byte{0xff},
+			},
+		},
+		{
+			name: "float baselines with stream metadata",
+			opts: testEncodingOptions.
+				SetFloatBaselines(map[string]float64{"latitude": 1.5}).
+				SetStreamMetadata([]byte("host=b")),
+			expected: StreamHeader{
+				Version:              streamFeaturesEncodingSchemeVersion,
+				ByteFieldDictLRUSize: 4,
+				FloatBaselines:       true,
+				Metadata:             []byte("host=b"),
+			},
+		},
+		{
+			name: "bytes prefix delta",
+			opts: testEncodingOptions.SetBytesPrefixDelta(true),
+			expected: StreamHeader{
+				Version:              streamFeaturesEncodingSchemeVersion,
+				ByteFieldDictLRUSize: 4,
+				BytesPrefixDelta:     true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				start  = time.Now().Truncate(time.Second)
+				schema = testVLSchema
+				ctx    = context.NewContext()
+			)
+			defer ctx.Close()
+			if tc.noCustom {
+				schema = noCustomFieldsSchema
+			}
+
+			enc := NewEncoder(start, tc.opts)
+			enc.Reset(start, 0, namespace.GetTestSchemaDescr(schema))
+			require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, nil))
+
+			header, err := ReadStreamHeader(
+				bytes.NewReader(getCurrEncoderBytes(ctx, t, enc)), testEncodingOptions)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, header)
+		})
+	}
+
+	_, err = ReadStreamHeader(bytes.NewReader([]byte{0x7f}), testEncodingOptions)
+	require.Error(t, err)
+}
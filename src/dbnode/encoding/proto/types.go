@@ -0,0 +1,404 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/x/instrument"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// Options represents the options of the ProtoBuf encoder and iterator, which
+// extend the generic encoding options with the options of the ProtoBuf encoding
+// scheme.
+type Options interface {
+	// SetEncodingOptions sets the generic encoding options.
+	SetEncodingOptions(value encoding.Options) Options
+
+	// EncodingOptions returns the generic encoding options.
+	EncodingOptions() encoding.Options
+
+	// SetEndOfStreamMarker sets whether the ProtoBuf encoder should terminate streams with an
+	// explicit end-of-stream marker so that iterators can detect streams that have been
+	// truncated. Streams encoded with this option enabled can not be read by iterators
+	// that predate it.
+	SetEndOfStreamMarker(value bool) Options
+
+	// EndOfStreamMarker returns whether the ProtoBuf encoder terminates streams with an
+	// end-of-stream marker.
+	EndOfStreamMarker() bool
+
+	// SetMapFieldDiffs sets whether the ProtoBuf encoder should encode changes to map
+	// fields as a diff of the added, changed and removed entries rather than re-encoding
+	// the entire map. Streams encoded with this option enabled can not be read by iterators
+	// that predate it.
+	SetMapFieldDiffs(value bool) Options
+
+	// MapFieldDiffs returns whether the ProtoBuf encoder encodes changes to map fields
+	// as diffs.
+	MapFieldDiffs() bool
+
+	// SetInvalidCustomFieldsAsDefault sets whether the ProtoBuf encoder should treat a custom
+	// encoded field whose value can not be interpreted according to the schema (I.E a
+	// wire type mismatch or an out of range integer) as if it were set to its default
+	// value rather than failing the entire write. Messages that are malformed such that
+	// the remaining fields can not be read still fail.
+	SetInvalidCustomFieldsAsDefault(value bool) Options
+
+	// InvalidCustomFieldsAsDefault returns whether the ProtoBuf encoder treats custom
+	// encoded fields with invalid values as default values.
+	InvalidCustomFieldsAsDefault() bool
+
+	// SetCompactHeader sets whether the ProtoBuf encoder should omit the dictionary
+	// compression LRU cache size and the custom types section from the header of streams
+	// whose schema has no custom encoded fields. Streams encoded with this option enabled
+	// can not be read by iterators that predate it.
+	SetCompactHeader(value bool) Options
+
+	// CompactHeader returns whether the ProtoBuf encoder uses a compact stream header
+	// for schemas without custom encoded fields.
+	CompactHeader() bool
+
+	// SetFullNonCustomFields sets whether the ProtoBuf encoder should marshal the non custom
+	// encoded fields of every message in full rather than only the fields that changed since the
+	// previous message. This avoids the cost of diffing consecutive messages for workloads where
+	// they are unrelated to each other and takes precedence over MapFieldDiffs. Streams
+	// encoded with this option enabled can not be read by iterators that predate it.
+	SetFullNonCustomFields(value bool) Options
+
+	// FullNonCustomFields returns whether the ProtoBuf encoder marshals the non custom
+	// encoded fields of every message in full.
+	FullNonCustomFields() bool
+
+	// SetLenientDecoding sets whether ProtoBuf iterators should skip the rest of a stream
+	// without failing when they encounter a corrupt datapoint, so that the datapoints that
+	// precede it can be salvaged. Since the stream has no checkpoints to resynchronize at,
+	// everything after the corrupt datapoint is skipped.
+	SetLenientDecoding(value bool) Options
+
+	// LenientDecoding returns whether ProtoBuf iterators skip the rest of a stream when
+	// they encounter a corrupt datapoint rather than failing.
+	LenientDecoding() bool
+
+	// SetStaticBytesDictionary sets a static dictionary of bytes values that is shared by
+	// all the streams encoded by the ProtoBuf encoder so that the first occurrence of each of
+	// its values in a stream can be encoded as an index into it rather than in full. The
+	// dictionary is not part of the streams (only its hash is) so iterators must be configured
+	// with the exact same dictionary to decode them.
+	SetStaticBytesDictionary(value [][]byte) Options
+
+	// StaticBytesDictionary returns the static dictionary of bytes values shared by all the
+	// streams encoded by the ProtoBuf encoder.
+	StaticBytesDictionary() [][]byte
+
+	// SetMaxRetainedBufferCapacity sets the capacity above which the buffers of proto
+	// encoders are released rather than retained for reuse when they are reset. Zero, the default,
+	// retains the buffers regardless of their capacity.
+	SetMaxRetainedBufferCapacity(value int) Options
+
+	// MaxRetainedBufferCapacity returns the capacity above which the buffers of proto
+	// encoders are released rather than retained for reuse when they are reset.
+	MaxRetainedBufferCapacity() int
+
+	// SetRejectEmptyAnnotations sets whether the ProtoBuf encoder should return an error when
+	// asked to encode an empty annotation rather than encoding it as a message whose fields all
+	// have their default values.
+	SetRejectEmptyAnnotations(value bool) Options
+
+	// RejectEmptyAnnotations returns whether the ProtoBuf encoder should return an error
+	// when asked to encode an empty annotation.
+	RejectEmptyAnnotations() bool
+
+	// SetOneofFields sets whether the ProtoBuf encoder should encode the members of oneof
+	// fields as marshalled Protobuf rather than custom encoding them so that switching the active
+	// member of a oneof is encoded as a single change.
+	SetOneofFields(value bool) Options
+
+	// OneofFields returns whether the ProtoBuf encoder should encode the members of oneof
+	// fields as marshalled Protobuf rather than custom encoding them.
+	OneofFields() bool
+
+	// SetMaxInternedBytesValues sets the maximum number of distinct values of each bytes
+	// field of a proto stream that are interned, such that once encoded in full they can later
+	// be encoded as a compact index even after they've been evicted from the LRU dictionary.
+	// Values beyond the maximum are encoded as usual. Zero disables interning.
+	SetMaxInternedBytesValues(value int) Options
+
+	// MaxInternedBytesValues returns the maximum number of distinct values of each bytes
+	// field of a proto stream that are interned.
+	MaxInternedBytesValues() int
+
+	// SetBytesDictResets sets whether the ProtoBuf encoder can reset the bytes
+	// dictionaries of a stream mid-stream (see the ResetBytesDictionaries method of the
+	// proto encoder) while retaining the compression state of the other fields.
+	SetBytesDictResets(value bool) Options
+
+	// BytesDictResets returns whether the ProtoBuf encoder can reset the bytes
+	// dictionaries of a stream mid-stream.
+	BytesDictResets() bool
+
+	// SetIntChangesBitset sets whether the ProtoBuf encoder can encode which of the custom
+	// encoded int fields of a message changed as a single bitset instead of one bit per field
+	// when that is more compact, which is the case for schemas with many int fields that
+	// rarely change.
+	SetIntChangesBitset(value bool) Options
+
+	// IntChangesBitset returns whether the ProtoBuf encoder can encode which of the custom
+	// encoded int fields of a message changed as a single bitset.
+	IntChangesBitset() bool
+
+	// SetIntDeltaOfDeltaFields sets the names of the custom encoded int fields that the
+	// ProtoBuf encoder encodes as the delta of the delta between consecutive values rather than
+	// the delta, which compresses counters that increase at a steady rate much better.
+	SetIntDeltaOfDeltaFields(value []string) Options
+
+	// IntDeltaOfDeltaFields returns the names of the custom encoded int fields that the
+	// ProtoBuf encoder encodes as the delta of the delta between consecutive values.
+	IntDeltaOfDeltaFields() []string
+
+	// SetValidateMessages sets whether the ProtoBuf encoder validates each message against
+	// the schema before encoding it (that the required fields are set and that the values of
+	// enum fields are defined by their enum, including in nested messages), which is off by
+	// default since it requires unmarshalling each message in full.
+	SetValidateMessages(value bool) Options
+
+	// ValidateMessages returns whether the ProtoBuf encoder validates each message against
+	// the schema before encoding it.
+	ValidateMessages() bool
+
+	// SetSchemaHash sets whether the ProtoBuf encoder writes a hash of the field numbers
+	// and types of the schema into the stream header so that iterators can verify that they
+	// decode the stream with the same schema it was encoded with.
+	SetSchemaHash(value bool) Options
+
+	// SchemaHash returns whether the ProtoBuf encoder writes a hash of the schema into
+	// the stream header.
+	SchemaHash() bool
+
+	// SetOmitEmptyProtoPortion sets whether the ProtoBuf encoder omits the control bit
+	// that precedes the Protobuf marshalled portion of every write for schemas whose fields
+	// are all custom encoded, since that portion is then always empty.
+	SetOmitEmptyProtoPortion(value bool) Options
+
+	// OmitEmptyProtoPortion returns whether the ProtoBuf encoder omits the Protobuf
+	// marshalled portion of every write for schemas whose fields are all custom encoded.
+	OmitEmptyProtoPortion() bool
+
+	// SetRepeatedToSingularStrategy sets how the ProtoBuf iterator decodes fields that were
+	// repeated in the schema the stream was encoded with but are singular in its own schema.
+	SetRepeatedToSingularStrategy(value RepeatedToSingularStrategy) Options
+
+	// RepeatedToSingularStrategy returns how the ProtoBuf iterator decodes fields that were
+	// repeated in the schema the stream was encoded with but are singular in its own schema.
+	RepeatedToSingularStrategy() RepeatedToSingularStrategy
+
+	// SetTracer sets the OpenTracing tracer used to emit spans covering the
+	// proto encoder's Encode path, a nil tracer disables tracing. The message size
+	// and the number of custom fields are set as tags of the Encode span.
+	SetTracer(value opentracing.Tracer) Options
+
+	// Tracer returns the tracer used to emit spans covering the proto
+	// encoder's Encode path.
+	Tracer() opentracing.Tracer
+
+	// SetTargetEncodingSchemeVersion sets the version of the encoding scheme that the
+	// streams of the ProtoBuf encoder must remain readable by, so that nodes can write
+	// streams that nodes running an older version can read during a rolling upgrade.
+	// Encoding fails if an enabled option requires a newer version, zero (the default)
+	// targets the latest version.
+	SetTargetEncodingSchemeVersion(value int) Options
+
+	// TargetEncodingSchemeVersion returns the version of the encoding scheme that the
+	// streams of the ProtoBuf encoder must remain readable by.
+	TargetEncodingSchemeVersion() int
+
+	// SetValueRangesTrailer sets whether the ProtoBuf encoder should end its streams
+	// with a trailer that contains the minimum and maximum value of each custom encoded
+	// numeric field so that readers can skip streams whose values can not satisfy a
+	// predicate without decoding them. It implies an end-of-stream marker.
+	SetValueRangesTrailer(value bool) Options
+
+	// ValueRangesTrailer returns whether the ProtoBuf encoder ends its streams with a
+	// trailer that contains the range of the values of each custom encoded numeric field.
+	ValueRangesTrailer() bool
+
+	// SetUnsignedIntWraparound sets whether the ProtoBuf encoder encodes the change of an
+	// unsigned int field as the delta that wraps around the 64 bit boundary when it's smaller
+	// than the delta that doesn't, which keeps the deltas of 64 bit counters that overflow small.
+	// The iterator reconstructs either delta with the same wrapping arithmetic so the streams
+	// remain readable by iterators that predate the option.
+	SetUnsignedIntWraparound(value bool) Options
+
+	// UnsignedIntWraparound returns whether the ProtoBuf encoder encodes the change of an
+	// unsigned int field as the delta that wraps around the 64 bit boundary when it's smaller.
+	UnsignedIntWraparound() bool
+
+	// SetMaxCustomFields sets the maximum number of fields of a schema that the ProtoBuf
+	// encoder custom encodes, the fields with the lowest field numbers are custom encoded and
+	// the values of the rest are marshalled as ProtoBuf, which bounds the cost of every write
+	// for very wide schemas. Zero or a negative value means no limit.
+	SetMaxCustomFields(value int) Options
+
+	// MaxCustomFields returns the maximum number of fields of a schema that the ProtoBuf
+	// encoder custom encodes, zero or a negative value if there is no limit.
+	MaxCustomFields() int
+
+	// SetCustomFieldsAllowlist sets the names of the only fields that the ProtoBuf encoder
+	// custom encodes (subject to MaxCustomFields), the values of any other fields are
+	// marshalled as ProtoBuf. All of the fields that can be are custom encoded if it's empty.
+	SetCustomFieldsAllowlist(value []string) Options
+
+	// CustomFieldsAllowlist returns the names of the only fields that the ProtoBuf encoder
+	// custom encodes, empty if all of the fields that can be are custom encoded.
+	CustomFieldsAllowlist() []string
+
+	// SetFlushMaxDatapoints sets the number of datapoints after which the ShouldFlush method of
+	// the ProtoBuf encoder reports that the block should be flushed, zero or a negative value means
+	// that the number of datapoints is not considered.
+	SetFlushMaxDatapoints(value int) Options
+
+	// FlushMaxDatapoints returns the number of datapoints after which the ProtoBuf encoder
+	// should be flushed, zero or a negative value if it's not considered.
+	FlushMaxDatapoints() int
+
+	// SetFlushMaxBytes sets the length of the stream in bytes after which the ShouldFlush
+	// method of the ProtoBuf encoder reports that the block should be flushed, zero or a negative
+	// value means that the length of the stream is not considered.
+	SetFlushMaxBytes(value int) Options
+
+	// FlushMaxBytes returns the length of the stream in bytes after which the ProtoBuf
+	// encoder should be flushed, zero or a negative value if it's not considered.
+	FlushMaxBytes() int
+
+	// SetCustomFieldOrder sets the names of the custom encoded fields whose values the ProtoBuf
+	// encoder writes first, in the given order, followed by the values of the rest of the custom
+	// encoded fields in field number order. Grouping the fields that change together can make the
+	// int changes bitset more effective. The order is recorded in the stream for iterators.
+	SetCustomFieldOrder(value []string) Options
+
+	// CustomFieldOrder returns the names of the custom encoded fields whose values the
+	// ProtoBuf encoder writes first, empty if they're written in field number order.
+	CustomFieldOrder() []string
+
+	// SetIntValuedFloats sets whether the ProtoBuf encoder encodes the change of a custom
+	// encoded float field from one integer value to another (e.g. counts stored as doubles) as
+	// the delta between the integers, which is much more compact than the XOR of the floats.
+	SetIntValuedFloats(value bool) Options
+
+	// IntValuedFloats returns whether the ProtoBuf encoder encodes the change of a float
+	// field from one integer value to another as the delta between the integers.
+	IntValuedFloats() bool
+
+	// SetStreamMetadata sets an opaque blob that the ProtoBuf encoder writes once in the header
+	// of every stream, for example to record the provenance of the stream, which iterators make
+	// available without interpreting it. No metadata is written if it's empty.
+	SetStreamMetadata(value []byte) Options
+
+	// StreamMetadata returns the opaque blob that the ProtoBuf encoder writes once in the
+	// header of every stream, empty if none is written.
+	StreamMetadata() []byte
+
+	// SetFloatBaselines sets the baseline values, by field name, that the ProtoBuf encoder
+	// encodes the first value of each custom encoded float field of a stream as the XOR with,
+	// instead of encoding it in full, which is more compact when values cluster near a known
+	// set point. Iterators must be configured with the same baselines.
+	SetFloatBaselines(value map[string]float64) Options
+
+	// FloatBaselines returns the baseline values, by field name, that the ProtoBuf encoder
+	// encodes the first value of each custom encoded float field of a stream as the XOR with.
+	FloatBaselines() map[string]float64
+
+	// SetUnknownFieldsPassthrough sets whether ProtoBuf iterators preserve the fields of the
+	// Protobuf marshalled portion of the stream that aren't in their schema as raw bytes in the
+	// messages they return, so that readers whose schema only covers some of the fields (such as
+	// proxies) can pass the rest through.
+	SetUnknownFieldsPassthrough(value bool) Options
+
+	// UnknownFieldsPassthrough returns whether ProtoBuf iterators preserve the fields that
+	// aren't in their schema as raw bytes in the messages they return.
+	UnknownFieldsPassthrough() bool
+
+	// SetBytesPrefixDelta sets whether the ProtoBuf encoder may encode a new value of a
+	// custom encoded bytes field as the lengths of its longest common prefix and suffix with
+	// the previous value followed by the bytes in between, instead of in full, which is more
+	// compact for values that change little from one write to the next such as paths or IDs.
+	SetBytesPrefixDelta(value bool) Options
+
+	// BytesPrefixDelta returns whether the ProtoBuf encoder may encode a new value of a
+	// custom encoded bytes field as the difference with the previous value.
+	BytesPrefixDelta() bool
+
+	// SetMessageBatches sets whether every write of the streams of the ProtoBuf encoder is
+	// a batch of messages that share its timestamp, which Encoder.EncodeMulti requires.
+	// Iterators return each batch as a single datapoint whose annotation contains the
+	// messages of the batch, see SplitMessageBatch.
+	SetMessageBatches(value bool) Options
+
+	// MessageBatches returns whether every write of the streams of the ProtoBuf encoder
+	// is a batch of messages that share its timestamp.
+	MessageBatches() bool
+
+	// SetInstrumentOptions sets the instrument options.
+	SetInstrumentOptions(value instrument.Options) Options
+
+	// InstrumentOptions returns the instrument options.
+	InstrumentOptions() instrument.Options
+
+	// SetLogMarshalFallbacks sets whether the proto encoder logs the numbers of the
+	// fields of its schema that are ProtoBuf marshalled rather than custom encoded, and why,
+	// which can reveal fields that compress worse than expected. The fields are logged when
+	// the encoder's schema is set, at most once per minute for each schema across all of the
+	// encoders since they're typically reset with the same schema for every block.
+	SetLogMarshalFallbacks(value bool) Options
+
+	// LogMarshalFallbacks returns whether the proto encoder logs the numbers of the
+	// fields of its schema that are ProtoBuf marshalled rather than custom encoded.
+	LogMarshalFallbacks() bool
+
+	// SetRetainLastEncodedMessage sets whether the proto encoder retains a copy of
+	// the last message it encoded, which LastEncodedMessage and EncodeDelta require.
+	// It's off by default since it costs a copy of every message and a buffer as large
+	// as the largest message for every encoder.
+	SetRetainLastEncodedMessage(value bool) Options
+
+	// RetainLastEncodedMessage returns whether the proto encoder retains a copy of
+	// the last message it encoded.
+	RetainLastEncodedMessage() bool
+}
+
+// RepeatedToSingularStrategy determines how the ProtoBuf iterator decodes fields
+// that were repeated in the schema a stream was encoded with, but that are singular in
+// the schema of the iterator. The iterator always interprets the stream according to the
+// custom types recorded in it, so such fields are never custom encoded in the stream.
+type RepeatedToSingularStrategy int
+
+const (
+	// RepeatedToSingularLastValue decodes only the last value of the field, which
+	// is how Protobuf parsers interpret repeated values of a singular field. It's the
+	// default strategy.
+	RepeatedToSingularLastValue RepeatedToSingularStrategy = iota
+	// RepeatedToSingularPassThrough decodes all of the values of the field exactly
+	// as they were encoded.
+	RepeatedToSingularPassThrough
+	// RepeatedToSingularError fails the iteration with an error.
+	RepeatedToSingularError
+)
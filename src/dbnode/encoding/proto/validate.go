@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// validateMessage validates the marshalled message against the schema: that all of its
+// required fields are set and that the values of its enum fields are defined by their enum,
+// including in nested messages. Proto3 enums are open so the encoder accepts undefined values
+// unless messages are validated.
+func validateMessage(schema *desc.MessageDescriptor, protoBytes []byte) error {
+	// Merge into an empty message rather than unmarshal so that the missing required fields
+	// of the message are reported by name below.
+	m := dynamic.NewMessage(schema)
+	if err := m.UnmarshalMerge(protoBytes); err != nil {
+		return err
+	}
+	return validateDynamicMessage(m, "")
+}
+
+func validateDynamicMessage(m *dynamic.Message, path string) error {
+	for _, field := range m.GetMessageDescriptor().GetFields() {
+		fieldPath := field.GetName()
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		if !m.HasField(field) {
+			if field.IsRequired() {
+				return fmt.Errorf("required field %s is not set", fieldPath)
+			}
+			continue
+		}
+
+		switch v := m.GetField(field).(type) {
+		case map[interface{}]interface{}:
+			valueField := field.GetMapValueType()
+			for key, value := range v {
+				valuePath := fmt.Sprintf("%s[%v]", fieldPath, key)
+				if err := validateFieldValue(valueField, value, valuePath); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, value := range v {
+				valuePath := fmt.Sprintf("%s[%d]", fieldPath, i)
+				if err := validateFieldValue(field, value, valuePath); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := validateFieldValue(field, v, fieldPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateFieldValue(field *desc.FieldDescriptor, value interface{}, path string) error {
+	if enumType := field.GetEnumType(); enumType != nil {
+		if number, ok := value.(int32); ok && enumType.FindValueByNumber(number) == nil {
+			return fmt.Errorf("enum field %s has undefined value %d", path, number)
+		}
+		return nil
+	}
+
+	if nested, ok := value.(*dynamic.Message); ok {
+		return validateDynamicMessage(nested, path)
+	}
+	return nil
+}
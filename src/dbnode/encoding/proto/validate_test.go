@@ -0,0 +1,176 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/ts"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/require"
+)
+
+func newValidateTestSchema(t *testing.T) *desc.MessageDescriptor {
+	status := builder.NewEnum("Status").
+		AddValue(builder.NewEnumValue("UNKNOWN").SetNumber(0)).
+		AddValue(builder.NewEnumValue("OK").SetNumber(1))
+	nested := builder.NewMessage("Nested").
+		AddField(builder.NewField("id", builder.FieldTypeString()).SetNumber(1)).
+		AddField(builder.NewField("status", builder.FieldTypeEnum(status)).SetNumber(2))
+	event := builder.NewMessage("Event").
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(1)).
+		AddField(builder.NewField("status", builder.FieldTypeEnum(status)).SetNumber(2)).
+		AddField(builder.NewField("statuses", builder.FieldTypeEnum(status)).SetNumber(3).SetRepeated()).
+		AddField(builder.NewField("nested", builder.FieldTypeMessage(nested)).SetNumber(4)).
+		AddField(builder.NewMapField("nested_by_key",
+			builder.FieldTypeString(), builder.FieldTypeMessage(nested)).SetNumber(5)).
+		AddField(builder.NewField("source", builder.FieldTypeString()).SetNumber(6).SetRequired())
+	// Required fields only exist in proto2.
+	fd, err := builder.NewFile("validate_test.proto").
+		SetProto3(false).
+		AddEnum(status).
+		AddMessage(nested).
+		AddMessage(event).
+		Build()
+	require.NoError(t, err)
+	md := fd.FindMessage("Event")
+	require.NotNil(t, md)
+	return md
+}
+
+func TestValidateMessage(t *testing.T) {
+	var (
+		md       = newValidateTestSchema(t)
+		nestedMD = md.FindFieldByNumber(4).GetMessageType()
+	)
+	newNested := func(id string, status int32) *dynamic.Message {
+		nested := dynamic.NewMessage(nestedMD)
+		nested.SetFieldByNumber(1, id)
+		nested.SetFieldByNumber(2, status)
+		return nested
+	}
+
+	tests := []struct {
+		name        string
+		setFields   func(m *dynamic.Message)
+		expectedErr string
+	}{
+		{
+			name: "valid",
+			setFields: func(m *dynamic.Message) {
+				m.SetFieldByNumber(1, 1.5)
+				m.SetFieldByNumber(2, int32(1))
+				m.SetFieldByNumber(3, []int32{0, 1})
+				m.SetFieldByNumber(4, newNested("a", 1))
+				m.PutMapFieldByNumber(5, "b", newNested("b", 0))
+			},
+		},
+		{
+			name: "undefined enum value",
+			setFields: func(m *dynamic.Message) {
+				m.SetFieldByNumber(2, int32(7))
+			},
+			expectedErr: "enum field status has undefined value 7",
+		},
+		{
+			name: "undefined repeated enum value",
+			setFields: func(m *dynamic.Message) {
+				m.SetFieldByNumber(3, []int32{1, 7})
+			},
+			expectedErr: "enum field statuses[1] has undefined value 7",
+		},
+		{
+			name: "undefined nested enum value",
+			setFields: func(m *dynamic.Message) {
+				m.SetFieldByNumber(4, newNested("a", 7))
+			},
+			expectedErr: "enum field nested.status has undefined value 7",
+		},
+		{
+			name: "undefined map value enum value",
+			setFields: func(m *dynamic.Message) {
+				m.PutMapFieldByNumber(5, "b", newNested("b", 7))
+			},
+			expectedErr: "enum field nested_by_key[b].status has undefined value 7",
+		},
+		{
+			name: "missing required field",
+			setFields: func(m *dynamic.Message) {
+				m.ClearFieldByNumber(6)
+			},
+			expectedErr: "required field source is not set",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := dynamic.NewMessage(md)
+			m.SetFieldByNumber(6, "source")
+			test.setFields(m)
+			// Marshal without checking for required fields.
+			marshalled, err := m.MarshalDeterministic()
+			require.NoError(t, err)
+
+			err = validateMessage(md, marshalled)
+			if test.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, test.expectedErr)
+		})
+	}
+}
+
+func TestEncoderValidateMessages(t *testing.T) {
+	var (
+		md     = newValidateTestSchema(t)
+		start  = time.Now().Truncate(time.Second)
+		schema = namespace.GetTestSchemaDescr(md)
+	)
+	m := dynamic.NewMessage(md)
+	m.SetFieldByNumber(2, int32(7))
+	m.SetFieldByNumber(6, "source")
+	invalid, err := m.Marshal()
+	require.NoError(t, err)
+
+	// Messages are not validated by default.
+	enc := NewEncoder(start, testEncodingOptions)
+	enc.Reset(start, 0, schema)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, invalid))
+
+	enc = NewEncoder(start, testEncodingOptions.SetValidateMessages(true))
+	enc.Reset(start, 0, schema)
+	err = enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, invalid)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "enum field status has undefined value 7")
+	require.Equal(t, 0, enc.NumEncoded())
+
+	m.SetFieldByNumber(2, int32(1))
+	valid, err := m.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, enc.Encode(ts.Datapoint{Timestamp: start}, xtime.Second, valid))
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/m3db/m3/src/dbnode/encoding"
+)
+
+// valueRangesTrailerLengthSize is the size of the big-endian length of the value ranges
+// trailer that the trailer ends with.
+const valueRangesTrailerLengthSize = 4
+
+var errValueRangesTrailerCorrupt = errors.New("value ranges trailer is corrupt")
+
+// ValueRangeKind is the kind of the values of a ValueRange.
+type ValueRangeKind uint8
+
+const (
+	// ValueRangeFloat is the kind of the ranges of float and double fields.
+	ValueRangeFloat ValueRangeKind = iota
+	// ValueRangeSignedInt is the kind of the ranges of signed int fields.
+	ValueRangeSignedInt
+	// ValueRangeUnsignedInt is the kind of the ranges of unsigned int fields.
+	ValueRangeUnsignedInt
+)
+
+// ValueRange is the minimum and maximum value of a custom encoded numeric field in a
+// stream, including the default values of writes that didn't set the field. NaN
+// float values are not part of the range.
+type ValueRange struct {
+	FieldNum int
+	Kind     ValueRangeKind
+
+	// The bits of the values, interpreted according to the kind.
+	min, max uint64
+	set      bool
+}
+
+// Float64 returns the range of a ValueRangeFloat range.
+func (r ValueRange) Float64() (min, max float64) {
+	return math.Float64frombits(r.min), math.Float64frombits(r.max)
+}
+
+// Int64 returns the range of a ValueRangeSignedInt range.
+func (r ValueRange) Int64() (min, max int64) {
+	return int64(r.min), int64(r.max)
+}
+
+// Uint64 returns the range of a ValueRangeUnsignedInt range.
+func (r ValueRange) Uint64() (min, max uint64) {
+	return r.min, r.max
+}
+
+func (r *ValueRange) addFloat64(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if !r.set || v < math.Float64frombits(r.min) {
+		r.min = math.Float64bits(v)
+	}
+	if !r.set || v > math.Float64frombits(r.max) {
+		r.max = math.Float64bits(v)
+	}
+	r.set = true
+}
+
+func (r *ValueRange) addInt64(v int64) {
+	if !r.set || v < int64(r.min) {
+		r.min = uint64(v)
+	}
+	if !r.set || v > int64(r.max) {
+		r.max = uint64(v)
+	}
+	r.set = true
+}
+
+func (r *ValueRange) addUint64(v uint64) {
+	if !r.set || v < r.min {
+		r.min = v
+	}
+	if !r.set || v > r.max {
+		r.max = v
+	}
+	r.set = true
+}
+
+// valueRangeKind returns the kind of the range of a custom encoded field, false if
+// the field is not numeric.
+func valueRangeKind(fieldType customFieldType) (ValueRangeKind, bool) {
+	switch {
+	case isCustomFloatEncodedField(fieldType):
+		return ValueRangeFloat, true
+	case isCustomIntEncodedField(fieldType) && isUnsignedInt(fieldType):
+		return ValueRangeUnsignedInt, true
+	case isCustomIntEncodedField(fieldType):
+		return ValueRangeSignedInt, true
+	default:
+		return 0, false
+	}
+}
+
+// assignValueRanges points each custom encoded numeric field of the schema to its value
+// range, the ranges are kept across schema changes so that they cover the whole stream.
+func (enc *Encoder) assignValueRanges() {
+	for i := range enc.customFields {
+		customField := &enc.customFields[i]
+		kind, ok := valueRangeKind(customField.fieldType)
+		if !ok {
+			continue
+		}
+
+		customField.valueRangeIdx = -1
+		for j, r := range enc.valueRanges {
+			if r.FieldNum == customField.fieldNum && r.Kind == kind {
+				customField.valueRangeIdx = j
+				break
+			}
+		}
+		if customField.valueRangeIdx < 0 {
+			customField.valueRangeIdx = len(enc.valueRanges)
+			enc.valueRanges = append(enc.valueRanges, ValueRange{
+				FieldNum: customField.fieldNum,
+				Kind:     kind,
+			})
+		}
+	}
+}
+
+// writeValueRangesTrailer writes the value ranges trailer, which follows the end-of-stream
+// marker.
+func (enc *Encoder) writeValueRangesTrailer(stream encoding.OStream) {
+	// Distinguishes the end-of-stream marker from a bytes dictionaries reset marker
+	// and then pad to the next byte so that the trailer is byte aligned.
+	stream.WriteBit(opCodeEndOfStream)
+	if _, pos := stream.Rawbytes(); pos < 8 {
+		stream.WriteBits(0, 8-pos)
+	}
+
+	ranges := make([]ValueRange, 0, len(enc.valueRanges))
+	for _, r := range enc.valueRanges {
+		if r.set {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].FieldNum != ranges[j].FieldNum {
+			return ranges[i].FieldNum < ranges[j].FieldNum
+		}
+		return ranges[i].Kind < ranges[j].Kind
+	})
+
+	var (
+		trailer = make([]byte, 0, binary.MaxVarintLen64+len(ranges)*(binary.MaxVarintLen64+17))
+		buf     [binary.MaxVarintLen64]byte
+	)
+	n := binary.PutUvarint(buf[:], uint64(len(ranges)))
+	trailer = append(trailer, buf[:n]...)
+	for _, r := range ranges {
+		n = binary.PutUvarint(buf[:], uint64(r.FieldNum))
+		trailer = append(trailer, buf[:n]...)
+		trailer = append(trailer, byte(r.Kind))
+		binary.BigEndian.PutUint64(buf[:], r.min)
+		trailer = append(trailer, buf[:8]...)
+		binary.BigEndian.PutUint64(buf[:], r.max)
+		trailer = append(trailer, buf[:8]...)
+	}
+	binary.BigEndian.PutUint32(buf[:], uint32(len(trailer)))
+	trailer = append(trailer, buf[:valueRangesTrailerLengthSize]...)
+	stream.WriteBytes(trailer)
+}
+
+// ReadValueRanges reads the minimum and maximum value of each custom encoded numeric
+// field of a stream from its trailer without decoding the stream, sorted by field number.
+// It returns false if the stream was encoded without a value ranges trailer.
+func ReadValueRanges(stream []byte, opts Options) ([]ValueRange, bool, error) {
+	header, err := ReadStreamHeader(bytes.NewReader(stream), opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if !header.ValueRangesTrailer {
+		return nil, false, nil
+	}
+
+	if len(stream) < valueRangesTrailerLengthSize {
+		return nil, false, errValueRangesTrailerCorrupt
+	}
+	var (
+		lengthStart = len(stream) - valueRangesTrailerLengthSize
+		length      = int(binary.BigEndian.Uint32(stream[lengthStart:]))
+	)
+	if length > lengthStart {
+		return nil, false, errValueRangesTrailerCorrupt
+	}
+	trailer := stream[lengthStart-length : lengthStart]
+
+	numRanges, n := binary.Uvarint(trailer)
+	if n <= 0 || numRanges > uint64(len(trailer)) {
+		return nil, false, errValueRangesTrailerCorrupt
+	}
+	trailer = trailer[n:]
+	ranges := make([]ValueRange, 0, numRanges)
+	for i := uint64(0); i < numRanges; i++ {
+		fieldNum, n := binary.Uvarint(trailer)
+		if n <= 0 || len(trailer) < n+17 {
+			return nil, false, errValueRangesTrailerCorrupt
+		}
+		trailer = trailer[n:]
+		kind := ValueRangeKind(trailer[0])
+		if kind > ValueRangeUnsignedInt {
+			return nil, false, fmt.Errorf("%v: unknown value range kind %d", errValueRangesTrailerCorrupt, kind)
+		}
+		ranges = append(ranges, ValueRange{
+			FieldNum: int(fieldNum),
+			Kind:     kind,
+			min:      binary.BigEndian.Uint64(trailer[1:9]),
+			max:      binary.BigEndian.Uint64(trailer[9:17]),
+			set:      true,
+		})
+		trailer = trailer[17:]
+	}
+	if len(trailer) != 0 {
+		return nil, false, errValueRangesTrailerCorrupt
+	}
+	return ranges, true, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+// The constants below describe the control bits of the encoding scheme, see
+// docs/encoding.md for how they're laid out in a stream. They're exported so that
+// tools such as external decoders and stream debuggers can be written against a
+// stable definition of the wire format, the encoder and iterator themselves use
+// the unexported equivalents.
+const (
+	// OpCodeMoreData indicates that another datapoint follows, as opposed to
+	// OpCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange.
+	OpCodeMoreData                                    = opCodeMoreData
+	OpCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange = opCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange
+
+	// OpCodeTimeUnitChangeAndOrSchemaChange follows
+	// OpCodeNoMoreDataOrTimeUnitChangeAndOrSchemaChange when the time unit and / or
+	// the schema changed, as opposed to the end of the stream.
+	OpCodeTimeUnitChangeAndOrSchemaChange = opCodeTimeUnitChangeAndOrSchemaChange
+	OpCodeNoMoreData                      = opCodeNoMoreData
+
+	// OpCodeTimeUnitChange indicates that the time unit changed.
+	OpCodeTimeUnitChange    = opCodeTimeUnitChange
+	OpCodeTimeUnitUnchanged = opCodeTimeUnitUnchanged
+
+	// OpCodeSchemaChange indicates that the schema changed.
+	OpCodeSchemaChange    = opCodeSchemaChange
+	OpCodeSchemaUnchanged = opCodeSchemaUnchanged
+
+	// OpCodeChange indicates that a value changed since the previous datapoint.
+	OpCodeChange   = opCodeChange
+	OpCodeNoChange = opCodeNoChange
+
+	// OpCodeInterpretSubsequentBitsAsLRUIndex indicates that a bytes value is
+	// encoded as an index into the LRU dictionary of the stream, as opposed to a
+	// varint length followed by the bytes themselves.
+	OpCodeInterpretSubsequentBitsAsLRUIndex          = opCodeInterpretSubsequentBitsAsLRUIndex
+	OpCodeInterpretSubsequentBitsAsBytesLengthVarInt = opCodeInterpretSubsequentBitsAsBytesLengthVarInt
+
+	// OpCodeInterpretSubsequentBitsAsStaticDictIndex indicates that a bytes value
+	// is encoded as an index into the static bytes dictionary of the stream.
+	OpCodeInterpretSubsequentBitsAsStaticDictIndex = opCodeInterpretSubsequentBitsAsStaticDictIndex
+	OpCodeBytesNotInStaticDict                     = opCodeBytesNotInStaticDict
+
+	// OpCodeInterpretSubsequentBitsAsInternedIndex indicates that a bytes value is
+	// encoded as an index into the interned values of the field.
+	OpCodeInterpretSubsequentBitsAsInternedIndex = opCodeInterpretSubsequentBitsAsInternedIndex
+	OpCodeBytesNotInterned                       = opCodeBytesNotInterned
+
+	// OpCodeFieldsSetToDefaultProtoMarshal indicates that a bitset of the fields
+	// that were set to their default value follows.
+	OpCodeFieldsSetToDefaultProtoMarshal   = opCodeFieldsSetToDefaultProtoMarshal
+	OpCodeNoFieldsSetToDefaultProtoMarshal = opCodeNoFieldsSetToDefaultProtoMarshal
+
+	// OpCodeIntDeltaNegative indicates the sign of an integer delta.
+	OpCodeIntDeltaNegative = opCodeIntDeltaNegative
+	OpCodeIntDeltaPositive = opCodeIntDeltaPositive
+
+	// OpCodeBitsetValueIsSet indicates whether a value of a bitset is set.
+	OpCodeBitsetValueIsSet    = opCodeBitsetValueIsSet
+	OpCodeBitsetValueIsNotSet = opCodeBitsetValueIsNotSet
+
+	// OpCodeBoolTrue is the value of a bool that is true.
+	OpCodeBoolTrue  = opCodeBoolTrue
+	OpCodeBoolFalse = opCodeBoolFalse
+
+	// OpCodeBytesDictReset follows the end-of-stream marker to indicate that the
+	// bytes dictionaries are reset rather than that the stream has ended.
+	OpCodeBytesDictReset = opCodeBytesDictReset
+	OpCodeEndOfStream    = opCodeEndOfStream
+
+	// OpCodeIntChangesBitset indicates that the int fields that changed are encoded
+	// as a bitset rather than one bit per field.
+	OpCodeIntChangesBitset   = opCodeIntChangesBitset
+	OpCodeIntChangesPerField = opCodeIntChangesPerField
+
+	// OpCodeIntDeltaOfDelta indicates that a custom encoded int field is encoded
+	// as the delta of the delta between consecutive values.
+	OpCodeIntDeltaOfDelta = opCodeIntDeltaOfDelta
+	OpCodeIntDelta        = opCodeIntDelta
+
+	// OpCodeHasProtoPortion indicates that the writes with a schema have a Protobuf
+	// marshalled portion, as opposed to OpCodeNoProtoPortion.
+	OpCodeHasProtoPortion = opCodeHasProtoPortion
+	OpCodeNoProtoPortion  = opCodeNoProtoPortion
+
+	// OpCodeIntValuedFloatDelta indicates that the change of a custom encoded float
+	// field from an integer value is encoded as the delta between the integers, as
+	// opposed to the XOR of the floats.
+	OpCodeIntValuedFloatDelta = opCodeIntValuedFloatDelta
+	OpCodeFloatXOR            = opCodeFloatXOR
+
+	// OpCodeBytesPrefixDelta indicates that a bytes value is encoded as the lengths of
+	// its common prefix and suffix with the previous value followed by the bytes in
+	// between, as opposed to one of the other encodings of bytes values.
+	OpCodeBytesPrefixDelta    = opCodeBytesPrefixDelta
+	OpCodeBytesNotPrefixDelta = opCodeBytesNotPrefixDelta
+
+	// NumBitsToEncodeCustomType is the number of bits used to encode the custom
+	// encoding type of each field in the custom fields section of a schema.
+	NumBitsToEncodeCustomType = 4
+)
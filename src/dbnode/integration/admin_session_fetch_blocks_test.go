@@ -205,6 +205,8 @@ func testSetupToSeriesMaps(
 			var datapoints []generate.TestValue
 			for readerIter.Next() {
 				datapoint, _, ann := readerIter.Current()
+				// The annotation is only valid until the next call to Next so copy it.
+				ann = append([]byte(nil), ann...)
 				datapoints = append(datapoints, generate.TestValue{Datapoint: datapoint, Annotation: ann})
 			}
 			require.NoError(t, readerIter.Err())
@@ -165,6 +165,8 @@ func m3dbClientFetch(client client.Client, req *rpc.FetchRequest) ([]generate.Te
 	var datapoints []generate.TestValue
 	for iter.Next() {
 		dp, _, annotation := iter.Current()
+		// The annotation is only valid until the next call to Next so copy it.
+		annotation = append([]byte(nil), annotation...)
 		datapoints = append(datapoints, generate.TestValue{Datapoint: dp, Annotation: annotation})
 	}
 	if err := iter.Err(); err != nil {
@@ -23,25 +23,43 @@
 package integration
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/m3db/m3/src/dbnode/integration/generate"
 	"github.com/m3db/m3/src/dbnode/retention"
 	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/persist"
+	"github.com/m3db/m3/src/dbnode/testdata/prototest"
 
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// protoSnapshotCompressionBaseline is the average size of the proto test datapoints
+// in the snapshot data files, update it when an encoder change improves compression.
+var protoSnapshotCompressionBaseline = compressionBaseline{
+	bytesPerDatapoint: 29,
+	tolerance:         0.1,
+}
+
 func TestCommitLogBootstrapWithSnapshots(t *testing.T) {
-	testCommitLogBootstrapWithSnapshots(t, nil, nil)
+	testCommitLogBootstrapWithSnapshots(t, nil, nil, nil)
 }
 
 func TestProtoCommitLogBootstrapWithSnapshots(t *testing.T) {
-	testCommitLogBootstrapWithSnapshots(t, setProtoTestOptions, setProtoTestInputConfig)
+	testCommitLogBootstrapWithSnapshots(t, setProtoTestOptions, setProtoTestInputConfig,
+		&protoSnapshotCompressionBaseline)
 }
 
-func testCommitLogBootstrapWithSnapshots(t *testing.T, setTestOpts setTestOptions, updateInputConfig generate.UpdateBlockConfig) {
+func testCommitLogBootstrapWithSnapshots(
+	t *testing.T,
+	setTestOpts setTestOptions,
+	updateInputConfig generate.UpdateBlockConfig,
+	baseline *compressionBaseline,
+) {
 	if testing.Short() {
 		t.SkipNow() // Just skip if we're doing a short run
 	}
@@ -85,10 +103,12 @@ func testCommitLogBootstrapWithSnapshots(t *testing.T, setTestOpts setTestOption
 
 	var (
 		snapshotInterval            = 10 * time.Second
+		numDatapointsInSnapshots    = 0
 		numDatapointsNotInSnapshots = 0
 		pred                        = func(dp generate.TestValue) bool {
 			blockStart := dp.Timestamp.Truncate(blockSize)
 			if dp.Timestamp.Before(blockStart.Add(snapshotInterval)) {
+				numDatapointsInSnapshots++
 				return true
 			}
 
@@ -98,7 +118,11 @@ func testCommitLogBootstrapWithSnapshots(t *testing.T, setTestOpts setTestOption
 	)
 
 	writeSnapshotsWithPredicate(
-		t, setup, commitLogOpts, seriesMaps, 0,ns1, nil, pred, snapshotInterval)
+		t, setup, commitLogOpts, seriesMaps, 0, ns1, nil, pred, snapshotInterval)
+	if baseline != nil {
+		verifyCompressionBaseline(t, setup.filePathPrefix, setup.shardSet, ns1.ID(),
+			persist.FileSetSnapshotType, numDatapointsInSnapshots, *baseline)
+	}
 
 	numDatapointsNotInCommitLogs := 0
 	writeCommitLogDataWithPredicate(t, setup, commitLogOpts, seriesMaps, ns1, func(dp generate.TestValue) bool {
@@ -136,6 +160,9 @@ func testCommitLogBootstrapWithSnapshots(t *testing.T, setTestOpts setTestOption
 	metadatasByShard := testSetupMetadatas(t, setup, testNamespaces[0], now.Add(-2*blockSize), now)
 	observedSeriesMaps := testSetupToSeriesMaps(t, setup, ns1, metadatasByShard)
 	verifySeriesMapsEqual(t, seriesMaps, observedSeriesMaps)
+	if opts.ProtoEncoding() {
+		verifySeriesMapsAnnotationsEqual(t, opts, seriesMaps, observedSeriesMaps)
+	}
 
 	// Verify in-memory data match what we expect - no writes should be present
 	// because we didn't issue any writes for this namespaces
@@ -145,3 +172,277 @@ func testCommitLogBootstrapWithSnapshots(t *testing.T, setTestOpts setTestOption
 	verifySeriesMapsEqual(t, emptySeriesMaps, observedSeriesMaps2)
 
 }
+
+// TestProtoCommitLogBootstrapWithSnapshotsAndSchemaEvolution writes snapshots with
+// the original version of the namespace schema and commit logs with an evolved version
+// of it (which adds a field) and then verifies that, once bootstrapped with the evolved
+// schema, the blocks which contain datapoints from both versions decode correctly.
+func TestProtoCommitLogBootstrapWithSnapshotsAndSchemaEvolution(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow() // Just skip if we're doing a short run
+	}
+
+	// Test setup
+	var (
+		ropts         = retention.NewOptions().SetRetentionPeriod(12 * time.Hour)
+		blockSize     = ropts.BlockSize()
+		schemaHistory = prototest.NewEvolvedSchemaHistory()
+	)
+	_, ok := schemaHistory.Get(prototest.EvolvedSchemaFirstDeployID)
+	require.True(t, ok)
+	v2Schema, ok := schemaHistory.GetLatest()
+	require.True(t, ok)
+	require.Equal(t, prototest.EvolvedSchemaSecondDeployID, v2Schema.DeployId())
+	v2MessageDescriptor := v2Schema.Get().MessageDescriptor
+
+	nsOpts := namespace.NewOptions().
+		SetRetentionOptions(ropts).
+		SetSchemaHistory(schemaHistory)
+	ns1, err := namespace.NewMetadata(testNamespaces[0], nsOpts)
+	require.NoError(t, err)
+	ns2, err := namespace.NewMetadata(testNamespaces[1], nsOpts)
+	require.NoError(t, err)
+	opts := newTestOptions(t).
+		SetNamespaces([]namespace.Metadata{ns1, ns2}).
+		SetProtoEncoding(true).
+		SetAssertTestDataEqual(func(t *testing.T, expected, actual []generate.TestValue) bool {
+			if !assert.Equal(t, len(expected), len(actual)) {
+				return false
+			}
+			for i := range expected {
+				if !assert.True(t, prototest.EvolvedProtoEqual(
+					v2MessageDescriptor, expected[i].Annotation, actual[i].Annotation)) {
+					return false
+				}
+			}
+			return true
+		})
+
+	setup, err := newTestSetup(t, opts, nil)
+	require.NoError(t, err)
+	defer setup.close()
+
+	commitLogOpts := setup.storageOpts.CommitLogOptions().
+		SetFlushInterval(defaultIntegrationTestFlushInterval)
+	setup.storageOpts = setup.storageOpts.SetCommitLogOptions(commitLogOpts)
+
+	log := setup.storageOpts.InstrumentOptions().Logger()
+	log.Info("commit log bootstrap with schema evolution test")
+
+	// Write test data, all of the messages set the field that only exists in the
+	// evolved schema.
+	log.Info("generating data")
+	messages := prototest.NewProtoTestMessages(v2MessageDescriptor)
+	for i, m := range messages {
+		m.SetFieldByName("region", fmt.Sprintf("region-%d", i%3))
+	}
+	var (
+		now        = setup.getNowFn().Truncate(blockSize)
+		seriesMaps = generateSeriesMaps(30, func(blockConfig []generate.BlockConfig) {
+			for i := range blockConfig {
+				blockConfig[i].AnnGen = prototest.NewProtoMessageIterator(messages)
+			}
+		}, now.Add(-2*blockSize), now.Add(-blockSize))
+		snapshotInterval = 10 * time.Second
+		inSnapshot       = func(dp generate.TestValue) bool {
+			return dp.Timestamp.Before(dp.Timestamp.Truncate(blockSize).Add(snapshotInterval))
+		}
+	)
+
+	// The datapoints that are written to the snapshots predate the schema evolution
+	// so strip the evolved field from them.
+	numDatapointsInSnapshots := 0
+	for _, seriesBlock := range seriesMaps {
+		for _, series := range seriesBlock {
+			for i, dp := range series.Data {
+				if !inSnapshot(dp) {
+					continue
+				}
+				m := dynamic.NewMessage(v2MessageDescriptor)
+				require.NoError(t, m.Unmarshal(dp.Annotation))
+				m.ClearFieldByName("region")
+				series.Data[i].Annotation, err = m.Marshal()
+				require.NoError(t, err)
+				numDatapointsInSnapshots++
+			}
+		}
+	}
+
+	log.Info("writing data")
+	// Snapshots are written with the original version of the schema.
+	v1NsOpts := nsOpts.SetSchemaHistory(prototest.NewSchemaHistory())
+	ns1V1, err := namespace.NewMetadata(testNamespaces[0], v1NsOpts)
+	require.NoError(t, err)
+	writeSnapshotsWithPredicate(
+		t, setup, commitLogOpts, seriesMaps, 0, ns1V1, nil, inSnapshot, snapshotInterval)
+
+	numDatapointsInCommitLogs := 0
+	writeCommitLogDataWithPredicate(t, setup, commitLogOpts, seriesMaps, ns1, func(dp generate.TestValue) bool {
+		if inSnapshot(dp) {
+			return false
+		}
+		numDatapointsInCommitLogs++
+		return true
+	})
+
+	// Make sure both versions of the schema were actually used.
+	require.True(t, numDatapointsInSnapshots > 0)
+	require.True(t, numDatapointsInCommitLogs > 0)
+
+	log.Info("finished writing data")
+
+	// Setup bootstrapper after writing data so filesystem inspection can find it.
+	setupCommitLogBootstrapperWithFSInspection(t, setup, commitLogOpts)
+
+	setup.setNowFn(now)
+	// Start the server with the evolved schema.
+	require.NoError(t, setup.startServer())
+	log.Debug("server is now up")
+
+	// Stop the server
+	defer func() {
+		require.NoError(t, setup.stopServer())
+		log.Debug("server is now down")
+	}()
+
+	// Verify in-memory data match what we expect when decoded with the evolved schema.
+	metadatasByShard := testSetupMetadatas(t, setup, testNamespaces[0], now.Add(-2*blockSize), now)
+	observedSeriesMaps := testSetupToSeriesMaps(t, setup, ns1, metadatasByShard)
+	verifySeriesMapsEqual(t, seriesMaps, observedSeriesMaps)
+	verifySeriesMapsAnnotationsEqual(t, opts, seriesMaps, observedSeriesMaps)
+}
+
+// TestProtoCommitLogBootstrapWithSnapshotsAndMixedFields writes snapshots and commit
+// logs of proto messages with a mix of custom encoded and protobuf marshalled fields,
+// the latter of which change back to their default values in some of the messages,
+// and then verifies that the bootstrapped blocks decode to the same messages.
+func TestProtoCommitLogBootstrapWithSnapshotsAndMixedFields(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow() // Just skip if we're doing a short run
+	}
+
+	// Test setup
+	var (
+		ropts             = retention.NewOptions().SetRetentionPeriod(12 * time.Hour)
+		blockSize         = ropts.BlockSize()
+		schemaHistory     = prototest.NewMixedFieldsSchemaHistory()
+		messageDescriptor = prototest.NewMessageDescriptor(schemaHistory)
+	)
+	nsOpts := namespace.NewOptions().
+		SetRetentionOptions(ropts).
+		SetSchemaHistory(schemaHistory)
+	ns1, err := namespace.NewMetadata(testNamespaces[0], nsOpts)
+	require.NoError(t, err)
+	ns2, err := namespace.NewMetadata(testNamespaces[1], nsOpts)
+	require.NoError(t, err)
+	opts := newTestOptions(t).
+		SetNamespaces([]namespace.Metadata{ns1, ns2}).
+		SetProtoEncoding(true).
+		SetAssertTestDataEqual(func(t *testing.T, expected, actual []generate.TestValue) bool {
+			if !assert.Equal(t, len(expected), len(actual)) {
+				return false
+			}
+			for i := range expected {
+				if !assert.True(t, prototest.MessagesEqual(
+					messageDescriptor, expected[i].Annotation, actual[i].Annotation)) {
+					return false
+				}
+			}
+			return true
+		})
+
+	setup, err := newTestSetup(t, opts, nil)
+	require.NoError(t, err)
+	defer setup.close()
+
+	commitLogOpts := setup.storageOpts.CommitLogOptions().
+		SetFlushInterval(defaultIntegrationTestFlushInterval)
+	setup.storageOpts = setup.storageOpts.SetCommitLogOptions(commitLogOpts)
+
+	log := setup.storageOpts.InstrumentOptions().Logger()
+	log.Info("commit log bootstrap with mixed fields test")
+
+	// Write test data
+	log.Info("generating data")
+	var (
+		messages   = prototest.NewMixedFieldsTestMessages(messageDescriptor)
+		now        = setup.getNowFn().Truncate(blockSize)
+		seriesMaps = generateSeriesMaps(30, func(blockConfig []generate.BlockConfig) {
+			for i := range blockConfig {
+				blockConfig[i].AnnGen = prototest.NewProtoMessageIterator(messages)
+			}
+		}, now.Add(-2*blockSize), now.Add(-blockSize))
+		snapshotInterval = 10 * time.Second
+		inSnapshot       = func(dp generate.TestValue) bool {
+			return dp.Timestamp.Before(dp.Timestamp.Truncate(blockSize).Add(snapshotInterval))
+		}
+	)
+
+	log.Info("writing data")
+	numDatapointsInSnapshots := 0
+	writeSnapshotsWithPredicate(
+		t, setup, commitLogOpts, seriesMaps, 0, ns1, nil, func(dp generate.TestValue) bool {
+			if !inSnapshot(dp) {
+				return false
+			}
+			numDatapointsInSnapshots++
+			return true
+		}, snapshotInterval)
+
+	numDatapointsInCommitLogs := 0
+	writeCommitLogDataWithPredicate(t, setup, commitLogOpts, seriesMaps, ns1, func(dp generate.TestValue) bool {
+		if inSnapshot(dp) {
+			return false
+		}
+		numDatapointsInCommitLogs++
+		return true
+	})
+
+	// Make sure both the snapshots and commit logs were actually used.
+	require.True(t, numDatapointsInSnapshots > 0)
+	require.True(t, numDatapointsInCommitLogs > 0)
+
+	log.Info("finished writing data")
+
+	// Setup bootstrapper after writing data so filesystem inspection can find it.
+	setupCommitLogBootstrapperWithFSInspection(t, setup, commitLogOpts)
+
+	setup.setNowFn(now)
+	require.NoError(t, setup.startServer())
+	log.Debug("server is now up")
+
+	// Stop the server
+	defer func() {
+		require.NoError(t, setup.stopServer())
+		log.Debug("server is now down")
+	}()
+
+	// Verify in-memory data match what we expect, including the annotations.
+	metadatasByShard := testSetupMetadatas(t, setup, testNamespaces[0], now.Add(-2*blockSize), now)
+	observedSeriesMaps := testSetupToSeriesMaps(t, setup, ns1, metadatasByShard)
+	verifySeriesMapsEqual(t, seriesMaps, observedSeriesMaps)
+	verifySeriesMapsAnnotationsEqual(t, opts, seriesMaps, observedSeriesMaps)
+}
+
+// verifySeriesMapsAnnotationsEqual verifies that the annotations of the datapoints of
+// the observed series are equal to the expected ones according to the AssertTestDataEqual
+// of the test options, which verifySeriesMapsEqual does not compare.
+func verifySeriesMapsAnnotationsEqual(
+	t *testing.T,
+	opts testOptions,
+	expectedSeriesMaps generate.SeriesBlocksByStart,
+	observedSeriesMaps generate.SeriesBlocksByStart,
+) {
+	for blockStart, expectedSeriesBlock := range expectedSeriesMaps {
+		observedSeriesByID := make(map[string]generate.Series, len(observedSeriesMaps[blockStart]))
+		for _, series := range observedSeriesMaps[blockStart] {
+			observedSeriesByID[series.ID.String()] = series
+		}
+		for _, expectedSeries := range expectedSeriesBlock {
+			observedSeries, ok := observedSeriesByID[expectedSeries.ID.String()]
+			require.True(t, ok)
+			require.True(t, opts.AssertTestDataEqual()(t, expectedSeries.Data, observedSeries.Data),
+				"annotation mismatch for series: %s", expectedSeries.ID.String())
+		}
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -357,3 +359,62 @@ func verifySnapshottedDataFiles(
 	}
 
 }
+
+// compressionBaseline is a recorded average on-disk size of the datapoints in the
+// data files of filesets, used to catch encoder changes that hurt compression.
+type compressionBaseline struct {
+	bytesPerDatapoint float64
+	// tolerance is the fraction by which the average size may exceed the baseline.
+	tolerance float64
+}
+
+// verifyCompressionBaseline fails the test if the average size of the numDatapoints
+// datapoints written to the data files of the filesets of the namespace regressed
+// beyond the tolerance of the baseline.
+func verifyCompressionBaseline(
+	t *testing.T,
+	filePathPrefix string,
+	shardSet sharding.ShardSet,
+	namespace ident.ID,
+	fileSetType persist.FileSetType,
+	numDatapoints int,
+	baseline compressionBaseline,
+) {
+	require.True(t, numDatapoints > 0)
+
+	var size int64
+	for _, shard := range shardSet.AllIDs() {
+		var (
+			fileSets fs.FileSetFilesSlice
+			err      error
+		)
+		switch fileSetType {
+		case persist.FileSetFlushType:
+			fileSets, err = fs.DataFiles(filePathPrefix, namespace, shard)
+		case persist.FileSetSnapshotType:
+			fileSets, err = fs.SnapshotFiles(filePathPrefix, namespace, shard)
+		default:
+			require.FailNow(t, "unknown fileset type", fileSetType.String())
+		}
+		require.NoError(t, err)
+
+		for _, fileSet := range fileSets {
+			for _, path := range fileSet.AbsoluteFilepaths {
+				if !strings.HasSuffix(path, "-data.db") {
+					continue
+				}
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				size += info.Size()
+			}
+		}
+	}
+
+	var (
+		bytesPerDatapoint = float64(size) / float64(numDatapoints)
+		maxBytesPerDP     = baseline.bytesPerDatapoint * (1 + baseline.tolerance)
+	)
+	require.True(t, bytesPerDatapoint <= maxBytesPerDP,
+		"compression regressed: %.2f bytes per datapoint, baseline %.2f with tolerance %.2f",
+		bytesPerDatapoint, baseline.bytesPerDatapoint, baseline.tolerance)
+}
@@ -0,0 +1,180 @@
+// +build integration
+
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package integration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/integration/generate"
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/testdata/prototest"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtoSchemaRegistryReload(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow() // Just skip if we're doing a short run
+	}
+
+	// Test setup, the namespace starts out with only the first version of the
+	// schema registered.
+	evolvedSchemaHistory := prototest.NewEvolvedSchemaHistory()
+	evolvedSchema, ok := evolvedSchemaHistory.GetLatest()
+	require.True(t, ok)
+	evolvedMessageDescriptor := evolvedSchema.Get().MessageDescriptor
+
+	nsOpts := namespace.NewOptions().SetSchemaHistory(prototest.NewPreEvolvedSchemaHistory())
+	ns1, err := namespace.NewMetadata(testNamespaces[0], nsOpts)
+	require.NoError(t, err)
+	testOpts := newTestOptions(t).
+		SetTickMinimumInterval(time.Second).
+		SetUseTChannelClientForReading(false).
+		SetUseTChannelClientForWriting(false).
+		SetNamespaces([]namespace.Metadata{ns1}).
+		SetProtoEncoding(true).
+		SetAssertTestDataEqual(func(t *testing.T, expected, actual []generate.TestValue) bool {
+			if !assert.Equal(t, len(expected), len(actual)) {
+				return false
+			}
+			for i := range expected {
+				if !assert.Equal(t, expected[i].Timestamp, actual[i].Timestamp) {
+					return false
+				}
+				if !assert.Equal(t, expected[i].Value, actual[i].Value) {
+					return false
+				}
+				if !assert.True(t, prototest.EvolvedProtoEqual(
+					evolvedMessageDescriptor, expected[i].Annotation, actual[i].Annotation)) {
+					return false
+				}
+			}
+			return true
+		})
+	testSetup, err := newTestSetup(t, testOpts, nil)
+	require.NoError(t, err)
+	defer testSetup.close()
+
+	// Input data setup, both batches of writes land in the same block so that the
+	// encoders that are active when the schema is reloaded are exercised too.
+	var (
+		blockSize = ns1.Options().RetentionOptions().BlockSize()
+		now       = testSetup.getNowFn().Truncate(blockSize)
+		messages  = prototest.NewProtoTestMessages(evolvedMessageDescriptor)
+		evolved   = prototest.NewProtoTestMessages(evolvedMessageDescriptor)
+	)
+	for i, m := range evolved {
+		m.SetFieldByName("region", fmt.Sprintf("region-%d", i%3))
+	}
+	inputData := []generate.BlockConfig{
+		{
+			IDs:       []string{"foo", "bar"},
+			NumPoints: 20,
+			Start:     now,
+			AnnGen:    prototest.NewProtoMessageIterator(messages),
+		},
+		{
+			IDs:       []string{"foo", "baz"},
+			NumPoints: 20,
+			Start:     now.Add(blockSize / 2),
+			AnnGen:    prototest.NewProtoMessageIterator(evolved),
+		},
+	}
+
+	// Start the server
+	log := testSetup.storageOpts.InstrumentOptions().Logger()
+	log.Debug("schema registry reload test")
+	require.NoError(t, testSetup.startServer())
+	log.Debug("server is now up")
+
+	// Stop the server
+	defer func() {
+		require.NoError(t, testSetup.stopServer())
+		log.Debug("server is now down")
+	}()
+
+	// Write the data that predates the schema reload.
+	seriesBlock := generate.Block(inputData[0])
+	testSetup.setNowFn(inputData[0].Start)
+	require.NoError(t, testSetup.writeBatch(testNamespaces[0], seriesBlock))
+
+	// Reload the schema and wait for the namespace to pick it up.
+	require.NoError(t, testSetup.schemaReg.SetSchemaHistory(testNamespaces[0], evolvedSchemaHistory))
+	require.True(t, waitUntil(func() bool {
+		ns, ok := testSetup.db.Namespace(testNamespaces[0])
+		if !ok {
+			return false
+		}
+		schema := ns.Schema()
+		return schema != nil && schema.DeployId() == prototest.EvolvedSchemaSecondDeployID
+	}, time.Minute))
+	log.Debug("schema is now reloaded")
+
+	// Write the data that sets the field that only exists in the evolved schema.
+	evolvedSeriesBlock := generate.Block(inputData[1])
+	testSetup.setNowFn(inputData[1].Start)
+	require.NoError(t, testSetup.writeBatch(testNamespaces[0], evolvedSeriesBlock))
+	log.Debug("test data is now written")
+
+	seriesMaps := map[xtime.UnixNano]generate.SeriesBlock{
+		xtime.ToUnixNano(now): mergeSeriesBlocks(seriesBlock, evolvedSeriesBlock),
+	}
+
+	// Verify in-memory data decodes with the evolved schema.
+	verifySeriesMaps(t, testSetup, testNamespaces[0], seriesMaps)
+
+	// Advance time and sleep for a long enough time so data blocks are sealed
+	// during ticking and verify again.
+	testSetup.setNowFn(testSetup.getNowFn().Add(blockSize * 2))
+	testSetup.sleepFor10xTickMinimumInterval()
+	verifySeriesMaps(t, testSetup, testNamespaces[0], seriesMaps)
+}
+
+// mergeSeriesBlocks merges the datapoints of series with the same ID, the
+// datapoints of the latter blocks must come after those of the former.
+func mergeSeriesBlocks(blocks ...generate.SeriesBlock) generate.SeriesBlock {
+	var (
+		merged  generate.SeriesBlock
+		indexes = make(map[string]int)
+	)
+	for _, block := range blocks {
+		for _, series := range block {
+			idx, ok := indexes[series.ID.String()]
+			if !ok {
+				indexes[series.ID.String()] = len(merged)
+				merged = append(merged, generate.Series{
+					ID:   series.ID,
+					Tags: series.Tags,
+					Data: append([]generate.TestValue(nil), series.Data...),
+				})
+				continue
+			}
+			merged[idx].Data = append(merged[idx].Data, series.Data...)
+		}
+	}
+	return merged
+}
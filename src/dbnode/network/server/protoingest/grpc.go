@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package protoingest
+
+import (
+	"google.golang.org/grpc"
+)
+
+// GRPCRequestConverter converts the requests of a client streaming gRPC method to the
+// writes that are ingested.
+type GRPCRequestConverter interface {
+	// NewRequest returns the message that a request is unmarshalled into.
+	NewRequest() interface{}
+
+	// StreamedWrite converts an unmarshalled request to a write.
+	StreamedWrite(request interface{}) (StreamedWrite, error)
+}
+
+type grpcReceiver struct {
+	stream    grpc.ServerStream
+	converter GRPCRequestConverter
+}
+
+// NewGRPCReceiver returns a StreamedWriteReceiver that receives the requests of the
+// server side of a client streaming gRPC method, the stream returns io.EOF once the
+// client has closed its side of the stream. The handler of the method remains
+// responsible for sending the response once StreamIngester.Ingest returns.
+func NewGRPCReceiver(
+	stream grpc.ServerStream,
+	converter GRPCRequestConverter,
+) StreamedWriteReceiver {
+	return &grpcReceiver{
+		stream:    stream,
+		converter: converter,
+	}
+}
+
+func (r *grpcReceiver) Recv() (StreamedWrite, error) {
+	request := r.converter.NewRequest()
+	if err := r.stream.RecvMsg(request); err != nil {
+		return StreamedWrite{}, err
+	}
+	return r.converter.StreamedWrite(request)
+}
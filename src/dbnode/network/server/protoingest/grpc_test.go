@@ -0,0 +1,172 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package protoingest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const testGRPCWriteMethod = "/protoingest.test.Ingest/Write"
+
+var (
+	testGRPCRequestSchema = newTestGRPCMessageDescriptor(builder.NewMessage("WriteRequest").
+				AddField(builder.NewField("id", builder.FieldTypeString()).SetNumber(1)).
+				AddField(builder.NewField("timestamp_nanos", builder.FieldTypeInt64()).SetNumber(2)).
+				AddField(builder.NewField("message", builder.FieldTypeBytes()).SetNumber(3)))
+	testGRPCResponseSchema = newTestGRPCMessageDescriptor(builder.NewMessage("WriteResponse").
+				AddField(builder.NewField("error", builder.FieldTypeString()).SetNumber(1)))
+)
+
+func newTestGRPCMessageDescriptor(b *builder.MessageBuilder) *desc.MessageDescriptor {
+	md, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return md
+}
+
+type testGRPCRequestConverter struct{}
+
+func (testGRPCRequestConverter) NewRequest() interface{} {
+	return dynamic.NewMessage(testGRPCRequestSchema)
+}
+
+func (testGRPCRequestConverter) StreamedWrite(request interface{}) (StreamedWrite, error) {
+	m := request.(*dynamic.Message)
+	id := m.GetFieldByName("id").(string)
+	if id == "" {
+		return StreamedWrite{}, errors.New("write has no series ID")
+	}
+	return StreamedWrite{
+		ID:        id,
+		Timestamp: time.Unix(0, m.GetFieldByName("timestamp_nanos").(int64)),
+		Unit:      xtime.Second,
+		Message:   m.GetFieldByName("message").([]byte),
+	}, nil
+}
+
+// newTestGRPCClient serves the write method of the ingester over an in-memory
+// connection and returns a client connection to it.
+func newTestGRPCClient(t *testing.T, ingester *StreamIngester) (*grpc.ClientConn, func()) {
+	var (
+		listener = bufconn.Listen(1 << 20)
+		server   = grpc.NewServer()
+	)
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "protoingest.test.Ingest",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Write",
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				response := dynamic.NewMessage(testGRPCResponseSchema)
+				if err := ingester.Ingest(NewGRPCReceiver(stream, testGRPCRequestConverter{})); err != nil {
+					response.SetFieldByName("error", err.Error())
+				}
+				return stream.SendMsg(response)
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	require.NoError(t, err)
+	return conn, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func writeTestGRPCStream(
+	t *testing.T,
+	conn *grpc.ClientConn,
+	writes []StreamedWrite,
+) *dynamic.Message {
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{
+		StreamName:    "Write",
+		ClientStreams: true,
+	}, testGRPCWriteMethod)
+	require.NoError(t, err)
+
+	for _, write := range writes {
+		request := dynamic.NewMessage(testGRPCRequestSchema)
+		request.SetFieldByName("id", write.ID)
+		request.SetFieldByName("timestamp_nanos", write.Timestamp.UnixNano())
+		request.SetFieldByName("message", write.Message)
+		require.NoError(t, stream.SendMsg(request))
+	}
+	require.NoError(t, stream.CloseSend())
+
+	response := dynamic.NewMessage(testGRPCResponseSchema)
+	require.NoError(t, stream.RecvMsg(response))
+	return response
+}
+
+func TestGRPCReceiverIngest(t *testing.T) {
+	var (
+		start                    = time.Now().Truncate(time.Second)
+		ingester, pool, segments = newTestStreamIngester(t, 3)
+		writes, messages         = newTestStreamedWrites(t, start, []string{"foo", "bar"}, 10)
+		conn, closeFn            = newTestGRPCClient(t, ingester)
+	)
+	defer closeFn()
+
+	response := writeTestGRPCStream(t, conn, writes)
+	require.Equal(t, "", response.GetFieldByName("error"))
+	require.Equal(t, 0, pool.outstanding)
+	for id, expected := range messages {
+		requireSegmentsDecodeTo(t, segments[id], expected)
+	}
+}
+
+func TestGRPCReceiverIngestConvertError(t *testing.T) {
+	var (
+		start                    = time.Now().Truncate(time.Second)
+		ingester, pool, segments = newTestStreamIngester(t, 0)
+		writes, messages         = newTestStreamedWrites(t, start, []string{"foo"}, 5)
+		conn, closeFn            = newTestGRPCClient(t, ingester)
+	)
+	defer closeFn()
+
+	// The writes received before the request that failed to convert are still flushed.
+	writes = append(writes, StreamedWrite{Timestamp: start.Add(time.Minute)})
+	response := writeTestGRPCStream(t, conn, writes)
+	require.Equal(t, "write has no series ID", response.GetFieldByName("error"))
+	require.Equal(t, 0, pool.outstanding)
+	requireSegmentsDecodeTo(t, segments["foo"], messages["foo"])
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package protoingest ingests streams of proto writes into pooled proto encoders.
+package protoingest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/dbnode/encoding/proto"
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/ts"
+	xtime "github.com/m3db/m3/src/x/time"
+)
+
+var errStreamIngesterNoEncoderPool = errors.New(
+	"proto stream ingester requires an encoder pool")
+
+// StreamedWrite is a single proto message received on a stream of writes.
+type StreamedWrite struct {
+	// ID is the ID of the series the message belongs to.
+	ID string
+	// Timestamp is the timestamp of the message.
+	Timestamp time.Time
+	// Unit is the time unit the timestamp is encoded with.
+	Unit xtime.Unit
+	// Message is the marshalled proto message.
+	Message []byte
+}
+
+// StreamedWriteReceiver receives the writes of a stream and returns io.EOF once
+// the stream has been closed by the sender, see NewGRPCReceiver for gRPC streams.
+type StreamedWriteReceiver interface {
+	Recv() (StreamedWrite, error)
+}
+
+// SegmentFlushFn is called with the encoded segment of a series when it is
+// flushed, the function takes ownership of the segment.
+type SegmentFlushFn func(id string, segment ts.Segment) error
+
+// StreamIngester encodes streams of proto writes with pooled encoders, one per
+// series, and flushes the encoded segments. A single StreamIngester can ingest
+// several streams concurrently as the encoders are scoped to each stream.
+type StreamIngester struct {
+	schema              namespace.SchemaDescr
+	opts                proto.Options
+	flushFn             SegmentFlushFn
+	maxPointsPerSegment int
+}
+
+// NewStreamIngester returns a new StreamIngester that acquires encoders from the
+// encoder pool of the provided options. The segment of a series is flushed once
+// it holds maxPointsPerSegment datapoints, or when the stream is closed if
+// maxPointsPerSegment is not positive.
+func NewStreamIngester(
+	schema namespace.SchemaDescr,
+	opts proto.Options,
+	flushFn SegmentFlushFn,
+	maxPointsPerSegment int,
+) (*StreamIngester, error) {
+	if opts.EncodingOptions().EncoderPool() == nil {
+		return nil, errStreamIngesterNoEncoderPool
+	}
+	return &StreamIngester{
+		schema:              schema,
+		opts:                opts,
+		flushFn:             flushFn,
+		maxPointsPerSegment: maxPointsPerSegment,
+	}, nil
+}
+
+// Ingest encodes the writes received on the stream until it is closed or fails.
+// The segments of the writes that were encoded are flushed and all encoders are
+// returned to the pool before Ingest returns, regardless of how the stream ended.
+func (s *StreamIngester) Ingest(recv StreamedWriteReceiver) (err error) {
+	encoders := make(map[string]encoding.Encoder)
+	defer func() {
+		for id, enc := range encoders {
+			if flushErr := s.flush(id, enc); err == nil {
+				err = flushErr
+			}
+		}
+	}()
+
+	for {
+		write, recvErr := recv.Recv()
+		if recvErr == io.EOF {
+			return nil
+		}
+		if recvErr != nil {
+			return recvErr
+		}
+
+		enc, ok := encoders[write.ID]
+		if !ok {
+			enc = s.opts.EncodingOptions().EncoderPool().Get()
+			enc.Reset(write.Timestamp, 0, s.schema)
+			encoders[write.ID] = enc
+		}
+
+		dp := ts.Datapoint{Timestamp: write.Timestamp}
+		if err := enc.Encode(dp, write.Unit, write.Message); err != nil {
+			return fmt.Errorf(
+				"proto stream ingester: error encoding write for series %s: %v",
+				write.ID, err)
+		}
+
+		if s.maxPointsPerSegment > 0 && enc.NumEncoded() >= s.maxPointsPerSegment {
+			delete(encoders, write.ID)
+			if err := s.flush(write.ID, enc); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush returns the encoder to the pool and passes its segment, if any, to the
+// flush function.
+func (s *StreamIngester) flush(id string, enc encoding.Encoder) error {
+	if enc.NumEncoded() == 0 {
+		enc.Close()
+		return nil
+	}
+	return s.flushFn(id, enc.Discard())
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package protoingest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/dbnode/encoding/proto"
+	"github.com/m3db/m3/src/dbnode/namespace"
+	"github.com/m3db/m3/src/dbnode/testdata/prototest"
+	"github.com/m3db/m3/src/dbnode/ts"
+	"github.com/m3db/m3/src/dbnode/x/xio"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSchemaHistory = prototest.NewSchemaHistory()
+	testSchema        = prototest.NewMessageDescriptor(testSchemaHistory)
+	testSchemaDescr   = namespace.GetTestSchemaDescr(testSchema)
+	testOptions       = proto.NewOptions().SetEncodingOptions(
+		encoding.NewOptions().SetDefaultTimeUnit(xtime.Second))
+)
+
+type testStreamedWriteReceiver struct {
+	writes []StreamedWrite
+	err    error
+}
+
+func (r *testStreamedWriteReceiver) Recv() (StreamedWrite, error) {
+	if len(r.writes) == 0 {
+		return StreamedWrite{}, r.err
+	}
+	write := r.writes[0]
+	r.writes = r.writes[1:]
+	return write, nil
+}
+
+type countingEncoderPool struct {
+	encoding.EncoderPool
+	outstanding int
+}
+
+func (p *countingEncoderPool) Get() encoding.Encoder {
+	p.outstanding++
+	return p.EncoderPool.Get()
+}
+
+func (p *countingEncoderPool) Put(e encoding.Encoder) {
+	p.outstanding--
+	p.EncoderPool.Put(e)
+}
+
+func newTestStreamIngester(
+	t *testing.T,
+	maxPointsPerSegment int,
+) (*StreamIngester, *countingEncoderPool, map[string][]ts.Segment) {
+	var (
+		pool = &countingEncoderPool{EncoderPool: encoding.NewEncoderPool(nil)}
+		opts = testOptions.SetEncodingOptions(
+			testOptions.EncodingOptions().SetEncoderPool(pool))
+		segments = make(map[string][]ts.Segment)
+	)
+	pool.Init(func() encoding.Encoder {
+		return proto.NewEncoder(time.Time{}, opts)
+	})
+
+	flushFn := func(id string, segment ts.Segment) error {
+		segments[id] = append(segments[id], segment)
+		return nil
+	}
+	ingester, err := NewStreamIngester(testSchemaDescr, opts, flushFn, maxPointsPerSegment)
+	require.NoError(t, err)
+	return ingester, pool, segments
+}
+
+func newTestStreamedWrites(
+	t *testing.T,
+	start time.Time,
+	ids []string,
+	numPerSeries int,
+) ([]StreamedWrite, map[string][]*dynamic.Message) {
+	var (
+		writes       []StreamedWrite
+		messages     = make(map[string][]*dynamic.Message)
+		testMessages = prototest.NewProtoTestMessages(testSchema)
+	)
+	for i := 0; i < numPerSeries; i++ {
+		for j, id := range ids {
+			m := testMessages[(i+j)%len(testMessages)]
+			marshalled, err := m.Marshal()
+			require.NoError(t, err)
+			writes = append(writes, StreamedWrite{
+				ID:        id,
+				Timestamp: start.Add(time.Duration(i) * time.Second),
+				Unit:      xtime.Second,
+				Message:   marshalled,
+			})
+			messages[id] = append(messages[id], m)
+		}
+	}
+	return writes, messages
+}
+
+func requireSegmentsDecodeTo(
+	t *testing.T,
+	segments []ts.Segment,
+	expected []*dynamic.Message,
+) {
+	var i int
+	for _, segment := range segments {
+		iter := proto.NewIterator(xio.NewSegmentReader(segment), testSchemaDescr, testOptions)
+		for iter.Next() {
+			_, _, annotation := iter.Current()
+			m := dynamic.NewMessage(testSchema)
+			require.NoError(t, m.Unmarshal(annotation))
+			require.True(t, i < len(expected))
+			require.True(t, dynamic.MessagesEqual(expected[i], m),
+				"expected: %s, actual: %s", expected[i].String(), m.String())
+			i++
+		}
+		require.NoError(t, iter.Err())
+		iter.Close()
+	}
+	require.Equal(t, len(expected), i)
+}
+
+func TestStreamIngesterIngest(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	for _, maxPointsPerSegment := range []int{0, 3} {
+		t.Run(fmt.Sprintf("maxPointsPerSegment=%d", maxPointsPerSegment), func(t *testing.T) {
+			ingester, pool, segments := newTestStreamIngester(t, maxPointsPerSegment)
+			writes, messages := newTestStreamedWrites(t, start, []string{"foo", "bar"}, 10)
+
+			require.NoError(t, ingester.Ingest(&testStreamedWriteReceiver{writes: writes, err: io.EOF}))
+			require.Equal(t, 0, pool.outstanding)
+
+			expectedSegments := 1
+			if maxPointsPerSegment > 0 {
+				expectedSegments = 4
+			}
+			for id, expected := range messages {
+				require.Equal(t, expectedSegments, len(segments[id]))
+				requireSegmentsDecodeTo(t, segments[id], expected)
+			}
+		})
+	}
+}
+
+func TestStreamIngesterIngestStreamError(t *testing.T) {
+	var (
+		start                    = time.Now().Truncate(time.Second)
+		ingester, pool, segments = newTestStreamIngester(t, 0)
+		writes, messages         = newTestStreamedWrites(t, start, []string{"foo"}, 5)
+		streamErr                = errors.New("stream reset")
+	)
+
+	// Writes received before the stream failed are still flushed.
+	err := ingester.Ingest(&testStreamedWriteReceiver{writes: writes, err: streamErr})
+	require.Equal(t, streamErr, err)
+	require.Equal(t, 0, pool.outstanding)
+	requireSegmentsDecodeTo(t, segments["foo"], messages["foo"])
+}
+
+func TestStreamIngesterIngestEncodeError(t *testing.T) {
+	var (
+		start                    = time.Now().Truncate(time.Second)
+		ingester, pool, segments = newTestStreamIngester(t, 0)
+		writes, messages         = newTestStreamedWrites(t, start, []string{"foo", "bar"}, 2)
+	)
+	writes = append(writes, StreamedWrite{
+		ID:        "baz",
+		Timestamp: start,
+		Unit:      xtime.Second,
+		Message:   []byte("not a proto message"),
+	})
+
+	err := ingester.Ingest(&testStreamedWriteReceiver{writes: writes, err: io.EOF})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error encoding write for series baz")
+	require.Equal(t, 0, pool.outstanding)
+	require.Empty(t, segments["baz"])
+	for id, expected := range messages {
+		requireSegmentsDecodeTo(t, segments[id], expected)
+	}
+}
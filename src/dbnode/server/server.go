@@ -1372,9 +1372,16 @@ func withEncodingAndPoolingOptions(
 		SetSegmentReaderPool(segmentReaderPool).
 		SetCheckedBytesWrapperPool(bytesWrapperPool)
 
+	protoOpts := proto.NewOptions().
+		SetEncodingOptions(encodingOpts).
+		SetInstrumentOptions(iopts)
+	if cfg.Proto != nil {
+		protoOpts = protoOpts.SetLogMarshalFallbacks(cfg.Proto.LogMarshalFallbacks)
+	}
+
 	encoderPool.Init(func() encoding.Encoder {
 		if cfg.Proto != nil && cfg.Proto.Enabled {
-			enc := proto.NewEncoder(time.Time{}, encodingOpts)
+			enc := proto.NewEncoder(time.Time{}, protoOpts)
 			return enc
 		}
 
@@ -1383,7 +1390,7 @@ func withEncodingAndPoolingOptions(
 
 	iteratorPool.Init(func(r io.Reader, descr namespace.SchemaDescr) encoding.ReaderIterator {
 		if cfg.Proto != nil && cfg.Proto.Enabled {
-			return proto.NewIterator(r, descr, encodingOpts)
+			return proto.NewIterator(r, descr, protoOpts)
 		}
 		return m3tsz.NewReaderIterator(r, m3tsz.DefaultIntOptimizationEnabled, encodingOpts)
 	})
@@ -22,6 +22,7 @@ package prototest
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -46,6 +47,49 @@ message TestMessage {
   map<string, string> attributes = 5;
 }
 `
+
+	// evolvedProtoStr is protoStr with an additional field, as if the schema had been
+	// evolved after data was written with the original schema.
+	evolvedProtoStr = `syntax = "proto3";
+package mainpkg;
+
+message TestMessage {
+  double latitude = 1;
+  double longitude = 2;
+  int64 epoch = 3;
+  bytes deliveryID = 4;
+  map<string, string> attributes = 5;
+  string region = 6;
+}
+`
+
+	// mixedFieldsProtoStr is a schema with a mix of fields that are compressed with
+	// custom encodings (the scalars) and fields that are marshalled as protobuf.
+	mixedFieldsProtoStr = `syntax = "proto3";
+package mainpkg;
+
+message MixedFieldsMessage {
+  double latitude = 1;
+  int64 epoch = 2;
+  string deliveryID = 3;
+  bool delivered = 4;
+  Location location = 5;
+  repeated int64 stops = 6;
+  map<string, string> attributes = 7;
+}
+
+message Location {
+  string city = 1;
+  int32 zone = 2;
+}
+`
+
+	// EvolvedSchemaFirstDeployID is the deploy ID of the original schema in the
+	// history returned by NewEvolvedSchemaHistory.
+	EvolvedSchemaFirstDeployID = "first"
+	// EvolvedSchemaSecondDeployID is the deploy ID of the evolved schema in the
+	// history returned by NewEvolvedSchemaHistory.
+	EvolvedSchemaSecondDeployID = "second"
 )
 
 type TestMessage struct {
@@ -77,6 +121,61 @@ func NewSchemaHistory() namespace.SchemaHistory {
 	return schemaHis
 }
 
+// NewEvolvedSchemaHistory returns a schema history with two versions of the test
+// schema where the second (latest) version adds a "region" string field.
+func NewEvolvedSchemaHistory() namespace.SchemaHistory {
+	return newEvolvedSchemaHistory(true)
+}
+
+// NewPreEvolvedSchemaHistory returns a schema history with only the first version
+// of the schemas returned by NewEvolvedSchemaHistory, which the latter extends.
+func NewPreEvolvedSchemaHistory() namespace.SchemaHistory {
+	return newEvolvedSchemaHistory(false)
+}
+
+func newEvolvedSchemaHistory(evolved bool) namespace.SchemaHistory {
+	const (
+		protoFile = "mainpkg/test.proto"
+		msgName   = "mainpkg.TestMessage"
+	)
+	schemaOpts, err := namespace.AppendSchemaOptions(nil, protoFile, msgName,
+		map[string]string{protoFile: protoStr}, EvolvedSchemaFirstDeployID)
+	if err != nil {
+		panic(err)
+	}
+	if evolved {
+		schemaOpts, err = namespace.AppendSchemaOptions(schemaOpts, protoFile, msgName,
+			map[string]string{protoFile: evolvedProtoStr}, EvolvedSchemaSecondDeployID)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	schemaHis, err := namespace.LoadSchemaHistory(schemaOpts)
+	if err != nil {
+		panic(err)
+	}
+	return schemaHis
+}
+
+// NewMixedFieldsSchemaHistory returns a schema history with a single schema whose
+// messages have a mix of custom encoded and protobuf marshalled fields, see
+// NewMixedFieldsTestMessages.
+func NewMixedFieldsSchemaHistory() namespace.SchemaHistory {
+	const protoFile = "mainpkg/mixed.proto"
+	schemaOpts, err := namespace.AppendSchemaOptions(nil, protoFile, "mainpkg.MixedFieldsMessage",
+		map[string]string{protoFile: mixedFieldsProtoStr}, "mixed")
+	if err != nil {
+		panic(err)
+	}
+
+	schemaHis, err := namespace.LoadSchemaHistory(schemaOpts)
+	if err != nil {
+		panic(err)
+	}
+	return schemaHis
+}
+
 func NewMessageDescriptor(his namespace.SchemaHistory) *desc.MessageDescriptor {
 	schema, ok := his.GetLatest()
 	if !ok {
@@ -154,6 +253,70 @@ func NewProtoTestMessages(md *desc.MessageDescriptor) []*dynamic.Message {
 	return msgs
 }
 
+// NewMixedFieldsTestMessages returns messages of the schema returned by
+// NewMixedFieldsSchemaHistory in which each of the protobuf marshalled fields is
+// set, changed, changed back to its default value and set again so that iterating
+// them exercises every path of the encoding of those fields.
+func NewMixedFieldsTestMessages(md *desc.MessageDescriptor) []*dynamic.Message {
+	var (
+		locationMD = md.FindFieldByName("location").GetMessageType()
+		location   = func(city string, zone int32) *dynamic.Message {
+			m := dynamic.NewMessage(locationMD)
+			m.SetFieldByName("city", city)
+			m.SetFieldByName("zone", zone)
+			return m
+		}
+		newMessage = func(
+			epoch int64,
+			loc *dynamic.Message,
+			stops []int64,
+			attributes map[string]string,
+		) *dynamic.Message {
+			m := dynamic.NewMessage(md)
+			m.SetFieldByName("latitude", 0.1*float64(epoch))
+			m.SetFieldByName("epoch", epoch)
+			m.SetFieldByName("deliveryID", fmt.Sprintf("delivery-%d", epoch%3))
+			m.SetFieldByName("delivered", epoch%2 == 0)
+			if loc != nil {
+				m.SetFieldByName("location", loc)
+			}
+			if stops != nil {
+				m.SetFieldByName("stops", stops)
+			}
+			if attributes != nil {
+				m.SetFieldByName("attributes", attributes)
+			}
+			return m
+		}
+	)
+	return []*dynamic.Message{
+		newMessage(1, nil, nil, nil),
+		newMessage(2, location("nyc", 1), []int64{1, 2}, map[string]string{"key1": "val1"}),
+		newMessage(3, location("nyc", 1), []int64{1, 2}, map[string]string{"key1": "val1"}),
+		newMessage(4, location("sf", 2), []int64{3}, map[string]string{"key1": "val2"}),
+		// All of the marshalled fields change back to their default value at once.
+		newMessage(5, nil, nil, nil),
+		newMessage(6, location("sf", 2), nil, nil),
+		// Only some of the marshalled fields change back to their default value.
+		newMessage(7, nil, []int64{4, 5, 6}, nil),
+		newMessage(8, nil, []int64{4, 5, 6}, map[string]string{"key2": "val2"}),
+		newMessage(9, location("la", 3), nil, map[string]string{"key2": "val2"}),
+	}
+}
+
+// MessagesEqual returns whether the marshalled expected and actual messages are equal.
+func MessagesEqual(md *desc.MessageDescriptor, expected, actual []byte) bool {
+	expectedMsg := dynamic.NewMessage(md)
+	if expectedMsg.Unmarshal(expected) != nil {
+		return false
+	}
+	actualMsg := dynamic.NewMessage(md)
+	if actualMsg.Unmarshal(actual) != nil {
+		return false
+	}
+	return dynamic.MessagesEqual(expectedMsg, actualMsg)
+}
+
 func RequireEqual(t *testing.T, md *desc.MessageDescriptor, expected, actual []byte) {
 	expectedMsg := dynamic.NewMessage(md)
 	require.NoError(t, expectedMsg.Unmarshal(expected))
@@ -209,6 +372,24 @@ func ProtoEqual(md *desc.MessageDescriptor, expected, actual []byte) bool {
 		actualMsg.GetFieldByName("attributes").(map[interface{}]interface{}))
 }
 
+// EvolvedProtoEqual is the same as ProtoEqual, but also compares the "region" field
+// of the evolved schema returned by NewEvolvedSchemaHistory.
+func EvolvedProtoEqual(md *desc.MessageDescriptor, expected, actual []byte) bool {
+	if !ProtoEqual(md, expected, actual) {
+		return false
+	}
+
+	expectedMsg := dynamic.NewMessage(md)
+	if expectedMsg.Unmarshal(expected) != nil {
+		return false
+	}
+	actualMsg := dynamic.NewMessage(md)
+	if actualMsg.Unmarshal(actual) != nil {
+		return false
+	}
+	return expectedMsg.GetFieldByName("region") == actualMsg.GetFieldByName("region")
+}
+
 func attributesEqual(expected, actual map[interface{}]interface{}) bool {
 	if len(expected) != len(actual) {
 		return false
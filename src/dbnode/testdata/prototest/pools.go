@@ -58,13 +58,14 @@ func newPools() Pools {
 	multiReaderIteratorPool := encoding.NewMultiReaderIteratorPool(nil)
 
 	encodingOpts := testEncodingOptions.SetEncoderPool(encoderPool)
+	protoOpts := proto.NewOptions().SetEncodingOptions(encodingOpts)
 
 	var timeZero time.Time
 	encoderPool.Init(func() encoding.Encoder {
-		return proto.NewEncoder(timeZero, encodingOpts)
+		return proto.NewEncoder(timeZero, protoOpts)
 	})
 	readerIterPool.Init(func(r io.Reader, descr namespace.SchemaDescr) encoding.ReaderIterator {
-		return proto.NewIterator(r, descr, encodingOpts)
+		return proto.NewIterator(r, descr, protoOpts)
 	})
 	multiReaderIteratorPool.Init(func(r io.Reader, descr namespace.SchemaDescr) encoding.ReaderIterator {
 		i := readerIterPool.Get()
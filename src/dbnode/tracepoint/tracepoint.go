@@ -60,4 +60,16 @@ const (
 
 	// BlockAggregate is the operation name for the index block aggregate path.
 	BlockAggregate = "storage/index.block.Aggregate"
+
+	// ProtoEncoderEncode is the operation name for the proto encoder Encode path.
+	ProtoEncoderEncode = "encoding/proto.Encoder.Encode"
+
+	// ProtoEncoderUnmarshal is the operation name for the proto encoder unmarshal path.
+	ProtoEncoderUnmarshal = "encoding/proto.Encoder.unmarshal"
+
+	// ProtoEncoderEncodeCustomValues is the operation name for the proto encoder custom values path.
+	ProtoEncoderEncodeCustomValues = "encoding/proto.Encoder.encodeCustomValues"
+
+	// ProtoEncoderMarshalNonCustomValues is the operation name for the proto encoder marshal path.
+	ProtoEncoderMarshalNonCustomValues = "encoding/proto.Encoder.encodeNonCustomValues"
 )
@@ -100,3 +100,21 @@ func (n *m3emNode) Bootstrapped() bool {
 	}
 	return health.Bootstrapped
 }
+
+func (n *m3emNode) Fetch(req *m3dbrpc.FetchRequest) (*m3dbrpc.FetchResult_, error) {
+	client, err := n.client()
+	if err != nil {
+		return nil, err
+	}
+
+	var result *m3dbrpc.FetchResult_
+	attemptFn := func() error {
+		tctx, _ := thrift.NewContext(n.opts.NodeOptions().OperationTimeout())
+		result, err = client.Fetch(tctx, req)
+		return err
+	}
+
+	retrier := n.opts.NodeOptions().Retrier()
+	err = retrier.Attempt(attemptFn)
+	return result, err
+}
@@ -64,3 +64,30 @@ func TestHealthEndpoint(t *testing.T) {
 	require.False(t, health.OK)
 	require.Equal(t, "NOT_OK", health.Status)
 }
+
+func TestFetchEndpoint(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	req := &m3dbrpc.FetchRequest{
+		RangeStart: 1,
+		RangeEnd:   2,
+		NameSpace:  "metrics",
+		ID:         "foo",
+	}
+	mockClient := m3dbrpc.NewMockTChanNode(ctrl)
+	mockClient.EXPECT().Fetch(gomock.Any(), req).Return(&m3dbrpc.FetchResult_{
+		Datapoints: []*m3dbrpc.Datapoint{{Timestamp: 1, Value: 42}},
+	}, nil)
+
+	opts := newTestOptions()
+	mockNode := node.NewMockServiceNode(ctrl)
+
+	nodeInterface, err := New(mockNode, opts)
+	require.NoError(t, err)
+	testNode := nodeInterface.(*m3emNode)
+	testNode.rpcClient = mockClient
+
+	result, err := testNode.Fetch(req)
+	require.NoError(t, err)
+	require.Equal(t, []*m3dbrpc.Datapoint{{Timestamp: 1, Value: 42}}, result.Datapoints)
+}
@@ -21,6 +21,7 @@
 package m3db
 
 import (
+	m3dbrpc "github.com/m3db/m3/src/dbnode/generated/thrift/rpc"
 	"github.com/m3db/m3/src/m3em/node"
 	"github.com/m3db/m3/src/x/instrument"
 )
@@ -34,6 +35,10 @@ type Node interface {
 
 	// Bootstrapped returns whether the node is bootstrapped
 	Bootstrapped() bool
+
+	// Fetch fetches the datapoints of a series from this node alone, rather
+	// than from all the replicas of the series like a client session does
+	Fetch(req *m3dbrpc.FetchRequest) (*m3dbrpc.FetchResult_, error)
 }
 
 // NodeHealth provides Health information for a M3DB node
@@ -127,6 +127,14 @@ func (h *opHeartbeatServer) Heartbeat(
 		h.listeners.notifyTermination(msg.GetError())
 
 	case hb.HeartbeatCode_OVERWRITTEN:
+		// Overwrites are only unexpected while monitoring heartbeats, otherwise the
+		// remote agent is being reset by a re-setup of the node. The overwrite is the
+		// last heartbeat of the previous setup, so forget those received before it
+		// in order for the re-setup to wait for the first heartbeat of the new one.
+		if !h.isRunning() {
+			h.resetLastHeartbeat()
+			break
+		}
 		h.listeners.notifyOverwrite(msg.GetError())
 		h.stop()
 
@@ -164,6 +172,12 @@ func (h *opHeartbeatServer) start() error {
 	return nil
 }
 
+func (h *opHeartbeatServer) isRunning() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.running
+}
+
 func (h *opHeartbeatServer) lastHeartbeatTime() time.Time {
 	h.RLock()
 	defer h.RUnlock()
@@ -203,6 +217,13 @@ func (h *opHeartbeatServer) updateLastHeartbeat(ts time.Time, msg *hb.HeartbeatR
 	h.Unlock()
 }
 
+func (h *opHeartbeatServer) resetLastHeartbeat() {
+	h.Lock()
+	h.lastHeartbeat = hb.HeartbeatRequest{}
+	h.lastHeartbeatTs = time.Time{}
+	h.Unlock()
+}
+
 func (h *opHeartbeatServer) stop() {
 	h.Lock()
 	if !h.running {
@@ -156,6 +156,51 @@ func TestHeartbeatingOverwrite(t *testing.T) {
 	require.True(t, overwritten)
 }
 
+func TestHeartbeatingOverwriteIgnoredWhenNotRunning(t *testing.T) {
+	var (
+		lg         = newListenerGroup(nil)
+		opts       = newTestHeartbeatOpts()
+		iopts      = instrument.NewOptions()
+		lnr        = newTestListener(t)
+		overwrites = make(chan string, 2)
+	)
+	lnr.onOverwrite = func(_ ServiceNode, desc string) {
+		overwrites <- desc
+	}
+	lg.add(lnr)
+
+	hbServer := newHeartbeater(lg, opts, iopts)
+	_, err := hbServer.Heartbeat(context.Background(),
+		&hb.HeartbeatRequest{
+			Code: hb.HeartbeatCode_HEALTHY,
+		})
+	require.NoError(t, err)
+	require.False(t, hbServer.lastHeartbeatTime().IsZero())
+
+	// The overwrite of a node that is being re-setup is not notified, and the
+	// heartbeats of the previous setup are forgotten.
+	_, err = hbServer.Heartbeat(context.Background(),
+		&hb.HeartbeatRequest{
+			Code:  hb.HeartbeatCode_OVERWRITTEN,
+			Error: "re-setup",
+		})
+	require.NoError(t, err)
+	require.True(t, hbServer.lastHeartbeatTime().IsZero())
+
+	// Whereas overwrites while heartbeats are monitored are notified. Listeners are
+	// notified asynchronously so wait for the notification of this overwrite, which
+	// would be accompanied by that of the ignored overwrite had it been notified.
+	require.NoError(t, hbServer.start())
+	_, err = hbServer.Heartbeat(context.Background(),
+		&hb.HeartbeatRequest{
+			Code:  hb.HeartbeatCode_OVERWRITTEN,
+			Error: "overwritten",
+		})
+	require.NoError(t, err)
+	require.Equal(t, "overwritten", <-overwrites)
+	require.Len(t, overwrites, 0)
+}
+
 func TestHeartbeatingTimeout(t *testing.T) {
 	var (
 		now       = time.Now()
@@ -134,6 +134,15 @@ func (i *svcNode) Setup(
 		return errUnableToSetupInitializedNode
 	}
 
+	if i.status == StatusSetup && i.heartbeater != nil {
+		// The node is being re-initialized, stop monitoring heartbeats for the previous
+		// setup as they're resumed below once the remote agent has been reset. The agent
+		// sends an overwrite heartbeat when it's reset, upon which the heartbeats of the
+		// previous setup are forgotten so that the wait for the initial heartbeat below
+		// is for the new setup.
+		i.heartbeater.stop()
+	}
+
 	i.currentConf = conf
 	i.currentBuild = bld
 
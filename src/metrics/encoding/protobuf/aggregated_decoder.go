@@ -68,6 +68,17 @@ func (d AggregatedDecoder) EncodeNanos() int64 {
 	return d.pb.EncodeNanos
 }
 
+// Annotation returns the decoded marshalled proto message, if any.
+func (d AggregatedDecoder) Annotation() []byte {
+	return d.pb.Annotation
+}
+
+// SchemaDeployID returns the decoded deploy ID of the schema that the annotation
+// was marshalled with, if any.
+func (d AggregatedDecoder) SchemaDeployID() string {
+	return d.pb.SchemaDeployId
+}
+
 // Close closes the decoder.
 func (d *AggregatedDecoder) Close() {
 	resetAggregatedMetricProto(&d.pb)
@@ -23,6 +23,7 @@ package protobuf
 import (
 	"testing"
 
+	"github.com/m3db/m3/src/metrics/generated/proto/metricpb"
 	"github.com/m3db/m3/src/metrics/metric"
 	"github.com/m3db/m3/src/metrics/metric/aggregated"
 	"github.com/m3db/m3/src/metrics/policy"
@@ -112,3 +113,26 @@ func TestAggregatedEncoderDecoder_ResetProtobuf(t *testing.T) {
 	require.Equal(t, testAggregatedMetric2.TimeNanos, dec.TimeNanos())
 	require.Equal(t, testAggregatedMetric2.Value, dec.Value())
 }
+
+func TestAggregatedDecoder_AnnotationAndSchemaDeployID(t *testing.T) {
+	var pb metricpb.AggregatedMetric
+	require.NoError(t, testAggregatedMetric1.ToProto(&pb.Metric))
+	pb.Annotation = []byte("marshalled proto message")
+	pb.SchemaDeployId = "schema-v2"
+	b, err := pb.Marshal()
+	require.NoError(t, err)
+
+	dec := NewAggregatedDecoder(nil)
+	require.NoError(t, dec.Decode(b))
+	require.Equal(t, pb.Annotation, dec.Annotation())
+	require.Equal(t, "schema-v2", dec.SchemaDeployID())
+	require.Equal(t, string(testAggregatedMetric1.ID), string(dec.ID()))
+
+	// Metrics without a proto message don't inherit those of the previous one.
+	dec.Close()
+	enc := NewAggregatedEncoder(nil)
+	require.NoError(t, enc.Encode(testAggregatedMetric2, 3000))
+	require.NoError(t, dec.Decode(enc.Buffer().Bytes()))
+	require.Empty(t, dec.Annotation())
+	require.Equal(t, "", dec.SchemaDeployID())
+}
@@ -30,6 +30,8 @@ func resetAggregatedMetricProto(pb *metricpb.AggregatedMetric) {
 	}
 	resetTimedMetricWithStoragePolicyProto(&pb.Metric)
 	pb.EncodeNanos = 0
+	pb.Annotation = pb.Annotation[:0]
+	pb.SchemaDeployId = ""
 }
 
 // resetMetricWithMetadatasProto resets the metric with metadatas proto, and
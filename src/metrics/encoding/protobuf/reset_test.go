@@ -132,7 +132,9 @@ func TestResetAggregatedMetricProto(t *testing.T) {
 				},
 			},
 		},
-		EncodeNanos: 1234,
+		EncodeNanos:    1234,
+		Annotation:     []byte("annotation"),
+		SchemaDeployId: "schema",
 	}
 	resetAggregatedMetricProto(input)
 	require.Equal(t, metricpb.AggregatedMetric{
@@ -141,8 +143,10 @@ func TestResetAggregatedMetricProto(t *testing.T) {
 			StoragePolicy: policypb.StoragePolicy{},
 		},
 		EncodeNanos: 0,
+		Annotation:  []byte{},
 	}, *input)
 	require.True(t, cap(input.Metric.TimedMetric.Id) > 0)
+	require.True(t, cap(input.Annotation) > 0)
 }
 
 func TestResetMetricWithMetadatasProtoOnlyCounter(t *testing.T) {
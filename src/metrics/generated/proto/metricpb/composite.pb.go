@@ -257,6 +257,10 @@ func (m *TimedMetricWithStoragePolicy) GetStoragePolicy() policypb.StoragePolicy
 type AggregatedMetric struct {
 	Metric      TimedMetricWithStoragePolicy `protobuf:"bytes,1,opt,name=metric" json:"metric"`
 	EncodeNanos int64                        `protobuf:"varint,2,opt,name=encode_nanos,json=encodeNanos,proto3" json:"encode_nanos,omitempty"`
+	// The marshalled proto message of a datapoint of a proto namespace, and the
+	// deploy ID of the schema of the namespace that it was marshalled with.
+	Annotation     []byte `protobuf:"bytes,3,opt,name=annotation,proto3" json:"annotation,omitempty"`
+	SchemaDeployId string `protobuf:"bytes,4,opt,name=schema_deploy_id,json=schemaDeployId,proto3" json:"schema_deploy_id,omitempty"`
 }
 
 func (m *AggregatedMetric) Reset()                    { *m = AggregatedMetric{} }
@@ -278,6 +282,20 @@ func (m *AggregatedMetric) GetEncodeNanos() int64 {
 	return 0
 }
 
+func (m *AggregatedMetric) GetAnnotation() []byte {
+	if m != nil {
+		return m.Annotation
+	}
+	return nil
+}
+
+func (m *AggregatedMetric) GetSchemaDeployId() string {
+	if m != nil {
+		return m.SchemaDeployId
+	}
+	return ""
+}
+
 // NB: we intentionally choose to explicitly define the message type as well
 // as the corresponding payload as opposed to use `oneof` protobuf type here.
 // This is because the generated `Unmarshal` method of `oneof` types doesn't
@@ -583,6 +601,18 @@ func (m *AggregatedMetric) MarshalTo(dAtA []byte) (int, error) {
 		i++
 		i = encodeVarintComposite(dAtA, i, uint64(m.EncodeNanos))
 	}
+	if len(m.Annotation) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintComposite(dAtA, i, uint64(len(m.Annotation)))
+		i += copy(dAtA[i:], m.Annotation)
+	}
+	if len(m.SchemaDeployId) > 0 {
+		dAtA[i] = 0x22
+		i++
+		i = encodeVarintComposite(dAtA, i, uint64(len(m.SchemaDeployId)))
+		i += copy(dAtA[i:], m.SchemaDeployId)
+	}
 	return i, nil
 }
 
@@ -736,6 +766,14 @@ func (m *AggregatedMetric) Size() (n int) {
 	if m.EncodeNanos != 0 {
 		n += 1 + sovComposite(uint64(m.EncodeNanos))
 	}
+	l = len(m.Annotation)
+	if l > 0 {
+		n += 1 + l + sovComposite(uint64(l))
+	}
+	l = len(m.SchemaDeployId)
+	if l > 0 {
+		n += 1 + l + sovComposite(uint64(l))
+	}
 	return n
 }
 
@@ -1519,6 +1557,66 @@ func (m *AggregatedMetric) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Annotation", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowComposite
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthComposite
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Annotation = append(m.Annotation[:0], dAtA[iNdEx:postIndex]...)
+			if m.Annotation == nil {
+				m.Annotation = []byte{}
+			}
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SchemaDeployId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowComposite
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthComposite
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SchemaDeployId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipComposite(dAtA[iNdEx:])
@@ -1884,51 +1982,54 @@ func init() {
 }
 
 var fileDescriptorComposite = []byte{
-	// 732 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x95, 0xcd, 0x6e, 0xd3, 0x5a,
-	0x10, 0xc7, 0xeb, 0x36, 0x69, 0x7b, 0x27, 0xbd, 0xbd, 0xb9, 0xe7, 0xe6, 0x36, 0x21, 0xad, 0x0c,
-	0xb5, 0x04, 0x42, 0x42, 0xc4, 0xa2, 0x91, 0xa8, 0x50, 0x05, 0x92, 0xf3, 0xd1, 0x34, 0x42, 0x4d,
-	0x91, 0xeb, 0x2a, 0x12, 0x8b, 0x5a, 0xfe, 0xaa, 0x63, 0x44, 0x62, 0xcb, 0x3e, 0x51, 0x55, 0xb1,
-	0x61, 0x09, 0x3b, 0x24, 0xc4, 0x1b, 0xb0, 0xe5, 0x3d, 0xba, 0x83, 0x27, 0x40, 0xa8, 0xbc, 0x08,
-	0xb2, 0x7d, 0x1c, 0xdb, 0xc7, 0x0e, 0x42, 0xed, 0xce, 0x9e, 0x99, 0xff, 0x6f, 0xfe, 0x39, 0x9e,
-	0x39, 0x81, 0x9e, 0x69, 0xe1, 0xd1, 0x54, 0x6d, 0x68, 0xf6, 0x98, 0x1f, 0x37, 0x75, 0x95, 0x1f,
-	0x37, 0x79, 0xcf, 0xd5, 0xf8, 0xb1, 0x81, 0x5d, 0x4b, 0xf3, 0x78, 0xd3, 0x98, 0x18, 0xae, 0x82,
-	0x0d, 0x9d, 0x77, 0x5c, 0x1b, 0xdb, 0x24, 0xee, 0xa8, 0xbc, 0x66, 0x8f, 0x1d, 0xdb, 0xb3, 0xb0,
-	0xd1, 0x08, 0x12, 0x68, 0x35, 0xca, 0xd4, 0x1f, 0x26, 0x90, 0xa6, 0x6d, 0xda, 0xa1, 0x52, 0x9d,
-	0x9e, 0x05, 0x6f, 0x21, 0xc6, 0x7f, 0x0a, 0x85, 0xf5, 0xce, 0x75, 0x1d, 0x84, 0x0f, 0x84, 0xb2,
-	0x7f, 0x03, 0x8a, 0xa2, 0x2b, 0x58, 0xb9, 0xa6, 0x1b, 0xc7, 0x7e, 0x6d, 0x69, 0x17, 0x8e, 0x4a,
-	0x1e, 0x42, 0x0a, 0xf7, 0x8e, 0x81, 0x4a, 0xdb, 0x9e, 0x4e, 0xb0, 0xe1, 0x0e, 0x2d, 0x3c, 0x3a,
-	0x24, 0x3d, 0x3c, 0xf4, 0x08, 0x56, 0xb4, 0x30, 0x5e, 0x63, 0xee, 0x30, 0xf7, 0x4b, 0x3b, 0xff,
-	0x36, 0x22, 0x27, 0x0d, 0x22, 0x68, 0x15, 0x2e, 0xbf, 0xdf, 0x5e, 0x10, 0xa3, 0x3a, 0xf4, 0x14,
-	0xfe, 0x8a, 0x3c, 0x7a, 0xb5, 0xc5, 0x40, 0x74, 0x2b, 0x16, 0x1d, 0x63, 0xc5, 0x34, 0xf4, 0x59,
-	0x03, 0x22, 0x8e, 0x15, 0xdc, 0x27, 0x06, 0xaa, 0x2d, 0x05, 0x6b, 0x23, 0xc9, 0x1a, 0xd3, 0x6e,
-	0xf6, 0xa0, 0xa4, 0xfa, 0x29, 0x19, 0xfb, 0x39, 0xe2, 0xa8, 0x12, 0xc3, 0x63, 0x1d, 0xe1, 0x82,
-	0x3a, 0x8b, 0xdc, 0xd4, 0xd7, 0x5b, 0x06, 0x50, 0x4f, 0x99, 0x9a, 0x46, 0xda, 0xd2, 0x03, 0x28,
-	0x9a, 0x7e, 0x94, 0x98, 0xf9, 0x27, 0x26, 0x06, 0xc5, 0x84, 0x13, 0xd6, 0xdc, 0xd4, 0xc2, 0x47,
-	0x06, 0x36, 0xf7, 0x6d, 0xf7, 0x5c, 0x71, 0xf5, 0xa0, 0xce, 0xb5, 0xb4, 0xa4, 0x19, 0xb4, 0x0b,
-	0xcb, 0x21, 0x8c, 0x98, 0x49, 0xb0, 0x29, 0x19, 0x61, 0x93, 0x72, 0xb4, 0x07, 0xab, 0x51, 0x97,
-	0xac, 0x2d, 0x22, 0x8d, 0xba, 0x10, 0xe9, 0x4c, 0xc0, 0xbd, 0x67, 0xa0, 0xea, 0x9f, 0x70, 0x9e,
-	0xa3, 0x26, 0xe5, 0xe8, 0xff, 0x18, 0x9b, 0x90, 0x50, 0x6e, 0x9e, 0x64, 0xdc, 0x54, 0xb3, 0xb2,
-	0x7c, 0x2f, 0x9f, 0x19, 0xd8, 0xa2, 0xbc, 0x1c, 0x63, 0xdb, 0x55, 0x4c, 0xe3, 0x45, 0x30, 0xee,
-	0xe8, 0x19, 0xac, 0xf9, 0xb3, 0xa3, 0xcb, 0x7f, 0x6e, 0xab, 0x84, 0xe3, 0x10, 0xea, 0xc0, 0xba,
-	0x17, 0x02, 0xe5, 0x70, 0x81, 0x66, 0x0e, 0xa3, 0xc5, 0x6a, 0xa4, 0x1a, 0x12, 0xc6, 0xdf, 0x5e,
-	0x32, 0xc8, 0xbd, 0x81, 0xb2, 0x60, 0x9a, 0xae, 0x61, 0xfa, 0x8b, 0x39, 0x23, 0xa7, 0x8f, 0xea,
-	0x5e, 0xae, 0xa7, 0xcc, 0x2f, 0xa2, 0xce, 0x6e, 0x1b, 0xd6, 0x8c, 0x89, 0x66, 0xeb, 0x86, 0x3c,
-	0x51, 0x26, 0x76, 0x38, 0x64, 0x4b, 0x62, 0x29, 0x8c, 0x0d, 0xfc, 0x10, 0xf7, 0xb5, 0x08, 0xff,
-	0x65, 0x3f, 0x95, 0x87, 0x1e, 0x43, 0x01, 0x5f, 0x38, 0xe1, 0x20, 0xaf, 0xef, 0x70, 0x71, 0xfb,
-	0x9c, 0xe2, 0x86, 0x74, 0xe1, 0x18, 0x62, 0x50, 0x8f, 0x24, 0xd8, 0x20, 0xab, 0x2f, 0x9f, 0x5b,
-	0x78, 0x24, 0xd3, 0x13, 0xce, 0x66, 0x6e, 0x8c, 0x14, 0x4a, 0xac, 0x68, 0x79, 0x17, 0xcf, 0x29,
-	0xd4, 0x13, 0xab, 0x4e, 0x93, 0x97, 0x02, 0xf2, 0x76, 0xde, 0xe6, 0xa7, 0xe1, 0x55, 0x75, 0xce,
-	0x55, 0x32, 0x80, 0x4a, 0xb0, 0x93, 0x34, 0xb9, 0x10, 0x90, 0xb7, 0xa8, 0x35, 0x4e, 0x43, 0x91,
-	0x99, 0xbd, 0x07, 0x5e, 0x01, 0x7b, 0x16, 0xed, 0x18, 0x19, 0xae, 0x34, 0xba, 0x56, 0x0c, 0xc8,
-	0x77, 0xe7, 0xee, 0x64, 0x92, 0x27, 0x6e, 0x9e, 0xfd, 0x66, 0xcf, 0x4f, 0xa1, 0x9e, 0x1c, 0x62,
-	0xaa, 0xcf, 0x32, 0x7d, 0x36, 0x73, 0x96, 0x53, 0xac, 0xe2, 0xfc, 0x04, 0xf7, 0x85, 0x81, 0x82,
-	0xff, 0x81, 0x51, 0x09, 0x56, 0x4e, 0x06, 0xcf, 0x07, 0x47, 0xc3, 0x41, 0x79, 0x01, 0xd5, 0x61,
-	0xa3, 0x7d, 0x74, 0x32, 0x90, 0xba, 0xa2, 0x3c, 0xec, 0x4b, 0x07, 0xf2, 0x61, 0x57, 0x12, 0x3a,
-	0x82, 0x24, 0x1c, 0x97, 0x19, 0xc4, 0x42, 0xbd, 0x25, 0x48, 0xed, 0x03, 0x59, 0xea, 0x1f, 0x66,
-	0xf3, 0x8b, 0xa8, 0x06, 0x95, 0x9e, 0x70, 0xd2, 0xeb, 0xd2, 0x99, 0x25, 0xc4, 0x01, 0xbb, 0x7f,
-	0x24, 0x0e, 0x05, 0xb1, 0xd3, 0xed, 0xf8, 0x09, 0xb1, 0xdf, 0x4e, 0x17, 0x95, 0x0b, 0x3e, 0xdd,
-	0xe7, 0xce, 0xc9, 0x17, 0x5b, 0xfd, 0xcb, 0x2b, 0x96, 0xf9, 0x76, 0xc5, 0x32, 0x3f, 0xae, 0x58,
-	0xe6, 0xc3, 0x4f, 0x76, 0xe1, 0xe5, 0xee, 0x35, 0xff, 0x5d, 0xd5, 0xe5, 0xe0, 0xbd, 0xf9, 0x2b,
-	0x00, 0x00, 0xff, 0xff, 0x1a, 0x70, 0xed, 0x30, 0x67, 0x08, 0x00, 0x00,
+	// 775 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x95, 0xdb, 0x6a, 0xe3, 0x46,
+	0x18, 0xc7, 0x33, 0xb1, 0x9d, 0xc3, 0xe7, 0x34, 0x75, 0xa7, 0x6e, 0xac, 0x3a, 0x41, 0x4d, 0x04,
+	0x2d, 0x86, 0x52, 0x9b, 0xc6, 0xd0, 0x50, 0x42, 0x0b, 0x3e, 0xc5, 0x31, 0x25, 0x4e, 0x51, 0x14,
+	0x0c, 0xbd, 0xa8, 0xd0, 0x29, 0xb2, 0x4a, 0xa4, 0x11, 0xd2, 0x98, 0xe0, 0xbb, 0x5e, 0xee, 0xde,
+	0x2d, 0x2c, 0xfb, 0x06, 0x7b, 0xbb, 0x8f, 0xb1, 0x90, 0xbb, 0xdd, 0x27, 0x58, 0x96, 0xec, 0x8b,
+	0x2c, 0x3a, 0x59, 0x07, 0xcb, 0xb0, 0x24, 0x77, 0xf2, 0xff, 0xfb, 0xfe, 0xbf, 0xf9, 0x6b, 0x34,
+	0xdf, 0x18, 0x86, 0xba, 0x41, 0xa7, 0x33, 0xb9, 0xa9, 0x10, 0xb3, 0x65, 0xb6, 0x55, 0xb9, 0x65,
+	0xb6, 0x5b, 0xae, 0xa3, 0xb4, 0x4c, 0x8d, 0x3a, 0x86, 0xe2, 0xb6, 0x74, 0xcd, 0xd2, 0x1c, 0x89,
+	0x6a, 0x6a, 0xcb, 0x76, 0x08, 0x25, 0xa1, 0x6e, 0xcb, 0x2d, 0x85, 0x98, 0x36, 0x71, 0x0d, 0xaa,
+	0x35, 0xfd, 0x02, 0xde, 0x8a, 0x2a, 0xf5, 0x5f, 0x12, 0x48, 0x9d, 0xe8, 0x24, 0x70, 0xca, 0xb3,
+	0x1b, 0xff, 0x57, 0x80, 0xf1, 0x9e, 0x02, 0x63, 0xbd, 0xff, 0xd8, 0x04, 0xc1, 0x43, 0x48, 0x39,
+	0x7b, 0x02, 0x45, 0x52, 0x25, 0x2a, 0x3d, 0x32, 0x8d, 0x4d, 0x6e, 0x0d, 0x65, 0x6e, 0xcb, 0xe1,
+	0x43, 0x40, 0xe1, 0x9e, 0x21, 0xa8, 0xf6, 0xc8, 0xcc, 0xa2, 0x9a, 0x33, 0x31, 0xe8, 0xf4, 0x22,
+	0x5c, 0xc3, 0xc5, 0xbf, 0xc2, 0xa6, 0x12, 0xe8, 0x0c, 0x3a, 0x44, 0x8d, 0xf2, 0xf1, 0x37, 0xcd,
+	0x28, 0x49, 0x33, 0x34, 0x74, 0x8b, 0xf7, 0x1f, 0x7e, 0x58, 0xe3, 0xa3, 0x3e, 0xfc, 0x07, 0x6c,
+	0x47, 0x19, 0x5d, 0x66, 0xdd, 0x37, 0x7d, 0x1f, 0x9b, 0xae, 0xa8, 0xa4, 0x6b, 0xea, 0x62, 0x81,
+	0xd0, 0x1c, 0x3b, 0xb8, 0x57, 0x08, 0x6a, 0x5d, 0x89, 0x2a, 0x53, 0xc1, 0x30, 0xb3, 0x69, 0x4e,
+	0xa1, 0x2c, 0x7b, 0x25, 0x91, 0x1a, 0xe6, 0x22, 0x51, 0x35, 0x86, 0xc7, 0xbe, 0x90, 0x0b, 0xf2,
+	0x42, 0x79, 0x6a, 0xae, 0xff, 0x11, 0xe0, 0xa1, 0x34, 0xd3, 0xb5, 0x74, 0xa4, 0x9f, 0xa1, 0xa4,
+	0x7b, 0x6a, 0x18, 0xe6, 0xeb, 0x98, 0xe8, 0x37, 0x87, 0x9c, 0xa0, 0xe7, 0xa9, 0x11, 0x5e, 0x22,
+	0xd8, 0x3f, 0x23, 0xce, 0x9d, 0xe4, 0xa8, 0x7e, 0x9f, 0x63, 0x28, 0xc9, 0x30, 0xf8, 0x04, 0x36,
+	0x02, 0x18, 0x83, 0xb2, 0xec, 0x8c, 0x2d, 0x64, 0x87, 0xed, 0xf8, 0x14, 0xb6, 0xa2, 0x55, 0x98,
+	0xf5, 0x15, 0xd6, 0x68, 0x95, 0xd0, 0xba, 0x30, 0x70, 0xcf, 0x11, 0xd4, 0xbc, 0x1d, 0xce, 0x4b,
+	0xd4, 0xce, 0x24, 0xfa, 0x2e, 0xc6, 0x26, 0x2c, 0x99, 0x34, 0xbf, 0x2f, 0xa5, 0xa9, 0x2d, 0xdb,
+	0xf2, 0xb3, 0xbc, 0x46, 0x70, 0x90, 0xc9, 0x72, 0x45, 0x89, 0x23, 0xe9, 0xda, 0xdf, 0xfe, 0x71,
+	0xc7, 0x7f, 0xc2, 0x8e, 0x77, 0x76, 0x54, 0xf1, 0xcb, 0x63, 0x95, 0x69, 0x2c, 0xe1, 0x3e, 0xec,
+	0xba, 0x01, 0x50, 0x0c, 0x06, 0x68, 0x91, 0x30, 0x1a, 0xac, 0x66, 0x6a, 0xc1, 0x90, 0xf1, 0x95,
+	0x9b, 0x14, 0xb9, 0xb7, 0x08, 0x2a, 0x1d, 0x5d, 0x77, 0x34, 0x5d, 0xa2, 0x09, 0x74, 0x7a, 0xaf,
+	0x7e, 0xca, 0x0d, 0xb5, 0xf4, 0x4a, 0x99, 0xcd, 0x3b, 0x82, 0x1d, 0xcd, 0x52, 0x88, 0xaa, 0x89,
+	0x96, 0x64, 0x91, 0xe0, 0x94, 0x15, 0xf8, 0x72, 0xa0, 0x8d, 0x3d, 0x09, 0xb3, 0x00, 0x92, 0x65,
+	0x11, 0x2a, 0x51, 0x83, 0x58, 0x4c, 0xe1, 0x10, 0x35, 0x76, 0xf8, 0x84, 0x82, 0x1b, 0x50, 0x71,
+	0x95, 0xa9, 0x66, 0x4a, 0xa2, 0xaa, 0xd9, 0xb7, 0x64, 0x2e, 0x1a, 0x2a, 0x53, 0x3c, 0x44, 0x8d,
+	0x6d, 0x7e, 0x37, 0xd0, 0xfb, 0xbe, 0x3c, 0x52, 0xb9, 0x77, 0x25, 0xf8, 0x76, 0xf9, 0xab, 0xbb,
+	0xf8, 0x37, 0x28, 0xd2, 0xb9, 0x1d, 0xcc, 0xc4, 0xee, 0x31, 0x17, 0xbf, 0x48, 0x4e, 0x73, 0x53,
+	0x98, 0xdb, 0x1a, 0xef, 0xf7, 0x63, 0x01, 0xf6, 0xc2, 0x5b, 0x44, 0xbc, 0x33, 0xe8, 0x54, 0xcc,
+	0x0e, 0x0b, 0xbb, 0x74, 0xf9, 0xa4, 0x50, 0x7c, 0x55, 0xc9, 0x51, 0xf1, 0xbf, 0x50, 0x4f, 0xdc,
+	0x1a, 0x59, 0x72, 0xc1, 0x27, 0x1f, 0xe5, 0x5d, 0x22, 0x69, 0x78, 0x4d, 0xce, 0x2f, 0xe0, 0x31,
+	0x54, 0xfd, 0xf1, 0xce, 0x92, 0x8b, 0x3e, 0xf9, 0x20, 0x73, 0x23, 0xa4, 0xa1, 0x58, 0x5f, 0xd2,
+	0xf0, 0x7f, 0xc0, 0xde, 0x44, 0xe3, 0x1a, 0x9e, 0xd3, 0x34, 0x9a, 0x29, 0xf9, 0xe4, 0x1f, 0x57,
+	0x8e, 0x77, 0x92, 0xc7, 0xef, 0xdf, 0xac, 0x2e, 0x7a, 0x7b, 0x93, 0x9c, 0x87, 0xcc, 0x3a, 0x1b,
+	0xd9, 0xbd, 0x59, 0x31, 0xe7, 0x7c, 0x8d, 0xe6, 0x17, 0xb8, 0x37, 0x08, 0x8a, 0xde, 0x07, 0xc6,
+	0x65, 0xd8, 0xbc, 0x1e, 0xff, 0x35, 0xbe, 0x9c, 0x8c, 0x2b, 0x6b, 0xb8, 0x0e, 0x7b, 0xbd, 0xcb,
+	0xeb, 0xb1, 0x30, 0xe0, 0xc5, 0xc9, 0x48, 0x38, 0x17, 0x2f, 0x06, 0x42, 0xa7, 0xdf, 0x11, 0x3a,
+	0x57, 0x15, 0x84, 0x59, 0xa8, 0x77, 0x3b, 0x42, 0xef, 0x5c, 0x14, 0x46, 0x17, 0xcb, 0xf5, 0x75,
+	0xcc, 0x40, 0x75, 0xd8, 0xb9, 0x1e, 0x0e, 0xb2, 0x95, 0x02, 0xe6, 0x80, 0x3d, 0xbb, 0xe4, 0x27,
+	0x1d, 0xbe, 0x3f, 0xe8, 0x7b, 0x05, 0x7e, 0xd4, 0x4b, 0x37, 0x55, 0x8a, 0x1e, 0xdd, 0xe3, 0xae,
+	0xa8, 0x97, 0xba, 0xa3, 0xfb, 0x07, 0x16, 0xbd, 0x7f, 0x60, 0xd1, 0xc7, 0x07, 0x16, 0xbd, 0xf8,
+	0xc4, 0xae, 0xfd, 0x73, 0xf2, 0xc8, 0x3f, 0x6a, 0x79, 0xc3, 0xff, 0xdd, 0xfe, 0x3c, 0x00, 0x6b,
+	0xf0, 0x72, 0xc0, 0xb2, 0x08, 0x00, 0x00,
 }
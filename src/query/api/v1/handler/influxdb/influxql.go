@@ -0,0 +1,377 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package influxdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// influxQuery is the parsed form of the subset of InfluxQL supported by the
+// query handler:
+//
+//   SELECT <field> FROM <measurement>
+//   WHERE time >= <time> [AND time <= <time>] [AND <tag> = '<value>' ...]
+//
+// where <time> is either an RFC3339 string literal, an integer epoch with an
+// optional precision suffix (nanoseconds by default), or now() optionally
+// offset by a duration literal (e.g. now() - 1h).
+type influxQuery struct {
+	measurement string
+	field       string
+	tags        []influxTagFilter
+	start       time.Time
+	end         time.Time
+}
+
+type influxTagFilter struct {
+	name  string
+	value string
+}
+
+type influxTokenType int
+
+const (
+	influxTokenEOF influxTokenType = iota
+	influxTokenIdent
+	influxTokenString
+	influxTokenNumber
+	influxTokenOperator
+)
+
+type influxToken struct {
+	typ influxTokenType
+	val string
+}
+
+var influxDurationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+func parseInfluxQuery(q string, now time.Time) (influxQuery, error) {
+	tokens, err := tokenizeInfluxQuery(q)
+	if err != nil {
+		return influxQuery{}, err
+	}
+
+	p := &influxQueryParser{tokens: tokens, now: now}
+	query, err := p.parse()
+	if err != nil {
+		return influxQuery{}, fmt.Errorf("unable to parse query %q: %v", q, err)
+	}
+	return query, nil
+}
+
+type influxQueryParser struct {
+	tokens []influxToken
+	pos    int
+	now    time.Time
+}
+
+func (p *influxQueryParser) parse() (influxQuery, error) {
+	var query influxQuery
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return query, err
+	}
+	field, err := p.expectIdent()
+	if err != nil {
+		return query, err
+	}
+	query.field = field
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return query, err
+	}
+	measurement, err := p.expectIdent()
+	if err != nil {
+		return query, err
+	}
+	query.measurement = measurement
+
+	if p.acceptKeyword("WHERE") {
+		for {
+			if err := p.parseCondition(&query); err != nil {
+				return query, err
+			}
+			if !p.acceptKeyword("AND") {
+				break
+			}
+		}
+	}
+
+	p.acceptOperator(";")
+	if tok := p.next(); tok.typ != influxTokenEOF {
+		return query, fmt.Errorf("unexpected token: %s", tok.val)
+	}
+
+	if query.start.IsZero() {
+		return query, fmt.Errorf("a lower bound on time is required")
+	}
+	if query.end.IsZero() {
+		query.end = p.now
+	}
+	if !query.start.Before(query.end) {
+		return query, fmt.Errorf("time range start %v is not before end %v", query.start, query.end)
+	}
+	return query, nil
+}
+
+func (p *influxQueryParser) parseCondition(query *influxQuery) error {
+	name, err := p.expectIdent()
+	if err != nil {
+		return err
+	}
+
+	op := p.next()
+	if op.typ != influxTokenOperator {
+		return fmt.Errorf("expected comparison operator, got: %s", op.val)
+	}
+
+	if !strings.EqualFold(name, "time") {
+		if op.val != "=" {
+			return fmt.Errorf("only equality is supported for tag %s, got: %s", name, op.val)
+		}
+		value := p.next()
+		if value.typ != influxTokenString {
+			return fmt.Errorf("expected string literal for tag %s, got: %s", name, value.val)
+		}
+		query.tags = append(query.tags, influxTagFilter{name: name, value: value.val})
+		return nil
+	}
+
+	t, err := p.parseTime()
+	if err != nil {
+		return err
+	}
+	switch op.val {
+	case ">":
+		query.start = t.Add(time.Nanosecond)
+	case ">=":
+		query.start = t
+	case "<":
+		query.end = t.Add(-time.Nanosecond)
+	case "<=":
+		query.end = t
+	case "=":
+		query.start, query.end = t, t.Add(time.Nanosecond)
+	default:
+		return fmt.Errorf("unsupported time comparison operator: %s", op.val)
+	}
+	return nil
+}
+
+func (p *influxQueryParser) parseTime() (time.Time, error) {
+	tok := p.next()
+	switch tok.typ {
+	case influxTokenString:
+		t, err := time.Parse(time.RFC3339Nano, tok.val)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time literal: %v", err)
+		}
+		return t, nil
+	case influxTokenNumber:
+		d, err := parseInfluxDuration(tok.val, time.Nanosecond)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(d)), nil
+	case influxTokenIdent:
+		if !strings.EqualFold(tok.val, "now") || !p.acceptOperator("(") || !p.acceptOperator(")") {
+			return time.Time{}, fmt.Errorf("unexpected time expression: %s", tok.val)
+		}
+		t := p.now
+		for {
+			var sign time.Duration
+			switch {
+			case p.acceptOperator("-"):
+				sign = -1
+			case p.acceptOperator("+"):
+				sign = 1
+			default:
+				return t, nil
+			}
+			offset := p.next()
+			if offset.typ != influxTokenNumber {
+				return time.Time{}, fmt.Errorf("expected duration, got: %s", offset.val)
+			}
+			d, err := parseInfluxDuration(offset.val, 0)
+			if err != nil {
+				return time.Time{}, err
+			}
+			t = t.Add(sign * d)
+		}
+	default:
+		return time.Time{}, fmt.Errorf("expected time, got: %s", tok.val)
+	}
+}
+
+// parseInfluxDuration parses an integer with an optional unit suffix, if the
+// default unit is zero then the suffix is required.
+func parseInfluxDuration(s string, defaultUnit time.Duration) (time.Duration, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+	num, suffix := s, ""
+	if i >= 0 {
+		num, suffix = s[:i], s[i:]
+	}
+
+	unit := defaultUnit
+	if suffix != "" {
+		var ok bool
+		if unit, ok = influxDurationUnits[suffix]; !ok {
+			return 0, fmt.Errorf("invalid duration unit: %s", s)
+		}
+	}
+	if unit == 0 {
+		return 0, fmt.Errorf("duration requires a unit: %s", s)
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func (p *influxQueryParser) next() influxToken {
+	if p.pos >= len(p.tokens) {
+		return influxToken{typ: influxTokenEOF, val: "EOF"}
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	return tok
+}
+
+func (p *influxQueryParser) peek() influxToken {
+	if p.pos >= len(p.tokens) {
+		return influxToken{typ: influxTokenEOF, val: "EOF"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *influxQueryParser) acceptKeyword(keyword string) bool {
+	if tok := p.peek(); tok.typ == influxTokenIdent && strings.EqualFold(tok.val, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *influxQueryParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return fmt.Errorf("expected %s, got: %s", keyword, p.peek().val)
+	}
+	return nil
+}
+
+func (p *influxQueryParser) acceptOperator(op string) bool {
+	if tok := p.peek(); tok.typ == influxTokenOperator && tok.val == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *influxQueryParser) expectIdent() (string, error) {
+	tok := p.next()
+	if tok.typ != influxTokenIdent {
+		return "", fmt.Errorf("expected identifier, got: %s", tok.val)
+	}
+	return tok.val, nil
+}
+
+func tokenizeInfluxQuery(q string) ([]influxToken, error) {
+	var (
+		tokens []influxToken
+		runes  = []rune(q)
+	)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			// Double quoted identifiers and single quoted string literals.
+			var (
+				sb     strings.Builder
+				closed bool
+			)
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					sb.WriteRune(runes[i])
+					continue
+				}
+				if runes[i] == r {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted string in query: %s", q)
+			}
+			typ := influxTokenString
+			if r == '"' {
+				typ = influxTokenIdent
+			}
+			tokens = append(tokens, influxToken{typ: typ, val: sb.String()})
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || unicode.IsLetter(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, influxToken{typ: influxTokenNumber, val: string(runes[start:i])})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) ||
+				runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, influxToken{typ: influxTokenIdent, val: string(runes[start:i])})
+		case r == '>' || r == '<':
+			op := string(r)
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				op += "="
+				i++
+			}
+			tokens = append(tokens, influxToken{typ: influxTokenOperator, val: op})
+		case strings.ContainsRune("=+-();", r):
+			tokens = append(tokens, influxToken{typ: influxTokenOperator, val: string(r)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q in query: %s", r, q)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/m3db/m3/src/query/api/v1/handler"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
+	"github.com/m3db/m3/src/query/api/v1/options"
+	"github.com/m3db/m3/src/query/executor"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/util/logging"
+	"github.com/m3db/m3/src/x/clock"
+	"github.com/m3db/m3/src/x/instrument"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// InfluxQueryURL is the Influx DB query handler URL
+	InfluxQueryURL = handler.RoutePrefixV1 + "/influxdb/query"
+
+	queryParam = "q"
+	epochParam = "epoch"
+)
+
+var (
+	// InfluxQueryHTTPMethods are the HTTP methods used with this resource
+	InfluxQueryHTTPMethods = []string{
+		http.MethodGet,
+		http.MethodPost,
+	}
+
+	errMissingQuery = errors.New("missing required parameter \"q\"")
+
+	epochPrecisions = map[string]time.Duration{
+		"ns": time.Nanosecond,
+		"u":  time.Microsecond,
+		"µ":  time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	}
+)
+
+type queryHandler struct {
+	engine              executor.Engine
+	fetchOptionsBuilder handleroptions.FetchOptionsBuilder
+	tagOpts             models.TagOptions
+	promRewriter        *promRewriter
+	nowFn               clock.NowFn
+	instrumentOpts      instrument.Options
+}
+
+// queryResponse mirrors the JSON response shape of the InfluxDB query endpoint.
+type queryResponse struct {
+	Results []queryResult `json:"results"`
+}
+
+type queryResult struct {
+	StatementID int           `json:"statement_id"`
+	Series      []querySeries `json:"series,omitempty"`
+}
+
+type querySeries struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+// NewInfluxQueryHandler returns a handler which serves a minimal subset of
+// InfluxQL SELECT statements (a single field of a single measurement within a
+// time range, optionally filtered by tag equality) from M3. Measurement, field
+// and tag names are mapped to M3 series the same way as on the write path.
+func NewInfluxQueryHandler(opts options.HandlerOptions) http.Handler {
+	return &queryHandler{
+		engine:              opts.Engine(),
+		fetchOptionsBuilder: opts.FetchOptionsBuilder(),
+		tagOpts:             opts.TagOptions(),
+		promRewriter:        newPromRewriter(),
+		nowFn:               opts.NowFn(),
+		instrumentOpts:      opts.InstrumentOpts(),
+	}
+}
+
+func (h *queryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), handler.HeaderKey, r.Header)
+	logger := logging.WithContext(ctx, h.instrumentOpts)
+
+	q := r.FormValue(queryParam)
+	if q == "" {
+		xhttp.Error(w, errMissingQuery, http.StatusBadRequest)
+		return
+	}
+
+	var precision time.Duration
+	if epoch := r.FormValue(epochParam); epoch != "" {
+		var ok bool
+		if precision, ok = epochPrecisions[epoch]; !ok {
+			xhttp.Error(w, fmt.Errorf("invalid epoch: %s", epoch), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query, err := parseInfluxQuery(q, h.nowFn())
+	if err != nil {
+		xhttp.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	fetchOpts, rErr := h.fetchOptionsBuilder.NewFetchOptions(r)
+	if rErr != nil {
+		xhttp.Error(w, rErr.Inner(), rErr.Code())
+		return
+	}
+
+	fetchQuery, err := h.fetchQuery(q, query)
+	if err != nil {
+		xhttp.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	queryOpts := &executor.QueryOptions{
+		QueryContextOptions: models.QueryContextOptions{
+			LimitMaxTimeseries: fetchOpts.Limit,
+		}}
+	result, err := h.engine.ExecuteProm(ctx, fetchQuery, queryOpts, fetchOpts)
+	if err != nil {
+		logger.Error("unable to fetch data", zap.Error(err))
+		xhttp.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	handleroptions.AddWarningHeaders(w, result.Metadata)
+	// Stream the response so that large results are compressed as they are
+	// encoded when the client accepts a compressed response.
+	xhttp.StreamJSONResponse(w, h.newQueryResponse(query, result, precision), logger)
+}
+
+func (h *queryHandler) fetchQuery(raw string, query influxQuery) (*storage.FetchQuery, error) {
+	name := make([]byte, 0, len(query.measurement)+1+len(query.field))
+	name = append(name, query.measurement...)
+	name = append(name, byte('_'))
+	h.promRewriter.rewriteMetric(name)
+	tail := []byte(query.field)
+	h.promRewriter.rewriteMetricTail(tail)
+	name = append(name, tail...)
+
+	nameMatcher, err := models.NewMatcher(models.MatchEqual, h.tagOpts.MetricName(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := models.Matchers{nameMatcher}
+	for _, tag := range query.tags {
+		tagName := []byte(tag.name)
+		h.promRewriter.rewriteLabel(tagName)
+		matcher, err := models.NewMatcher(models.MatchEqual, tagName, []byte(tag.value))
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return &storage.FetchQuery{
+		Raw:         raw,
+		TagMatchers: matchers,
+		Start:       query.start,
+		End:         query.end,
+	}, nil
+}
+
+func (h *queryHandler) newQueryResponse(
+	query influxQuery,
+	result storage.PromResult,
+	precision time.Duration,
+) queryResponse {
+	var series []querySeries
+	if result.PromResult != nil {
+		series = make([]querySeries, 0, len(result.PromResult.Timeseries))
+		for _, ts := range result.PromResult.Timeseries {
+			if ts == nil || len(ts.Samples) == 0 {
+				continue
+			}
+
+			s := querySeries{
+				Name:    query.measurement,
+				Columns: []string{"time", query.field},
+				Values:  make([][]interface{}, 0, len(ts.Samples)),
+			}
+			for _, label := range ts.Labels {
+				if bytes.Equal(label.Name, h.tagOpts.MetricName()) {
+					continue
+				}
+				if s.Tags == nil {
+					s.Tags = make(map[string]string, len(ts.Labels))
+				}
+				s.Tags[string(label.Name)] = string(label.Value)
+			}
+			for _, sample := range ts.Samples {
+				t := time.Unix(0, sample.Timestamp*int64(time.Millisecond)).UTC()
+				var formatted interface{} = t.Format(time.RFC3339Nano)
+				if precision > 0 {
+					formatted = t.UnixNano() / int64(precision)
+				}
+				s.Values = append(s.Values, []interface{}{formatted, sample.Value})
+			}
+			series = append(series, s)
+		}
+	}
+
+	return queryResponse{
+		Results: []queryResult{{StatementID: 0, Series: series}},
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package influxdb
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
+	"github.com/m3db/m3/src/query/api/v1/options"
+	"github.com/m3db/m3/src/query/executor"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/prometheus/util/httputil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInfluxQuery(t *testing.T) {
+	now := time.Unix(1574838670, 0)
+	for _, tc := range []struct {
+		query    string
+		expected influxQuery
+	}{
+		{
+			query: `SELECT usage FROM cpu WHERE time >= now() - 1h`,
+			expected: influxQuery{
+				measurement: "cpu", field: "usage",
+				start: now.Add(-time.Hour), end: now,
+			},
+		},
+		{
+			query: `select "usage idle" from "cpu" where time > 1574838670000ms and time <= '2019-11-27T08:11:10Z' and "host" = 'a\'b';`,
+			expected: influxQuery{
+				measurement: "cpu", field: "usage idle",
+				tags:  []influxTagFilter{{name: "host", value: "a'b"}},
+				start: time.Unix(1574838670, 0).Add(time.Nanosecond),
+				end:   time.Date(2019, 11, 27, 8, 11, 10, 0, time.UTC),
+			},
+		},
+		{
+			query: `SELECT v FROM m WHERE time >= 1574838600000000000 AND time < now() - 1m + 30s`,
+			expected: influxQuery{
+				measurement: "m", field: "v",
+				start: time.Unix(1574838600, 0),
+				end:   now.Add(-30 * time.Second).Add(-time.Nanosecond),
+			},
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			actual, err := parseInfluxQuery(tc.query, now)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected.measurement, actual.measurement)
+			assert.Equal(t, tc.expected.field, actual.field)
+			assert.Equal(t, tc.expected.tags, actual.tags)
+			assert.True(t, tc.expected.start.Equal(actual.start), "start: %v", actual.start)
+			assert.True(t, tc.expected.end.Equal(actual.end), "end: %v", actual.end)
+		})
+	}
+}
+
+func TestParseInfluxQueryErrors(t *testing.T) {
+	now := time.Unix(1574838670, 0)
+	for _, query := range []string{
+		`SELECT usage FROM cpu`,
+		`SELECT usage, idle FROM cpu WHERE time >= now() - 1h`,
+		`SELECT usage FROM cpu WHERE time >= now() - 1`,
+		`SELECT usage FROM cpu WHERE time >= now() - 1h AND host != 'a'`,
+		`SELECT usage FROM cpu WHERE time >= now() - 1h AND host = 1`,
+		`SELECT usage FROM cpu WHERE time >= now() + 1h`,
+		`SELECT usage FROM 'cpu WHERE time >= now() - 1h`,
+		`SHOW MEASUREMENTS`,
+	} {
+		_, err := parseInfluxQuery(query, now)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestInfluxQueryHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now     = time.Unix(1574838670, 0)
+		tagOpts = models.NewTagOptions()
+		engine  = executor.NewMockEngine(ctrl)
+	)
+	engine.EXPECT().
+		ExecuteProm(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Times(2).
+		DoAndReturn(func(
+			_ interface{},
+			query *storage.FetchQuery,
+			_ *executor.QueryOptions,
+			_ *storage.FetchOptions,
+		) (storage.PromResult, error) {
+			require.Equal(t, 2, len(query.TagMatchers))
+			assert.Equal(t, "__name__", string(query.TagMatchers[0].Name))
+			assert.Equal(t, "cpu_usage_idle", string(query.TagMatchers[0].Value))
+			assert.Equal(t, "host_name", string(query.TagMatchers[1].Name))
+			assert.Equal(t, "a", string(query.TagMatchers[1].Value))
+			assert.True(t, now.Add(-time.Hour).Equal(query.Start))
+			assert.True(t, now.Equal(query.End))
+
+			return storage.PromResult{
+				PromResult: &prompb.QueryResult{
+					Timeseries: []*prompb.TimeSeries{
+						{
+							Labels: []prompb.Label{
+								{Name: []byte("__name__"), Value: []byte("cpu_usage_idle")},
+								{Name: []byte("host_name"), Value: []byte("a")},
+							},
+							Samples: []prompb.Sample{
+								{Timestamp: now.Add(-time.Minute).UnixNano() / int64(time.Millisecond), Value: 1},
+								{Timestamp: now.UnixNano() / int64(time.Millisecond), Value: 2},
+							},
+						},
+					},
+				},
+			}, nil
+		})
+
+	opts := options.EmptyHandlerOptions().
+		SetEngine(engine).
+		SetTagOptions(tagOpts).
+		SetNowFn(func() time.Time { return now }).
+		SetFetchOptionsBuilder(handleroptions.NewFetchOptionsBuilder(
+			handleroptions.FetchOptionsBuilderOptions{}))
+	// Responses are compressed by the middleware that wraps all the routes.
+	h := httputil.CompressionHandler{Handler: NewInfluxQueryHandler(opts)}
+
+	params := url.Values{}
+	params.Set("q", `SELECT "usage.idle" FROM cpu WHERE time >= now() - 1h AND "host-name" = 'a'`)
+	params.Set("epoch", "s")
+	for _, acceptGzip := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, InfluxQueryURL+"?"+params.Encode(), nil)
+		if acceptGzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		body := recorder.Body.Bytes()
+		if acceptGzip {
+			require.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+			reader, err := gzip.NewReader(recorder.Body)
+			require.NoError(t, err)
+			body, err = ioutil.ReadAll(reader)
+			require.NoError(t, err)
+		}
+		assert.JSONEq(t, `{"results":[{"statement_id":0,"series":[{
+			"name":"cpu",
+			"tags":{"host_name":"a"},
+			"columns":["time","usage.idle"],
+			"values":[[1574838610,1],[1574838670,2]]
+		}]}]}`, string(body))
+	}
+}
+
+func TestInfluxQueryHandlerBadRequest(t *testing.T) {
+	h := NewInfluxQueryHandler(options.EmptyHandlerOptions())
+	for _, target := range []string{
+		InfluxQueryURL,
+		InfluxQueryURL + "?q=" + url.QueryEscape("SELECT x FROM y"),
+		InfluxQueryURL + "?epoch=foo&q=" + url.QueryEscape("SELECT x FROM y WHERE time > now() - 1h"),
+	} {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, target)
+	}
+}
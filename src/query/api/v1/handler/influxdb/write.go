@@ -26,11 +26,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
 	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3/src/metrics/policy"
 	"github.com/m3db/m3/src/query/api/v1/handler"
 	"github.com/m3db/m3/src/query/api/v1/options"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
 	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3/src/query/ts"
 	"github.com/m3db/m3/src/query/util/logging"
@@ -38,10 +43,33 @@ import (
 	xerrors "github.com/m3db/m3/src/x/errors"
 	xhttp "github.com/m3db/m3/src/x/net/http"
 	xtime "github.com/m3db/m3/src/x/time"
+	"github.com/gorilla/mux"
 	imodels "github.com/influxdata/influxdb/models"
+	"github.com/uber-go/tally"
 	"go.uber.org/zap"
 )
 
+var errEmptyMeasurement = errors.New("empty measurement")
+
+var errTimestampOutOfBounds = errors.New("timestamp out of bounds")
+
+var errUnknownPathNamespace = errors.New("unknown namespace in path")
+
+var _ ingest.DownsampleMappingRulesIter = &ingestIterator{}
+
+const (
+	// influxMeasurementLabel is the annotation label of the original measurement
+	// of a point when original names are preserved.
+	influxMeasurementLabel = "__influx_measurement__"
+	// influxFieldLabel is the annotation label of the original key of the field
+	// that a datapoint was written from when original names are preserved.
+	influxFieldLabel = "__influx_field__"
+	// influxTagKeyLabelPrefix prefixes the rewritten tag names in the annotation
+	// labels of the original keys of the tags that were changed by rewriting
+	// when original names are preserved.
+	influxTagKeyLabelPrefix = "__influx_tag_key__"
+)
+
 const (
 	// InfluxWriteURL is the Influx DB write handler URL
 	InfluxWriteURL = handler.RoutePrefixV1 + "/influxdb/write"
@@ -50,41 +78,168 @@ const (
 	InfluxWriteHTTPMethod = http.MethodPost
 )
 
+// InfluxWritePathURL returns the Influx DB write handler URL followed by the
+// given path segments as route variables, e.g. /write/{org}/{bucket}.
+func InfluxWritePathURL(segments []string) string {
+	var b strings.Builder
+	b.WriteString(InfluxWriteURL)
+	for _, segment := range segments {
+		b.WriteString("/{")
+		b.WriteString(segment)
+		b.WriteString("}")
+	}
+	return b.String()
+}
+
 type ingestWriteHandler struct {
-	handlerOpts  options.HandlerOptions
-	tagOpts      models.TagOptions
-	promRewriter *promRewriter
+	handlerOpts          options.HandlerOptions
+	tagOpts              models.TagOptions
+	promRewriter         *promRewriter
+	partialWrites        bool
+	emptyMeasurementName []byte
+	exemplarTags         [][]byte
+	preserveNames        bool
+	maxFutureSkew        time.Duration
+	maxPastAge           time.Duration
+	// pathTagSegments are the path segments whose values are added as tags,
+	// pathTagNames are the (rewritten) names of those tags.
+	pathTagSegments []string
+	pathTagNames    [][]byte
+	// namespaceSegment is the path segment that selects the storage policy
+	// from namespaces that writes go to, if any.
+	namespaceSegment string
+	namespaces       map[string]policy.StoragePolicy
+	// measurementRules are the mapping rules that the datapoints of the
+	// points of each measurement are downsampled with.
+	measurementRules map[string][]downsample.AutoMappingRule
+	metrics          influxWriteMetrics
+}
+
+type influxWriteMetrics struct {
+	// batchSize is the number of points in each write request.
+	batchSize tally.Histogram
+	// droppedNoValues is the number of points that were dropped because none
+	// of their fields have numeric values.
+	droppedNoValues tally.Counter
+	// droppedEmptyMeasurement is the number of points that were dropped
+	// because their measurement is empty and no fallback is configured.
+	droppedEmptyMeasurement tally.Counter
+	// droppedTimestampOutOfBounds is the number of points that were dropped
+	// because their timestamp is too far in the future or in the past.
+	droppedTimestampOutOfBounds tally.Counter
+}
+
+func newInfluxWriteMetrics(scope tally.Scope) influxWriteMetrics {
+	return influxWriteMetrics{
+		batchSize: scope.SubScope("write").Histogram("batch-size",
+			tally.MustMakeExponentialValueBuckets(1, 2, 17)),
+		droppedNoValues: scope.SubScope("write").
+			Tagged(map[string]string{"reason": "no-values"}).
+			Counter("dropped"),
+		droppedEmptyMeasurement: scope.SubScope("write").
+			Tagged(map[string]string{"reason": "empty-measurement"}).
+			Counter("dropped"),
+		droppedTimestampOutOfBounds: scope.SubScope("write").
+			Tagged(map[string]string{"reason": "timestamp-out-of-bounds"}).
+			Counter("dropped"),
+	}
 }
 
 type ingestField struct {
 	name  []byte // to be stored in __name__; rest of tags stay constant for the Point
+	key   []byte // original field key, used to report name collisions
 	value float64
+	// annotation is the marshalled prompb.Labels of the exemplar labels and the
+	// original names of the point and the field, only set if original names are
+	// preserved.
+	annotation []byte
 }
 
 type ingestIterator struct {
 	// what is being iterated (comes from outside)
-	points       []imodels.Point
-	tagOpts      models.TagOptions
-	promRewriter *promRewriter
+	points        []imodels.Point
+	tagOpts       models.TagOptions
+	promRewriter  *promRewriter
+	partialWrites bool
+	// emptyMeasurementName replaces empty measurements when set, otherwise
+	// points with an empty measurement are invalid.
+	emptyMeasurementName []byte
+	// exemplarTags are the keys of the tags that are encoded into the annotation
+	// of the datapoints as exemplar labels rather than added to the series tags.
+	exemplarTags [][]byte
+	// preserveNames is whether the original (pre-rewrite) measurement, field
+	// key and tag keys are encoded into the annotation of the datapoints.
+	preserveNames bool
+	// minTimestamp and maxTimestamp bound the timestamps of valid points, a
+	// zero value means the timestamps are not bounded in that direction.
+	minTimestamp time.Time
+	maxTimestamp time.Time
+	// pathTags are the tags extracted from the path segments of the request
+	// that are added to every series.
+	pathTags []models.Tag
+	// measurementRules are the mapping rules that the datapoints of the points
+	// of each measurement are downsampled with, in place of those of the write.
+	measurementRules map[string][]downsample.AutoMappingRule
 
 	// internal
 	pointIndex int
 	err        xerrors.MultiError
+	// invalidPoints holds the first error of each invalid point by index, it is
+	// not cleared on Reset so that points are only counted once when the batch
+	// is iterated more than once (e.g. when downsampling).
+	invalidPoints map[int]error
+	// pointsWithoutValues holds the indexes of the valid points that have no
+	// fields with numeric values (e.g. only string fields) and so are dropped,
+	// it's not cleared on Reset for the same reason as invalidPoints.
+	pointsWithoutValues map[int]struct{}
+	// numEmptyMeasurement is the number of points dropped because their
+	// measurement is empty.
+	numEmptyMeasurement int
+	// numTimestampOutOfBounds is the number of points dropped because their
+	// timestamp is out of bounds.
+	numTimestampOutOfBounds int
 
 	// following entries are within current point, and initialized
 	// when we go to the first entry in the current point
-	fields         []*ingestField
+	fields         []ingestField
 	nextFieldIndex int
 	tags           models.Tags
+	nameIndex      int
+	// exemplar is the marshalled prompb.Labels of the exemplar tags of the
+	// point, nil if it has none.
+	exemplar []byte
+	// mappingRules are the mapping rules of the measurement of the point, nil
+	// if it has none.
+	mappingRules []downsample.AutoMappingRule
 }
 
 func (ii *ingestIterator) populateFields() bool {
 	point := ii.points[ii.pointIndex]
 	it := point.FieldIterator()
 	n := 0
-	ii.fields = make([]*ingestField, 0, 10)
-	bname := make([]byte, 0, len(point.Name())+1)
-	bname = append(bname, point.Name()...)
+	ii.fields = ii.fields[:0]
+	measurement := point.Name()
+	if len(measurement) == 0 {
+		if len(ii.emptyMeasurementName) == 0 {
+			if _, ok := ii.invalidPoints[ii.pointIndex]; !ok {
+				ii.numEmptyMeasurement++
+			}
+			ii.addPointError(errEmptyMeasurement)
+			return false
+		}
+		measurement = ii.emptyMeasurementName
+	}
+	ii.mappingRules = ii.measurementRules[string(measurement)]
+	if t := point.Time(); (!ii.minTimestamp.IsZero() && t.Before(ii.minTimestamp)) ||
+		(!ii.maxTimestamp.IsZero() && t.After(ii.maxTimestamp)) {
+		if _, ok := ii.invalidPoints[ii.pointIndex]; !ok {
+			ii.numTimestampOutOfBounds++
+		}
+		ii.addPointError(fmt.Errorf("%v: %v", errTimestampOutOfBounds, t))
+		return false
+	}
+	bname := make([]byte, 0, len(measurement)+1)
+	bname = append(bname, measurement...)
 	bname = append(bname, byte('_'))
 	bnamelen := len(bname)
 	ii.promRewriter.rewriteMetric(bname)
@@ -95,7 +250,7 @@ func (ii *ingestIterator) populateFields() bool {
 		case imodels.Boolean:
 			v, err := it.BooleanValue()
 			if err != nil {
-				ii.err = ii.err.Add(err)
+				ii.addPointError(err)
 				continue
 			}
 			if v {
@@ -104,21 +259,21 @@ func (ii *ingestIterator) populateFields() bool {
 		case imodels.Integer:
 			v, err := it.IntegerValue()
 			if err != nil {
-				ii.err = ii.err.Add(err)
+				ii.addPointError(err)
 				continue
 			}
 			value = float64(v)
 		case imodels.Unsigned:
 			v, err := it.UnsignedValue()
 			if err != nil {
-				ii.err = ii.err.Add(err)
+				ii.addPointError(err)
 				continue
 			}
 			value = float64(v)
 		case imodels.Float:
 			v, err := it.FloatValue()
 			if err != nil {
-				ii.err = ii.err.Add(err)
+				ii.addPointError(err)
 				continue
 			}
 			value = v
@@ -133,48 +288,177 @@ func (ii *ingestIterator) populateFields() bool {
 		name = append(name, bname...)
 		name = append(name, tail...)
 		ii.promRewriter.rewriteMetricTail(name[bnamelen:])
-		ii.fields = append(ii.fields, &ingestField{name: name, value: value})
+		// Distinct field keys can be rewritten to the same metric name (e.g.
+		// foo.bar and foo/bar), drop the whole point rather than silently
+		// writing the values of both fields to the same series.
+		for i := range ii.fields {
+			if bytes.Equal(ii.fields[i].name, name) {
+				ii.addPointError(fmt.Errorf(
+					"non-unique Prometheus metric name %s for fields %s and %s",
+					name, ii.fields[i].key, tail))
+				ii.fields = ii.fields[:0]
+				return false
+			}
+		}
+		ii.fields = append(ii.fields, ingestField{name: name, key: tail, value: value})
 	}
 	return n > 0
 }
 
+// addPointError records an error for the current point, annotated with its
+// position amongst the points of the batch as well as its original measurement
+// name to make it easier to track down bad writes. The position is not a line
+// number since blank and comment lines are not points, and a string field value
+// may span several lines.
+//
+// In partial write mode the error does not fail the batch, instead the point is
+// recorded as invalid and reported once the valid points have been written.
+func (ii *ingestIterator) addPointError(err error) {
+	point := ii.points[ii.pointIndex]
+	err = fmt.Errorf("point %d (measurement %s): %v",
+		ii.pointIndex+1, point.Name(), err)
+	if ii.invalidPoints == nil {
+		ii.invalidPoints = make(map[int]error)
+	}
+	if _, ok := ii.invalidPoints[ii.pointIndex]; !ok {
+		ii.invalidPoints[ii.pointIndex] = err
+	}
+	if ii.partialWrites {
+		return
+	}
+	ii.err = ii.err.Add(err)
+}
+
+// partialWriteError returns an error describing the points that were dropped
+// from the batch, or nil if all points were valid.
+func (ii *ingestIterator) partialWriteError() error {
+	if len(ii.invalidPoints) == 0 {
+		return nil
+	}
+	first := -1
+	for idx := range ii.invalidPoints {
+		if first < 0 || idx < first {
+			first = idx
+		}
+	}
+	return fmt.Errorf("partial write: %v dropped=%d",
+		ii.invalidPoints[first], len(ii.invalidPoints))
+}
+
+// populateTags builds the rewritten tag set of the current point once, with a
+// placeholder for the metric name, so that emitting each of the point's fields
+// only needs to set the name rather than re-rewriting and re-sorting the tags.
+func (ii *ingestIterator) populateTags() bool {
+	point := ii.points[ii.pointIndex]
+	ptags := point.Tags()
+	tags := models.NewTags(len(ptags)+1, ii.tagOpts)
+	var (
+		exemplar        prompb.Labels
+		originalTagKeys []prompb.Label
+	)
+	for _, tag := range ptags {
+		name := make([]byte, len(tag.Key))
+		copy(name, tag.Key)
+		ii.promRewriter.rewriteLabel(name)
+		if ii.preserveNames && !bytes.Equal(name, tag.Key) {
+			originalTagKeys = append(originalTagKeys, prompb.Label{
+				Name:  append([]byte(influxTagKeyLabelPrefix), name...),
+				Value: tag.Key,
+			})
+		}
+		if ii.isExemplarTag(tag.Key) {
+			exemplar.Labels = append(exemplar.Labels, prompb.Label{Name: name, Value: tag.Value})
+			continue
+		}
+		tags = tags.AddTagWithoutNormalizing(models.Tag{Name: name, Value: tag.Value})
+	}
+	for _, tag := range ii.pathTags {
+		// Tags of the point with the same name are reported as duplicates below.
+		tags = tags.AddTagWithoutNormalizing(tag)
+	}
+	ii.exemplar = nil
+	if len(exemplar.Labels) > 0 {
+		marshalled, err := exemplar.Marshal()
+		if err != nil {
+			ii.addPointError(fmt.Errorf("unable to marshal exemplar: %v", err))
+			return false
+		}
+		ii.exemplar = marshalled
+	}
+	if ii.preserveNames {
+		labels := append(exemplar.Labels, originalTagKeys...)
+		labels = append(labels, prompb.Label{
+			Name:  []byte(influxMeasurementLabel),
+			Value: point.Name(),
+		})
+		if !ii.populateFieldAnnotations(labels) {
+			return false
+		}
+	}
+	// Dummy w/o value set; used for dupe check and value is rewritten in-place
+	// for each field in Current later on. Adding it also sorts the tags by name,
+	// which is what keeps the series IDs stable since neither rewriting nor the
+	// path tags preserve the order that the tags of the point were parsed in.
+	tags = tags.AddTag(models.Tag{Name: tags.Opts.MetricName()})
+
+	// sanity check no duplicate Name's;
+	// after Normalize, they are sorted so
+	// can just check them sequentially
+	metricName := tags.Opts.MetricName()
+	for i := range tags.Tags {
+		iname := tags.Tags[i].Name
+		if i > 0 && bytes.Equal(tags.Tags[i-1].Name, iname) {
+			ii.addPointError(fmt.Errorf("non-unique Prometheus label %v", string(iname)))
+			return false
+		}
+		if bytes.Equal(iname, metricName) {
+			ii.nameIndex = i
+		}
+	}
+	ii.tags = tags
+	return true
+}
+
+// populateFieldAnnotations sets the annotation of each field of the current
+// point to the given labels of the point followed by the original field key.
+func (ii *ingestIterator) populateFieldAnnotations(pointLabels []prompb.Label) bool {
+	n := len(pointLabels)
+	for i := range ii.fields {
+		// Cap the point labels so that appending the field key never overwrites
+		// the field key of the previous field.
+		annotation := prompb.Labels{Labels: append(pointLabels[:n:n], prompb.Label{
+			Name:  []byte(influxFieldLabel),
+			Value: ii.fields[i].key,
+		})}
+		marshalled, err := annotation.Marshal()
+		if err != nil {
+			ii.addPointError(fmt.Errorf("unable to marshal original names: %v", err))
+			return false
+		}
+		ii.fields[i].annotation = marshalled
+	}
+	return true
+}
+
+func (ii *ingestIterator) isExemplarTag(key []byte) bool {
+	for _, exemplarTag := range ii.exemplarTags {
+		if bytes.Equal(key, exemplarTag) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ii *ingestIterator) Next() bool {
 	for len(ii.points) > ii.pointIndex {
 		if ii.nextFieldIndex == 0 {
 			// Populate tags only if we have fields we care about
-			if ii.populateFields() {
-				point := ii.points[ii.pointIndex]
-				ptags := point.Tags()
-				tags := models.NewTags(len(ptags), ii.tagOpts)
-				for _, tag := range ptags {
-					name := make([]byte, len(tag.Key))
-					copy(name, tag.Key)
-					ii.promRewriter.rewriteLabel(name)
-					tags = tags.AddTagWithoutNormalizing(models.Tag{Name: name, Value: tag.Value})
-				}
-				// sanity check no duplicate Name's;
-				// after Normalize, they are sorted so
-				// can just check them sequentially
-				valid := true
-				if len(tags.Tags) > 0 {
-					// Dummy w/o value set; used for dupe check and value is rewrittein in-place in SetName later on
-					tags = tags.AddTag(models.Tag{Name: tags.Opts.MetricName()})
-					name := tags.Tags[0].Name
-					for i := 1; i < len(tags.Tags); i++ {
-						iname := tags.Tags[i].Name
-						if bytes.Equal(name, iname) {
-							ii.err = ii.err.Add(fmt.Errorf("non-unique Prometheus label %v", string(iname)))
-							valid = false
-							break
-						}
-						name = iname
-					}
-				}
-				if !valid {
-					ii.pointIndex += 1
-					continue
-				}
-				ii.tags = tags
+			if ii.populateFields() && !ii.populateTags() {
+				ii.pointIndex += 1
+				continue
+			}
+			if len(ii.fields) == 0 {
+				ii.addPointWithoutValues()
 			}
 		}
 		ii.nextFieldIndex += 1
@@ -188,18 +472,41 @@ func (ii *ingestIterator) Next() bool {
 	return false
 }
 
+// addPointWithoutValues records that the current point is dropped because it
+// has no fields with numeric values, unless it was already recorded as invalid.
+func (ii *ingestIterator) addPointWithoutValues() {
+	if _, ok := ii.invalidPoints[ii.pointIndex]; ok {
+		return
+	}
+	if ii.pointsWithoutValues == nil {
+		ii.pointsWithoutValues = make(map[int]struct{})
+	}
+	ii.pointsWithoutValues[ii.pointIndex] = struct{}{}
+}
+
 func (ii *ingestIterator) Current() (models.Tags, ts.Datapoints, xtime.Unit, []byte) {
 	if ii.pointIndex < len(ii.points) && ii.nextFieldIndex > 0 && len(ii.fields) > (ii.nextFieldIndex-1) {
 		point := ii.points[ii.pointIndex]
 		field := ii.fields[ii.nextFieldIndex-1]
-		tags := ii.tags.SetName(field.name)
+		tags := ii.tags
+		tags.Tags[ii.nameIndex].Value = field.name
+		annotation := ii.exemplar
+		if ii.preserveNames {
+			annotation = field.annotation
+		}
 
 		return tags, []ts.Datapoint{ts.Datapoint{Timestamp: point.Time(),
-			Value: field.value}}, xtime.Nanosecond, nil
+			Value: field.value}}, xtime.Nanosecond, annotation
 	}
 	return models.EmptyTags(), nil, 0, nil
 }
 
+// CurrentDownsampleMappingRules returns the mapping rules of the measurement of
+// the current point, if any.
+func (ii *ingestIterator) CurrentDownsampleMappingRules() ([]downsample.AutoMappingRule, bool) {
+	return ii.mappingRules, ii.mappingRules != nil
+}
+
 func (ii *ingestIterator) Reset() error {
 	ii.pointIndex = 0
 	ii.nextFieldIndex = 0
@@ -207,31 +514,164 @@ func (ii *ingestIterator) Reset() error {
 	return nil
 }
 
+// Error returns the errors of the invalid points that failed the batch, as an
+// invalid params error since they're caused by the contents of the request.
 func (ii *ingestIterator) Error() error {
-	return ii.err.FinalError()
+	err := ii.err.FinalError()
+	if err == nil {
+		return nil
+	}
+	return xerrors.NewInvalidParamsError(err)
 }
 
+// NewInfluxWriterHandler returns a handler which ingests InfluxDB line protocol
+// writes, or newline-delimited JSON points if the content type of the request
+// is application/json or application/x-ndjson (see parseJSONPoints). If
+// partial writes are enabled in the config then invalid points are skipped and
+// reported in the response rather than failing the whole batch.
+// Tags that are configured as exemplar tags are written to the annotation of
+// the datapoints of a point rather than to its series tags, and points with
+// timestamps outside of the configured bounds are rejected as invalid. Writes
+// routed by path (see InfluxWritePathURL) are tagged with and written to the
+// namespace selected by the configured path segments. If original names are
+// preserved then the measurement, field key and tag keys of each point prior to
+// being rewritten are written to the annotation of its datapoints as well.
+// The datapoints of the measurements that are configured to be downsampled
+// separately are downsampled with their own mapping rules.
 func NewInfluxWriterHandler(options options.HandlerOptions) http.Handler {
-	return &ingestWriteHandler{handlerOpts: options,
-		tagOpts:      options.TagOptions(),
-		promRewriter: newPromRewriter()}
+	scope := options.InstrumentOpts().MetricsScope().
+		Tagged(map[string]string{"handler": "influx-write"})
+	writeCfg := options.Config().Influx.Write
+	exemplarTags := make([][]byte, 0, len(writeCfg.ExemplarTags))
+	for _, tag := range writeCfg.ExemplarTags {
+		exemplarTags = append(exemplarTags, []byte(tag))
+	}
+	iwh := &ingestWriteHandler{handlerOpts: options,
+		tagOpts:              options.TagOptions(),
+		promRewriter:         newPromRewriter(),
+		partialWrites:        writeCfg.PartialWrites,
+		emptyMeasurementName: []byte(writeCfg.EmptyMeasurementName),
+		exemplarTags:         exemplarTags,
+		preserveNames:        writeCfg.PreserveOriginalNames,
+		maxFutureSkew:        writeCfg.MaxFutureSkew,
+		maxPastAge:           writeCfg.MaxPastAge,
+		metrics:              newInfluxWriteMetrics(scope)}
+	if pathRouting := writeCfg.PathRouting; pathRouting != nil {
+		for _, segment := range pathRouting.TagSegments {
+			name := []byte(segment)
+			iwh.promRewriter.rewriteLabel(name)
+			iwh.pathTagSegments = append(iwh.pathTagSegments, segment)
+			iwh.pathTagNames = append(iwh.pathTagNames, name)
+		}
+		iwh.namespaceSegment = pathRouting.NamespaceSegment
+		iwh.namespaces = pathRouting.Namespaces
+	}
+	if len(writeCfg.MeasurementDownsampling) > 0 {
+		iwh.measurementRules = make(map[string][]downsample.AutoMappingRule,
+			len(writeCfg.MeasurementDownsampling))
+		for measurement, downsampling := range writeCfg.MeasurementDownsampling {
+			iwh.measurementRules[measurement] = []downsample.AutoMappingRule{
+				downsampling.MappingRule(),
+			}
+		}
+	}
+	return iwh
+}
+
+// parsePathRouting extracts the tags and the write options of a request from
+// its path segments, if it was routed by path.
+func (iwh *ingestWriteHandler) parsePathRouting(
+	r *http.Request,
+) ([]models.Tag, ingest.WriteOptions, error) {
+	var (
+		opts ingest.WriteOptions
+		vars = mux.Vars(r)
+	)
+	if len(vars) == 0 {
+		return nil, opts, nil
+	}
+
+	var tags []models.Tag
+	for i, segment := range iwh.pathTagSegments {
+		tags = append(tags, models.Tag{
+			Name:  iwh.pathTagNames[i],
+			Value: []byte(vars[segment]),
+		})
+	}
+
+	if iwh.namespaceSegment != "" {
+		value := vars[iwh.namespaceSegment]
+		storagePolicy, ok := iwh.namespaces[value]
+		if !ok {
+			return nil, opts, fmt.Errorf("%v: %s=%s",
+				errUnknownPathNamespace, iwh.namespaceSegment, value)
+		}
+
+		// Make sure only the namespace of the storage policy is written to, the
+		// same as for writes that specify the storage policy with headers.
+		opts.DownsampleOverride = true
+		opts.WriteOverride = true
+		opts.WriteStoragePolicies = policy.StoragePolicies{storagePolicy}
+	}
+
+	return tags, opts, nil
 }
 
 func (iwh *ingestWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	bytes, err := ioutil.ReadAll(r.Body)
+	pathTags, opts, err := iwh.parsePathRouting(r)
 	if err != nil {
-		xhttp.Error(w, err, http.StatusInternalServerError)
+		xhttp.Error(w, err, http.StatusBadRequest)
 		return
 	}
-	points, err := imodels.ParsePoints(bytes)
+	bytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		xhttp.Error(w, err, http.StatusInternalServerError)
 		return
 	}
-	opts := ingest.WriteOptions{}
-	iter := &ingestIterator{points: points, tagOpts: iwh.tagOpts, promRewriter: iwh.promRewriter}
+	var points []imodels.Point
+	if isJSONContentType(r.Header.Get("Content-Type")) {
+		points, err = parseJSONPoints(bytes, iwh.handlerOpts.NowFn()())
+		if err != nil {
+			xhttp.Error(w, err, http.StatusBadRequest)
+			return
+		}
+	} else {
+		points, err = imodels.ParsePoints(bytes)
+		if err != nil {
+			xhttp.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	iwh.metrics.batchSize.RecordValue(float64(len(points)))
+	iter := &ingestIterator{points: points, tagOpts: iwh.tagOpts,
+		promRewriter: iwh.promRewriter, partialWrites: iwh.partialWrites,
+		emptyMeasurementName: iwh.emptyMeasurementName, exemplarTags: iwh.exemplarTags,
+		preserveNames: iwh.preserveNames, pathTags: pathTags,
+		measurementRules: iwh.measurementRules}
+	now := iwh.handlerOpts.NowFn()()
+	if iwh.maxFutureSkew > 0 {
+		iter.maxTimestamp = now.Add(iwh.maxFutureSkew)
+	}
+	if iwh.maxPastAge > 0 {
+		iter.minTimestamp = now.Add(-iwh.maxPastAge)
+	}
 	batchErr := iwh.handlerOpts.DownsamplerAndWriter().WriteBatch(r.Context(), iter, opts)
+	iwh.metrics.droppedNoValues.Inc(int64(len(iter.pointsWithoutValues)))
+	iwh.metrics.droppedEmptyMeasurement.Inc(int64(iter.numEmptyMeasurement))
+	iwh.metrics.droppedTimestampOutOfBounds.Inc(int64(iter.numTimestampOutOfBounds))
 	if batchErr == nil {
+		if partialErr := iter.partialWriteError(); iwh.partialWrites && partialErr != nil {
+			// Mirror InfluxDB which responds with a bad request when only some
+			// of the points in a batch could be written.
+			logger := logging.WithContext(r.Context(), iwh.handlerOpts.InstrumentOpts())
+			logger.Warn("partial write",
+				zap.String("remoteAddr", r.RemoteAddr),
+				zap.Int("numPoints", len(points)),
+				zap.Int("numDroppedPoints", len(iter.invalidPoints)),
+				zap.Error(partialErr))
+			xhttp.Error(w, partialErr, http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package influxdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"time"
+
+	imodels "github.com/influxdata/influxdb/models"
+)
+
+var jsonContentTypes = map[string]struct{}{
+	"application/json":     {},
+	"application/x-ndjson": {},
+}
+
+// jsonPoint is a point written as a JSON object rather than in line protocol,
+// the timestamp is in nanoseconds and defaults to the time of the write.
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Timestamp   *int64                 `json:"timestamp"`
+}
+
+// isJSONContentType returns whether the content type of a write request is
+// newline-delimited JSON points rather than line protocol.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	_, ok := jsonContentTypes[mediaType]
+	return ok
+}
+
+// parseJSONPoints parses newline-delimited JSON points, for example:
+//
+//	{"measurement":"cpu","tags":{"host":"a"},"fields":{"idle":0.5,"count":2},"timestamp":1574838670386469800}
+//
+// into the same points that the line protocol parser returns so that they're
+// rewritten and validated the same way. Integer field values that don't have a
+// fractional part or exponent are integer fields, like the i suffix in line
+// protocol, any other numbers are float fields. Errors identify the invalid point
+// by its position rather than its line number, since a point may span several
+// lines.
+func parseJSONPoints(body []byte, now time.Time) ([]imodels.Point, error) {
+	var (
+		dec    = json.NewDecoder(bytes.NewReader(body))
+		points []imodels.Point
+	)
+	dec.UseNumber()
+	for {
+		var p jsonPoint
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			return points, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("point %d: unable to parse JSON point: %v", len(points)+1, err)
+		}
+
+		fields := make(imodels.Fields, len(p.Fields))
+		for key, value := range p.Fields {
+			fieldValue, err := jsonFieldValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("point %d: field %s: %v", len(points)+1, key, err)
+			}
+			fields[key] = fieldValue
+		}
+		t := now
+		if p.Timestamp != nil {
+			t = time.Unix(0, *p.Timestamp).UTC()
+		}
+		point, err := imodels.NewPoint(p.Measurement, imodels.NewTags(p.Tags), fields, t)
+		if err != nil {
+			return nil, fmt.Errorf("point %d: %v", len(points)+1, err)
+		}
+		points = append(points, point)
+	}
+}
+
+// jsonFieldValue converts a JSON field value to the field value type of the
+// line protocol parser.
+func jsonFieldValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		return v.Float64()
+	case bool, string:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v", value)
+	}
+}
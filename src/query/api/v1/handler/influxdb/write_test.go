@@ -21,12 +21,31 @@
 package influxdb
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/options"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/models"
+	xerrors "github.com/m3db/m3/src/x/errors"
+	"github.com/m3db/m3/src/x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
 	imodels "github.com/influxdata/influxdb/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 // human-readable string out of what the iterator produces;
@@ -34,13 +53,33 @@ import (
 func (self *ingestIterator) pop(t *testing.T) string {
 	if self.Next() {
 		tags, dp, _, _ := self.Current()
-		assert.Equal(t, 1, len(dp))
+		require.Equal(t, 1, len(dp))
 
 		return fmt.Sprintf("%s %v %s", tags.String(), dp[0].Value, dp[0].Timestamp)
 	}
 	return ""
 }
 
+// writeBatchFn returns a mock WriteBatch that calls onWrite for every datapoint of
+// the batch and that fails the batch with the error of the iterator, if any.
+func writeBatchFn(
+	onWrite func(iter ingest.DownsampleAndWriteIter, opts ingest.WriteOptions),
+) func(context.Context, ingest.DownsampleAndWriteIter, ingest.WriteOptions) ingest.BatchError {
+	return func(
+		_ context.Context,
+		iter ingest.DownsampleAndWriteIter,
+		opts ingest.WriteOptions,
+	) ingest.BatchError {
+		for iter.Next() {
+			onWrite(iter, opts)
+		}
+		if err := iter.Error(); err != nil {
+			return xerrors.NewMultiError().Add(err)
+		}
+		return nil
+	}
+}
+
 func TestIngestIterator(t *testing.T) {
 	// test prometheus-illegal measure and label components (should be _s)
 	// as well as all value types influxdb supports
@@ -63,6 +102,63 @@ func TestIngestIterator(t *testing.T) {
 	require.NoError(t, iter.Error())
 }
 
+func TestIngestIteratorSortsTags(t *testing.T) {
+	// The tags are sorted by their rewritten names, so points with the same tags
+	// in any order have the same ID even though rewriting b~ to b_ changes its
+	// position relative to bz, and the path tags are added after the others.
+	s := `measure,bz=1,b~=2 key=1i 1574838670386469800
+measure,b~=2,bz=1 key=2i 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{
+		points:       points,
+		tagOpts:      models.NewTagOptions(),
+		promRewriter: newPromRewriter(),
+		pathTags:     []models.Tag{{Name: []byte("a"), Value: []byte("path")}},
+	}
+	var ids []string
+	for iter.Next() {
+		tags, _, _, _ := iter.Current()
+		var names []string
+		for _, tag := range tags.Tags {
+			names = append(names, string(tag.Name))
+		}
+		assert.Equal(t, []string{"__name__", "a", "b_", "bz"}, names)
+		ids = append(ids, string(tags.ID()))
+	}
+	require.NoError(t, iter.Error())
+	require.Len(t, ids, 2)
+	assert.Equal(t, ids[0], ids[1])
+}
+
+func TestIngestIteratorEscapedCharacters(t *testing.T) {
+	// Ensure that escaped commas, spaces and equals signs are unescaped in tag
+	// values and are otherwise stored as is, whereas they are rewritten in the
+	// metric and label names like any other character Prometheus disallows
+	s := `meas\ ure,tag\,1=a\,b\ c\=d,tag2=x\\y,tag3=π\=3.14 key\=1=1i 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter()}
+	require.True(t, iter.Next())
+	tags, _, _, _ := iter.Current()
+	expected := map[string]string{
+		"__name__": "meas_ure_key_1",
+		"tag_1":    "a,b c=d",
+		// Backslashes are not an escape character on their own.
+		"tag2": `x\\y`,
+		"tag3": "π=3.14",
+	}
+	actual := make(map[string]string, len(tags.Tags))
+	for _, tag := range tags.Tags {
+		actual[string(tag.Name)] = string(tag.Value)
+	}
+	assert.Equal(t, expected, actual)
+	assert.False(t, iter.Next())
+	require.NoError(t, iter.Error())
+}
+
 func TestIngestIteratorDuplicateTag(t *testing.T) {
 	// Ensure that duplicate tag causes error and no metrics entries
 	s := `measure,lab!=2,lab?=3 key=2i 1574838670386469800
@@ -76,7 +172,7 @@ func TestIngestIteratorDuplicateTag(t *testing.T) {
 	} {
 		assert.Equal(t, line, iter.pop(t))
 	}
-	require.EqualError(t, iter.Error(), "non-unique Prometheus label lab_")
+	require.EqualError(t, iter.Error(), "point 1 (measurement measure): non-unique Prometheus label lab_")
 }
 
 func TestIngestIteratorDuplicateNameTag(t *testing.T) {
@@ -92,5 +188,628 @@ func TestIngestIteratorDuplicateNameTag(t *testing.T) {
 	} {
 		assert.Equal(t, line, iter.pop(t))
 	}
-	require.EqualError(t, iter.Error(), "non-unique Prometheus label __name__")
+	require.EqualError(t, iter.Error(), "point 1 (measurement measure): non-unique Prometheus label __name__")
+}
+
+func TestIngestIteratorDuplicateField(t *testing.T) {
+	// Ensure that field keys which collide after rewriting cause an error
+	// naming both keys and no metrics entries for the point
+	s := `measure,tag=1 foo.bar=1i,foo/bar=2i 1574838670386469800
+measure,tag=2 foo_bar=3i,foo.bar=4i 1574838670386469800
+measure,tag=3 foo.bar=5i,foo.baz=6i 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter(), partialWrites: true}
+	for _, line := range []string{
+		"__name__: measure_foo_bar, tag: 3 5 2019-11-27 07:11:10.3864698 +0000 UTC",
+		"__name__: measure_foo_baz, tag: 3 6 2019-11-27 07:11:10.3864698 +0000 UTC",
+		"",
+	} {
+		assert.Equal(t, line, iter.pop(t))
+	}
+	require.NoError(t, iter.Error())
+	require.Len(t, iter.invalidPoints, 2)
+	assert.EqualError(t, iter.invalidPoints[0],
+		"point 1 (measurement measure): non-unique Prometheus metric name measure_foo_bar for fields foo.bar and foo/bar")
+	assert.EqualError(t, iter.invalidPoints[1],
+		"point 2 (measurement measure): non-unique Prometheus metric name measure_foo_bar for fields foo_bar and foo.bar")
+	assert.Empty(t, iter.pointsWithoutValues)
+}
+
+func TestIngestIteratorErrorPointNumber(t *testing.T) {
+	// Ensure that errors identify the offending point in a multi-line batch,
+	// blank and comment lines are not points so they're not counted
+	s := `measure,tag=1 key=2i 1574838670386469800
+# comment
+
+measure,tag=2 key=2i 1574838670386469800
+bad-measure,lab!=2,lab?=3 key=2i 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter()}
+	for iter.Next() {
+	}
+	require.EqualError(t, iter.Error(), "point 3 (measurement bad-measure): non-unique Prometheus label lab_")
+}
+
+func TestIngestIteratorPartialWrites(t *testing.T) {
+	// Ensure that invalid points are skipped without failing the batch and
+	// are only counted once when the batch is iterated again
+	s := `measure,tag=1 key=2i 1574838670386469800
+bad-measure,lab!=2,lab?=3 key=2i 1574838670386469800
+measure,tag=2 key=3i 1574838670386469800
+measure,__name__=x key=2i 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter(), partialWrites: true}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, iter.Reset())
+		for _, line := range []string{
+			"__name__: measure_key, tag: 1 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+			"__name__: measure_key, tag: 2 3 2019-11-27 07:11:10.3864698 +0000 UTC",
+			"",
+		} {
+			assert.Equal(t, line, iter.pop(t))
+		}
+		require.NoError(t, iter.Error())
+	}
+	require.EqualError(t, iter.partialWriteError(),
+		"partial write: point 2 (measurement bad-measure): non-unique Prometheus label lab_ dropped=2")
+}
+
+func TestInfluxWriteHandlerPartialWrites(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	body := `measure,tag=1 key=2i 1574838670386469800
+bad-measure,lab!=2,lab?=3 key=2i 1574838670386469800
+`
+	for _, partialWrites := range []bool{false, true} {
+		var written int
+		writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+		writer.EXPECT().
+			WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(writeBatchFn(func(ingest.DownsampleAndWriteIter, ingest.WriteOptions) {
+				written++
+			}))
+
+		cfg := config.Configuration{}
+		cfg.Influx.Write.PartialWrites = partialWrites
+		opts := options.EmptyHandlerOptions().
+			SetConfig(cfg).
+			SetDownsamplerAndWriter(writer)
+		h := NewInfluxWriterHandler(opts)
+
+		req := httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+
+		// The batch is rejected either way, but only partial writes report the
+		// number of points that were dropped.
+		assert.Equal(t, 1, written)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		if !partialWrites {
+			assert.Contains(t, recorder.Body.String(), "point 2 (measurement bad-measure)")
+			assert.NotContains(t, recorder.Body.String(), "partial write")
+			continue
+		}
+		assert.Contains(t, recorder.Body.String(), "partial write: point 2")
+		assert.Contains(t, recorder.Body.String(), "dropped=1")
+	}
+}
+
+func TestInfluxWriteHandlerBatchSizeMetric(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+	writer.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil).
+		Times(2)
+
+	scope := tally.NewTestScope("", nil)
+	opts := options.EmptyHandlerOptions().
+		SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+		SetDownsamplerAndWriter(writer)
+	h := NewInfluxWriterHandler(opts)
+
+	for _, body := range []string{
+		"measure,tag=1 key=2i 1574838670386469800\n",
+		"measure,tag=1 key=2i 1574838670386469800\nmeasure,tag=2 key=3i 1574838670386469800\n" +
+			"measure,tag=3 key=4i 1574838670386469800\n",
+	} {
+		req := httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	}
+
+	histograms := scope.Snapshot().Histograms()
+	histogram, ok := histograms["write.batch-size+handler=influx-write"]
+	require.True(t, ok, "histograms: %v", histograms)
+	assert.Equal(t, map[float64]int64{
+		1: 1,
+		2: 0,
+		4: 1,
+	}, valueBucketsUpTo(histogram.Values(), 4))
+}
+
+// valueBucketsUpTo returns the counts of the buckets whose upper bound is at
+// most max.
+func valueBucketsUpTo(values map[float64]int64, max float64) map[float64]int64 {
+	result := make(map[float64]int64)
+	for upper, count := range values {
+		if upper <= max {
+			result[upper] = count
+		}
+	}
+	return result
+}
+
+func TestIngestIteratorEmptyMeasurement(t *testing.T) {
+	// Line protocol parsing rejects empty measurements so build the points
+	// directly to ensure they are either renamed or dropped
+	newPoint := func(name string, tags map[string]string) imodels.Point {
+		p, err := imodels.NewPoint(name, imodels.NewTags(tags),
+			imodels.Fields{"key": int64(2)}, time.Unix(0, 1574838670386469800))
+		require.NoError(t, err)
+		return p
+	}
+	points := []imodels.Point{
+		newPoint("measure", map[string]string{"tag": "1"}),
+		newPoint("", nil),
+	}
+
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter(),
+		emptyMeasurementName: []byte("fallback.measure")}
+	for _, line := range []string{
+		"__name__: measure_key, tag: 1 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+		"__name__: fallback_measure_key 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+		"",
+	} {
+		assert.Equal(t, line, iter.pop(t))
+	}
+	require.NoError(t, iter.Error())
+
+	iter = &ingestIterator{points: points, promRewriter: newPromRewriter(), partialWrites: true}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, iter.Reset())
+		for _, line := range []string{
+			"__name__: measure_key, tag: 1 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+			"",
+		} {
+			assert.Equal(t, line, iter.pop(t))
+		}
+		require.NoError(t, iter.Error())
+	}
+	require.EqualError(t, iter.partialWriteError(),
+		"partial write: point 2 (measurement ): empty measurement dropped=1")
+	assert.Equal(t, 1, iter.numEmptyMeasurement)
+	assert.Empty(t, iter.pointsWithoutValues)
+}
+
+func TestIngestIteratorPointsWithoutValues(t *testing.T) {
+	// Ensure that points with only string fields yield no datapoints, are
+	// dropped without failing the batch and are only counted once
+	s := `measure,tag=1 key="string" 1574838670386469800
+measure,tag=2 key=2i 1574838670386469800
+measure,tag=3 key1="string",key2="other" 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter()}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, iter.Reset())
+		for _, line := range []string{
+			"__name__: measure_key, tag: 2 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+			"",
+		} {
+			assert.Equal(t, line, iter.pop(t))
+		}
+		require.NoError(t, iter.Error())
+	}
+	assert.Equal(t, map[int]struct{}{0: {}, 2: {}}, iter.pointsWithoutValues)
+}
+
+func TestInfluxWriteHandlerPointsWithoutValuesMetric(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var written int
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+	writer.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(writeBatchFn(func(ingest.DownsampleAndWriteIter, ingest.WriteOptions) {
+			written++
+		}))
+
+	scope := tally.NewTestScope("", nil)
+	opts := options.EmptyHandlerOptions().
+		SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+		SetDownsamplerAndWriter(writer)
+	h := NewInfluxWriterHandler(opts)
+
+	body := `measure,tag=1 key="string" 1574838670386469800
+measure,tag=2 key=2i 1574838670386469800
+`
+	req := httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, 1, written)
+
+	counters := scope.Snapshot().Counters()
+	counter, ok := counters["write.dropped+handler=influx-write,reason=no-values"]
+	require.True(t, ok, "counters: %v", counters)
+	assert.Equal(t, int64(1), counter.Value())
+}
+
+func TestInfluxWriteHandlerTimestampBounds(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var written []string
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+	writer.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(writeBatchFn(func(iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) {
+			tags, _, _, _ := iter.Current()
+			written = append(written, tags.String())
+		}))
+
+	var (
+		now   = time.Unix(0, 1574838670386469800)
+		scope = tally.NewTestScope("", nil)
+		cfg   = config.Configuration{}
+	)
+	cfg.Influx.Write.PartialWrites = true
+	cfg.Influx.Write.MaxFutureSkew = time.Minute
+	cfg.Influx.Write.MaxPastAge = time.Hour
+	opts := options.EmptyHandlerOptions().
+		SetConfig(cfg).
+		SetNowFn(func() time.Time { return now }).
+		SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+		SetDownsamplerAndWriter(writer)
+	h := NewInfluxWriterHandler(opts)
+
+	body := fmt.Sprintf(`measure,tag=1 key=1i %d
+measure,tag=2 key=2i %d
+measure,tag=3 key=3i %d
+measure,tag=4 key=4i %d
+`,
+		now.UnixNano(),
+		now.Add(2*time.Minute).UnixNano(),
+		now.Add(-2*time.Hour).UnixNano(),
+		now.Add(-time.Minute).UnixNano())
+	req := httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	assert.Equal(t, []string{
+		"__name__: measure_key, tag: 1",
+		"__name__: measure_key, tag: 4",
+	}, written)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "partial write: point 2")
+	assert.Contains(t, recorder.Body.String(), "timestamp out of bounds")
+	assert.Contains(t, recorder.Body.String(), "dropped=2")
+
+	counters := scope.Snapshot().Counters()
+	counter, ok := counters["write.dropped+handler=influx-write,reason=timestamp-out-of-bounds"]
+	require.True(t, ok, "counters: %v", counters)
+	assert.Equal(t, int64(2), counter.Value())
+}
+
+func TestInfluxWriteHandlerPathRouting(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		written     []string
+		writtenOpts ingest.WriteOptions
+	)
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+	writer.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(writeBatchFn(func(iter ingest.DownsampleAndWriteIter, opts ingest.WriteOptions) {
+			tags, _, _, _ := iter.Current()
+			written = append(written, tags.String())
+			writtenOpts = opts
+		})).
+		Times(2)
+
+	storagePolicy := policy.MustParseStoragePolicy("1m:40d")
+	cfg := config.Configuration{}
+	cfg.Influx.Write.PathRouting = &config.InfluxWritePathRoutingConfiguration{
+		Segments:         []string{"org", "bucket"},
+		TagSegments:      []string{"org"},
+		NamespaceSegment: "bucket",
+		Namespaces: map[string]policy.StoragePolicy{
+			"metrics-1m": storagePolicy,
+		},
+	}
+	require.NoError(t, cfg.Influx.Write.PathRouting.Validate())
+	opts := options.EmptyHandlerOptions().
+		SetConfig(cfg).
+		SetInstrumentOpts(instrument.NewOptions()).
+		SetDownsamplerAndWriter(writer)
+	h := NewInfluxWriterHandler(opts)
+
+	router := mux.NewRouter()
+	router.Handle(InfluxWriteURL, h)
+	router.Handle(InfluxWritePathURL(cfg.Influx.Write.PathRouting.Segments), h)
+
+	body := "measure,tag=1 key=1i 1574838670386469800\n"
+	req := httptest.NewRequest(InfluxWriteHTTPMethod,
+		InfluxWriteURL+"/acme/metrics-1m", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []string{"__name__: measure_key, org: acme, tag: 1"}, written)
+	assert.True(t, writtenOpts.WriteOverride)
+	assert.True(t, writtenOpts.DownsampleOverride)
+	assert.Equal(t, []policy.StoragePolicy{storagePolicy}, writtenOpts.WriteStoragePolicies)
+
+	// Writes that are not routed by path are written as usual.
+	written = nil
+	req = httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []string{"__name__: measure_key, tag: 1"}, written)
+	assert.Equal(t, ingest.WriteOptions{}, writtenOpts)
+
+	// Writes to unknown namespaces are rejected.
+	req = httptest.NewRequest(InfluxWriteHTTPMethod,
+		InfluxWriteURL+"/acme/unknown", strings.NewReader(body))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "unknown namespace in path: bucket=unknown")
+}
+
+func TestInfluxWriteHandlerMeasurementDownsampling(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	type writtenSeries struct {
+		tags  string
+		rules []downsample.AutoMappingRule
+	}
+	var written []writtenSeries
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+	writer.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(writeBatchFn(func(iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) {
+			rulesIter, ok := iter.(ingest.DownsampleMappingRulesIter)
+			require.True(t, ok)
+			tags, _, _, _ := iter.Current()
+			rules, ok := rulesIter.CurrentDownsampleMappingRules()
+			require.Equal(t, rules != nil, ok)
+			written = append(written, writtenSeries{tags: tags.String(), rules: rules})
+		}))
+
+	cpuDownsampling := config.InfluxMeasurementDownsamplingConfiguration{
+		Aggregations: []aggregation.Type{aggregation.Max},
+		Policies:     []policy.StoragePolicy{policy.MustParseStoragePolicy("1m:40d")},
+	}
+	require.NoError(t, cpuDownsampling.Validate())
+	require.Error(t, config.InfluxMeasurementDownsamplingConfiguration{}.Validate())
+
+	cfg := config.Configuration{}
+	cfg.Influx.Write.MeasurementDownsampling = map[string]config.InfluxMeasurementDownsamplingConfiguration{
+		"cpu": cpuDownsampling,
+	}
+	opts := options.EmptyHandlerOptions().
+		SetConfig(cfg).
+		SetInstrumentOpts(instrument.NewOptions()).
+		SetDownsamplerAndWriter(writer)
+	h := NewInfluxWriterHandler(opts)
+
+	body := `cpu,host=a user=1,sys=2 1574838670386469800
+mem,host=a free=3 1574838670386469800
+`
+	req := httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	cpuRules := []downsample.AutoMappingRule{cpuDownsampling.MappingRule()}
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []writtenSeries{
+		{tags: "__name__: cpu_user, host: a", rules: cpuRules},
+		{tags: "__name__: cpu_sys, host: a", rules: cpuRules},
+		{tags: "__name__: mem_free, host: a"},
+	}, written)
+}
+
+func TestIngestIteratorNoTags(t *testing.T) {
+	s := `measure key1=1,key2=2 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter()}
+	for _, line := range []string{
+		"__name__: measure_key1 1 2019-11-27 07:11:10.3864698 +0000 UTC",
+		"__name__: measure_key2 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+		"",
+	} {
+		assert.Equal(t, line, iter.pop(t))
+	}
+	require.NoError(t, iter.Error())
+}
+
+func TestIngestIteratorExemplarTags(t *testing.T) {
+	s := `measure,tag=1,trace_id=abc key1=1,key2=2 1574838670386469800
+measure,tag=2 key=3i 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter(),
+		exemplarTags: [][]byte{[]byte("trace_id")}}
+
+	expectedExemplar, err := (&prompb.Labels{Labels: []prompb.Label{
+		{Name: []byte("trace_id"), Value: []byte("abc")},
+	}}).Marshal()
+	require.NoError(t, err)
+	for _, expected := range []struct {
+		line       string
+		annotation []byte
+	}{
+		{
+			line:       "__name__: measure_key1, tag: 1 1 2019-11-27 07:11:10.3864698 +0000 UTC",
+			annotation: expectedExemplar,
+		},
+		{
+			line:       "__name__: measure_key2, tag: 1 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+			annotation: expectedExemplar,
+		},
+		{
+			line: "__name__: measure_key, tag: 2 3 2019-11-27 07:11:10.3864698 +0000 UTC",
+		},
+	} {
+		require.True(t, iter.Next())
+		tags, dp, _, annotation := iter.Current()
+		require.Equal(t, 1, len(dp))
+		assert.Equal(t, expected.line,
+			fmt.Sprintf("%s %v %s", tags.String(), dp[0].Value, dp[0].Timestamp))
+		assert.Equal(t, expected.annotation, annotation)
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Error())
+}
+
+func TestIngestIteratorPreserveOriginalNames(t *testing.T) {
+	s := `cpu.load,host.name=a,region=us,trace_id=abc user.pct=1,sys=2 1574838670386469800
+`
+	points, err := imodels.ParsePoints([]byte(s))
+	require.NoError(t, err)
+	iter := &ingestIterator{points: points, promRewriter: newPromRewriter(),
+		exemplarTags: [][]byte{[]byte("trace_id")}, preserveNames: true}
+
+	for _, expected := range []struct {
+		line  string
+		field string
+	}{
+		{
+			line:  "__name__: cpu_load_user_pct, host_name: a, region: us 1 2019-11-27 07:11:10.3864698 +0000 UTC",
+			field: "user.pct",
+		},
+		{
+			line:  "__name__: cpu_load_sys, host_name: a, region: us 2 2019-11-27 07:11:10.3864698 +0000 UTC",
+			field: "sys",
+		},
+	} {
+		require.True(t, iter.Next())
+		tags, dp, _, annotation := iter.Current()
+		require.Equal(t, 1, len(dp))
+		assert.Equal(t, expected.line,
+			fmt.Sprintf("%s %v %s", tags.String(), dp[0].Value, dp[0].Timestamp))
+
+		var labels prompb.Labels
+		require.NoError(t, labels.Unmarshal(annotation))
+		assert.Equal(t, []prompb.Label{
+			{Name: []byte("trace_id"), Value: []byte("abc")},
+			{Name: []byte("__influx_tag_key__host_name"), Value: []byte("host.name")},
+			{Name: []byte("__influx_measurement__"), Value: []byte("cpu.load")},
+			{Name: []byte("__influx_field__"), Value: []byte(expected.field)},
+		}, labels.Labels)
+	}
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Error())
+}
+
+func BenchmarkIngestIteratorWideMeasurement(b *testing.B) {
+	var line strings.Builder
+	line.WriteString("measure")
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&line, ",tag.%d=value%d", i, i)
+	}
+	for i := 0; i < 50; i++ {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&line, "%sfield.%d=%di", sep, i, i)
+	}
+	line.WriteString(" 1574838670386469800\n")
+
+	points, err := imodels.ParsePoints([]byte(strings.Repeat(line.String(), 100)))
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter := &ingestIterator{points: points, promRewriter: newPromRewriter()}
+		for iter.Next() {
+			iter.Current()
+		}
+	}
+}
+
+func TestInfluxWriteHandlerJSONPoints(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var written []string
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+	writer.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(writeBatchFn(func(iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) {
+			tags, dp, _, _ := iter.Current()
+			written = append(written, fmt.Sprintf("%s %v %s", tags.String(), dp[0].Value, dp[0].Timestamp))
+		})).
+		Times(2)
+
+	now := time.Unix(0, 1574838670386469800).UTC()
+	opts := options.EmptyHandlerOptions().
+		SetNowFn(func() time.Time { return now }).
+		SetDownsamplerAndWriter(writer)
+	h := NewInfluxWriterHandler(opts)
+
+	// The JSON points are rewritten the same way as the equivalent line protocol.
+	var (
+		lineProtocol = `?measure:!,?tag1:!=tval1,tag2=tval2 ?key1:!=3,?key2:!=2i,key3="string",key4=T 1574838670386469801
+`
+		jsonPoints = `{"measurement":"?measure:!","tags":{"?tag1:!":"tval1","tag2":"tval2"},` +
+			`"fields":{"?key1:!":3.0,"?key2:!":2,"key3":"string","key4":true},"timestamp":1574838670386469801}
+
+{"measurement":"measure","fields":{"key":18446744073709551615}}
+`
+	)
+	req := httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(lineProtocol))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusNoContent, recorder.Code, recorder.Body.String())
+	expected := append([]string(nil), written...)
+	written = written[:0]
+
+	req = httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(jsonPoints))
+	req.Header.Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusNoContent, recorder.Code, recorder.Body.String())
+	assert.Equal(t, append(expected,
+		"__name__: measure_key 1.8446744073709552e+19 2019-11-27 07:11:10.3864698 +0000 UTC"), written)
+
+	for body, expectedErr := range map[string]string{
+		`{"measurement":"measure","fields":{"key":1}}` + "\n" + `{"measurement":"measure","fields":{}}`: "point 2",
+		`{"measurement":"measure","fields":{"key":null}}`:                                               "point 1",
+		`{"measurement":"measure","fields":{"key":1}`:                                                   "point 1",
+		// Points are identified by their position since they may span lines.
+		"{\n\"measurement\":\"measure\",\n\"fields\":{\"key\":1}}\n{\"fields\":{\"key\":null}}": "point 2",
+	} {
+		req = httptest.NewRequest(InfluxWriteHTTPMethod, InfluxWriteURL, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		recorder = httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, body)
+		assert.Contains(t, recorder.Body.String(), expectedErr, body)
+	}
 }
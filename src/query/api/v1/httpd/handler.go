@@ -170,9 +170,24 @@ func (h *Handler) RegisterRoutes() error {
 		wrapped(native.NewPromReadInstantHandler(h.options)).ServeHTTP,
 	).Methods(native.PromReadInstantHTTPMethods...)
 
-	// InfluxDB write endpoint.
+	// InfluxDB write and query endpoints.
+	for measurement, downsampling := range h.options.Config().Influx.Write.MeasurementDownsampling {
+		if err := downsampling.Validate(); err != nil {
+			return fmt.Errorf("invalid downsampling of influx measurement %s: %v", measurement, err)
+		}
+	}
+	influxWriteHandler := wrapped(influxdb.NewInfluxWriterHandler(h.options))
 	h.router.HandleFunc(influxdb.InfluxWriteURL,
-		wrapped(influxdb.NewInfluxWriterHandler(h.options)).ServeHTTP).Methods(influxdb.InfluxWriteHTTPMethod)
+		influxWriteHandler.ServeHTTP).Methods(influxdb.InfluxWriteHTTPMethod)
+	if pathRouting := h.options.Config().Influx.Write.PathRouting; pathRouting != nil {
+		if err := pathRouting.Validate(); err != nil {
+			return err
+		}
+		h.router.HandleFunc(influxdb.InfluxWritePathURL(pathRouting.Segments),
+			influxWriteHandler.ServeHTTP).Methods(influxdb.InfluxWriteHTTPMethod)
+	}
+	h.router.HandleFunc(influxdb.InfluxQueryURL,
+		wrapped(influxdb.NewInfluxQueryHandler(h.options)).ServeHTTP).Methods(influxdb.InfluxQueryHTTPMethods...)
 
 	// Native M3 search and write endpoints.
 	h.router.HandleFunc(handler.SearchURL,
@@ -43,6 +43,18 @@ func WriteJSONResponse(w http.ResponseWriter, data interface{}, logger *zap.Logg
 	w.Write(jsonData)
 }
 
+// StreamJSONResponse encodes generic data directly to the ResponseWriter rather
+// than marshalling it in full first, so that large responses are written (and
+// compressed, if the ResponseWriter compresses them) as they're encoded. Since
+// the response status has already been sent by the time an encoding error
+// occurs, such errors are only logged.
+func StreamJSONResponse(w http.ResponseWriter, data interface{}, logger *zap.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logger.Error("unable to encode json", zap.Error(err))
+	}
+}
+
 // WriteProtoMsgJSONResponse writes a protobuf message to the ResponseWriter. This uses jsonpb
 // for json marshalling, which encodes fields with default values, even with the omitempty tag.
 func WriteProtoMsgJSONResponse(w http.ResponseWriter, data proto.Message, logger *zap.Logger) {
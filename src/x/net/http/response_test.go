@@ -51,6 +51,19 @@ func TestWriteJSONResponseError(t *testing.T) {
 	assertWroteJSONError(t, recorder, http.StatusInternalServerError)
 }
 
+func TestStreamJSONResponse(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	StreamJSONResponse(recorder, struct {
+		Foo string `json:"foo"`
+	}{
+		Foo: "bar",
+	}, zap.NewNop())
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"foo\":\"bar\"}\n", recorder.Body.String())
+}
+
 func TestWriteUninitializedResponse(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	WriteUninitializedResponse(recorder, zap.NewNop())